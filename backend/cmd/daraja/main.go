@@ -0,0 +1,89 @@
+// Command daraja runs M-PESA Daraja operations from the shell, using the
+// same MPESA_* environment variables and database as the API server.
+//
+//	go run ./cmd/daraja token
+//	go run ./cmd/daraja register-urls [-response-type Completed] [-school 1]
+//	go run ./cmd/daraja status -trans-id NLJ7RT61SV [-school 1]
+//	go run ./cmd/daraja balance [-school 1]
+//
+// Status and balance results arrive asynchronously on the callback URLs and
+// are stored against the query by the running API server.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"schoolms-go/daraja"
+	"schoolms-go/models"
+	"schoolms-go/services"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: daraja <token|register-urls|status|balance> [flags]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	client := daraja.NewClient(daraja.ConfigFromEnv())
+	cmd, args := os.Args[1], os.Args[2:]
+
+	switch cmd {
+	case "token":
+		token, err := client.AccessToken()
+		if err != nil {
+			log.Fatal("Failed to get access token: ", err)
+		}
+		fmt.Println(token)
+
+	case "register-urls":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		responseType := fs.String("response-type", "Completed", "Completed or Cancelled when validation is unreachable")
+		schoolID := fs.Uint("school", 0, "School ID to store the result against")
+		fs.Parse(args)
+
+		models.ConnectDB()
+		query, err := services.RegisterC2BURLs(client, uint(*schoolID), 0, *responseType)
+		printQuery(query, err)
+
+	case "status":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		transID := fs.String("trans-id", "", "M-PESA transaction ID to check")
+		remarks := fs.String("remarks", "", "Remarks sent with the query")
+		schoolID := fs.Uint("school", 0, "School ID to store the result against")
+		fs.Parse(args)
+		if *transID == "" {
+			log.Fatal("-trans-id is required")
+		}
+
+		models.ConnectDB()
+		query, err := services.RunTransactionStatusQuery(client, uint(*schoolID), 0, *transID, *remarks)
+		printQuery(query, err)
+
+	case "balance":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		schoolID := fs.Uint("school", 0, "School ID to store the result against")
+		fs.Parse(args)
+
+		models.ConnectDB()
+		query, err := services.RunAccountBalanceQuery(client, uint(*schoolID), 0)
+		printQuery(query, err)
+
+	default:
+		usage()
+	}
+}
+
+func printQuery(query *models.MPESAQuery, err error) {
+	out, _ := json.MarshalIndent(query, "", "  ")
+	fmt.Println(string(out))
+	if err != nil {
+		log.Fatal("Daraja request failed: ", err)
+	}
+}
@@ -0,0 +1,137 @@
+package daraja
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Callback paths, relative to Config.CallbackURL
+const (
+	B2CResultPath    = "/b2c/result"
+	B2CTimeoutPath   = "/b2c/timeout"
+	QueryResultPath  = "/query/result"
+	QueryTimeoutPath = "/query/timeout"
+	ValidationPath   = "/c2b/validation"
+	ConfirmationPath = "/c2b/confirmation"
+)
+
+// B2CRequest - Business to customer payment (used for refunds)
+type B2CRequest struct {
+	Amount   float64
+	Phone    string // 2547XXXXXXXX
+	Remarks  string
+	Occasion string
+}
+
+// B2CPayment - Sends money from the B2C shortcode to a phone
+func (c *Client) B2CPayment(req B2CRequest) (*Response, error) {
+	shortcode := c.Config.B2CShortcode
+	if shortcode == "" {
+		shortcode = c.Config.Shortcode
+	}
+
+	return c.post("/mpesa/b2c/v3/paymentrequest", map[string]interface{}{
+		"OriginatorConversationID": uuid.New().String(),
+		"InitiatorName":            c.Config.InitiatorName,
+		"SecurityCredential":       c.Config.SecurityCredential,
+		"CommandID":                "BusinessPayment",
+		"Amount":                   req.Amount,
+		"PartyA":                   shortcode,
+		"PartyB":                   req.Phone,
+		"Remarks":                  req.Remarks,
+		"QueueTimeOutURL":          c.CallbackURL(B2CTimeoutPath),
+		"ResultURL":                c.CallbackURL(B2CResultPath),
+		"Occasion":                 req.Occasion,
+	})
+}
+
+// TransactionStatus - Asks Safaricom for the state of an M-PESA transaction
+// The answer arrives asynchronously on QueryResultPath
+func (c *Client) TransactionStatus(transID, remarks string) (*Response, error) {
+	if transID == "" {
+		return nil, fmt.Errorf("transaction id is required")
+	}
+	if remarks == "" {
+		remarks = "Transaction status query"
+	}
+
+	return c.post("/mpesa/transactionstatus/v1/query", map[string]interface{}{
+		"Initiator":          c.Config.InitiatorName,
+		"SecurityCredential": c.Config.SecurityCredential,
+		"CommandID":          "TransactionStatusQuery",
+		"TransactionID":      transID,
+		"PartyA":             c.Config.Shortcode,
+		"IdentifierType":     "4", // Organisation shortcode
+		"ResultURL":          c.CallbackURL(QueryResultPath),
+		"QueueTimeOutURL":    c.CallbackURL(QueryTimeoutPath),
+		"Remarks":            remarks,
+		"Occasion":           "",
+	})
+}
+
+// AccountBalance - Asks Safaricom for the paybill account balances
+// The answer arrives asynchronously on QueryResultPath
+func (c *Client) AccountBalance(remarks string) (*Response, error) {
+	if remarks == "" {
+		remarks = "Account balance query"
+	}
+
+	return c.post("/mpesa/accountbalance/v1/query", map[string]interface{}{
+		"Initiator":          c.Config.InitiatorName,
+		"SecurityCredential": c.Config.SecurityCredential,
+		"CommandID":          "AccountBalance",
+		"PartyA":             c.Config.Shortcode,
+		"IdentifierType":     "4",
+		"Remarks":            remarks,
+		"QueueTimeOutURL":    c.CallbackURL(QueryTimeoutPath),
+		"ResultURL":          c.CallbackURL(QueryResultPath),
+	})
+}
+
+// RegisterC2BURLs - Registers our validation and confirmation URLs
+// responseType is what Safaricom does if validation is unreachable: Completed or Cancelled
+func (c *Client) RegisterC2BURLs(responseType string) (*Response, error) {
+	if responseType == "" {
+		responseType = "Completed"
+	}
+
+	return c.post("/mpesa/c2b/v1/registerurl", map[string]interface{}{
+		"ShortCode":       c.Config.Shortcode,
+		"ResponseType":    responseType,
+		"ConfirmationURL": c.CallbackURL(ConfirmationPath),
+		"ValidationURL":   c.CallbackURL(ValidationPath),
+	})
+}
+
+// Callback - Result/timeout payload posted by Safaricom for async APIs
+type Callback struct {
+	Result CallbackResult `json:"Result"`
+}
+
+type CallbackResult struct {
+	ResultType               int    `json:"ResultType"`
+	ResultCode               int    `json:"ResultCode"`
+	ResultDesc               string `json:"ResultDesc"`
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	ConversationID           string `json:"ConversationID"`
+	TransactionID            string `json:"TransactionID"`
+	ResultParameters         struct {
+		ResultParameter []Parameter `json:"ResultParameter"`
+	} `json:"ResultParameters"`
+}
+
+// Parameter - Key/value pair; Value may be a string or a number
+type Parameter struct {
+	Key   string      `json:"Key"`
+	Value interface{} `json:"Value"`
+}
+
+// Params - Result parameters flattened to strings
+func (r CallbackResult) Params() map[string]string {
+	params := make(map[string]string)
+	for _, p := range r.ResultParameters.ResultParameter {
+		params[p.Key] = fmt.Sprint(p.Value)
+	}
+	return params
+}
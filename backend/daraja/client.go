@@ -0,0 +1,163 @@
+// Package daraja is a small client for the Safaricom Daraja (M-PESA) API.
+// It covers OAuth, B2C payments, Transaction Status, Account Balance and
+// C2B URL registration. Asynchronous APIs return immediately with a
+// ConversationID; the outcome is posted later to the configured ResultURL.
+package daraja
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config - Daraja credentials and callback settings, loaded from environment
+type Config struct {
+	ConsumerKey        string
+	ConsumerSecret     string
+	Shortcode          string
+	Passkey            string
+	CallbackURL        string // Public base of our /api/v1/mpesa routes
+	Environment        string // "sandbox" or "production"
+	BaseURL            string // Optional override of the Daraja host (local stand-ins)
+	InitiatorName      string // API operator for B2C, status and balance queries
+	SecurityCredential string // Encrypted initiator password
+	B2CShortcode       string // Shortcode refunds are paid from
+}
+
+// ConfigFromEnv - Reads the MPESA_* environment variables
+func ConfigFromEnv() Config {
+	return Config{
+		ConsumerKey:        getEnv("MPESA_CONSUMER_KEY", ""),
+		ConsumerSecret:     getEnv("MPESA_CONSUMER_SECRET", ""),
+		Shortcode:          getEnv("MPESA_SHORTCODE", "174379"), // Sandbox default
+		Passkey:            getEnv("MPESA_PASSKEY", ""),
+		CallbackURL:        getEnv("MPESA_CALLBACK_URL", ""),
+		Environment:        getEnv("MPESA_ENV", "sandbox"),
+		BaseURL:            getEnv("MPESA_BASE_URL", ""),
+		InitiatorName:      getEnv("MPESA_INITIATOR_NAME", ""),
+		SecurityCredential: getEnv("MPESA_SECURITY_CREDENTIAL", ""),
+		B2CShortcode:       getEnv("MPESA_B2C_SHORTCODE", ""),
+	}
+}
+
+func getEnv(key, defaultVal string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
+// Client - Daraja API client
+type Client struct {
+	Config Config
+	HTTP   *http.Client
+}
+
+// NewClient - Client with a 30 second timeout
+func NewClient(cfg Config) *Client {
+	return &Client{
+		Config: cfg,
+		HTTP:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// BaseURL - Daraja host for the configured environment
+func (c *Client) BaseURL() string {
+	if c.Config.BaseURL != "" {
+		return strings.TrimRight(c.Config.BaseURL, "/")
+	}
+	if c.Config.Environment == "production" {
+		return "https://api.safaricom.co.ke"
+	}
+	return "https://sandbox.safaricom.co.ke"
+}
+
+// CallbackURL - Absolute URL of one of our callback routes
+func (c *Client) CallbackURL(path string) string {
+	return strings.TrimRight(c.Config.CallbackURL, "/") + path
+}
+
+// AccessToken - OAuth client-credentials token
+func (c *Client) AccessToken() (string, error) {
+	url := c.BaseURL() + "/oauth/v1/generate?grant_type=client_credentials"
+
+	auth := base64.StdEncoding.EncodeToString(
+		[]byte(c.Config.ConsumerKey + ":" + c.Config.ConsumerSecret))
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Authorization", "Basic "+auth)
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	json.Unmarshal(body, &result)
+
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("no access token in response (HTTP %d)", resp.StatusCode)
+	}
+
+	return result.AccessToken, nil
+}
+
+// Response - Synchronous acknowledgement returned by Daraja
+type Response struct {
+	ConversationID           string `json:"ConversationID"`
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	ResponseCode             string `json:"ResponseCode"`
+	ResponseDescription      string `json:"ResponseDescription"`
+	ErrorCode                string `json:"errorCode,omitempty"`
+	ErrorMessage             string `json:"errorMessage,omitempty"`
+
+	// Raw body, kept so callers can store exactly what Safaricom said
+	Raw string `json:"-"`
+}
+
+// post - Authenticated JSON POST; non-zero ResponseCode is returned as an error
+func (c *Client) post(path string, payload interface{}) (*Response, error) {
+	token, err := c.AccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", c.BaseURL()+path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(resp.Body)
+
+	var result Response
+	json.Unmarshal(raw, &result)
+	result.Raw = string(raw)
+
+	// Most APIs answer "0"; C2B registration has answered "00000000"
+	if resp.StatusCode != http.StatusOK || result.ResponseCode == "" || strings.Trim(result.ResponseCode, "0") != "" {
+		msg := result.ResponseDescription
+		if msg == "" {
+			msg = result.ErrorMessage
+		}
+		return &result, fmt.Errorf("HTTP %d: %s", resp.StatusCode, msg)
+	}
+
+	return &result, nil
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"schoolms-go/models"
 	"schoolms-go/routes"
+	"schoolms-go/services"
 	"schoolms-go/utils"
+	"strings"
 
 	"time"
 
@@ -20,11 +23,18 @@ func main() {
 	// Initialize Gin
 	r := gin.Default()
 
+	// Only these proxies may set X-Forwarded-For, which login throttling uses for the client IP
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		if err := r.SetTrustedProxies(strings.Split(proxies, ",")); err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+		}
+	}
+
 	// CORS Configuration
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5173"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key", "Last-Event-ID"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
@@ -38,6 +48,11 @@ func main() {
 	// Setup Routes
 	api := r.Group("/api/v1")
 	routes.RegisterAuthRoutes(api)
+	routes.RegisterUserRoutes(api)
+	routes.RegisterRoleRoutes(api)
+	routes.RegisterMembershipRoutes(api)
+	routes.RegisterSSORoutes(api)
+	routes.RegisterAPIKeyRoutes(api)
 	routes.RegisterSuperAdminRoutes(api)
 	routes.RegisterInviteRoutes(api)
 	routes.RegisterClassRoutes(api)
@@ -46,6 +61,7 @@ func main() {
 	routes.RegisterReportRoutes(api)
 	routes.RegisterTicketRoutes(api)
 	routes.RegisterNotificationRoutes(api)
+	routes.RegisterStreamRoutes(api)
 	routes.RegisterTeacherRoutes(api)
 	routes.RegisterContentRoutes(api)
 	routes.RegisterGradeRoutes(api)
@@ -56,8 +72,13 @@ func main() {
 	routes.RegisterAnalyticsRoutes(api)
 	routes.RegisterVoteHeadRoutes(api)
 	routes.RegisterMpesaRoutes(api)
+	routes.RegisterFamilyAccountRoutes(api)
 	routes.RegisterTVETRoutes(api)
 	routes.RegisterSMSRoutes(api)
+	routes.RegisterUSSDRoutes(api)
+	routes.RegisterAlertRoutes(api)
+	routes.RegisterEmailRoutes(api)
+	routes.RegisterWhatsAppRoutes(api)
 	routes.RegisterImportRoutes(api)
 	routes.RegisterAuditRoutes(api)
 
@@ -67,6 +88,18 @@ func main() {
 	// Seed Superadmin
 	utils.SeedSuperAdmin()
 
+	// Deliver queued SMS in the background
+	services.StartOutboxWorkers(context.Background(), 2)
+
+	// Turn payments, absences, grades and discharges into guardian alerts
+	services.RegisterAlertSubscribers()
+	services.RegisterNotificationSubscribers()
+	services.RegisterStreamSubscribers()
+	services.StartEventWorkers(context.Background(), 1)
+
+	// Publish scheduled announcements and text/email them to recipients
+	services.StartNotificationPublisher(context.Background())
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -2,15 +2,26 @@ package middleware
 
 import (
 	"net/http"
+	"schoolms-go/services"
 	"schoolms-go/utils"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	allowPasswordChangeKey = "allowPendingPasswordChange"
+	allowPreAuthKey        = "allowPreAuth"
+	apiKeyScopesKey        = "apiKeyScopes"
+)
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
+		if key := c.GetHeader("X-API-Key"); key != "" && authHeader == "" {
+			authHeader = "Bearer " + key
+		}
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
 			c.Abort()
@@ -24,6 +35,12 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// Integrations send an API key instead of a JWT
+		if services.IsAPIKey(parts[1]) {
+			authenticateAPIKey(c, parts[1])
+			return
+		}
+
 		claims, err := utils.ValidateToken(parts[1])
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
@@ -31,8 +48,44 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// Pre-auth tokens (password checked, two-factor pending) only reach the two-factor endpoints
+		if claims.Purpose != "" && !c.GetBool(allowPreAuthKey) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Two-factor verification required"})
+			c.Abort()
+			return
+		}
+
+		// User tokens are always issued for a session, and stop working as soon as it is revoked
+		// (logout, password change, deactivation); only pre-auth tokens have none
+		if claims.Purpose == "" && claims.SessionID == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			c.Abort()
+			return
+		}
+		if claims.SessionID != 0 {
+			user, ok := services.SessionUser(claims.SessionID, claims.UserID)
+			if !ok {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+				c.Abort()
+				return
+			}
+			if claims.MembershipID != 0 && !services.MembershipActive(claims.MembershipID, claims.UserID) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Membership has been removed"})
+				c.Abort()
+				return
+			}
+			if user.MustChangePassword && !c.GetBool(allowPasswordChangeKey) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Password change required", "code": "PASSWORD_CHANGE_REQUIRED"})
+				c.Abort()
+				return
+			}
+		}
+
 		// Set claims in context
 		c.Set("userID", claims.UserID)
+		c.Set("sessionID", claims.SessionID)
+		c.Set("membershipID", claims.MembershipID)
+		c.Set("preAuth", claims.Purpose)
 		c.Set("role", claims.Role)
 		// Handle nullable SchoolID safely
 		if claims.SchoolID != nil {
@@ -46,31 +99,97 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
-// RoleGuard ensures the user has one of the allowed roles
-func RoleGuard(allowedRoles ...string) gin.HandlerFunc {
+// authenticateAPIKey - Act as the key's service account, limited to the key's scopes
+func authenticateAPIKey(c *gin.Context, key string) {
+	record, account, err := services.AuthenticateAPIKey(key, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid, expired or revoked API key"})
+		c.Abort()
+		return
+	}
+	c.Set("userID", account.ID)
+	c.Set("sessionID", uint(0))
+	c.Set("membershipID", uint(0))
+	c.Set("preAuth", "")
+	c.Set("role", account.Role)
+	c.Set("schoolID", record.SchoolID)
+	c.Set("apiKeyID", record.ID)
+	c.Set(apiKeyScopesKey, services.ParsePermissions(record.Scopes))
+	c.Next()
+}
+
+// Permissions - What the request may do: the API key's scopes, else the user's role or custom role
+func Permissions(c *gin.Context) []string {
+	if scopes, ok := c.Get(apiKeyScopesKey); ok {
+		return scopes.([]string)
+	}
+	return services.UserPermissions(c.GetUint("userID"), c.GetUint("membershipID"), c.GetString("role"))
+}
+
+// RequirePermission - Only let through users whose role (or custom role) has the permission
+// The name must be in services.Permissions; a typo panics when the route is registered
+func RequirePermission(permission string) gin.HandlerFunc {
+	if !services.IsPermission(permission) {
+		panic("middleware: unknown permission " + permission)
+	}
 	return func(c *gin.Context) {
-		userRole, exists := c.Get("role")
-		if !exists {
+		if _, exists := c.Get("role"); !exists {
 			c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
 			c.Abort()
 			return
 		}
 
-		roleStr, ok := userRole.(string)
-		if !ok {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid role type"})
+		if !slices.Contains(Permissions(c), permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions", "permission": permission})
 			c.Abort()
 			return
 		}
+		c.Next()
+	}
+}
 
-		for _, role := range allowedRoles {
-			if role == roleStr {
-				c.Next()
-				return
-			}
+// StreamTicketAuth - Accept a single-use ?ticket= for clients that can't set headers (EventSource), else AuthMiddleware
+// A ticket rather than the JWT goes in the URL, as URLs end up in proxy and access logs; an Authorization header still wins
+func StreamTicketAuth() gin.HandlerFunc {
+	auth := AuthMiddleware()
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+		if ticket == "" || c.GetHeader("Authorization") != "" || c.GetHeader("X-API-Key") != "" {
+			auth(c)
+			return
+		}
+		record, err := services.RedeemStreamTicket(ticket)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired stream ticket"})
+			c.Abort()
+			return
+		}
+		c.Set("userID", record.UserID)
+		c.Set("sessionID", record.SessionID)
+		c.Set("membershipID", record.MembershipID)
+		c.Set("preAuth", "")
+		c.Set("role", record.Role)
+		if record.SchoolID != nil {
+			c.Set("schoolID", *record.SchoolID)
 		}
+		c.Next()
+	}
+}
 
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-		c.Abort()
+// AllowPendingPasswordChange - Let users who must change their password through (change password, logout)
+// Must run before AuthMiddleware
+func AllowPendingPasswordChange() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(allowPasswordChangeKey, true)
+		c.Next()
+	}
+}
+
+// AllowPreAuth - Also accept pre-auth tokens, for finishing a two-factor sign-in; handlers check "preAuth"
+// Must run before AuthMiddleware
+func AllowPreAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(allowPreAuthKey, true)
+		c.Next()
 	}
 }
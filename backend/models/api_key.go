@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// APIKey - A key an integration (gate system, accounting package) uses instead of a person's password
+// It acts as its service account, a User with role SERVICE, and may only do what its scopes allow
+type APIKey struct {
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	SchoolID         uint       `gorm:"index;not null" json:"school_id"`
+	ServiceAccountID uint       `gorm:"index;not null" json:"service_account_id"`
+	Name             string     `gorm:"not null" json:"name"`          // e.g. Main gate
+	Prefix           string     `gorm:"not null" json:"prefix"`        // First characters of the key, to tell keys apart
+	KeyHash          string     `gorm:"uniqueIndex;not null" json:"-"` // SHA-256 of the key; the key itself is shown once
+	Scopes           string     `gorm:"type:text" json:"-"`            // Comma-separated permission names
+	ExpiresAt        time.Time  `gorm:"index" json:"expires_at"`
+	LastUsedAt       *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP       string     `json:"last_used_ip,omitempty"`
+	RevokedAt        *time.Time `gorm:"index" json:"revoked_at,omitempty"`
+	CreatedByID      uint       `json:"created_by_id"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
@@ -29,6 +29,47 @@ const (
 	AuditImportData              = "IMPORT_DATA"
 	AuditDeleteStudent           = "DELETE_STUDENT"
 	AuditMPESAMatch              = "MPESA_MANUAL_MATCH"
+	AuditRefundRequested         = "REFUND_REQUESTED"
+	AuditRefundApproved          = "REFUND_APPROVED"
+	AuditRefundRejected          = "REFUND_REJECTED"
+	AuditMPESARegisterURLs       = "MPESA_REGISTER_URLS"
+	AuditFamilyAccountCreated    = "FAMILY_ACCOUNT_CREATED"
+	AuditFamilySplitRuleChange   = "FAMILY_SPLIT_RULE_CHANGE"
+	AuditSMSSettingsChange       = "SMS_SETTINGS_CHANGE"
+	AuditSMSCreditTopUp          = "SMS_CREDIT_TOPUP"
+	AuditSMSBillingChange        = "SMS_BILLING_CHANGE"
+	AuditAlertRuleChange         = "ALERT_RULE_CHANGE"
+	AuditEmailSettingsChange     = "EMAIL_SETTINGS_CHANGE"
+	AuditWhatsAppSettingsChange  = "WHATSAPP_SETTINGS_CHANGE"
+	AuditPasswordChanged         = "PASSWORD_CHANGED"
+	AuditSessionsRevoked         = "SESSIONS_REVOKED"
+	AuditUserDeactivated         = "USER_DEACTIVATED"
+	AuditUserReactivated         = "USER_REACTIVATED"
+	AuditPasswordResetRequested  = "PASSWORD_RESET_REQUESTED"
+	AuditPasswordResetCompleted  = "PASSWORD_RESET_COMPLETED"
+	AuditPasswordResetLocked     = "PASSWORD_RESET_LOCKED"
+	AuditTwoFactorEnabled        = "TWO_FACTOR_ENABLED"
+	AuditTwoFactorDisabled       = "TWO_FACTOR_DISABLED"
+	AuditTwoFactorReset          = "TWO_FACTOR_RESET"
+	AuditRecoveryCodeUsed        = "RECOVERY_CODE_USED"
+	AuditTwoFactorPolicyChange   = "TWO_FACTOR_POLICY_CHANGE"
+	AuditLoginFailed             = "LOGIN_FAILED"
+	AuditAccountLocked           = "ACCOUNT_LOCKED"
+	AuditAccountUnlocked         = "ACCOUNT_UNLOCKED"
+	AuditLoginIPBlocked          = "LOGIN_IP_BLOCKED"
+	AuditRoleChange              = "ROLE_CHANGE"
+	AuditCustomRoleChange        = "CUSTOM_ROLE_CHANGE"
+	AuditMembershipAdded         = "MEMBERSHIP_ADDED"
+	AuditMembershipRemoved       = "MEMBERSHIP_REMOVED"
+	AuditSSOLogin                = "SSO_LOGIN"
+	AuditSSOUserProvisioned      = "SSO_USER_PROVISIONED"
+	AuditSSOProviderChange       = "SSO_PROVIDER_CHANGE"
+	AuditServiceAccountChange    = "SERVICE_ACCOUNT_CHANGE"
+	AuditAPIKeyCreated           = "API_KEY_CREATED"
+	AuditAPIKeyRevoked           = "API_KEY_REVOKED"
+	AuditInvitesCreated          = "INVITES_CREATED"
+	AuditInviteRevoked           = "INVITE_REVOKED"
+	AuditInviteClaimed           = "INVITE_CLAIMED"
 )
 
 // CreateAuditLog - Helper to create audit log entries
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// CustomRole - A school's own role: a named set of permissions that replaces the
+// default bundle of the built-in role for the users it is given to
+type CustomRole struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	SchoolID    uint      `gorm:"uniqueIndex:idx_custom_role_school_name;not null" json:"school_id"`
+	Name        string    `gorm:"uniqueIndex:idx_custom_role_school_name;not null" json:"name"` // e.g. Deputy Principal
+	Description string    `json:"description"`
+	Permissions string    `gorm:"type:text" json:"-"` // Comma-separated permission names
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
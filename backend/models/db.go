@@ -62,6 +62,7 @@ func ConnectDB() {
 
 	// AutoMigrate
 	log.Println("Running database migrations...")
+	legacyReads := renameLegacyNotificationReads(db)
 	db.AutoMigrate(
 		&User{}, &School{}, &Invite{},
 		&Class{}, &Student{},
@@ -69,11 +70,50 @@ func ConnectDB() {
 		&Ticket{}, &Notification{}, &NotificationRead{},
 		&ClassContent{}, &Grade{},
 		&Attendance{}, &Timetable{}, &ParentStudent{}, &Exam{}, &ExamResult{},
-		&VoteHead{}, &FeeItem{}, &VoteHeadBalance{}, &PaymentAllocation{}, &MPESATransaction{},
+		&VoteHead{}, &FeeItem{}, &VoteHeadBalance{}, &PaymentAllocation{}, &MPESATransaction{}, &MPESAQuery{},
 		&IntakeGroup{}, &Course{}, &Module{}, &StudentModuleEnrollment{}, &IndustrialAttachment{},
-		&AuditLog{},
+		&AuditLog{}, &Refund{}, &FamilyAccount{}, &SMSLog{}, &SMSSettings{},
+		&MessageJob{}, &OutboundMessage{}, &SMSOptOut{}, &InboundMessage{}, &MessageTemplate{},
+		&SMSWallet{}, &SMSCreditTransaction{}, &Event{}, &AlertRule{},
+		&EmailSettings{}, &EmailLog{}, &WhatsAppSettings{}, &WhatsAppTemplate{},
+		&NotificationRecipient{}, &NotificationGroup{}, &NotificationGroupMember{}, &NotificationAcknowledgement{},
+		&UserSession{}, &PasswordReset{}, &RecoveryCode{}, &LoginFailure{}, &CustomRole{}, &Membership{},
+		&SSOProvider{}, &SSOLoginState{}, &SSOIdentityLink{}, &APIKey{}, &StreamTicket{},
 	)
+	if legacyReads {
+		migrateLegacyNotificationReads(db)
+	}
 	log.Println("Database migrations complete!")
 
 	DB = db
 }
+
+const legacyNotificationReads = "notification_reads_legacy"
+
+// renameLegacyNotificationReads - Move aside read receipts still keyed by student_id so AutoMigrate
+// can create the user-keyed table; reports whether there was anything to move
+func renameLegacyNotificationReads(db *gorm.DB) bool {
+	m := db.Migrator()
+	if !m.HasTable(&NotificationRead{}) || !m.HasColumn(&NotificationRead{}, "student_id") {
+		return false
+	}
+	if err := m.RenameTable(&NotificationRead{}, legacyNotificationReads); err != nil {
+		log.Printf("Could not rename legacy notification reads: %v", err)
+		return false
+	}
+	return true
+}
+
+// migrateLegacyNotificationReads - Copy student read receipts over to the student's user
+func migrateLegacyNotificationReads(db *gorm.DB) {
+	err := db.Exec(`INSERT INTO notification_reads (notification_id, user_id, read_at)
+		SELECT r.notification_id, s.user_id, MIN(r.read_at) FROM ` + legacyNotificationReads + ` r
+		JOIN students s ON s.id = r.student_id
+		GROUP BY r.notification_id, s.user_id`).Error
+	if err != nil {
+		log.Printf("Could not migrate legacy notification reads: %v", err)
+		return
+	}
+	db.Migrator().DropTable(legacyNotificationReads)
+	log.Println("Migrated notification reads to users")
+}
@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// EmailSettings - Per-school SMTP server; schools without a row use the server default
+type EmailSettings struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	SchoolID    uint      `gorm:"not null;uniqueIndex" json:"school_id"`
+	Host        string    `gorm:"not null" json:"host"`
+	Port        int       `gorm:"not null" json:"port"`
+	Username    string    `json:"username"`
+	Password    string    `json:"-"`
+	Encryption  string    `gorm:"not null" json:"encryption"` // NONE, STARTTLS, TLS
+	FromAddress string    `gorm:"not null" json:"from_address"`
+	FromName    string    `json:"from_name"`
+	UpdatedBy   uint      `json:"updated_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// EmailLog - Every email sent, like SMSLog
+type EmailLog struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	SchoolID    uint      `gorm:"index" json:"school_id"`
+	To          string    `json:"to"`
+	Subject     string    `json:"subject"`
+	Template    string    `json:"template"`
+	Attachments string    `json:"attachments,omitempty"` // File names, comma separated
+	Status      string    `json:"status"`                // SENT, FAILED
+	Error       string    `json:"error,omitempty"`
+	MessageID   string    `json:"message_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// SMTP encryption modes
+const (
+	EmailEncryptionNone     = "NONE"
+	EmailEncryptionSTARTTLS = "STARTTLS"
+	EmailEncryptionTLS      = "TLS"
+)
+
+// Email templates
+const (
+	EmailTemplateInvite        = "INVITE"
+	EmailTemplatePasswordReset = "PASSWORD_RESET"
+	EmailTemplateReceipt       = "RECEIPT"
+	EmailTemplateFeeStatement  = "FEE_STATEMENT"
+	EmailTemplateReportCard    = "REPORT_CARD"
+	EmailTemplateTest          = "TEST"
+	EmailTemplateAnnouncement  = "ANNOUNCEMENT"
+	EmailTemplateAccountLocked = "ACCOUNT_LOCKED"
+)
+
+// Email delivery states
+const (
+	EmailSent   = "SENT"
+	EmailFailed = "FAILED"
+)
@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// Event - Something that happened to a student, queued for subscribers (alerts, SMS)
+type Event struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	SchoolID    uint       `gorm:"not null;index" json:"school_id"`
+	Type        string     `gorm:"not null;index" json:"type"`
+	StudentID   uint       `gorm:"index" json:"student_id"`
+	ActorID     uint       `json:"actor_id"`                     // User whose action raised it; 0 for M-PESA callbacks
+	Payload     string     `gorm:"type:text" json:"payload"`     // JSON object of string fields
+	Status      string     `gorm:"not null;index" json:"status"` // PENDING, PROCESSING, PROCESSED, FAILED
+	Error       string     `json:"error,omitempty"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// Event types
+const (
+	EventPaymentRecorded   = "PAYMENT_RECORDED"
+	EventAttendanceAbsent  = "ATTENDANCE_ABSENT"
+	EventGradePublished    = "GRADE_PUBLISHED"
+	EventStudentDischarged = "STUDENT_DISCHARGED"
+
+	EventNotificationPublished = "NOTIFICATION_PUBLISHED" // Payload: notification_id
+)
+
+// Event states
+const (
+	EventPending    = "PENDING"
+	EventProcessing = "PROCESSING"
+	EventProcessed  = "PROCESSED"
+	EventFailed     = "FAILED"
+)
+
+// AlertRule - How a school wants guardians told about one event type
+// Schools without a row get the built-in default for that event
+type AlertRule struct {
+	ID                  uint      `gorm:"primaryKey" json:"id"`
+	SchoolID            uint      `gorm:"not null;uniqueIndex:idx_alert_rule_school_event" json:"school_id"`
+	EventType           string    `gorm:"not null;uniqueIndex:idx_alert_rule_school_event" json:"event_type"`
+	Enabled             bool      `json:"enabled"`
+	SendSMS             bool      `json:"send_sms"`
+	SendNotification    bool      `json:"send_notification"`    // In-app notification on the student
+	ConsecutiveAbsences int       `json:"consecutive_absences"` // ATTENDANCE_ABSENT: alert from the Nth absence in a row
+	UpdatedBy           uint      `json:"updated_by"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
@@ -44,10 +44,12 @@ type Timetable struct {
 
 // ParentStudent - Links parents to students
 type ParentStudent struct {
-	ID        uint   `gorm:"primaryKey" json:"id"`
-	ParentID  uint   `gorm:"not null;index" json:"parent_id"`
-	StudentID uint   `gorm:"not null;index" json:"student_id"`
-	Relation  string `json:"relation"` // FATHER, MOTHER, GUARDIAN
+	ID            uint   `gorm:"primaryKey" json:"id"`
+	ParentID      uint   `gorm:"not null;index" json:"parent_id"`
+	StudentID     uint   `gorm:"not null;index" json:"student_id"`
+	Relation      string `json:"relation"`        // FATHER, MOTHER, GUARDIAN
+	Phone         string `json:"phone,omitempty"` // Guardian's number for this child, E.164
+	PhoneVerified bool   `gorm:"default:false" json:"phone_verified"`
 
 	// Relations
 	Parent  User    `gorm:"foreignKey:ParentID" json:"parent,omitempty"`
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// FamilyAccount - One M-PESA account reference covering all of a parent's children
+// Siblings are whoever the parent is linked to through ParentStudent
+// An incoming payment is split across their balances by SplitRule
+type FamilyAccount struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	SchoolID   uint      `gorm:"not null;uniqueIndex:idx_family_accounts_school_parent" json:"school_id"`
+	ParentID   uint      `gorm:"not null;uniqueIndex:idx_family_accounts_school_parent" json:"parent_id"` // One account per parent per school
+	AccountRef string    `gorm:"not null;uniqueIndex" json:"account_ref"`                                 // Used as the M-PESA BillRefNumber
+	SplitRule  string    `gorm:"not null;default:OLDEST_DEBT" json:"split_rule"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	// Relations
+	Parent User `gorm:"foreignKey:ParentID" json:"parent,omitempty"`
+}
+
+// Family payment split rules
+const (
+	SplitOldestDebt   = "OLDEST_DEBT"  // Clear the longest-outstanding debt first
+	SplitProportional = "PROPORTIONAL" // Share by each child's outstanding balance
+)
+
+// FamilyAccountRef - Account reference for a parent in a school, e.g. FAM3-00042
+// Every school shares the paybill, so the school is part of the reference
+func FamilyAccountRef(schoolID, parentID uint) string {
+	return fmt.Sprintf("FAM%d-%05d", schoolID, parentID)
+}
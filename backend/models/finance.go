@@ -17,14 +17,15 @@ type FeeStructure struct {
 }
 
 type Payment struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	StudentID uint      `gorm:"not null;index" json:"student_id"`
-	Amount    float64   `gorm:"type:decimal(10,2);not null" json:"amount"`
-	Method    string    `json:"method"` // CASH, MPESA, BANK
-	Reference string    `json:"reference"`
-	SchoolID  uint      `gorm:"not null;index" json:"school_id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	StudentID       uint      `gorm:"not null;index" json:"student_id"`
+	Amount          float64   `gorm:"type:decimal(10,2);not null" json:"amount"`
+	Method          string    `json:"method"` // CASH, MPESA, BANK
+	Reference       string    `json:"reference"`
+	SchoolID        uint      `gorm:"not null;index" json:"school_id"`
+	FamilyAccountID *uint     `gorm:"index" json:"family_account_id,omitempty"` // Set when split from a family payment
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
 
 	// Relationships
 	Student Student `gorm:"foreignKey:StudentID"`
@@ -7,13 +7,21 @@ import (
 )
 
 type Invite struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Code      uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"code"`
-	Role      string    `gorm:"not null" json:"role"`
-	SchoolID  uint      `gorm:"not null;index" json:"school_id"`
-	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
-	IsUsed    bool      `gorm:"default:false" json:"is_used"`
-	CreatedAt time.Time `json:"created_at"`
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	Code        uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex" json:"code"`
+	Role        string     `gorm:"not null" json:"role"`
+	SchoolID    uint       `gorm:"not null;index" json:"school_id"`
+	ExpiresAt   time.Time  `gorm:"not null" json:"expires_at"`
+	IsUsed      bool       `gorm:"default:false" json:"is_used"` // Set once UseCount reaches MaxUses
+	MaxUses     int        `gorm:"default:1" json:"max_uses"`    // Signups allowed; linked invites are single-use
+	UseCount    int        `gorm:"default:0" json:"use_count"`
+	StudentID   *uint      `gorm:"index" json:"student_id,omitempty"` // STUDENT: claim this student's account; PARENT: link the new parent to this student
+	ParentID    *uint      `gorm:"index" json:"parent_id,omitempty"`  // Claim this guardian's account
+	Email       string     `json:"email,omitempty"`                   // Where the code was sent
+	Phone       string     `json:"phone,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	CreatedByID uint       `json:"created_by_id,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
 
 	// Relations
 	School School `gorm:"foreignKey:SchoolID"`
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// LoginFailure - A failed sign-in, kept for a day to throttle guessing from one IP address
+type LoginFailure struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Email     string    `gorm:"index" json:"email"`
+	UserID    *uint     `json:"user_id,omitempty"` // Nil when no account has the email
+	IPAddress string    `gorm:"index" json:"ip_address"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
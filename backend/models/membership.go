@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// Membership - A further school and role a user holds besides the home ones on their
+// User row, e.g. a teacher who is also a parent, or a bursar serving a sister school
+type Membership struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"uniqueIndex:idx_membership_user_school_role;not null" json:"user_id"`
+	SchoolID  uint      `gorm:"uniqueIndex:idx_membership_user_school_role;index;not null" json:"school_id"`
+	Role      string    `gorm:"uniqueIndex:idx_membership_user_school_role;not null" json:"role"`
+	AddedByID uint      `json:"added_by_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
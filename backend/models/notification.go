@@ -2,27 +2,115 @@ package models
 
 import "time"
 
-// Notification represents a message sent to students
+// Notification target types
+const (
+	NotificationTargetAll          = "ALL"           // Everyone in the school
+	NotificationTargetClass        = "CLASS"         // Students of a class (TargetID = ClassID)
+	NotificationTargetStudent      = "STUDENT"       // A student and their parents (TargetID = StudentID)
+	NotificationTargetRole         = "ROLE"          // Everyone with TargetRole
+	NotificationTargetClassParents = "CLASS_PARENTS" // Parents of a class's students (TargetID = ClassID)
+	NotificationTargetTeachers     = "TEACHERS"      // All teachers, or a class's teachers when TargetID is set
+	NotificationTargetUsers        = "USERS"         // Listed in NotificationRecipient
+	NotificationTargetGroup        = "GROUP"         // Members of a NotificationGroup (TargetID = GroupID)
+)
+
+// Notification priorities, highest first in the inbox after pinned ones
+const (
+	NotificationPriorityNormal = "NORMAL"
+	NotificationPriorityHigh   = "HIGH"
+	NotificationPriorityUrgent = "URGENT"
+)
+
+// Notification states, derived from the publish and expiry times
+const (
+	NotificationScheduled = "SCHEDULED"
+	NotificationPublished = "PUBLISHED"
+	NotificationExpired   = "EXPIRED"
+)
+
+// Notification represents an in-app message to a set of users
 type Notification struct {
-	ID         uint      `gorm:"primaryKey" json:"id"`
-	SchoolID   uint      `gorm:"index;not null" json:"school_id"`
-	SenderID   uint      `gorm:"not null" json:"sender_id"`   // Who sent it
-	TargetType string    `gorm:"not null" json:"target_type"` // ALL, CLASS, STUDENT
-	TargetID   *uint     `json:"target_id,omitempty"`         // ClassID or StudentID if targeted
-	Title      string    `gorm:"not null" json:"title"`
-	Message    string    `gorm:"type:text;not null" json:"message"`
-	Category   string    `gorm:"not null" json:"category"` // FEE_REMINDER, ANNOUNCEMENT, ALERT
-	CreatedAt  time.Time `json:"created_at"`
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	SchoolID   uint   `gorm:"index;not null" json:"school_id"`
+	SenderID   uint   `gorm:"not null" json:"sender_id"`   // Who sent it
+	TargetType string `gorm:"not null" json:"target_type"` // See NotificationTarget*
+	TargetID   *uint  `json:"target_id,omitempty"`         // ClassID, StudentID or GroupID if targeted
+	TargetRole string `json:"target_role,omitempty"`       // Role for ROLE notifications
+	Title      string `gorm:"not null" json:"title"`
+	Message    string `gorm:"type:text;not null" json:"message"`
+	Category   string `gorm:"not null" json:"category"` // FEE_REMINDER, ANNOUNCEMENT, ALERT
+	Priority   string `gorm:"default:NORMAL" json:"priority"`
+	Pinned     bool   `gorm:"default:false" json:"pinned"`
+
+	PublishAt   *time.Time `gorm:"index" json:"publish_at,omitempty"`   // Hidden from inboxes until then; nil means straight away
+	ExpiresAt   *time.Time `gorm:"index" json:"expires_at,omitempty"`   // Hidden from inboxes from then on
+	PublishedAt *time.Time `gorm:"index" json:"published_at,omitempty"` // When SMS/email delivery was started
+
+	AckRequired bool  `gorm:"default:false" json:"ack_required"` // Recipients must acknowledge, e.g. consent or policy changes
+	SendSMS     bool  `gorm:"default:false" json:"send_sms"`     // Also text recipients at publish time
+	SendEmail   bool  `gorm:"default:false" json:"send_email"`   // Also email recipients at publish time
+	SMSJobID    *uint `json:"sms_job_id,omitempty"`
+	EmailsSent  int   `json:"emails_sent"`
+
+	CreatedAt time.Time `json:"created_at"`
 
 	// Relations
 	School School `gorm:"foreignKey:SchoolID" json:"-"`
 	Sender User   `gorm:"foreignKey:SenderID" json:"sender,omitempty"`
 }
 
-// NotificationRead tracks which students have read notifications
+// Status - SCHEDULED, PUBLISHED or EXPIRED at the given time
+func (n Notification) Status(now time.Time) string {
+	switch {
+	case n.ExpiresAt != nil && !n.ExpiresAt.After(now):
+		return NotificationExpired
+	case n.PublishAt != nil && n.PublishAt.After(now):
+		return NotificationScheduled
+	}
+	return NotificationPublished
+}
+
+// NotificationRecipient - A user picked by hand for a USERS notification
+type NotificationRecipient struct {
+	ID             uint `gorm:"primaryKey" json:"id"`
+	NotificationID uint `gorm:"uniqueIndex:idx_notification_recipient;not null" json:"notification_id"`
+	UserID         uint `gorm:"uniqueIndex:idx_notification_recipient;index;not null" json:"user_id"`
+}
+
+// NotificationRead tracks which users have read notifications
 type NotificationRead struct {
 	ID             uint      `gorm:"primaryKey"`
-	NotificationID uint      `gorm:"index;not null"`
-	StudentID      uint      `gorm:"index;not null"`
+	NotificationID uint      `gorm:"uniqueIndex:idx_notification_read;not null"`
+	UserID         uint      `gorm:"uniqueIndex:idx_notification_read;index;not null"`
 	ReadAt         time.Time `json:"read_at"`
 }
+
+// NotificationAcknowledgement - A user confirming they have read and accept an AckRequired notification
+type NotificationAcknowledgement struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	NotificationID uint      `gorm:"uniqueIndex:idx_notification_ack;not null" json:"notification_id"`
+	UserID         uint      `gorm:"uniqueIndex:idx_notification_ack;index;not null" json:"user_id"`
+	AcknowledgedAt time.Time `json:"acknowledged_at"`
+}
+
+// NotificationGroup - A custom audience, e.g. "Drama club parents" or "Bus duty teachers"
+type NotificationGroup struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	SchoolID    uint      `gorm:"uniqueIndex:idx_notification_group_name;not null" json:"school_id"`
+	Name        string    `gorm:"uniqueIndex:idx_notification_group_name;not null" json:"name"`
+	Description string    `json:"description,omitempty"`
+	CreatedBy   uint      `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	Members []NotificationGroupMember `gorm:"foreignKey:GroupID" json:"members,omitempty"`
+}
+
+// NotificationGroupMember - A user in a NotificationGroup
+type NotificationGroupMember struct {
+	ID      uint `gorm:"primaryKey" json:"id"`
+	GroupID uint `gorm:"uniqueIndex:idx_notification_group_member;not null" json:"group_id"`
+	UserID  uint `gorm:"uniqueIndex:idx_notification_group_member;index;not null" json:"user_id"`
+
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// PasswordReset - A one-time code sent to a user who forgot their password
+// The code (and the token in the emailed link) are stored hashed
+type PasswordReset struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"index;not null" json:"user_id"`
+	Channel     string     `gorm:"not null" json:"channel"` // EMAIL, SMS
+	Destination string     `json:"destination"`             // Masked address or number it went to
+	CodeHash    string     `gorm:"not null" json:"-"`
+	TokenHash   string     `gorm:"uniqueIndex;not null" json:"-"`
+	Attempts    int        `gorm:"default:0" json:"attempts"` // Wrong codes entered
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UsedAt      *time.Time `json:"used_at,omitempty"` // Also set when superseded or locked
+	IPAddress   string     `json:"ip_address"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Password reset channels
+const (
+	ResetChannelEmail = "EMAIL"
+	ResetChannelSMS   = "SMS"
+)
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+)
+
+// Refund - M-PESA B2C refund of a student's credit or of a specific payment
+// A refund is requested by one user and must be approved by a second user
+// before the B2C request is sent to Safaricom
+type Refund struct {
+	ID                       uint       `gorm:"primaryKey" json:"id"`
+	SchoolID                 uint       `gorm:"not null;index" json:"school_id"`
+	StudentID                uint       `gorm:"not null;index" json:"student_id"`
+	PaymentID                *uint      `gorm:"index" json:"payment_id,omitempty"` // Set for REVERSAL refunds
+	Type                     string     `gorm:"not null" json:"type"`              // CREDIT, REVERSAL
+	Amount                   float64    `gorm:"not null" json:"amount"`
+	Phone                    string     `gorm:"not null" json:"phone"` // 2547XXXXXXXX
+	Reason                   string     `json:"reason"`
+	Status                   string     `gorm:"not null;index" json:"status"` // PENDING_APPROVAL, REJECTED, PROCESSING, COMPLETED, FAILED, TIMED_OUT
+	RequestedBy              uint       `gorm:"not null" json:"requested_by"`
+	ApprovedBy               *uint      `json:"approved_by,omitempty"`
+	ApprovedAt               *time.Time `json:"approved_at,omitempty"`
+	ConversationID           string     `gorm:"index" json:"conversation_id,omitempty"`
+	OriginatorConversationID string     `gorm:"index" json:"originator_conversation_id,omitempty"`
+	TransactionID            string     `json:"transaction_id,omitempty"` // M-PESA receipt from the B2C result
+	ResultCode               *int       `json:"result_code,omitempty"`
+	ResultDesc               string     `json:"result_desc,omitempty"`
+	ReversalPaymentID        *uint      `json:"reversal_payment_id,omitempty"` // Negative payment recorded on completion
+	CreatedAt                time.Time  `json:"created_at"`
+	UpdatedAt                time.Time  `json:"updated_at"`
+
+	// Relations
+	Student Student `gorm:"foreignKey:StudentID" json:"student,omitempty"`
+}
+
+// Refund types
+const (
+	RefundTypeCredit   = "CREDIT"
+	RefundTypeReversal = "REVERSAL"
+)
+
+// Refund statuses
+const (
+	RefundPendingApproval = "PENDING_APPROVAL"
+	RefundRejected        = "REJECTED"
+	RefundProcessing      = "PROCESSING"
+	RefundCompleted       = "COMPLETED"
+	RefundFailed          = "FAILED"
+	RefundTimedOut        = "TIMED_OUT"
+)
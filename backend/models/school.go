@@ -8,6 +8,8 @@ type School struct {
 	Address            string    `json:"address"`
 	ContactInfo        string    `json:"contact_info"`
 	SubscriptionStatus string    `json:"subscription_status"` // ACTIVE, INACTIVE, TRIAL
+	Paybill            string    `json:"paybill"`             // M-PESA paybill shown in messages; defaults to MPESA_SHORTCODE
+	TwoFactorRoles     string    `json:"two_factor_roles"`    // Comma-separated roles that must use two-factor sign-in
 	CreatedAt          time.Time `json:"created_at"`
 	UpdatedAt          time.Time `json:"updated_at"`
 
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// UserSession - A signed-in device; access tokens carry its ID and are refused once it is revoked
+type UserSession struct {
+	ID                uint       `gorm:"primaryKey" json:"id"`
+	UserID            uint       `gorm:"index;not null" json:"user_id"`
+	RefreshTokenHash  string     `gorm:"uniqueIndex;not null" json:"-"` // SHA-256 of the current refresh token
+	PreviousTokenHash string     `gorm:"index" json:"-"`                // The refresh token it replaced, to spot reuse
+	IPAddress         string     `json:"ip_address"`
+	UserAgent         string     `json:"user_agent"`
+	MembershipID      uint       `json:"membership_id"` // The active Membership; 0 for the user's home school and role
+	LastUsedAt        time.Time  `json:"last_used_at"`
+	ExpiresAt         time.Time  `json:"expires_at"` // Pushed back on every refresh
+	RevokedAt         *time.Time `gorm:"index" json:"revoked_at,omitempty"`
+	RevokedReason     string     `json:"revoked_reason,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// Why a session was revoked
+const (
+	SessionRevokedLogout          = "LOGOUT"
+	SessionRevokedLogoutAll       = "LOGOUT_ALL"
+	SessionRevokedPasswordChanged = "PASSWORD_CHANGED"
+	SessionRevokedUserDeactivated = "USER_DEACTIVATED"
+	SessionRevokedTokenReuse      = "REFRESH_TOKEN_REUSED"
+)
+
+// StreamTicket - A single-use pass for opening the event stream
+// EventSource can't send headers; a ticket in the URL keeps the access token out of proxy and access logs
+type StreamTicket struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	TicketHash   string     `gorm:"uniqueIndex;not null" json:"-"` // SHA-256 of the ticket
+	UserID       uint       `gorm:"index;not null" json:"user_id"`
+	SessionID    uint       `gorm:"not null" json:"session_id"`
+	MembershipID uint       `json:"membership_id"`
+	Role         string     `json:"role"`
+	SchoolID     *uint      `json:"school_id"`
+	ExpiresAt    time.Time  `gorm:"index" json:"expires_at"`
+	UsedAt       *time.Time `json:"used_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
@@ -0,0 +1,210 @@
+package models
+
+import "time"
+
+// SMSLog - Every SMS sent, with the provider that carried it
+type SMSLog struct {
+	ID                uint       `gorm:"primaryKey" json:"id"`
+	SchoolID          uint       `gorm:"index" json:"school_id"`
+	To                string     `json:"to"`
+	Message           string     `json:"message"`
+	Provider          string     `json:"provider"`
+	ProviderMessageID string     `gorm:"index" json:"provider_message_id,omitempty"`
+	Status            string     `json:"status"`                                // Provider's immediate response
+	Cost              string     `json:"cost"`                                  // As the provider reported it, e.g. "KES 0.8000"
+	CostAmount        float64    `gorm:"type:decimal(10,4)" json:"cost_amount"` // Provider cost parsed from Cost
+	Segments          int        `json:"segments"`
+	Charged           float64    `gorm:"type:decimal(10,2)" json:"charged"` // Debited from the school's SMS wallet
+	Error             string     `json:"error"`
+	DeliveryStatus    string     `json:"delivery_status,omitempty"` // From delivery reports: DELIVERED, FAILED, PENDING
+	FailureReason     string     `json:"failure_reason,omitempty"`
+	DeliveredAt       *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// SMSSettings - Per-school SMS provider; schools without a row use the server default
+type SMSSettings struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	SchoolID     uint      `gorm:"not null;uniqueIndex" json:"school_id"`
+	Provider     string    `gorm:"not null" json:"provider"` // AFRICASTALKING, HTTP
+	SenderID     string    `json:"sender_id"`                // Shortcode or alphanumeric sender
+	Username     string    `json:"username"`                 // Africa's Talking username
+	APIKey       string    `json:"-"`
+	Environment  string    `json:"environment"` // sandbox, production
+	GatewayURL   string    `json:"gateway_url"` // HTTP gateway endpoint
+	GatewayToken string    `json:"-"`
+	UpdatedBy    uint      `json:"updated_by"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// SMS provider names
+const (
+	SMSProviderAfricasTalking = "AFRICASTALKING"
+	SMSProviderHTTP           = "HTTP"
+	SMSProviderFile           = "FILE"
+	SMSProviderMemory         = "MEMORY"
+)
+
+// MessageJob - A batch of outbound messages (broadcast, fee reminders) the UI can poll
+type MessageJob struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	SchoolID  uint      `gorm:"not null;index" json:"school_id"`
+	Kind      string    `gorm:"not null" json:"kind"` // BROADCAST, FEE_REMINDER, ALERT
+	Status    string    `gorm:"not null" json:"status"`
+	Total     int       `json:"total"`
+	Sent      int       `json:"sent"`
+	Failed    int       `json:"failed"`
+	CreatedBy uint      `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// OutboundMessage - One durable outbox entry; workers deliver and retry these
+type OutboundMessage struct {
+	ID                uint       `gorm:"primaryKey" json:"id"`
+	SchoolID          uint       `gorm:"not null;index" json:"school_id"`
+	JobID             *uint      `gorm:"index" json:"job_id,omitempty"`
+	To                string     `gorm:"not null" json:"to"`
+	Message           string     `gorm:"type:text;not null" json:"message"`
+	Status            string     `gorm:"not null;index" json:"status"`
+	Attempts          int        `json:"attempts"`
+	MaxAttempts       int        `json:"max_attempts"`
+	NextAttemptAt     time.Time  `gorm:"index" json:"next_attempt_at"`
+	LastError         string     `json:"last_error,omitempty"`
+	Provider          string     `json:"provider,omitempty"`
+	ProviderMessageID string     `json:"provider_message_id,omitempty"`
+	Charge            float64    `gorm:"type:decimal(10,2)" json:"charge"` // Reserved from the wallet at enqueue; refunded if it fails
+	Channel           string     `gorm:"default:SMS" json:"channel"`       // WHATSAPP falls back to SMS when it can't be delivered
+	Template          string     `json:"template,omitempty"`               // WhatsApp or email template name
+	TemplateLanguage  string     `json:"template_language,omitempty"`
+	TemplateParams    string     `gorm:"type:text" json:"template_params,omitempty"` // JSON array of parameter values
+	Subject           string     `json:"subject,omitempty"`                          // EMAIL: Message is the text part
+	HTML              string     `gorm:"type:text" json:"-"`                         // EMAIL
+	SentAt            *time.Time `json:"sent_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// Message job kinds
+const (
+	MessageJobBroadcast    = "BROADCAST"
+	MessageJobFeeReminder  = "FEE_REMINDER"
+	MessageJobAlert        = "ALERT" // Sent by event subscribers
+	MessageJobAnnouncement = "ANNOUNCEMENT"
+	MessageJobInvite       = "INVITE"
+	MessageJobSecurity     = "SECURITY" // Account notices such as a lockout
+)
+
+// Job and outbox states
+const (
+	JobQueued    = "QUEUED"
+	JobRunning   = "RUNNING"
+	JobCompleted = "COMPLETED"
+
+	OutboxQueued  = "QUEUED"
+	OutboxSending = "SENDING"
+	OutboxSent    = "SENT"
+	OutboxFailed  = "FAILED"
+)
+
+// Delivery report states
+const (
+	DeliveryDelivered = "DELIVERED"
+	DeliveryFailed    = "FAILED"
+	DeliveryPending   = "PENDING"
+)
+
+// SMSOptOut - Numbers that replied STOP; nothing more is sent to them from this school
+type SMSOptOut struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	SchoolID  uint      `gorm:"not null;uniqueIndex:idx_optout_school_phone" json:"school_id"`
+	Phone     string    `gorm:"not null;uniqueIndex:idx_optout_school_phone" json:"phone"`
+	Source    string    `json:"source"` // SMS_REPLY, ADMIN
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InboundMessage - SMS replies received on the school's shortcode
+type InboundMessage struct {
+	ID                uint      `gorm:"primaryKey" json:"id"`
+	SchoolID          uint      `gorm:"index" json:"school_id"` // 0 when the sender couldn't be matched to a school
+	From              string    `gorm:"index" json:"from"`
+	To                string    `json:"to"`
+	Text              string    `gorm:"type:text" json:"text"`
+	ProviderMessageID string    `json:"provider_message_id,omitempty"`
+	Channel           string    `gorm:"default:SMS" json:"channel"` // SMS, WHATSAPP
+	UserID            *uint     `json:"user_id,omitempty"`          // Parent or user whose phone matched
+	IsRead            bool      `gorm:"default:false" json:"is_read"`
+	ReceivedAt        time.Time `json:"received_at"`
+	CreatedAt         time.Time `json:"created_at"`
+
+	User *User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+// MessageTemplate - A school's wording for one kind of message, in English and Swahili
+// Bodies use merge fields like {{student_name}}; schools without a row get the built-in text
+type MessageTemplate struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	SchoolID  uint      `gorm:"not null;uniqueIndex:idx_template_school_name" json:"school_id"`
+	Name      string    `gorm:"not null;uniqueIndex:idx_template_school_name" json:"name"`
+	BodyEN    string    `gorm:"type:text;not null" json:"body_en"`
+	BodySW    string    `gorm:"type:text" json:"body_sw"` // Falls back to English when empty
+	UpdatedBy uint      `json:"updated_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Built-in template names
+const (
+	TemplateFeeReminder         = "FEE_REMINDER"
+	TemplatePaymentConfirmation = "PAYMENT_CONFIRMATION"
+	TemplateAttendanceAlert     = "ATTENDANCE_ALERT"
+	TemplateBroadcast           = "BROADCAST"
+	TemplateGradePublished      = "GRADE_PUBLISHED"
+	TemplateStudentDischarged   = "STUDENT_DISCHARGED"
+)
+
+// Languages
+const (
+	LanguageEnglish = "en"
+	LanguageSwahili = "sw"
+)
+
+// SMSWallet - A school's SMS credit, in KES
+// PREPAID schools can't send beyond their balance; POSTPAID schools run a
+// negative balance and are invoiced from the monthly statement
+type SMSWallet struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	SchoolID        uint      `gorm:"not null;uniqueIndex" json:"school_id"`
+	Balance         float64   `gorm:"type:decimal(12,2);not null;default:0" json:"balance"`
+	BillingMode     string    `gorm:"not null" json:"billing_mode"`                // PREPAID, POSTPAID
+	PricePerSegment float64   `gorm:"type:decimal(10,4)" json:"price_per_segment"` // 0 uses SMS_COST_PER_SEGMENT
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// SMSCreditTransaction - Every change to a wallet balance
+type SMSCreditTransaction struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	SchoolID     uint      `gorm:"not null;index" json:"school_id"`
+	Type         string    `gorm:"not null;index" json:"type"`                // TOPUP, CHARGE, REFUND, ADJUSTMENT
+	Amount       float64   `gorm:"type:decimal(12,2);not null" json:"amount"` // Positive adds credit, negative spends it
+	BalanceAfter float64   `gorm:"type:decimal(12,2);not null" json:"balance_after"`
+	Segments     int       `json:"segments,omitempty"`
+	JobID        *uint     `gorm:"index" json:"job_id,omitempty"`
+	Reference    string    `json:"reference,omitempty"` // Invoice or receipt number for top-ups
+	Description  string    `json:"description,omitempty"`
+	CreatedBy    uint      `json:"created_by,omitempty"`
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+}
+
+// SMS billing modes and credit transaction types
+const (
+	SMSBillingPrepaid  = "PREPAID"
+	SMSBillingPostpaid = "POSTPAID"
+
+	SMSCreditTopUp      = "TOPUP"
+	SMSCreditCharge     = "CHARGE"
+	SMSCreditRefund     = "REFUND"
+	SMSCreditAdjustment = "ADJUSTMENT"
+)
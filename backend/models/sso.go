@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// SSOProvider - A school's OpenID Connect identity provider, e.g. Google Workspace or Microsoft 365
+type SSOProvider struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	SchoolID       uint      `gorm:"index;not null" json:"school_id"`
+	Name           string    `gorm:"not null" json:"name"`   // Shown on the sign-in button, e.g. Google
+	Issuer         string    `gorm:"not null" json:"issuer"` // e.g. https://accounts.google.com
+	ClientID       string    `gorm:"not null" json:"client_id"`
+	ClientSecret   string    `json:"-"`
+	AllowedDomains string    `json:"allowed_domains"` // Comma-separated email domains that may sign in, e.g. school.ac.ke
+	AutoProvision  bool      `gorm:"default:false" json:"auto_provision"`
+	DefaultRole    string    `gorm:"default:TEACHER" json:"default_role"` // Role of accounts created on first sign-in
+	Enabled        bool      `json:"enabled"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// SSOLoginState - A sign-in sent to the identity provider and not yet back; used once
+type SSOLoginState struct {
+	ID           uint      `gorm:"primaryKey"`
+	ProviderID   uint      `gorm:"index;not null"`
+	StateHash    string    `gorm:"uniqueIndex;not null"` // SHA-256 of the state parameter
+	Nonce        string    `gorm:"not null"`             // Must come back in the ID token
+	CodeVerifier string    `gorm:"not null"`             // PKCE; only its S256 challenge goes to the provider
+	ExpiresAt    time.Time `gorm:"index"`
+	CreatedAt    time.Time
+}
+
+// SSOIdentityLink - The provider identity an account was bound to on its first single sign-on
+// Later sign-ins match the issuer and subject, so a changed or reused email can't take the account over
+type SSOIdentityLink struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index;not null" json:"user_id"`
+	Issuer    string    `gorm:"not null;uniqueIndex:idx_sso_issuer_subject" json:"issuer"`
+	Subject   string    `gorm:"not null;uniqueIndex:idx_sso_issuer_subject" json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -10,15 +10,28 @@ import (
 
 // User model
 type User struct {
-	ID           uint       `gorm:"primaryKey"`
-	Email        string     `gorm:"uniqueIndex;not null" json:"email"`
-	FullName     string     `json:"full_name"`
-	PasswordHash string     `gorm:"not null" json:"-"`
-	Role         string     `gorm:"not null" json:"role"`             // SUPERADMIN, SCHOOLADMIN, TEACHER, STUDENT
-	SchoolID     *uint      `gorm:"index" json:"school_id,omitempty"` // Nullable for Superadmin
-	LastLoginAt  *time.Time `json:"last_login_at,omitempty"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
+	ID                 uint       `gorm:"primaryKey"`
+	Email              string     `gorm:"uniqueIndex;not null" json:"email"`
+	FullName           string     `json:"full_name"`
+	PasswordHash       string     `gorm:"not null" json:"-"`
+	Role               string     `gorm:"not null" json:"role"`                  // SUPERADMIN, SCHOOLADMIN, TEACHER, STUDENT
+	CustomRoleID       *uint      `gorm:"index" json:"custom_role_id,omitempty"` // Permissions come from this role instead of Role's defaults
+	SchoolID           *uint      `gorm:"index" json:"school_id,omitempty"`      // Nullable for Superadmin
+	Phone              string     `gorm:"index" json:"phone,omitempty"`          // E.164, e.g. +254712345678
+	PhoneVerified      bool       `gorm:"default:false" json:"phone_verified"`
+	Language           string     `gorm:"default:en" json:"language"`         // en, sw - for SMS and notifications
+	MessageChannel     string     `gorm:"default:SMS" json:"message_channel"` // SMS, WHATSAPP - how parents prefer to be messaged
+	LastLoginAt        *time.Time `json:"last_login_at,omitempty"`
+	DeactivatedAt      *time.Time `json:"deactivated_at,omitempty"`                  // Set when the user may no longer sign in
+	MustChangePassword bool       `gorm:"default:false" json:"must_change_password"` // Created with a shared default password
+	TOTPSecret         string     `json:"-"`                                         // Base32; pending until TOTPEnabledAt is set
+	TOTPEnabledAt      *time.Time `json:"totp_enabled_at,omitempty"`                 // Two-factor sign-in is on
+	TOTPLastStep       int64      `json:"-"`                                         // Last accepted time step, so a code works once
+	FailedLogins       int        `gorm:"default:0" json:"-"`                        // Wrong passwords or codes in a row
+	LastFailedLoginAt  *time.Time `json:"-"`
+	LockedUntil        *time.Time `json:"locked_until,omitempty"` // Too many failed logins; sign-in refused until then
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
 }
 
 // Force table name and DISABLE soft deletes completely
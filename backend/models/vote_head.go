@@ -38,7 +38,8 @@ type VoteHeadBalance struct {
 	StudentID   uint      `gorm:"not null;index" json:"student_id"`
 	VoteHeadID  uint      `gorm:"not null;index" json:"vote_head_id"`
 	SchoolID    uint      `gorm:"not null;index" json:"school_id"`
-	Balance     float64   `json:"balance"` // Outstanding balance (positive = owes)
+	Balance     float64   `json:"balance"`    // Outstanding balance (positive = owes)
+	ChargedAt   time.Time `json:"charged_at"` // When the fee was charged (its fee structure or import); payments don't move it
 	LastUpdated time.Time `json:"last_updated"`
 
 	// Relations
@@ -82,6 +83,34 @@ type MPESATransaction struct {
 	Status            string    `json:"status"`     // PENDING, MATCHED, FAILED
 	PaymentID         *uint     `json:"payment_id"` // Linked payment after matching
 	MatchedStudentID  *uint     `json:"matched_student_id"`
+	FamilyAccountID   *uint     `gorm:"index" json:"family_account_id,omitempty"` // Set when paid to a family account
 	ErrorMessage      string    `json:"error_message,omitempty"`
 	CreatedAt         time.Time `json:"created_at"`
 }
+
+// MPESAQuery - Daraja Transaction Status, Account Balance and C2B URL
+// registration requests, stored next to MPESATransaction with their results
+type MPESAQuery struct {
+	ID                       uint      `gorm:"primaryKey" json:"id"`
+	SchoolID                 uint      `gorm:"index" json:"school_id"`
+	QueryType                string    `gorm:"not null" json:"query_type"` // TRANSACTION_STATUS, ACCOUNT_BALANCE, REGISTER_URLS
+	TransID                  string    `gorm:"index" json:"trans_id,omitempty"`
+	MPESATransactionID       *uint     `gorm:"index" json:"mpesa_transaction_id,omitempty"` // Set when TransID is already known locally
+	ConversationID           string    `gorm:"index" json:"conversation_id,omitempty"`
+	OriginatorConversationID string    `gorm:"index" json:"originator_conversation_id,omitempty"`
+	Status                   string    `json:"status"` // PENDING, COMPLETED, FAILED, TIMED_OUT
+	ResultCode               *int      `json:"result_code,omitempty"`
+	ResultDesc               string    `json:"result_desc,omitempty"`
+	Response                 string    `gorm:"type:text" json:"response"` // Synchronous Daraja response body
+	Result                   string    `gorm:"type:text" json:"result"`   // Result parameters (JSON)
+	RequestedBy              uint      `json:"requested_by"`              // 0 when run from the CLI
+	CreatedAt                time.Time `json:"created_at"`
+	UpdatedAt                time.Time `json:"updated_at"`
+}
+
+// M-PESA query types
+const (
+	MPESAQueryTransactionStatus = "TRANSACTION_STATUS"
+	MPESAQueryAccountBalance    = "ACCOUNT_BALANCE"
+	MPESAQueryRegisterURLs      = "REGISTER_URLS"
+)
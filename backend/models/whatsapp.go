@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// WhatsAppSettings - Per-school WhatsApp Business Cloud API number; schools without a row use the server default
+type WhatsAppSettings struct {
+	ID                uint      `gorm:"primaryKey" json:"id"`
+	SchoolID          uint      `gorm:"not null;uniqueIndex" json:"school_id"`
+	PhoneNumberID     string    `gorm:"not null;index" json:"phone_number_id"` // Cloud API sender ID, also used to route webhooks
+	BusinessAccountID string    `json:"business_account_id"`
+	AccessToken       string    `json:"-"`
+	UpdatedBy         uint      `json:"updated_by"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// WhatsAppTemplate - Which pre-approved WhatsApp template carries one of our message templates
+// Params lists the merge fields filling {{1}}, {{2}}... in order
+type WhatsAppTemplate struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	SchoolID     uint      `gorm:"not null;uniqueIndex:idx_wa_template_school_name" json:"school_id"`
+	Name         string    `gorm:"not null;uniqueIndex:idx_wa_template_school_name" json:"name"` // FEE_REMINDER, PAYMENT_CONFIRMATION
+	TemplateName string    `gorm:"not null" json:"template_name"`                                // As approved in WhatsApp Manager
+	Params       string    `json:"params"`                                                       // Comma separated merge fields
+	UpdatedBy    uint      `json:"updated_by"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Message channels
+const (
+	ChannelSMS      = "SMS"
+	ChannelWhatsApp = "WHATSAPP"
+	ChannelEmail    = "EMAIL" // Outbox only: a rendered email, e.g. a lockout notice
+)
+
+// SMSProviderWhatsApp - Provider name recorded in message logs for WhatsApp sends
+const SMSProviderWhatsApp = "WHATSAPP"
@@ -0,0 +1,102 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"schoolms-go/middleware"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterAlertRoutes(router *gin.RouterGroup) {
+	alerts := router.Group("/alerts")
+	alerts.Use(middleware.AuthMiddleware(), middleware.RequirePermission("alerts.manage"))
+	{
+		alerts.GET("/rules", listAlertRules)
+		alerts.PUT("/rules/:event", updateAlertRule)
+		alerts.GET("/events", listEvents)
+	}
+}
+
+// listAlertRules - The school's rule for every event type, defaults included
+func listAlertRules(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	rules := make([]gin.H, 0)
+	for _, eventType := range services.AlertEventTypes() {
+		rule, _ := services.GetAlertRule(schoolID, eventType)
+		rules = append(rules, gin.H{"rule": rule, "customised": rule.ID != 0})
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+type AlertRuleInput struct {
+	Enabled             bool `json:"enabled"`
+	SendSMS             bool `json:"send_sms"`
+	SendNotification    bool `json:"send_notification"`
+	ConsecutiveAbsences int  `json:"consecutive_absences" binding:"min=0,max=30"`
+}
+
+// updateAlertRule - Choose whether and how guardians are alerted for an event
+func updateAlertRule(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+	eventType := strings.ToUpper(c.Param("event"))
+
+	rule, known := services.GetAlertRule(schoolID, eventType)
+	if !known {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown event type"})
+		return
+	}
+
+	var input AlertRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	old := fmt.Sprintf("enabled=%t sms=%t notification=%t absences=%d",
+		rule.Enabled, rule.SendSMS, rule.SendNotification, rule.ConsecutiveAbsences)
+
+	rule.Enabled = input.Enabled
+	rule.SendSMS = input.SendSMS
+	rule.SendNotification = input.SendNotification
+	rule.ConsecutiveAbsences = input.ConsecutiveAbsences
+	if eventType == models.EventAttendanceAbsent && rule.ConsecutiveAbsences < 1 {
+		rule.ConsecutiveAbsences = 1
+	}
+	rule.UpdatedBy = userID
+
+	if err := models.DB.Save(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save alert rule"})
+		return
+	}
+
+	models.CreateAuditLog(schoolID, userID, models.AuditAlertRuleChange, "AlertRule", rule.ID, old,
+		fmt.Sprintf("enabled=%t sms=%t notification=%t absences=%d",
+			rule.Enabled, rule.SendSMS, rule.SendNotification, rule.ConsecutiveAbsences),
+		c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// listEvents - Recent events and whether their alerts went out (?status=FAILED)
+func listEvents(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	query := models.DB.Where("school_id = ?", schoolID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if eventType := c.Query("type"); eventType != "" {
+		query = query.Where("type = ?", eventType)
+	}
+
+	var events []models.Event
+	query.Order("id DESC").Limit(100).Find(&events)
+
+	c.JSON(http.StatusOK, events)
+}
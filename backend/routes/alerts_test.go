@@ -0,0 +1,115 @@
+package routes_test
+
+import (
+	"fmt"
+	"net/http"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type alertFixture struct {
+	*smsFixture
+	student models.Student
+}
+
+func setupAlertTest(t *testing.T) *alertFixture {
+	f := setupSMSTest(t)
+	f.db.AutoMigrate(&models.Class{}, &models.Attendance{}, &models.Grade{}, &models.Payment{},
+		&models.VoteHeadBalance{}, &models.Notification{}, &models.Event{}, &models.AlertRule{})
+	services.RegisterAlertSubscribers()
+
+	api := f.router.Group("/api/v1")
+	routes.RegisterAlertRoutes(api)
+	routes.RegisterAttendanceRoutes(api)
+	routes.RegisterFinanceRoutes(api)
+	routes.RegisterStudentRoutes(api)
+	routes.RegisterGradeRoutes(api)
+
+	parent := models.User{Email: "mzazi@test.com", Role: "PARENT", SchoolID: &f.school.ID, Language: models.LanguageSwahili}
+	studentUser := models.User{Email: "amani@test.com", FullName: "Amani Otieno", Role: "STUDENT", SchoolID: &f.school.ID}
+	f.db.Create(&parent)
+	f.db.Create(&studentUser)
+	student := models.Student{UserID: studentUser.ID, SchoolID: f.school.ID, EnrollmentNumber: "ADM001", Status: "ENROLLED"}
+	f.db.Create(&student)
+	f.db.Create(&models.ParentStudent{ParentID: parent.ID, StudentID: student.ID, Phone: "+254712345678", PhoneVerified: true})
+
+	return &alertFixture{smsFixture: f, student: student}
+}
+
+func (f *alertFixture) markAbsent(date string) {
+	w := f.do("POST", "/api/v1/attendance/mark", f.admin, map[string]interface{}{
+		"student_id": f.student.ID, "class_id": 1, "date": date, "status": "ABSENT",
+	})
+	if w.Code >= 300 {
+		panic(w.Body.String())
+	}
+}
+
+func TestAlerts_AbsenceAlertAfterSecondConsecutiveDay(t *testing.T) {
+	f := setupAlertTest(t)
+
+	w := f.do("PUT", "/api/v1/alerts/rules/attendance_absent", f.admin, map[string]interface{}{
+		"enabled": true, "send_sms": true, "consecutive_absences": 2,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	f.markAbsent("2026-10-12")
+	services.ProcessEvents(10)
+	services.ProcessOutbox(10)
+	assert.Empty(t, f.provider.Sent())
+
+	f.markAbsent("2026-10-13")
+	f.markAbsent("2026-10-13") // Re-marking the same day doesn't raise another event
+	services.ProcessEvents(10)
+	services.ProcessOutbox(10)
+
+	sent := f.provider.Sent()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, "+254712345678", sent[0].To)
+	assert.Contains(t, sent[0].Message, "hakuwepo shuleni tarehe 13 Oct 2026") // Guardian prefers Swahili
+
+	var events int64
+	f.db.Model(&models.Event{}).Count(&events)
+	assert.Equal(t, int64(2), events)
+}
+
+func TestAlerts_PaymentConfirmationAndDisabledRules(t *testing.T) {
+	f := setupAlertTest(t)
+
+	w := f.do("POST", "/api/v1/finance/payments", f.admin, map[string]interface{}{
+		"student_id": f.student.ID, "amount": 5000, "method": "CASH", "reference": "RCT-9",
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Empty(t, f.provider.Sent()) // Queued, not sent inside the request
+
+	services.ProcessEvents(10)
+	services.ProcessOutbox(10)
+	sent := f.provider.Sent()
+	assert.Len(t, sent, 1)
+	assert.Contains(t, sent[0].Message, "Malipo ya KES 5,000.00 yamepokelewa kwa Amani Otieno")
+
+	// Grades raise an in-app notification by default, no SMS
+	w = f.do("POST", "/api/v1/grades", f.admin, map[string]interface{}{
+		"student_id": f.student.ID, "class_id": 1, "subject": "Maths", "score": 45, "max_score": 50, "term": "Term 3",
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	services.ProcessEvents(10)
+	var notification models.Notification
+	assert.NoError(t, f.db.Where("target_type = ? AND target_id = ?", "STUDENT", f.student.ID).First(&notification).Error)
+	assert.Contains(t, notification.Message, "scored 45/50 in Maths")
+
+	// A disabled rule keeps discharges quiet
+	f.do("PUT", "/api/v1/alerts/rules/STUDENT_DISCHARGED", f.admin, map[string]interface{}{"enabled": false})
+	w = f.do("POST", fmt.Sprintf("/api/v1/students/%d/discharge", f.student.ID), f.admin, map[string]string{"reason": "Transfer"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	services.ProcessEvents(10)
+	services.ProcessOutbox(10)
+	assert.Len(t, f.provider.Sent(), 1)
+
+	w = f.do("GET", "/api/v1/alerts/events?type=STUDENT_DISCHARGED", f.admin, nil)
+	assert.Contains(t, w.Body.String(), models.EventProcessed)
+}
@@ -11,7 +11,7 @@ import (
 
 func RegisterAnalyticsRoutes(router *gin.RouterGroup) {
 	analytics := router.Group("/analytics")
-	analytics.Use(middleware.AuthMiddleware(), middleware.RoleGuard("SCHOOLADMIN", "FINANCE"))
+	analytics.Use(middleware.AuthMiddleware(), middleware.RequirePermission("analytics.view"))
 	{
 		analytics.GET("/dashboard", getDashboardAnalytics)
 		analytics.GET("/enrollment", getEnrollmentTrends)
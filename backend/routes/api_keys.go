@@ -0,0 +1,211 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"schoolms-go/middleware"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiKeyDefaultDays = 365
+	apiKeyMaxDays     = 730
+)
+
+// ServiceAccountInput - An integration that will act through API keys, e.g. Biometric gate
+type ServiceAccountInput struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// APIKeyInput - A key for a service account and what it may do
+type APIKeyInput struct {
+	ServiceAccountID uint     `json:"service_account_id" binding:"required"`
+	Name             string   `json:"name" binding:"required"`
+	Scopes           []string `json:"scopes" binding:"required"`
+	ExpiresInDays    int      `json:"expires_in_days"` // Defaults to a year; at most two
+}
+
+func RegisterAPIKeyRoutes(router *gin.RouterGroup) {
+	accounts := router.Group("/service-accounts")
+	accounts.Use(middleware.AuthMiddleware(), middleware.RequirePermission("api_keys.manage"))
+	{
+		accounts.GET("", listServiceAccounts)
+		accounts.POST("", createServiceAccount)
+		accounts.DELETE("/:id", deleteServiceAccount)
+	}
+
+	keys := router.Group("/api-keys")
+	keys.Use(middleware.AuthMiddleware(), middleware.RequirePermission("api_keys.manage"))
+	{
+		keys.GET("", listAPIKeys)
+		keys.POST("", createAPIKey)
+		keys.DELETE("/:id", revokeAPIKey)
+	}
+}
+
+func apiKeyJSON(key models.APIKey) gin.H {
+	status := "active"
+	switch {
+	case key.RevokedAt != nil:
+		status = "revoked"
+	case !key.ExpiresAt.After(time.Now()):
+		status = "expired"
+	}
+	return gin.H{
+		"id":                 key.ID,
+		"service_account_id": key.ServiceAccountID,
+		"name":               key.Name,
+		"prefix":             key.Prefix,
+		"scopes":             append([]string{}, services.ParsePermissions(key.Scopes)...),
+		"status":             status,
+		"expires_at":         key.ExpiresAt,
+		"last_used_at":       key.LastUsedAt,
+		"last_used_ip":       key.LastUsedIP,
+		"revoked_at":         key.RevokedAt,
+		"created_at":         key.CreatedAt,
+	}
+}
+
+// serviceAccount - The school's service account in the path or body
+func serviceAccount(c *gin.Context, id interface{}) (models.User, bool) {
+	var account models.User
+	err := models.DB.Where("id = ? AND school_id = ? AND role = ?", id, c.MustGet("schoolID").(uint), services.RoleService).
+		First(&account).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service account not found"})
+		return account, false
+	}
+	return account, true
+}
+
+// listServiceAccounts - The school's integrations and how many live keys each has
+func listServiceAccounts(c *gin.Context) {
+	var accounts []models.User
+	models.DB.Where("school_id = ? AND role = ?", c.MustGet("schoolID").(uint), services.RoleService).Order("id").Find(&accounts)
+	out := make([]gin.H, len(accounts))
+	for i, a := range accounts {
+		var live int64
+		models.DB.Model(&models.APIKey{}).
+			Where("service_account_id = ? AND revoked_at IS NULL AND expires_at > ?", a.ID, time.Now()).Count(&live)
+		out[i] = gin.H{"id": a.ID, "name": a.FullName, "deactivated_at": a.DeactivatedAt, "active_keys": live, "created_at": a.CreatedAt}
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// createServiceAccount - An identity for an integration, so its actions aren't logged against a person
+func createServiceAccount(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	var input ServiceAccountInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	account, err := services.CreateServiceAccount(schoolID, strings.TrimSpace(input.Name))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service account"})
+		return
+	}
+	models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditServiceAccountChange, "User", account.ID,
+		"", account.FullName, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusCreated, gin.H{"id": account.ID, "name": account.FullName, "active_keys": 0, "created_at": account.CreatedAt})
+}
+
+// deleteServiceAccount - Retire an integration: deactivate its account and revoke all its keys
+func deleteServiceAccount(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	account, ok := serviceAccount(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	now := time.Now()
+	revoked := models.DB.Model(&models.APIKey{}).Where("service_account_id = ? AND revoked_at IS NULL", account.ID).
+		Update("revoked_at", now).RowsAffected
+	models.DB.Model(&account).Update("deactivated_at", now)
+	models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditServiceAccountChange, "User", account.ID,
+		account.FullName, "", c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Service account deactivated", "keys_revoked": revoked})
+}
+
+// listAPIKeys - The school's keys, optionally for one service account; never the keys themselves
+func listAPIKeys(c *gin.Context) {
+	query := models.DB.Where("school_id = ?", c.MustGet("schoolID").(uint))
+	if id := c.Query("service_account_id"); id != "" {
+		query = query.Where("service_account_id = ?", id)
+	}
+	var keys []models.APIKey
+	query.Order("id DESC").Find(&keys)
+	out := make([]gin.H, len(keys))
+	for i, k := range keys {
+		out[i] = apiKeyJSON(k)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// createAPIKey - Issue a key; it is in this response only, so the integration must store it now
+func createAPIKey(c *gin.Context) {
+	actorID := c.MustGet("userID").(uint)
+	var input APIKeyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	account, ok := serviceAccount(c, input.ServiceAccountID)
+	if !ok {
+		return
+	}
+	if account.DeactivatedAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Service account has been deactivated"})
+		return
+	}
+	if input.ExpiresInDays == 0 {
+		input.ExpiresInDays = apiKeyDefaultDays
+	}
+	if input.ExpiresInDays < 1 || input.ExpiresInDays > apiKeyMaxDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in_days must be between 1 and %d", apiKeyMaxDays)})
+		return
+	}
+	scopes, err := services.ValidateAPIKeyScopes(input.Scopes)
+	if err != nil || len(scopes) == 0 {
+		if err == nil {
+			err = errors.New("at least one scope is required")
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if missing := permissionsNotHeld(c, scopes); len(missing) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't grant permissions you don't have", "permissions": missing})
+		return
+	}
+
+	expiresAt := time.Now().AddDate(0, 0, input.ExpiresInDays)
+	key, record, err := services.CreateAPIKey(account, strings.TrimSpace(input.Name), scopes, expiresAt, actorID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	models.CreateAuditLog(record.SchoolID, actorID, models.AuditAPIKeyCreated, "APIKey", record.ID,
+		"", fmt.Sprintf(`{"service_account":%q,"prefix":%q,"scopes":%q}`, account.FullName, record.Prefix, record.Scopes),
+		c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusCreated, gin.H{"key": key, "api_key": apiKeyJSON(record)})
+}
+
+// revokeAPIKey - Stop a key working straight away, e.g. when it leaks or the integration is replaced
+func revokeAPIKey(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	var key models.APIKey
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if services.RevokeAPIKey(key.ID) {
+		models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditAPIKeyRevoked, "APIKey", key.ID,
+			key.Prefix, "", c.ClientIP(), c.Request.UserAgent())
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
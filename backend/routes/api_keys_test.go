@@ -0,0 +1,131 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupAPIKeyTest(t *testing.T) (*sessionFixture, string) {
+	f := setupSessionTest(t)
+	f.db.AutoMigrate(&models.APIKey{}, &models.Class{}, &models.FeeStructure{})
+	api := f.router.Group("/api/v1")
+	routes.RegisterAPIKeyRoutes(api)
+	routes.RegisterFinanceRoutes(api)
+	return f, f.login(t, f.admin.Email, "password123").AccessToken
+}
+
+func (f *sessionFixture) createServiceAccount(t *testing.T, token, name string) uint {
+	w := f.do("POST", "/api/v1/service-accounts", token, map[string]string{"name": name})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var account struct {
+		ID uint `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &account)
+	return account.ID
+}
+
+func (f *sessionFixture) createAPIKey(t *testing.T, token string, accountID uint, scopes ...string) (string, uint) {
+	w := f.do("POST", "/api/v1/api-keys", token, map[string]interface{}{
+		"service_account_id": accountID, "name": "Main gate", "scopes": scopes, "expires_in_days": 30,
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var out struct {
+		Key    string `json:"key"`
+		APIKey struct {
+			ID uint `json:"id"`
+		} `json:"api_key"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return out.Key, out.APIKey.ID
+}
+
+// withAPIKey - A request authenticated by the X-API-Key header
+func (f *sessionFixture) withAPIKey(method, path, key string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("X-API-Key", key)
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIKeys_ActAsServiceAccountWithinScopes(t *testing.T) {
+	f, admin := setupAPIKeyTest(t)
+	account := f.createServiceAccount(t, admin, "Accounting package")
+	key, keyID := f.createAPIKey(t, admin, account, "finance.fees.view", "students.view")
+	require.Regexp(t, `^smk_`, key)
+
+	// Only the hash is stored
+	var stored models.APIKey
+	f.db.First(&stored, keyID)
+	assert.NotEqual(t, key, stored.KeyHash)
+	assert.Equal(t, key[:10], stored.Prefix)
+	assert.Nil(t, stored.LastUsedAt)
+
+	// Accepted as a bearer token or X-API-Key, limited to its scopes
+	assert.Equal(t, http.StatusOK, f.withAPIKey("GET", "/api/v1/finance/fees", key).Code)
+	assert.Equal(t, []string{"students.view", "finance.fees.view"}, f.permissions(t, key))
+	w := f.do("POST", "/api/v1/finance/fees", key, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "finance.fees.create")
+	assert.Equal(t, http.StatusForbidden, f.do("GET", "/api/v1/api-keys", key, nil).Code)
+
+	f.db.First(&stored, keyID)
+	require.NotNil(t, stored.LastUsedAt)
+	w = f.do("GET", "/api/v1/api-keys", admin, nil)
+	assert.Contains(t, w.Body.String(), `"status":"active"`)
+	assert.NotContains(t, w.Body.String(), key)
+
+	// Revoked and expired keys stop working straight away
+	w = f.do("DELETE", fmt.Sprintf("/api/v1/api-keys/%d", keyID), admin, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, f.withAPIKey("GET", "/api/v1/finance/fees", key).Code)
+
+	expiring, expiringID := f.createAPIKey(t, admin, account, "finance.fees.view")
+	f.db.Model(&models.APIKey{}).Where("id = ?", expiringID).Update("expires_at", time.Now().Add(-time.Minute))
+	assert.Equal(t, http.StatusUnauthorized, f.withAPIKey("GET", "/api/v1/finance/fees", expiring).Code)
+
+	// Deleting the service account revokes the rest
+	live, _ := f.createAPIKey(t, admin, account, "finance.fees.view")
+	w = f.do("DELETE", fmt.Sprintf("/api/v1/service-accounts/%d", account), admin, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"keys_revoked":2`)
+	assert.Equal(t, http.StatusUnauthorized, f.withAPIKey("GET", "/api/v1/finance/fees", live).Code)
+
+	assert.Equal(t, int64(3), f.auditCount(models.AuditAPIKeyCreated))
+	assert.Equal(t, int64(1), f.auditCount(models.AuditAPIKeyRevoked))
+}
+
+func TestAPIKeys_OnlyAdminsIssueLimitedKeys(t *testing.T) {
+	f, admin := setupAPIKeyTest(t)
+	account := f.createServiceAccount(t, admin, "Biometric gate")
+
+	for name, body := range map[string]map[string]interface{}{
+		"keys can't mint keys": {"scopes": []string{"api_keys.manage"}},
+		"unknown scope":        {"scopes": []string{"gate.open"}},
+		"platform scope":       {"scopes": []string{"platform.schools.manage"}},
+		"no scopes":            {"scopes": []string{}},
+		"too long":             {"scopes": []string{"attendance.mark"}, "expires_in_days": 1000},
+	} {
+		body["service_account_id"], body["name"] = account, "Gate"
+		assert.Equal(t, http.StatusBadRequest, f.do("POST", "/api/v1/api-keys", admin, body).Code, name)
+	}
+
+	teacher := f.login(t, f.user.Email, "password123").AccessToken
+	w := f.do("POST", "/api/v1/service-accounts", teacher, map[string]string{"name": "Sneaky"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Service accounts can't sign in with a password, and aren't given roles
+	var svc models.User
+	f.db.First(&svc, account)
+	assert.Equal(t, "SERVICE", svc.Role)
+	assert.Equal(t, http.StatusUnauthorized, f.loginFrom("10.0.0.1", svc.Email, "!service").Code)
+}
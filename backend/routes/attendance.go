@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,14 +15,14 @@ func RegisterAttendanceRoutes(router *gin.RouterGroup) {
 	attendance.Use(middleware.AuthMiddleware())
 	{
 		// Teacher/Admin mark and view attendance
-		attendance.POST("/mark", middleware.RoleGuard("TEACHER", "SCHOOLADMIN"), markAttendance)
-		attendance.POST("/bulk", middleware.RoleGuard("TEACHER", "SCHOOLADMIN"), bulkMarkAttendance)
-		attendance.GET("/class/:classId", middleware.RoleGuard("TEACHER", "SCHOOLADMIN", "FINANCE"), getClassAttendance)
-		attendance.GET("/student/:studentId", middleware.RoleGuard("TEACHER", "SCHOOLADMIN", "PARENT"), getStudentAttendance)
-		attendance.GET("/stats", middleware.RoleGuard("TEACHER", "SCHOOLADMIN"), getAttendanceStats)
+		attendance.POST("/mark", middleware.RequirePermission("attendance.mark"), markAttendance)
+		attendance.POST("/bulk", middleware.RequirePermission("attendance.mark"), bulkMarkAttendance)
+		attendance.GET("/class/:classId", middleware.RequirePermission("attendance.class.view"), getClassAttendance)
+		attendance.GET("/student/:studentId", middleware.RequirePermission("attendance.student.view"), getStudentAttendance)
+		attendance.GET("/stats", middleware.RequirePermission("attendance.stats.view"), getAttendanceStats)
 
 		// Student views own attendance
-		attendance.GET("/my", middleware.RoleGuard("STUDENT"), getMyAttendance)
+		attendance.GET("/my", middleware.RequirePermission("attendance.view_own"), getMyAttendance)
 	}
 }
 
@@ -64,10 +65,15 @@ func markAttendance(c *gin.Context) {
 	if err := models.DB.Where("student_id = ? AND date = ? AND school_id = ?",
 		input.StudentID, date, schoolID).First(&existing).Error; err == nil {
 		// Update existing
+		wasAbsent := existing.Status == "ABSENT"
 		existing.Status = input.Status
 		existing.Notes = input.Notes
 		existing.MarkedBy = userID
 		models.DB.Save(&existing)
+		if !wasAbsent {
+			publishAbsence(existing)
+		}
+		services.StreamAttendanceSubmitted(schoolID, existing.ClassID, userID, date, map[string]int{existing.Status: 1})
 		c.JSON(http.StatusOK, existing)
 		return
 	}
@@ -86,6 +92,8 @@ func markAttendance(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark attendance"})
 		return
 	}
+	publishAbsence(attendance)
+	services.StreamAttendanceSubmitted(schoolID, attendance.ClassID, userID, date, map[string]int{attendance.Status: 1})
 
 	c.JSON(http.StatusCreated, attendance)
 }
@@ -107,17 +115,23 @@ func bulkMarkAttendance(c *gin.Context) {
 	}
 
 	var created, updated int
+	counts := map[string]int{}
 	for _, r := range input.Records {
+		counts[r.Status]++
 		var existing models.Attendance
 		if err := models.DB.Where("student_id = ? AND date = ? AND school_id = ?",
 			r.StudentID, date, schoolID).First(&existing).Error; err == nil {
+			wasAbsent := existing.Status == "ABSENT"
 			existing.Status = r.Status
 			existing.Notes = r.Notes
 			existing.MarkedBy = userID
 			models.DB.Save(&existing)
+			if !wasAbsent {
+				publishAbsence(existing)
+			}
 			updated++
 		} else {
-			models.DB.Create(&models.Attendance{
+			attendance := models.Attendance{
 				StudentID: r.StudentID,
 				ClassID:   input.ClassID,
 				SchoolID:  schoolID,
@@ -125,10 +139,13 @@ func bulkMarkAttendance(c *gin.Context) {
 				Status:    r.Status,
 				Notes:     r.Notes,
 				MarkedBy:  userID,
-			})
+			}
+			models.DB.Create(&attendance)
+			publishAbsence(attendance)
 			created++
 		}
 	}
+	services.StreamAttendanceSubmitted(schoolID, input.ClassID, userID, date, counts)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Attendance marked",
@@ -137,6 +154,16 @@ func bulkMarkAttendance(c *gin.Context) {
 	})
 }
 
+// publishAbsence - Queue an alert when a student is newly marked absent
+func publishAbsence(record models.Attendance) {
+	if record.Status != "ABSENT" {
+		return
+	}
+	services.PublishEvent(record.SchoolID, record.MarkedBy, models.EventAttendanceAbsent, record.StudentID, map[string]string{
+		"date": record.Date.Format("2006-01-02"),
+	})
+}
+
 func getClassAttendance(c *gin.Context) {
 	schoolID := c.MustGet("schoolID").(uint)
 	classID := c.Param("classId")
@@ -15,7 +15,7 @@ import (
 func RegisterAuditRoutes(router *gin.RouterGroup) {
 	audit := router.Group("/audit-logs")
 	audit.Use(middleware.AuthMiddleware())
-	audit.Use(middleware.RoleGuard("SCHOOLADMIN", "SUPERADMIN"))
+	audit.Use(middleware.RequirePermission("audit.view"))
 	{
 		audit.GET("", listAuditLogs)
 		audit.GET("/export", exportAuditLogs)
@@ -1,10 +1,15 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 	"schoolms-go/utils"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,14 +27,66 @@ type SignupInput struct {
 	Email      string `json:"email" binding:"required,email"`
 	Password   string `json:"password" binding:"required,min=6"`
 	InviteCode string `json:"invite_code" binding:"required"`
+	Phone      string `json:"phone"` // Optional; unverified until the school confirms it
 	// Role and SchoolID are determined by the invite
 }
 
+// RefreshInput - Refresh token to swap for a new pair
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// ForgotPasswordInput - Who forgot their password; one of email or phone
+type ForgotPasswordInput struct {
+	Email   string `json:"email"`
+	Phone   string `json:"phone"`
+	Channel string `json:"channel"` // EMAIL or SMS; falls back to the other if unavailable
+}
+
+// ResetPasswordInput - A code (with the email or phone it was requested for) or the emailed link's token
+type ResetPasswordInput struct {
+	Email       string `json:"email"`
+	Phone       string `json:"phone"`
+	Code        string `json:"code"`
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+// ChangePasswordInput - Change the signed-in user's password
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
 func RegisterAuthRoutes(router *gin.RouterGroup) {
 	auth := router.Group("/auth")
 	{
 		auth.POST("/signup", signup)
 		auth.POST("/login", login)
+		auth.POST("/refresh", refreshToken)
+		auth.POST("/forgot-password", forgotPassword)
+		auth.POST("/reset-password", resetPassword)
+		auth.POST("/logout", logoutWithRefreshToken, middleware.AllowPendingPasswordChange(), middleware.AuthMiddleware(), logout)
+
+		session := auth.Group("")
+		session.Use(middleware.AllowPendingPasswordChange(), middleware.AuthMiddleware())
+		session.POST("/logout-all", logoutAll)
+		session.GET("/sessions", listSessions)
+		session.DELETE("/sessions/:id", revokeSession)
+		session.POST("/change-password", changePassword)
+		session.GET("/permissions", myPermissions)
+		session.GET("/memberships", myMemberships)
+		session.POST("/switch", switchMembership)
+		session.GET("/2fa", twoFactorStatus)
+		session.POST("/2fa/disable", disableTwoFactor)
+		session.POST("/2fa/recovery-codes", regenerateRecoveryCodes)
+
+		// Also reachable with the pre-auth token from a two-step login
+		twoFactor := auth.Group("/2fa")
+		twoFactor.Use(middleware.AllowPreAuth(), middleware.AllowPendingPasswordChange(), middleware.AuthMiddleware())
+		twoFactor.POST("/setup", setupTwoFactor)
+		twoFactor.POST("/enable", enableTwoFactor)
+		twoFactor.POST("/verify", verifyTwoFactor)
 	}
 }
 
@@ -41,24 +98,41 @@ func signup(c *gin.Context) {
 	}
 
 	// 1. Validate Invite Code
-	var invite models.Invite
-	if err := models.DB.Where("code = ? AND is_used = ?", input.InviteCode, false).First(&invite).Error; err != nil {
+	invite, err := services.FindInvite(input.InviteCode)
+	switch {
+	case errors.Is(err, services.ErrInviteExpired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invite code expired"})
+		return
+	case errors.Is(err, services.ErrInviteRevoked):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invite code has been revoked"})
+		return
+	case err != nil:
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or used invite code"})
 		return
 	}
 
-	if invite.ExpiresAt.Before(time.Now()) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invite code expired"})
+	// Linked invites hand over an account the school already made, e.g. for an imported student
+	claimed, linked, err := services.InviteLinkedUser(invite)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This invite's account has already been claimed"})
 		return
 	}
 
 	// 2. Check if email exists
 	var existing models.User
-	if result := models.DB.Where("email = ?", input.Email).First(&existing); result.RowsAffected > 0 {
+	if result := models.DB.Where("email = ?", input.Email).First(&existing); result.RowsAffected > 0 && (!linked || existing.ID != claimed.ID) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Email already registered"})
 		return
 	}
 
+	phone := ""
+	if input.Phone != "" {
+		if phone = services.NormalizePhone(input.Phone); phone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number"})
+			return
+		}
+	}
+
 	// 3. Hash Password
 	hashedPassword, err := models.HashPassword(input.Password)
 	if err != nil {
@@ -66,13 +140,30 @@ func signup(c *gin.Context) {
 		return
 	}
 
-	// 4. Create User (Atomic transaction with invite update)
+	// 4. Create or claim the User (Atomic transaction with invite update)
 	err = models.DB.Transaction(func(tx *gorm.DB) error {
+		// Counted first, so a used-up or revoked invite rolls everything back
+		if err := services.UseInvite(tx, invite); err != nil {
+			return err
+		}
+
+		if linked {
+			updates := map[string]interface{}{"email": input.Email, "password_hash": hashedPassword, "must_change_password": false}
+			if phone != "" && phone != claimed.Phone {
+				updates["phone"], updates["phone_verified"] = phone, false
+			}
+			if err := tx.Model(&claimed).Updates(updates).Error; err != nil {
+				return err
+			}
+			return services.RevokeOtherLinkedInvites(tx, invite)
+		}
+
 		user := models.User{
 			Email:        input.Email,
 			PasswordHash: hashedPassword,
 			Role:         invite.Role,
 			SchoolID:     &invite.SchoolID,
+			Phone:        phone,
 			// FullName logic if needed
 		}
 
@@ -80,12 +171,6 @@ func signup(c *gin.Context) {
 			return err
 		}
 
-		// Mark invite as used
-		invite.IsUsed = true
-		if err := tx.Save(&invite).Error; err != nil {
-			return err
-		}
-
 		// If Role is STUDENT, create Student record automatically
 		if user.Role == "STUDENT" {
 			student := models.Student{
@@ -98,18 +183,35 @@ func signup(c *gin.Context) {
 			}
 		}
 
+		// A parent invited for a student is linked to them straight away
+		if user.Role == "PARENT" && invite.StudentID != nil {
+			link := models.ParentStudent{ParentID: user.ID, StudentID: *invite.StudentID, Relation: "GUARDIAN", Phone: phone}
+			if err := tx.Create(&link).Error; err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 
+	if errors.Is(err, services.ErrInviteInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or used invite code"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Signup failed: " + err.Error()})
 		return
 	}
+	if linked {
+		models.CreateAuditLog(invite.SchoolID, claimed.ID, models.AuditInviteClaimed, "User", claimed.ID,
+			claimed.Email, input.Email, c.ClientIP(), c.Request.UserAgent())
+	}
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message": fmt.Sprintf("%s created successfully!", invite.Role),
 		"email":   input.Email,
 		"role":    invite.Role,
+		"claimed": linked,
 	})
 }
 
@@ -120,31 +222,110 @@ func login(c *gin.Context) {
 		return
 	}
 
+	// Throttled before the password hash is compared, so blocked guesses cost no CPU
+	ip, userAgent := c.ClientIP(), c.Request.UserAgent()
+	if wait := services.LoginIPBlocked(ip); wait > 0 {
+		loginBlocked(c, services.LoginBlock{RetryAfter: wait})
+		return
+	}
+
 	var user models.User
 	if result := models.DB.Where("email = ?", input.Email).First(&user); result.RowsAffected == 0 {
+		services.RecordLoginFailure(nil, input.Email, "unknown_email", ip, userAgent)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
+	if block, blocked := services.LoginAccountBlocked(user); blocked {
+		loginBlocked(c, block)
+		return
+	}
 
 	if !models.CheckPasswordHash(input.Password, user.PasswordHash) {
+		if services.RecordLoginFailure(&user, input.Email, "password", ip, userAgent) {
+			loginBlocked(c, services.LoginBlock{RetryAfter: time.Until(*user.LockedUntil), Locked: true})
+			return
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
+	continueLogin(c, user, nil)
+}
 
-	// Update last login time
-	now := time.Now()
-	user.LastLoginAt = &now
-	models.DB.Save(&user)
+// continueLogin - Once the user has proven who they are (password or single sign-on), ask for the
+// two-factor code if they need one, else open the session
+func continueLogin(c *gin.Context, user models.User, extra gin.H) {
+	if user.DeactivatedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account has been deactivated"})
+		return
+	}
+
+	// Two-step login: the code (or setting two-factor up) is still needed
+	// Sessions start on the home membership, so that is the policy that applies
+	if user.TOTPEnabledAt != nil || services.TwoFactorRequiredFor(services.HomeMembership(user)) {
+		purpose := utils.PurposeTwoFactor
+		if user.TOTPEnabledAt == nil {
+			purpose = utils.PurposeTwoFactorSetup
+		}
+		token, err := utils.GeneratePreAuthToken(user.ID, user.Role, user.SchoolID, purpose)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+			return
+		}
+		response := gin.H{
+			"two_factor_required":       true,
+			"two_factor_setup_required": purpose == utils.PurposeTwoFactorSetup,
+			"pre_auth_token":            token,
+			"expires_in":                int(utils.PreAuthTokenTTL.Seconds()),
+		}
+		for k, v := range extra {
+			response[k] = v
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	completeLogin(c, user, extra)
+}
+
+// loginBlocked - 429 with Retry-After for a sign-in refused by throttling or lockout
+func loginBlocked(c *gin.Context, block services.LoginBlock) {
+	seconds := int(math.Ceil(block.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	if block.Locked {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "Account temporarily locked after too many failed sign-ins",
+			"code":        "ACCOUNT_LOCKED",
+			"retry_after": seconds,
+		})
+		return
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed sign-ins; try again shortly", "retry_after": seconds})
+}
 
-	token, err := utils.GenerateToken(user.ID, user.Role, user.SchoolID)
+// completeLogin - Open a session for a user who has passed every sign-in step
+func completeLogin(c *gin.Context, user models.User, extra gin.H) {
+	pair, _, err := services.StartSession(user, c.ClientIP(), c.Request.UserAgent())
+	if errors.Is(err, services.ErrAccountDeactivated) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account has been deactivated"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token": token,
-		"token_type":   "Bearer",
+	services.RecordLoginSuccess(user)
+
+	// Update last login time
+	now := time.Now()
+	user.LastLoginAt = &now
+	models.DB.Model(&user).Update("last_login_at", now)
+
+	response := gin.H{
+		"access_token":  pair.AccessToken,
+		"refresh_token": pair.RefreshToken,
+		"token_type":    pair.TokenType,
+		"expires_in":    pair.ExpiresIn,
 		"user": gin.H{
 			"id":        user.ID,
 			"email":     user.Email,
@@ -152,5 +333,212 @@ func login(c *gin.Context) {
 			"role":      user.Role,
 			"school_id": user.SchoolID,
 		},
-	})
+		"must_change_password": user.MustChangePassword,
+		"memberships":          services.UserMemberships(user),
+		"active":               services.HomeMembership(user),
+	}
+	for k, v := range extra {
+		response[k] = v
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// refreshToken - Swap a refresh token for a new access and refresh token
+func refreshToken(c *gin.Context) {
+	var input RefreshInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pair, _, err := services.RefreshSession(input.RefreshToken, c.ClientIP(), c.Request.UserAgent())
+	switch {
+	case errors.Is(err, services.ErrAccountDeactivated):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account has been deactivated"})
+		return
+	case errors.Is(err, services.ErrInvalidRefreshToken):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, pair)
+}
+
+// logoutWithRefreshToken - Sign out with the refresh token alone, so an expired access token doesn't stop it
+// Without one in the body, logout falls through to the access token's session
+func logoutWithRefreshToken(c *gin.Context) {
+	var input RefreshInput
+	if c.ShouldBindJSON(&input) == nil && services.EndSession(input.RefreshToken) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{"message": "Logged out"})
+		return
+	}
+	c.Next()
+}
+
+// logout - Revoke the session the request was made with
+func logout(c *gin.Context) {
+	sessionID := c.MustGet("sessionID").(uint)
+	if sessionID != 0 {
+		services.RevokeSession(sessionID, models.SessionRevokedLogout)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// logoutAll - Revoke every session of the current user, this one included
+func logoutAll(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	revoked := services.RevokeUserSessions(userID, models.SessionRevokedLogoutAll, 0)
+
+	models.CreateAuditLog(c.GetUint("schoolID"), userID, models.AuditSessionsRevoked, "User", userID,
+		"", fmt.Sprintf(`{"revoked":%d}`, revoked), c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all devices", "revoked": revoked})
+}
+
+// listSessions - The current user's signed-in devices
+func listSessions(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	current := c.MustGet("sessionID").(uint)
+
+	sessions := services.ActiveSessions(userID)
+	out := make([]gin.H, len(sessions))
+	for i, s := range sessions {
+		out[i] = gin.H{
+			"id":           s.ID,
+			"ip_address":   s.IPAddress,
+			"user_agent":   s.UserAgent,
+			"created_at":   s.CreatedAt,
+			"last_used_at": s.LastUsedAt,
+			"expires_at":   s.ExpiresAt,
+			"current":      s.ID == current,
+		}
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// revokeSession - Sign one of the current user's devices out, e.g. a lost phone
+func revokeSession(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var session models.UserSession
+	if err := models.DB.Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("id"), userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	services.RevokeSession(session.ID, models.SessionRevokedLogout)
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// changePassword - Change the current user's password and sign out their other devices
+func changePassword(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	sessionID := c.MustGet("sessionID").(uint)
+
+	var input ChangePasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := models.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if !models.CheckPasswordHash(input.CurrentPassword, user.PasswordHash) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	hashedPassword, err := models.HashPassword(input.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+	err = models.DB.Model(&user).Updates(map[string]interface{}{"password_hash": hashedPassword, "must_change_password": false}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+	revoked := services.RevokeUserSessions(userID, models.SessionRevokedPasswordChanged, sessionID)
+
+	models.CreateAuditLog(c.GetUint("schoolID"), userID, models.AuditPasswordChanged, "User", userID,
+		"", fmt.Sprintf(`{"sessions_revoked":%d}`, revoked), c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed", "sessions_revoked": revoked})
+}
+
+// forgotPassword - Send a one-time reset code to the account's verified email or phone
+// The response is the same whether or not the account exists
+func forgotPassword(c *gin.Context) {
+	var input ForgotPasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Email == "" && input.Phone == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email or phone is required"})
+		return
+	}
+
+	if user, ok := services.FindUserForReset(input.Email, input.Phone); ok {
+		reset, err := services.RequestPasswordReset(user, input.Channel, c.ClientIP())
+		detail := fmt.Sprintf(`{"channel":%q,"destination":%q}`, reset.Channel, reset.Destination)
+		if err != nil {
+			detail = fmt.Sprintf(`{"error":%q}`, err.Error())
+		}
+		models.CreateAuditLog(schoolIDOf(user), user.ID, models.AuditPasswordResetRequested, "User", user.ID,
+			"", detail, c.ClientIP(), c.Request.UserAgent())
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the account exists, a reset code has been sent to its verified email or phone"})
+}
+
+// resetPassword - Set a new password with a reset code or link token
+func resetPassword(c *gin.Context) {
+	var input ResetPasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var reset models.PasswordReset
+	err := services.ErrResetCodeInvalid
+	switch {
+	case input.Token != "":
+		reset, err = services.VerifyResetToken(input.Token)
+	case input.Code != "":
+		if user, ok := services.FindUserForReset(input.Email, input.Phone); ok {
+			reset, err = services.VerifyResetCode(user.ID, input.Code)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code or token is required"})
+		return
+	}
+
+	if errors.Is(err, services.ErrResetTooManyAttempts) {
+		var user models.User
+		models.DB.First(&user, reset.UserID)
+		models.CreateAuditLog(schoolIDOf(user), user.ID, models.AuditPasswordResetLocked, "User", user.ID,
+			"", fmt.Sprintf(`{"attempts":%d}`, reset.Attempts), c.ClientIP(), c.Request.UserAgent())
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many wrong codes; request a new one"})
+		return
+	}
+	if err == nil {
+		err = services.CompletePasswordReset(reset, input.NewPassword)
+	}
+	if errors.Is(err, services.ErrResetCodeInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired code"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	var user models.User
+	models.DB.First(&user, reset.UserID)
+	models.CreateAuditLog(schoolIDOf(user), user.ID, models.AuditPasswordResetCompleted, "User", user.ID,
+		"", fmt.Sprintf(`{"channel":%q}`, reset.Channel), c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset. Sign in with your new password"})
 }
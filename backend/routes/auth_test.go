@@ -24,6 +24,7 @@ func setupAuthTestDB(t *testing.T) *gorm.DB {
 
 	db.AutoMigrate(
 		&models.User{}, &models.School{}, &models.Student{}, &models.Invite{},
+		&models.UserSession{}, &models.LoginFailure{}, &models.Membership{},
 	)
 
 	models.DB = db
@@ -18,9 +18,9 @@ func RegisterClassRoutes(router *gin.RouterGroup) {
 	classes.Use(middleware.AuthMiddleware())
 	{
 		// Create - SCHOOLADMIN only
-		classes.POST("", middleware.RoleGuard("SCHOOLADMIN"), createClass)
+		classes.POST("", middleware.RequirePermission("classes.create"), createClass)
 		// Read - SCHOOLADMIN, TEACHER, FINANCE
-		classes.GET("", middleware.RoleGuard("SCHOOLADMIN", "TEACHER", "FINANCE"), listClasses)
+		classes.GET("", middleware.RequirePermission("classes.view"), listClasses)
 	}
 }
 
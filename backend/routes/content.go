@@ -1,12 +1,15 @@
 package routes
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -18,9 +21,9 @@ func RegisterContentRoutes(router *gin.RouterGroup) {
 	content.Use(middleware.AuthMiddleware())
 	{
 		// Teacher routes
-		content.POST("/classes/:classId", middleware.RoleGuard("TEACHER", "SCHOOLADMIN"), uploadContent)
+		content.POST("/classes/:classId", middleware.RequirePermission("content.manage"), uploadContent)
 		content.GET("/classes/:classId", getClassContent)
-		content.DELETE("/:id", middleware.RoleGuard("TEACHER", "SCHOOLADMIN"), deleteContent)
+		content.DELETE("/:id", middleware.RequirePermission("content.manage"), deleteContent)
 	}
 }
 
@@ -165,15 +168,26 @@ func RegisterGradeRoutes(router *gin.RouterGroup) {
 	grades.Use(middleware.AuthMiddleware())
 	{
 		// Teacher creates/updates grades
-		grades.POST("", middleware.RoleGuard("TEACHER", "SCHOOLADMIN"), createGrade)
-		grades.POST("/bulk", middleware.RoleGuard("TEACHER", "SCHOOLADMIN"), createBulkGrades)
-		grades.GET("/class/:classId", middleware.RoleGuard("TEACHER", "SCHOOLADMIN"), getClassGrades)
+		grades.POST("", middleware.RequirePermission("grades.create"), createGrade)
+		grades.POST("/bulk", middleware.RequirePermission("grades.create"), createBulkGrades)
+		grades.GET("/class/:classId", middleware.RequirePermission("grades.view"), getClassGrades)
+		grades.GET("/report-card/:id", middleware.RequirePermission("grades.view"), getReportCard)
+		grades.POST("/report-card/:id/email", middleware.RequirePermission("grades.publish"), emailReportCard)
 
 		// Student views their own grades
-		grades.GET("/my", middleware.RoleGuard("STUDENT"), getMyGrades)
+		grades.GET("/my", middleware.RequirePermission("grades.view_own"), getMyGrades)
 	}
 }
 
+// publishGrade - Queue GRADE_PUBLISHED so guardians hear about a new grade
+func publishGrade(grade models.Grade, actorID uint) {
+	services.PublishEvent(grade.SchoolID, actorID, models.EventGradePublished, grade.StudentID, map[string]string{
+		"subject": grade.Subject,
+		"score":   fmt.Sprintf("%g/%g", grade.Score, grade.MaxScore),
+		"term":    strings.TrimSpace(fmt.Sprintf("%s %d", grade.Term, grade.Year)),
+	})
+}
+
 type GradeInput struct {
 	StudentID uint    `json:"student_id" binding:"required"`
 	ClassID   uint    `json:"class_id" binding:"required"`
@@ -217,6 +231,7 @@ func createGrade(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create grade"})
 		return
 	}
+	publishGrade(grade, c.MustGet("userID").(uint))
 
 	c.JSON(http.StatusCreated, grade)
 }
@@ -255,6 +270,9 @@ func createBulkGrades(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create grades"})
 		return
 	}
+	for _, grade := range grades {
+		publishGrade(grade, c.MustGet("userID").(uint))
+	}
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Grades created successfully",
@@ -284,6 +302,50 @@ func getClassGrades(c *gin.Context) {
 	c.JSON(http.StatusOK, grades)
 }
 
+// ReportCardInput - Term of a report card, plus who to email it to
+type ReportCardInput struct {
+	Term string   `json:"term" form:"term" binding:"required"`
+	Year int      `json:"year" form:"year" binding:"required"`
+	To   []string `json:"to"`
+}
+
+// getReportCard - Printable report card for one student and term
+func getReportCard(c *gin.Context) {
+	var input ReportCardInput
+	if err := c.ShouldBindQuery(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	student, ok := schoolStudent(c)
+	if !ok {
+		return
+	}
+
+	card, err := services.ReportCardHTML(student, input.Term, input.Year)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Type", "text/html")
+	c.String(http.StatusOK, card)
+}
+
+// emailReportCard - Email a student's report card to the given addresses, or their guardians
+func emailReportCard(c *gin.Context) {
+	var input ReportCardInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	student, ok := schoolStudent(c)
+	if !ok {
+		return
+	}
+	respondEmailResult(c, services.EmailReportCard(student, input.Term, input.Year, input.To))
+}
+
 func getMyGrades(c *gin.Context) {
 	schoolID := c.MustGet("schoolID").(uint)
 	userID := c.MustGet("userID").(uint)
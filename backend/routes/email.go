@@ -0,0 +1,139 @@
+package routes
+
+import (
+	"net/http"
+	"schoolms-go/middleware"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterEmailRoutes(router *gin.RouterGroup) {
+	email := router.Group("/email")
+	email.Use(middleware.AuthMiddleware(), middleware.RequirePermission("email.manage"))
+	{
+		email.GET("/settings", getEmailSettings)
+		email.PUT("/settings", updateEmailSettings)
+		email.POST("/test", sendTestEmail)
+		email.GET("/logs", getEmailLogs)
+	}
+}
+
+// EmailRecipientsInput - Who to email; empty means the student's guardians
+type EmailRecipientsInput struct {
+	To []string `json:"to"`
+}
+
+// getEmailSettings - The school's SMTP server, or whether the server default applies
+func getEmailSettings(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var settings models.EmailSettings
+	if err := models.DB.Where("school_id = ?", schoolID).First(&settings).Error; err != nil {
+		mailer, _ := services.MailerForSchool(schoolID)
+		c.JSON(http.StatusOK, gin.H{"configured": false, "default_available": mailer != nil})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"configured":   true,
+		"settings":     settings,
+		"has_password": settings.Password != "",
+	})
+}
+
+// updateEmailSettings - Set the SMTP server this school's email goes through
+func updateEmailSettings(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var input struct {
+		Host        string `json:"host" binding:"required"`
+		Port        int    `json:"port" binding:"required,min=1,max=65535"`
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+		Encryption  string `json:"encryption" binding:"omitempty,oneof=NONE STARTTLS TLS"`
+		FromAddress string `json:"from_address" binding:"required,email"`
+		FromName    string `json:"from_name"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var settings models.EmailSettings
+	models.DB.Where("school_id = ?", schoolID).First(&settings)
+	oldHost := settings.Host
+
+	settings.SchoolID = schoolID
+	settings.Host = strings.TrimSpace(input.Host)
+	settings.Port = input.Port
+	settings.Username = input.Username
+	settings.Encryption = input.Encryption
+	if settings.Encryption == "" {
+		settings.Encryption = services.DefaultEmailEncryption(input.Port)
+	}
+	settings.FromAddress = input.FromAddress
+	settings.FromName = input.FromName
+	settings.UpdatedBy = userID
+	// The password is write-only; leaving it blank keeps the stored value
+	if input.Password != "" {
+		settings.Password = input.Password
+	}
+
+	if err := models.DB.Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save email settings"})
+		return
+	}
+
+	models.CreateAuditLog(schoolID, userID, models.AuditEmailSettingsChange, "EmailSettings", settings.ID,
+		oldHost, settings.Host, c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// sendTestEmail - Check the settings by sending a test message
+func sendTestEmail(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var input struct {
+		To string `json:"to" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	msg, err := services.RenderEmail(schoolID, models.EmailTemplateTest, services.MergeFields{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	msg.To = []string{input.To}
+	respondEmailResult(c, services.SendSchoolEmail(schoolID, models.EmailTemplateTest, msg))
+}
+
+func getEmailLogs(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	query := models.DB.Where("school_id = ?", schoolID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", strings.ToUpper(status))
+	}
+
+	var logs []models.EmailLog
+	query.Order("created_at DESC").Limit(100).Find(&logs)
+
+	c.JSON(http.StatusOK, logs)
+}
+
+// respondEmailResult - 200 when the server accepted the email, 502 with the reason when not
+func respondEmailResult(c *gin.Context, result services.EmailResult) {
+	if !result.Success {
+		c.JSON(http.StatusBadGateway, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email sent", "message_id": result.MessageID})
+}
@@ -0,0 +1,147 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type emailFixture struct {
+	*smsFixture
+	catcher *services.SMTPCatcher
+	student models.Student
+}
+
+func setupEmailTest(t *testing.T) *emailFixture {
+	f := setupSMSTest(t)
+	f.db.AutoMigrate(&models.EmailSettings{}, &models.EmailLog{}, &models.Class{}, &models.Grade{}, &models.Invite{},
+		&models.Payment{}, &models.PaymentAllocation{}, &models.VoteHead{}, &models.VoteHeadBalance{})
+
+	catcher, err := services.StartSMTPCatcher("127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { catcher.Close() })
+	services.SetDefaultMailer(nil, mail.Address{})
+
+	api := f.router.Group("/api/v1")
+	routes.RegisterEmailRoutes(api)
+	routes.RegisterFinanceRoutes(api)
+	routes.RegisterGradeRoutes(api)
+	routes.RegisterInviteRoutes(api)
+
+	parent := models.User{Email: "mzazi@example.com", Role: "PARENT", SchoolID: &f.school.ID}
+	placeholder := models.User{Email: "254700000000@parent.local", Role: "PARENT", SchoolID: &f.school.ID}
+	studentUser := models.User{Email: "amani@test.com", FullName: "Amani Otieno", Role: "STUDENT", SchoolID: &f.school.ID}
+	f.db.Create(&parent)
+	f.db.Create(&placeholder)
+	f.db.Create(&studentUser)
+	student := models.Student{UserID: studentUser.ID, SchoolID: f.school.ID, EnrollmentNumber: "ADM/001", Status: "ENROLLED"}
+	f.db.Create(&student)
+	f.db.Create(&models.ParentStudent{ParentID: parent.ID, StudentID: student.ID})
+	f.db.Create(&models.ParentStudent{ParentID: placeholder.ID, StudentID: student.ID})
+
+	fx := &emailFixture{smsFixture: f, catcher: catcher, student: student}
+	w := f.do("PUT", "/api/v1/email/settings", f.admin, map[string]interface{}{
+		"host": catcher.Host(), "port": catcher.Port(), "encryption": "NONE",
+		"from_address": "office@test.ac.ke", "from_name": "Test School", "password": "secret",
+	})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return fx
+}
+
+func TestEmail_SettingsHidePasswordAndTestEmail(t *testing.T) {
+	f := setupEmailTest(t)
+
+	w := f.do("GET", "/api/v1/email/settings", f.admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "secret")
+	assert.Contains(t, w.Body.String(), `"has_password":true`)
+
+	w = f.do("POST", "/api/v1/email/test", f.admin, map[string]string{"to": "me@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	caught := f.catcher.Messages()
+	assert.Len(t, caught, 1)
+	assert.Equal(t, "Test email from Test School", caught[0].Subject)
+	assert.Contains(t, string(caught[0].Raw), `"Test School" <office@test.ac.ke>`)
+
+	var audits int64
+	f.db.Model(&models.AuditLog{}).Where("action = ?", models.AuditEmailSettingsChange).Count(&audits)
+	assert.Equal(t, int64(1), audits)
+}
+
+func TestEmail_ReceiptGoesToGuardiansWithAttachment(t *testing.T) {
+	f := setupEmailTest(t)
+
+	tuition := models.VoteHead{SchoolID: f.school.ID, Name: "Tuition", Priority: 1}
+	f.db.Create(&tuition)
+	payment := models.Payment{StudentID: f.student.ID, SchoolID: f.school.ID, Amount: 2500, Method: "MPESA", Reference: "QK12AB"}
+	f.db.Create(&payment)
+	f.db.Create(&models.PaymentAllocation{PaymentID: payment.ID, VoteHeadID: tuition.ID, Amount: 2500})
+
+	w := f.do("POST", fmt.Sprintf("/api/v1/finance/receipts/%d/email", payment.ID), f.admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	caught := f.catcher.Messages()
+	assert.Len(t, caught, 1)
+	assert.Equal(t, []string{"mzazi@example.com"}, caught[0].To) // Placeholder import address skipped
+	assert.Contains(t, caught[0].Subject, "RCP-")
+	assert.Contains(t, caught[0].Text, "KES 2,500.00")
+	assert.Len(t, caught[0].Attachments, 1)
+	assert.Contains(t, string(caught[0].Attachments[0].Data), "QK12AB")
+	assert.Contains(t, string(caught[0].Attachments[0].Data), "Tuition")
+
+	w = f.do("GET", "/api/v1/email/logs", f.admin, nil)
+	var logs []models.EmailLog
+	json.Unmarshal(w.Body.Bytes(), &logs)
+	assert.Len(t, logs, 1)
+	assert.Equal(t, models.EmailTemplateReceipt, logs[0].Template)
+	assert.Equal(t, models.EmailSent, logs[0].Status)
+	assert.Contains(t, logs[0].Attachments, ".html")
+}
+
+func TestEmail_StatementAndReportCard(t *testing.T) {
+	f := setupEmailTest(t)
+
+	f.db.Create(&models.Grade{StudentID: f.student.ID, ClassID: 1, SchoolID: f.school.ID, Subject: "Maths", Score: 45, MaxScore: 50, Term: "Term 1", Year: 2026})
+
+	w := f.do("POST", fmt.Sprintf("/api/v1/finance/students/%d/statement/email", f.student.ID), f.admin,
+		map[string]interface{}{"to": []string{"bursar@example.com"}})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = f.do("POST", fmt.Sprintf("/api/v1/grades/report-card/%d/email", f.student.ID), f.admin,
+		map[string]interface{}{"term": "Term 1", "year": 2026})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = f.do("POST", fmt.Sprintf("/api/v1/grades/report-card/%d/email", f.student.ID), f.admin,
+		map[string]interface{}{"term": "Term 3", "year": 2026})
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	caught := f.catcher.Messages()
+	assert.Len(t, caught, 2)
+	assert.Equal(t, []string{"bursar@example.com"}, caught[0].To)
+	assert.Equal(t, "Fee statement for Amani Otieno", caught[0].Subject)
+	assert.Equal(t, "statement-ADM-001.html", caught[0].Attachments[0].Filename)
+	assert.Equal(t, "Term 1 2026 report card for Amani Otieno", caught[1].Subject)
+	assert.Contains(t, string(caught[1].Attachments[0].Data), "45/50")
+}
+
+func TestEmail_InviteCodeEmailed(t *testing.T) {
+	f := setupEmailTest(t)
+
+	w := f.do("POST", "/api/v1/invites", f.admin, map[string]string{"role": "TEACHER", "email": "mwalimu@example.com"})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var invite models.Invite
+	f.db.First(&invite)
+	caught := f.catcher.Messages()
+	assert.Len(t, caught, 1)
+	assert.Equal(t, "You're invited to join Test School", caught[0].Subject)
+	assert.Contains(t, caught[0].Text, invite.Code.String())
+}
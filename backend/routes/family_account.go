@@ -0,0 +1,256 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"schoolms-go/middleware"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterFamilyAccountRoutes(router *gin.RouterGroup) {
+	family := router.Group("/family-accounts")
+	family.Use(middleware.AuthMiddleware())
+	{
+		family.POST("", middleware.RequirePermission("finance.family_accounts.manage"), createFamilyAccount)
+		family.GET("", middleware.RequirePermission("finance.family_accounts.view"), listFamilyAccounts)
+		family.PUT("/:id", middleware.RequirePermission("finance.family_accounts.manage"), updateFamilyAccount)
+		family.GET("/mine", middleware.RequirePermission("finance.family_accounts.view_own"), getMyFamilyAccount)
+		family.GET("/:id/receipts/:reference", middleware.RequirePermission("finance.family_accounts.receipts.view"), getFamilyReceipt)
+	}
+}
+
+// createFamilyAccount - Issue a family reference for a parent with linked children
+func createFamilyAccount(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var input struct {
+		ParentID  uint   `json:"parent_id" binding:"required"`
+		SplitRule string `json:"split_rule" binding:"omitempty,oneof=OLDEST_DEBT PROPORTIONAL"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A parent of children in several schools is a parent here through a membership
+	var parent models.User
+	memberships := models.DB.Model(&models.Membership{}).Select("user_id").Where("school_id = ? AND role = ?", schoolID, "PARENT")
+	if err := models.DB.Where("id = ? AND ((school_id = ? AND role = ?) OR id IN (?))", input.ParentID, schoolID, "PARENT", memberships).
+		First(&parent).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Parent not found"})
+		return
+	}
+
+	siblings, err := services.GetFamilySiblings(parent.ID, schoolID)
+	if err != nil || len(siblings) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Parent has no linked students in this school"})
+		return
+	}
+
+	var existing models.FamilyAccount
+	if err := models.DB.Where("parent_id = ? AND school_id = ?", parent.ID, schoolID).First(&existing).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Parent already has a family account", "account": existing})
+		return
+	}
+
+	account := models.FamilyAccount{
+		SchoolID:   schoolID,
+		ParentID:   parent.ID,
+		AccountRef: models.FamilyAccountRef(schoolID, parent.ID),
+		SplitRule:  input.SplitRule,
+	}
+	if account.SplitRule == "" {
+		account.SplitRule = models.SplitOldestDebt
+	}
+
+	if err := models.DB.Create(&account).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create family account"})
+		return
+	}
+
+	models.CreateAuditLog(schoolID, userID, models.AuditFamilyAccountCreated, "FamilyAccount", account.ID,
+		"", account.AccountRef, c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusCreated, gin.H{
+		"account":  account,
+		"children": len(siblings),
+	})
+}
+
+// listFamilyAccounts - All family references in the school
+func listFamilyAccounts(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var accounts []models.FamilyAccount
+	models.DB.Where("school_id = ?", schoolID).Preload("Parent").Order("account_ref").Find(&accounts)
+
+	c.JSON(http.StatusOK, accounts)
+}
+
+// updateFamilyAccount - Change how future payments are split
+func updateFamilyAccount(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var account models.FamilyAccount
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&account).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Family account not found"})
+		return
+	}
+
+	var input struct {
+		SplitRule string `json:"split_rule" binding:"required,oneof=OLDEST_DEBT PROPORTIONAL"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	oldRule := account.SplitRule
+	account.SplitRule = input.SplitRule
+	models.DB.Save(&account)
+
+	models.CreateAuditLog(schoolID, userID, models.AuditFamilySplitRuleChange, "FamilyAccount", account.ID,
+		oldRule, account.SplitRule, c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, account)
+}
+
+// getMyFamilyAccount - Parent's family reference to pay all children at once
+func getMyFamilyAccount(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var account models.FamilyAccount
+	if err := models.DB.Where("parent_id = ? AND school_id = ?", userID, schoolID).First(&account).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No family account; ask the school bursar to set one up"})
+		return
+	}
+
+	var payments []models.Payment
+	models.DB.Where("family_account_id = ?", account.ID).Order("created_at DESC").Limit(100).Find(&payments)
+
+	c.JSON(http.StatusOK, gin.H{
+		"account":  account,
+		"payments": payments,
+	})
+}
+
+// getFamilyReceipt - One combined receipt for a payment split across siblings
+func getFamilyReceipt(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+	role := c.MustGet("role").(string)
+
+	var account models.FamilyAccount
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&account).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Family account not found"})
+		return
+	}
+	if role == "PARENT" && account.ParentID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized to view this account"})
+		return
+	}
+
+	var payments []models.Payment
+	models.DB.Where("family_account_id = ? AND reference = ?", account.ID, c.Param("reference")).
+		Order("id").Find(&payments)
+	if len(payments) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+
+	var school models.School
+	models.DB.Where("id = ?", schoolID).First(&school)
+
+	var total float64
+	children := make([]gin.H, 0, len(payments))
+	for _, payment := range payments {
+		var student models.Student
+		models.DB.Where("id = ?", payment.StudentID).Preload("User").First(&student)
+
+		var allocations []models.PaymentAllocation
+		models.DB.Where("payment_id = ?", payment.ID).Preload("VoteHead").Find(&allocations)
+
+		total += payment.Amount
+		children = append(children, gin.H{
+			"receipt_number": fmt.Sprintf("RCP-%06d", payment.ID),
+			"student": gin.H{
+				"id":     student.ID,
+				"name":   student.User.FullName,
+				"adm_no": student.EnrollmentNumber,
+			},
+			"amount":      payment.Amount,
+			"allocations": allocations,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"receipt_number": fmt.Sprintf("FRC-%s", payments[0].Reference),
+		"account_ref":    account.AccountRef,
+		"reference":      payments[0].Reference,
+		"split_rule":     account.SplitRule,
+		"total":          total,
+		"school": gin.H{
+			"id":   school.ID,
+			"name": school.Name,
+		},
+		"children": children,
+		"date":     payments[0].CreatedAt.Format("2006-01-02 15:04:05"),
+	})
+}
+
+// findFamilyAccount - Family account for an M-PESA BillRefNumber, if any
+func findFamilyAccount(billRef string) *models.FamilyAccount {
+	ref := strings.ToUpper(strings.TrimSpace(billRef))
+	if !strings.HasPrefix(ref, "FAM") {
+		return nil
+	}
+	var account models.FamilyAccount
+	if err := models.DB.Where("account_ref = ?", ref).First(&account).Error; err != nil {
+		return nil
+	}
+	return &account
+}
+
+// confirmFamilyPayment - Split a C2B payment across siblings and record the transaction
+func confirmFamilyPayment(c *gin.Context, account *models.FamilyAccount, mpesaTx *models.MPESATransaction) {
+	mpesaTx.SchoolID = account.SchoolID
+	mpesaTx.FamilyAccountID = &account.ID
+
+	// A failed split writes nothing, so the transaction can be left for manual matching
+	payments, err := services.AllocateFamilyPayment(account, mpesaTx.TransAmount, "MPESA", mpesaTx.TransID)
+	if err != nil || len(payments) == 0 {
+		mpesaTx.Status = "UNMATCHED"
+		mpesaTx.ErrorMessage = fmt.Sprintf("Family payment split failed: %v", err)
+		models.DB.Create(mpesaTx)
+
+		c.JSON(http.StatusOK, gin.H{
+			"ResultCode": 0,
+			"ResultDesc": "Logged for manual matching",
+		})
+		return
+	}
+
+	fmt.Printf("[M-PESA] Family payment %s split across %d students\n", mpesaTx.TransID, len(payments))
+
+	// The transaction points at the first child's payment; the rest share its reference
+	mpesaTx.Status = "MATCHED"
+	mpesaTx.PaymentID = &payments[0].ID
+	mpesaTx.MatchedStudentID = &payments[0].StudentID
+	models.DB.Create(mpesaTx)
+
+	for _, payment := range payments {
+		services.PublishPaymentEvent(payment, 0)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ResultCode": 0,
+		"ResultDesc": "Success",
+	})
+}
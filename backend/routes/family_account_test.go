@@ -0,0 +1,185 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// familyFixture - A parent with two children who both owe 4,000; the second has owed for longer
+type familyFixture struct {
+	*refundFixture
+	school      models.School
+	parent      models.User
+	children    []models.Student
+	bursarToken string
+	parentToken string
+}
+
+func setupFamilyAccountTest(t *testing.T) *familyFixture {
+	db := setupMpesaTestDB(t)
+	db.AutoMigrate(&models.ParentStudent{}, &models.FamilyAccount{}, &models.AuditLog{}, &models.Membership{})
+	t.Cleanup(func() { sqlDB, _ := db.DB(); sqlDB.Close() })
+
+	school := models.School{Name: "Test School"}
+	db.Create(&school)
+
+	bursar := models.User{Email: "bursar@test.com", Role: "FINANCE", SchoolID: &school.ID}
+	parent := models.User{Email: "parent@test.com", Role: "PARENT", SchoolID: &school.ID}
+	db.Create(&bursar)
+	db.Create(&parent)
+
+	voteHead := models.VoteHead{SchoolID: school.ID, Name: "Tuition", Priority: 1, IsActive: true}
+	db.Create(&voteHead)
+
+	// Older child was charged earlier, so OLDEST_DEBT clears them first even though a payment
+	// on their account was made more recently
+	var children []models.Student
+	for i, charged := range []time.Time{time.Now().AddDate(0, -1, 0), time.Now().AddDate(0, -3, 0)} {
+		u := models.User{Email: "child" + string(rune('a'+i)) + "@test.com", Role: "STUDENT", SchoolID: &school.ID}
+		db.Create(&u)
+		s := models.Student{UserID: u.ID, SchoolID: school.ID, EnrollmentNumber: "ADM00" + string(rune('1'+i)), Status: "ENROLLED"}
+		db.Create(&s)
+		db.Create(&models.ParentStudent{ParentID: parent.ID, StudentID: s.ID, Relation: "MOTHER"})
+		db.Create(&models.VoteHeadBalance{StudentID: s.ID, VoteHeadID: voteHead.ID, SchoolID: school.ID, Balance: 4000, ChargedAt: charged, LastUpdated: time.Now().AddDate(0, 0, i-1)})
+		children = append(children, s)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api/v1")
+	routes.RegisterMpesaRoutes(api)
+	routes.RegisterFamilyAccountRoutes(api)
+	return &familyFixture{
+		refundFixture: &refundFixture{db: db, router: router},
+		school:        school,
+		parent:        parent,
+		children:      children,
+		bursarToken:   sessionToken(t, bursar),
+		parentToken:   sessionToken(t, parent),
+	}
+}
+
+// account - Issue the parent's family account
+func (f *familyFixture) account(t *testing.T) models.FamilyAccount {
+	w := f.do("POST", "/api/v1/family-accounts", f.bursarToken, map[string]interface{}{"parent_id": f.parent.ID})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		Account models.FamilyAccount `json:"account"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	return created.Account
+}
+
+func TestFamilyAccount_C2BPaymentSplitAcrossSiblings(t *testing.T) {
+	f := setupFamilyAccountTest(t)
+	db, parent, children, parentToken := f.db, f.parent, f.children, f.parentToken
+
+	account := f.account(t)
+	assert.Equal(t, models.FamilyAccountRef(f.school.ID, parent.ID), account.AccountRef)
+
+	payment := routes.C2BValidationRequest{
+		TransID: "FAMTX001", TransAmount: 6000, BillRefNumber: account.AccountRef, MSISDN: "254708374149",
+	}
+	w := f.do("POST", "/api/v1/mpesa/c2b/validation", "", payment)
+	var validation map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &validation)
+	assert.Equal(t, float64(0), validation["ResultCode"])
+
+	w = f.do("POST", "/api/v1/mpesa/c2b/confirmation", "", payment)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var payments []models.Payment
+	db.Where("reference = ?", "FAMTX001").Order("id").Find(&payments)
+	assert.Len(t, payments, 2)
+	assert.Equal(t, children[1].ID, payments[0].StudentID)
+	assert.Equal(t, 4000.0, payments[0].Amount)
+	assert.Equal(t, children[0].ID, payments[1].StudentID)
+	assert.Equal(t, 2000.0, payments[1].Amount)
+
+	var tx models.MPESATransaction
+	db.Where("trans_id = ?", "FAMTX001").First(&tx)
+	assert.Equal(t, "MATCHED", tx.Status)
+	assert.Equal(t, account.ID, *tx.FamilyAccountID)
+
+	// Parent gets one combined receipt
+	w = f.do("GET", fmt.Sprintf("/api/v1/family-accounts/%d/receipts/FAMTX001", account.ID), parentToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var receipt struct {
+		Total    float64       `json:"total"`
+		Children []interface{} `json:"children"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &receipt)
+	assert.Equal(t, 6000.0, receipt.Total)
+	assert.Len(t, receipt.Children, 2)
+}
+
+func TestFamilyAccount_FailedSplitWritesNothing(t *testing.T) {
+	f := setupFamilyAccountTest(t)
+	account := f.account(t)
+
+	// The second child's payment fails to save after the first child's has been written
+	f.db.Callback().Create().Before("gorm:create").Register("fail_second_share", func(tx *gorm.DB) {
+		if p, ok := tx.Statement.Dest.(*models.Payment); ok && p.StudentID == f.children[0].ID {
+			tx.AddError(errors.New("disk full"))
+		}
+	})
+
+	payment := routes.C2BValidationRequest{TransID: "FAMTX002", TransAmount: 6000, BillRefNumber: account.AccountRef, MSISDN: "254708374149"}
+	w := f.do("POST", "/api/v1/mpesa/c2b/confirmation", "", payment)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var tx models.MPESATransaction
+	f.db.Where("trans_id = ?", "FAMTX002").First(&tx)
+	assert.Equal(t, "UNMATCHED", tx.Status)
+
+	// Nothing was credited, so matching the transaction by hand doesn't count the money twice
+	var payments, allocations int64
+	f.db.Model(&models.Payment{}).Count(&payments)
+	f.db.Model(&models.PaymentAllocation{}).Count(&allocations)
+	assert.Zero(t, payments)
+	assert.Zero(t, allocations)
+	var balance models.VoteHeadBalance
+	f.db.Where("student_id = ?", f.children[1].ID).First(&balance)
+	assert.Equal(t, 4000.0, balance.Balance)
+}
+
+func TestFamilyAccount_OnePerSchoolForTheSameParent(t *testing.T) {
+	f := setupFamilyAccountTest(t)
+	home := f.account(t)
+
+	// The parent also has a child at a sister school on the same paybill
+	other := models.School{Name: "Sister School"}
+	f.db.Create(&other)
+	bursar := models.User{Email: "bursar@sister.test", Role: "FINANCE", SchoolID: &other.ID}
+	f.db.Create(&bursar)
+	f.db.Create(&models.Membership{UserID: f.parent.ID, SchoolID: other.ID, Role: "PARENT"})
+	u := models.User{Email: "childc@test.com", Role: "STUDENT", SchoolID: &other.ID}
+	f.db.Create(&u)
+	s := models.Student{UserID: u.ID, SchoolID: other.ID, EnrollmentNumber: "SIS001", Status: "ENROLLED"}
+	f.db.Create(&s)
+	f.db.Create(&models.ParentStudent{ParentID: f.parent.ID, StudentID: s.ID, Relation: "MOTHER"})
+
+	w := f.do("POST", "/api/v1/family-accounts", sessionToken(t, bursar), map[string]interface{}{"parent_id": f.parent.ID})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		Account models.FamilyAccount `json:"account"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	assert.Equal(t, models.FamilyAccountRef(other.ID, f.parent.ID), created.Account.AccountRef)
+	assert.NotEqual(t, home.AccountRef, created.Account.AccountRef)
+
+	// A second account in the same school is still refused
+	w = f.do("POST", "/api/v1/family-accounts", f.bursarToken, map[string]interface{}{"parent_id": f.parent.ID})
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
@@ -1,10 +1,10 @@
 package routes
 
 import (
-	"fmt"
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,21 +27,24 @@ func RegisterFinanceRoutes(router *gin.RouterGroup) {
 	finance.Use(middleware.AuthMiddleware())
 	{
 		// Finance, Admin, and Teacher routes
-		adminFinance := finance.Group("")
-		adminFinance.Use(middleware.RoleGuard("SCHOOLADMIN", "TEACHER", "FINANCE"))
-		{
-			adminFinance.POST("/fees", createFeeStructure)
-			adminFinance.GET("/fees", listFeeStructures)
-			adminFinance.POST("/payments", recordPayment)
-			adminFinance.GET("/payments", listPayments)
-			adminFinance.GET("/students/:id/balance", getStudentBalance)
-			adminFinance.GET("/dashboard-stats", getFinanceDashboardStats)
-			adminFinance.GET("/receipts/:id", getReceipt)
-			adminFinance.GET("/receipts/:id/print", getReceiptPrint)
-		}
+		finance.POST("/fees", middleware.RequirePermission("finance.fees.create"), createFeeStructure)
+		finance.GET("/fees", middleware.RequirePermission("finance.fees.view"), listFeeStructures)
+		finance.POST("/payments", middleware.RequirePermission("finance.payments.create"), recordPayment)
+
+		view := middleware.RequirePermission("finance.payments.view")
+		finance.GET("/payments", view, listPayments)
+		finance.GET("/students/:id/balance", view, getStudentBalance)
+		finance.GET("/dashboard-stats", view, getFinanceDashboardStats)
+		finance.GET("/receipts/:id", view, getReceipt)
+		finance.GET("/receipts/:id/print", view, getReceiptPrint)
+		finance.GET("/students/:id/statement", view, getFeeStatement)
+
+		send := middleware.RequirePermission("finance.documents.send")
+		finance.POST("/receipts/:id/email", send, emailReceipt)
+		finance.POST("/students/:id/statement/email", send, emailFeeStatement)
 
 		// Student can view their own balance
-		finance.GET("/my-balance", middleware.RoleGuard("STUDENT"), getMyBalance)
+		finance.GET("/my-balance", middleware.RequirePermission("finance.balance.view_own"), getMyBalance)
 	}
 }
 
@@ -90,6 +93,7 @@ func recordPayment(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record payment"})
 		return
 	}
+	services.PublishPaymentEvent(payment, c.MustGet("userID").(uint))
 
 	c.JSON(http.StatusCreated, payment)
 }
@@ -316,7 +320,7 @@ func getReceipt(c *gin.Context) {
 	models.DB.Where("payment_id = ?", payment.ID).Preload("VoteHead").Find(&allocations)
 
 	c.JSON(http.StatusOK, gin.H{
-		"receipt_number": fmt.Sprintf("RCP-%06d", payment.ID),
+		"receipt_number": services.ReceiptNumber(payment.ID),
 		"payment":        payment,
 		"student": gin.H{
 			"id":     student.ID,
@@ -344,93 +348,63 @@ func getReceiptPrint(c *gin.Context) {
 		return
 	}
 
-	// Get student info
-	var student models.Student
-	models.DB.Where("id = ?", payment.StudentID).Preload("User").First(&student)
+	c.Header("Content-Type", "text/html")
+	c.String(http.StatusOK, services.ReceiptHTML(payment, format))
+}
 
-	// Get school info
-	var school models.School
-	models.DB.Where("id = ?", schoolID).First(&school)
+// emailReceipt - Email a receipt to the given addresses, or the student's guardians
+func emailReceipt(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
 
-	// Get vote head allocations
-	var allocations []models.PaymentAllocation
-	models.DB.Where("payment_id = ?", payment.ID).Preload("VoteHead").Find(&allocations)
+	var input EmailRecipientsInput
+	c.ShouldBindJSON(&input)
 
-	// Build vote head breakdown HTML
-	voteHeadRows := ""
-	for _, alloc := range allocations {
-		voteHeadRows += fmt.Sprintf("<tr><td>%s</td><td style='text-align:right'>KES %.2f</td></tr>",
-			alloc.VoteHead.Name, alloc.Amount)
+	var payment models.Payment
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&payment).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
 	}
 
-	var width, padding string
-	if format == "thermal" {
-		width = "80mm"
-		padding = "5px"
-	} else {
-		width = "210mm"
-		padding = "20px"
-	}
+	respondEmailResult(c, services.EmailReceipt(payment, input.To))
+}
 
-	html := fmt.Sprintf(`
-<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <title>Receipt #RCP-%06d</title>
-    <style>
-        body { font-family: Arial, sans-serif; margin: 0; padding: %s; width: %s; }
-        .header { text-align: center; margin-bottom: 20px; }
-        .header h1 { margin: 0; font-size: 1.5em; }
-        .header p { margin: 5px 0; color: #666; }
-        table { width: 100%%; border-collapse: collapse; margin: 15px 0; }
-        th, td { padding: 8px; border-bottom: 1px solid #ddd; text-align: left; }
-        .total { font-weight: bold; font-size: 1.2em; }
-        .footer { margin-top: 30px; text-align: center; font-size: 0.9em; color: #666; }
-        .signature { margin-top: 50px; border-top: 1px solid #000; width: 200px; text-align: center; }
-        @media print { body { width: auto; } }
-    </style>
-</head>
-<body>
-    <div class="header">
-        <h1>%s</h1>
-        <p>Official Fee Receipt</p>
-    </div>
-    
-    <table>
-        <tr><th>Receipt No:</th><td>RCP-%06d</td></tr>
-        <tr><th>Date:</th><td>%s</td></tr>
-        <tr><th>Student:</th><td>%s (%s)</td></tr>
-        <tr><th>Payment Method:</th><td>%s</td></tr>
-        <tr><th>Reference:</th><td>%s</td></tr>
-    </table>
-
-    <h3>Vote Head Breakdown</h3>
-    <table>
-        <thead><tr><th>Vote Head</th><th style='text-align:right'>Amount</th></tr></thead>
-        <tbody>%s</tbody>
-    </table>
-
-    <table>
-        <tr class="total"><td>TOTAL PAID</td><td style='text-align:right'>KES %.2f</td></tr>
-    </table>
-
-    <div class="footer">
-        <p>Thank you for your payment!</p>
-        <div class="signature">Served By: _____________</div>
-    </div>
-</body>
-</html>`,
-		payment.ID, padding, width,
-		school.Name,
-		payment.ID,
-		payment.CreatedAt.Format("2006-01-02 15:04"),
-		student.User.Email, student.EnrollmentNumber,
-		payment.Method,
-		payment.Reference,
-		voteHeadRows,
-		payment.Amount)
+// getFeeStatement - Printable fee statement for a student
+func getFeeStatement(c *gin.Context) {
+	student, ok := schoolStudent(c)
+	if !ok {
+		return
+	}
 
+	statement, _, err := services.FeeStatementHTML(student)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build statement"})
+		return
+	}
 	c.Header("Content-Type", "text/html")
-	c.String(http.StatusOK, html)
+	c.String(http.StatusOK, statement)
+}
+
+// emailFeeStatement - Email a student's fee statement
+func emailFeeStatement(c *gin.Context) {
+	var input EmailRecipientsInput
+	c.ShouldBindJSON(&input)
+
+	student, ok := schoolStudent(c)
+	if !ok {
+		return
+	}
+	respondEmailResult(c, services.EmailFeeStatement(student, input.To))
+}
+
+// schoolStudent - The :id student, if they belong to the caller's school
+func schoolStudent(c *gin.Context) (models.Student, bool) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var student models.Student
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).
+		Preload("User").Preload("Class").First(&student).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+		return student, false
+	}
+	return student, true
 }
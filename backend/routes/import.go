@@ -6,8 +6,10 @@ import (
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
@@ -15,7 +17,7 @@ import (
 
 func RegisterImportRoutes(router *gin.RouterGroup) {
 	imp := router.Group("/import")
-	imp.Use(middleware.AuthMiddleware(), middleware.RoleGuard("SCHOOLADMIN"))
+	imp.Use(middleware.AuthMiddleware(), middleware.RequirePermission("data.import"))
 	{
 		imp.POST("/students", importStudents)
 		imp.POST("/students/preview", previewStudentImport)
@@ -36,10 +38,21 @@ type ImportRow struct {
 
 // ImportResult - Result of import operation
 type ImportResult struct {
-	TotalRows int         `json:"total_rows"`
-	Imported  int         `json:"imported"`
-	Skipped   int         `json:"skipped"`
-	Errors    []ImportRow `json:"errors"`
+	TotalRows       int             `json:"total_rows"`
+	Imported        int             `json:"imported"`
+	Skipped         int             `json:"skipped"`
+	Errors          []ImportRow     `json:"errors"`
+	GuardianMatches []GuardianMatch `json:"guardian_matches"`
+}
+
+// GuardianMatch - A row whose parent_phone belongs to a parent account that already existed
+// The student isn't linked to them; an admin confirms the match with POST /parent-links
+type GuardianMatch struct {
+	RowNum    int    `json:"row_num"`
+	AdmNo     string `json:"adm_no"`
+	StudentID uint   `json:"student_id"`
+	ParentID  uint   `json:"parent_id"`
+	Phone     string `json:"phone"`
 }
 
 func previewStudentImport(c *gin.Context) {
@@ -101,6 +114,9 @@ func importStudents(c *gin.Context) {
 		classMap[strings.ToLower(cl.Name)] = cl.ID
 	}
 
+	// Parent accounts made by this import, so siblings in the file share one
+	createdParents := make(map[string]uint)
+
 	// Import each valid row
 	for _, row := range validRows {
 		// Check for duplicate admission number
@@ -115,10 +131,11 @@ func importStudents(c *gin.Context) {
 		// Create user
 		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("changeme123"), bcrypt.DefaultCost)
 		user := models.User{
-			Email:        row.Email,
-			PasswordHash: string(hashedPassword),
-			Role:         "STUDENT",
-			SchoolID:     &schoolID,
+			Email:              row.Email,
+			PasswordHash:       string(hashedPassword),
+			Role:               "STUDENT",
+			SchoolID:           &schoolID,
+			MustChangePassword: true,
 		}
 		if err := models.DB.Create(&user).Error; err != nil {
 			row.Error = "Failed to create user: " + err.Error()
@@ -150,6 +167,19 @@ func importStudents(c *gin.Context) {
 			continue
 		}
 
+		// Link the guardian by phone, creating a parent account if needed
+		if row.ParentPhone != "" {
+			matched, err := linkImportedGuardian(schoolID, student.ID, row.ParentPhone, createdParents)
+			if err != nil {
+				row.Error = "Student imported but guardian not linked: " + err.Error()
+				result.Errors = append(result.Errors, row)
+			} else if matched != 0 {
+				result.GuardianMatches = append(result.GuardianMatches, GuardianMatch{
+					RowNum: row.RowNum, AdmNo: row.AdmNo, StudentID: student.ID, ParentID: matched, Phone: row.ParentPhone,
+				})
+			}
+		}
+
 		// Create initial balance if provided
 		if row.CurrentBalance > 0 {
 			// Create a general vote head balance (simplified)
@@ -160,6 +190,7 @@ func importStudents(c *gin.Context) {
 					VoteHeadID: voteHead.ID,
 					SchoolID:   schoolID,
 					Balance:    row.CurrentBalance,
+					ChargedAt:  time.Now(),
 				}
 				models.DB.Create(&balance)
 			}
@@ -171,6 +202,44 @@ func importStudents(c *gin.Context) {
 	c.JSON(http.StatusOK, result)
 }
 
+// linkImportedGuardian - Link the student to a parent account for this phone, creating it if needed
+// Numbers from a CSV are unverified until staff confirm them on the link. A phone that belongs to a
+// parent who existed before this import isn't trusted to link them: their ID is returned instead
+func linkImportedGuardian(schoolID, studentID uint, phone string, created map[string]uint) (uint, error) {
+	parentID, ok := created[phone]
+	if !ok {
+		var existing models.User
+		if models.DB.Where("phone = ? AND role = ? AND school_id = ?", phone, "PARENT", schoolID).First(&existing).Error == nil {
+			return existing.ID, nil
+		}
+
+		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("changeme123"), bcrypt.DefaultCost)
+		parent := models.User{
+			Email:        strings.TrimPrefix(phone, "+") + "@parent.local",
+			PasswordHash: string(hashedPassword),
+			Role:         "PARENT",
+			SchoolID:     &schoolID,
+			Phone:        phone,
+			// Shares the import default password
+			MustChangePassword: true,
+		}
+		if err := models.DB.Create(&parent).Error; err != nil {
+			return 0, err
+		}
+		parentID = parent.ID
+		created[phone] = parentID
+	}
+
+	link := models.ParentStudent{
+		ParentID:  parentID,
+		StudentID: studentID,
+		Relation:  "GUARDIAN",
+		Phone:     phone,
+	}
+	return 0, models.DB.Where(models.ParentStudent{ParentID: parentID, StudentID: studentID}).
+		Attrs(link).FirstOrCreate(&link).Error
+}
+
 func parseCSV(file io.Reader) ([]ImportRow, string) {
 	reader := csv.NewReader(file)
 
@@ -265,6 +334,15 @@ func validateImportRows(rows []ImportRow, schoolID uint) ([]ImportRow, []ImportR
 			errors = append(errors, row)
 			continue
 		}
+		if row.ParentPhone != "" {
+			phone := services.NormalizePhone(row.ParentPhone)
+			if phone == "" {
+				row.Error = "Invalid parent phone"
+				errors = append(errors, row)
+				continue
+			}
+			row.ParentPhone = phone
+		}
 
 		valid = append(valid, row)
 	}
@@ -1,26 +1,83 @@
 package routes
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
+// bulkInviteLimit - Invites one bulk request may create
+const bulkInviteLimit = 500
+
 type CreateInviteInput struct {
-	Role string `json:"role" binding:"required,oneof=TEACHER STUDENT FINANCE PARENT"`
+	Role           string `json:"role" binding:"required,oneof=TEACHER STUDENT FINANCE PARENT"`
+	Email          string `json:"email" binding:"omitempty,email"` // Optional: email the code to this address
+	Phone          string `json:"phone"`                           // Optional: text the code to this number
+	StudentID      *uint  `json:"student_id"`                      // STUDENT: claim this student's account; PARENT: link the new parent to them
+	ParentID       *uint  `json:"parent_id"`                       // PARENT: claim this guardian's account
+	ExpiresInHours int    `json:"expires_in_hours"`                // Defaults to 48
+	MaxUses        int    `json:"max_uses"`                        // Defaults to 1
+}
+
+// InviteRecipient - Someone to send an unlinked invite to
+type InviteRecipient struct {
+	Email string `json:"email" binding:"omitempty,email"`
+	Phone string `json:"phone"`
+}
+
+// BulkInviteInput - One invite per student, per guardian of the students, or per recipient
+type BulkInviteInput struct {
+	Role           string            `json:"role" binding:"required,oneof=TEACHER STUDENT FINANCE PARENT"`
+	StudentIDs     []uint            `json:"student_ids"` // STUDENT: claim each student's account; PARENT: claim each guardian's
+	Recipients     []InviteRecipient `json:"recipients" binding:"dive"`
+	ExpiresInHours int               `json:"expires_in_hours"`
+}
+
+// inviteView - An invite with its status
+type inviteView struct {
+	models.Invite
+	Status string `json:"status"`
+}
+
+// bulkInviteSkip - A student or guardian no invite was made for, and why
+type bulkInviteSkip struct {
+	StudentID uint   `json:"student_id,omitempty"`
+	ParentID  uint   `json:"parent_id,omitempty"`
+	Reason    string `json:"reason"`
 }
 
 func RegisterInviteRoutes(router *gin.RouterGroup) {
 	// SchoolAdmin only
 	invites := router.Group("/invites")
-	invites.Use(middleware.AuthMiddleware(), middleware.RoleGuard("SCHOOLADMIN"))
+	invites.Use(middleware.AuthMiddleware(), middleware.RequirePermission("invites.manage"))
 	{
 		invites.POST("", createInvite)
+		invites.POST("/bulk", createBulkInvites)
 		invites.GET("", listInvites)
+		invites.DELETE("/:id", revokeInvite)
+	}
+}
+
+// inviteTTL - expires_in_hours as a duration; 0 leaves the default
+func inviteTTL(hours int) time.Duration {
+	return time.Duration(hours) * time.Hour
+}
+
+// inviteError - Answer a failed services.CreateInvite
+func inviteError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInviteClaimed):
+		c.JSON(http.StatusConflict, gin.H{"error": "That account has already been claimed"})
+	case errors.Is(err, services.ErrInviteOptions), errors.Is(err, services.ErrInviteLink):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
 	}
 }
 
@@ -38,21 +95,189 @@ func createInvite(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	phone := ""
+	if input.Phone != "" {
+		if phone = services.NormalizePhone(input.Phone); phone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number"})
+			return
+		}
+	}
 
-	invite := models.Invite{
-		Code:      uuid.New(),
-		Role:      input.Role,
-		SchoolID:  schoolID,                       // Scoped to creator's school
-		ExpiresAt: time.Now().Add(48 * time.Hour), // 2 days expiration
-		IsUsed:    false,
+	invite, err := services.CreateInvite(schoolID, services.InviteOptions{
+		Role:        input.Role,
+		StudentID:   input.StudentID,
+		ParentID:    input.ParentID,
+		MaxUses:     input.MaxUses,
+		TTL:         inviteTTL(input.ExpiresInHours),
+		Email:       input.Email,
+		Phone:       phone,
+		CreatedByID: c.MustGet("userID").(uint),
+	})
+	if err != nil {
+		inviteError(c, err)
+		return
 	}
 
-	if err := models.DB.Create(&invite).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
+	if input.Email == "" && phone == "" {
+		c.JSON(http.StatusCreated, invite)
+		return
+	}
+	response := gin.H{"invite": invite}
+	if input.Email != "" {
+		response["email"] = services.SendInviteEmail(invite, input.Email)
+	}
+	if phone != "" {
+		response["sms"] = services.SendInviteSMS(invite, phone)
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// createBulkInvites - Invites for many people at once, e.g. every student just imported or their guardians
+// Each goes to the email and phone on record; texts are queued on the outbox as one job
+func createBulkInvites(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	actorID := c.MustGet("userID").(uint)
+
+	var input BulkInviteInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(input.StudentIDs) > 0 && input.Role != services.RoleStudent && input.Role != services.RoleParent {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "student_ids is for STUDENT and PARENT invites"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, invite)
+	var planned []services.InviteOptions
+	var skipped []bulkInviteSkip
+	if len(input.StudentIDs) > 0 {
+		var students []models.Student
+		models.DB.Preload("User").Where("id IN ? AND school_id = ?", input.StudentIDs, schoolID).Order("id").Find(&students)
+		found := map[uint]bool{}
+		for _, s := range students {
+			found[s.ID] = true
+		}
+		for _, id := range input.StudentIDs {
+			if !found[id] {
+				skipped = append(skipped, bulkInviteSkip{StudentID: id, Reason: "Student not found"})
+			}
+		}
+		if input.Role == services.RoleStudent {
+			for _, s := range students {
+				if !services.Claimable(s.User) {
+					skipped = append(skipped, bulkInviteSkip{StudentID: s.ID, Reason: "Student already has an account"})
+					continue
+				}
+				studentID, phone := s.ID, ""
+				if s.User.PhoneVerified {
+					phone = s.User.Phone
+				}
+				planned = append(planned, services.InviteOptions{StudentID: &studentID, Email: services.InviteEmail(s.User), Phone: phone})
+			}
+		} else {
+			p, s := plannedGuardianInvites(students)
+			planned, skipped = append(planned, p...), append(skipped, s...)
+		}
+	}
+	for _, r := range input.Recipients {
+		phone := ""
+		if r.Phone != "" {
+			if phone = services.NormalizePhone(r.Phone); phone == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number: " + r.Phone})
+				return
+			}
+		}
+		if r.Email == "" && phone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Each recipient needs an email or phone"})
+			return
+		}
+		planned = append(planned, services.InviteOptions{Email: r.Email, Phone: phone})
+	}
+	if len(planned) == 0 && len(skipped) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give student_ids or recipients"})
+		return
+	}
+	if len(planned) > bulkInviteLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d invites at a time", bulkInviteLimit)})
+		return
+	}
+
+	created := make([]models.Invite, 0, len(planned))
+	var texts []services.SMSMessage
+	emailsSent := 0
+	for _, opts := range planned {
+		opts.Role, opts.TTL, opts.CreatedByID = input.Role, inviteTTL(input.ExpiresInHours), actorID
+		invite, err := services.CreateInvite(schoolID, opts)
+		if errors.Is(err, services.ErrInviteOptions) {
+			inviteError(c, err) // Same for every invite, so nothing has been created yet
+			return
+		}
+		if err != nil {
+			skip := bulkInviteSkip{Reason: err.Error()}
+			if opts.StudentID != nil {
+				skip.StudentID = *opts.StudentID
+			}
+			if opts.ParentID != nil {
+				skip.ParentID = *opts.ParentID
+			}
+			skipped = append(skipped, skip)
+			continue
+		}
+		created = append(created, invite)
+		if invite.Email != "" && services.SendInviteEmail(invite, invite.Email).Success {
+			emailsSent++
+		}
+		if invite.Phone != "" {
+			texts = append(texts, services.SMSMessage{To: invite.Phone, Message: services.InviteSMS(invite)})
+		}
+	}
+
+	response := gin.H{"created": len(created), "invites": created, "skipped": skipped, "emails_sent": emailsSent}
+	if len(texts) > 0 {
+		job, err := services.EnqueueMessages(schoolID, actorID, models.MessageJobInvite, texts)
+		if err != nil {
+			response["sms_error"] = err.Error()
+		} else {
+			response["sms_job_id"] = job.ID
+		}
+	}
+	if len(created) > 0 {
+		models.CreateAuditLog(schoolID, actorID, models.AuditInvitesCreated, "Invite", created[0].ID,
+			"", fmt.Sprintf(`{"role":%q,"count":%d}`, input.Role, len(created)), c.ClientIP(), c.Request.UserAgent())
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// plannedGuardianInvites - One invite per guardian of the students, claiming the account made for them on import
+// A guardian linked to several of the students gets one invite
+func plannedGuardianInvites(students []models.Student) ([]services.InviteOptions, []bulkInviteSkip) {
+	var planned []services.InviteOptions
+	var skipped []bulkInviteSkip
+	seen := map[uint]bool{}
+	for _, s := range students {
+		var links []models.ParentStudent
+		models.DB.Preload("Parent").Where("student_id = ?", s.ID).Order("id").Find(&links)
+		if len(links) == 0 {
+			skipped = append(skipped, bulkInviteSkip{StudentID: s.ID, Reason: "No guardian on record"})
+		}
+		for _, link := range links {
+			if seen[link.ParentID] {
+				continue
+			}
+			seen[link.ParentID] = true
+			if !services.Claimable(link.Parent) {
+				skipped = append(skipped, bulkInviteSkip{StudentID: s.ID, ParentID: link.ParentID, Reason: "Guardian already has an account"})
+				continue
+			}
+			phone := services.GuardianPhone(link)
+			if phone == "" && link.Parent.PhoneVerified {
+				phone = link.Parent.Phone
+			}
+			parentID := link.ParentID
+			planned = append(planned, services.InviteOptions{ParentID: &parentID, Email: services.InviteEmail(link.Parent), Phone: phone})
+		}
+	}
+	return planned, skipped
 }
 
 func listInvites(c *gin.Context) {
@@ -65,7 +290,34 @@ func listInvites(c *gin.Context) {
 
 	var invites []models.Invite
 	// Tenant isolation mandatory
-	models.DB.Where("school_id = ?", schoolID).Find(&invites)
+	models.DB.Where("school_id = ?", schoolID).Order("id DESC").Find(&invites)
 
-	c.JSON(http.StatusOK, invites)
+	status := c.Query("status") // active, used, expired or revoked
+	out := make([]inviteView, 0, len(invites))
+	for _, invite := range invites {
+		view := inviteView{Invite: invite, Status: services.InviteStatus(invite)}
+		if status == "" || status == view.Status {
+			out = append(out, view)
+		}
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// revokeInvite - Stop an unused code working, e.g. one sent to the wrong number
+func revokeInvite(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	var invite models.Invite
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&invite).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	}
+	if invite.IsUsed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invite has already been used"})
+		return
+	}
+	if services.RevokeInvite(invite.ID) {
+		models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditInviteRevoked, "Invite", invite.ID,
+			invite.Code.String(), "", c.ClientIP(), c.Request.UserAgent())
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invite revoked"})
 }
@@ -0,0 +1,148 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupInviteTest(t *testing.T) *emailFixture {
+	f := setupEmailTest(t)
+	routes.RegisterAuthRoutes(f.router.Group("/api/v1"))
+	return f
+}
+
+func (f *emailFixture) invite(t *testing.T, body map[string]interface{}) models.Invite {
+	w := f.do("POST", "/api/v1/invites", f.admin, body)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var invite models.Invite
+	json.Unmarshal(w.Body.Bytes(), &invite)
+	return invite
+}
+
+func (f *emailFixture) signup(code, email string) (int, string) {
+	w := f.do("POST", "/api/v1/auth/signup", "", map[string]string{"invite_code": code, "email": email, "password": "password123"})
+	return w.Code, w.Body.String()
+}
+
+func TestInvites_BulkGuardianInvitesClaimImportedAccounts(t *testing.T) {
+	f := setupInviteTest(t)
+	var placeholder models.User
+	f.db.Where("email = ?", "254700000000@parent.local").First(&placeholder)
+	f.db.Model(&models.ParentStudent{}).Where("parent_id = ?", placeholder.ID).
+		Updates(map[string]interface{}{"phone": "+254700000000", "phone_verified": true})
+
+	w := f.do("POST", "/api/v1/invites/bulk", f.admin, map[string]interface{}{
+		"role": "PARENT", "student_ids": []uint{f.student.ID, 9999}, "expires_in_hours": 168,
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var bulk struct {
+		Created    int                      `json:"created"`
+		Invites    []models.Invite          `json:"invites"`
+		Skipped    []map[string]interface{} `json:"skipped"`
+		EmailsSent int                      `json:"emails_sent"`
+		SMSJobID   uint                     `json:"sms_job_id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &bulk)
+	assert.Equal(t, 2, bulk.Created)
+	assert.Equal(t, 1, bulk.EmailsSent) // The placeholder address isn't emailed
+	assert.Len(t, bulk.Skipped, 1)
+	assert.NotZero(t, bulk.SMSJobID)
+	assert.WithinDuration(t, time.Now().Add(168*time.Hour), bulk.Invites[0].ExpiresAt, time.Minute)
+
+	services.ProcessOutbox(10)
+	sent := f.provider.Sent()
+	require.Len(t, sent, 1)
+	assert.Equal(t, "+254700000000", sent[0].To)
+	var code string
+	for _, inv := range bulk.Invites {
+		if inv.ParentID != nil && *inv.ParentID == placeholder.ID {
+			code = inv.Code.String()
+		}
+	}
+	assert.Contains(t, sent[0].Message, "/register?code="+code)
+
+	// Signup takes over the guardian's account and keeps the link to the child
+	status, body := f.signup(code, "wanjiru@example.com")
+	require.Equal(t, http.StatusCreated, status, body)
+	assert.Contains(t, body, `"claimed":true`)
+	var claimed models.User
+	f.db.First(&claimed, placeholder.ID)
+	assert.Equal(t, "wanjiru@example.com", claimed.Email)
+	var parents int64
+	f.db.Model(&models.User{}).Where("role = ?", "PARENT").Count(&parents)
+	assert.Equal(t, int64(2), parents)
+	var links int64
+	f.db.Model(&models.ParentStudent{}).Where("parent_id = ? AND student_id = ?", placeholder.ID, f.student.ID).Count(&links)
+	assert.Equal(t, int64(1), links)
+	var audits int64
+	f.db.Model(&models.AuditLog{}).Where("action = ?", models.AuditInviteClaimed).Count(&audits)
+	assert.Equal(t, int64(1), audits)
+
+	// Guardians who have signed in aren't invited again
+	f.db.Model(&claimed).Update("last_login_at", time.Now())
+	w = f.do("POST", "/api/v1/invites/bulk", f.admin, map[string]interface{}{"role": "PARENT", "student_ids": []uint{f.student.ID}})
+	assert.Contains(t, w.Body.String(), "Guardian already has an account")
+	assert.Contains(t, w.Body.String(), `"created":1`)
+}
+
+func TestInvites_LinkedMultiUseAndRevoked(t *testing.T) {
+	f := setupInviteTest(t)
+
+	// A student invite claims the student's account; a resend stops working once it is claimed
+	first := f.invite(t, map[string]interface{}{"role": "STUDENT", "student_id": f.student.ID})
+	resend := f.invite(t, map[string]interface{}{"role": "STUDENT", "student_id": f.student.ID})
+	status, body := f.signup(first.Code.String(), "amani@test.com")
+	require.Equal(t, http.StatusCreated, status, body)
+	var students int64
+	f.db.Model(&models.Student{}).Count(&students)
+	assert.Equal(t, int64(1), students)
+	status, body = f.signup(resend.Code.String(), "someone@test.com")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "revoked")
+
+	// Linked invites are single-use, and limits are checked
+	for _, bad := range []map[string]interface{}{
+		{"role": "STUDENT", "student_id": f.student.ID, "max_uses": 2},
+		{"role": "TEACHER", "expires_in_hours": 1000},
+		{"role": "TEACHER", "max_uses": 501},
+		{"role": "TEACHER", "student_id": f.student.ID},
+	} {
+		assert.Equal(t, http.StatusBadRequest, f.do("POST", "/api/v1/invites", f.admin, bad).Code, bad)
+	}
+
+	// A shared code works until its cap
+	shared := f.invite(t, map[string]interface{}{"role": "TEACHER", "max_uses": 2})
+	for i := 1; i <= 3; i++ {
+		status, body = f.signup(shared.Code.String(), fmt.Sprintf("mwalimu%d@test.com", i))
+		if i <= 2 {
+			assert.Equal(t, http.StatusCreated, status, body)
+		} else {
+			assert.Equal(t, http.StatusBadRequest, status)
+		}
+	}
+
+	revoked := f.invite(t, map[string]interface{}{"role": "FINANCE"})
+	assert.Equal(t, http.StatusOK, f.do("DELETE", fmt.Sprintf("/api/v1/invites/%d", revoked.ID), f.admin, nil).Code)
+	status, _ = f.signup(revoked.Code.String(), "bursar@test.com")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	w := f.do("GET", "/api/v1/invites?status=revoked", f.admin, nil)
+	var list []struct {
+		ID     uint   `json:"id"`
+		Status string `json:"status"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Len(t, list, 2) // The resend and the FINANCE invite
+	w = f.do("GET", "/api/v1/invites?status=used", f.admin, nil)
+	json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Len(t, list, 2)
+}
@@ -0,0 +1,213 @@
+package routes_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loginFrom - A login attempt from a given client IP
+func (f *sessionFixture) loginFrom(ip, email, password string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+// waitOutDelay - Move the user's last failure into the past instead of sleeping through the delay
+func (f *sessionFixture) waitOutDelay(userID uint) {
+	f.db.Model(&models.User{}).Where("id = ?", userID).Update("last_failed_login_at", time.Now().Add(-time.Hour))
+}
+
+func (f *sessionFixture) auditCount(action string) int64 {
+	var count int64
+	f.db.Model(&models.AuditLog{}).Where("action = ?", action).Count(&count)
+	return count
+}
+
+func TestLoginGuard_ProgressiveDelayThenLockout(t *testing.T) {
+	f := setupResetTest(t)
+	email := f.user.Email
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, f.loginFrom("10.0.0.1", email, "wrong").Code)
+	}
+
+	// From the fourth try the account has to wait, whatever the password
+	w := f.loginFrom("10.0.0.1", email, "password123")
+	require.Equal(t, http.StatusTooManyRequests, w.Code, w.Body.String())
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.NotContains(t, w.Body.String(), "ACCOUNT_LOCKED")
+
+	for i := 4; i < 10; i++ {
+		f.waitOutDelay(f.user.ID)
+		assert.Equal(t, http.StatusUnauthorized, f.loginFrom("10.0.0.1", email, "wrong").Code, "attempt %d", i)
+	}
+	f.waitOutDelay(f.user.ID)
+	w = f.loginFrom("10.0.0.1", email, "wrong")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "ACCOUNT_LOCKED")
+	retry, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.InDelta(t, 900, retry, 5)
+
+	// Locked: the right password doesn't help until it runs out
+	w = f.loginFrom("10.0.0.1", email, "password123")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "ACCOUNT_LOCKED")
+
+	// The notice is queued rather than sent inside the failed sign-in
+	assert.Empty(t, f.catcher.Messages())
+	services.ProcessOutbox(10)
+	caught := f.catcher.Messages()
+	require.Len(t, caught, 1)
+	assert.Equal(t, []string{email}, caught[0].To)
+	assert.Contains(t, caught[0].Subject, "locked")
+	assert.Contains(t, caught[0].Text, "10 failed sign-in attempts, the last from 10.0.0.1")
+	assert.Equal(t, int64(10), f.auditCount(models.AuditLoginFailed))
+	assert.Equal(t, int64(1), f.auditCount(models.AuditAccountLocked))
+
+	admin := f.login(t, f.admin.Email, "password123")
+	w = f.do("POST", fmt.Sprintf("/api/v1/users/%d/unlock", f.user.ID), admin.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, int64(1), f.auditCount(models.AuditAccountUnlocked))
+	f.login(t, email, "password123")
+}
+
+func TestLoginGuard_SuccessClearsFailures(t *testing.T) {
+	f := setupSessionTest(t)
+
+	for i := 0; i < 2; i++ {
+		f.loginFrom("10.0.0.1", f.user.Email, "wrong")
+	}
+	f.login(t, f.user.Email, "password123")
+	var user models.User
+	f.db.First(&user, f.user.ID)
+	assert.Zero(t, user.FailedLogins)
+	assert.Nil(t, user.LastFailedLoginAt)
+
+	// So the next few mistakes are free again
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, f.loginFrom("10.0.0.1", f.user.Email, "wrong").Code)
+	}
+}
+
+func TestLoginGuard_BlocksNoisyIPAddress(t *testing.T) {
+	f := setupSessionTest(t)
+
+	// Spraying made-up accounts never reaches bcrypt but still counts against the IP
+	for i := 0; i < 50; i++ {
+		w := f.loginFrom("10.0.0.9", fmt.Sprintf("guess%d@session.test", i), "password123")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w := f.loginFrom("10.0.0.9", f.user.Email, "password123")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retry, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.InDelta(t, 900, retry, 5)
+	assert.Equal(t, int64(1), f.auditCount(models.AuditLoginIPBlocked))
+
+	// Other addresses are unaffected
+	assert.Equal(t, http.StatusOK, f.loginFrom("10.0.0.10", f.user.Email, "password123").Code)
+}
+
+func TestLoginGuard_WrongTwoFactorCodesLockToo(t *testing.T) {
+	f := setupTwoFactorTest(t)
+	pair := f.login(t, f.user.Email, "password123")
+	f.enrol(t, pair.AccessToken)
+
+	step := f.startLogin(t, f.user.Email)
+	f.db.Model(&models.User{}).Where("id = ?", f.user.ID).Update("failed_logins", 9)
+	w := f.do("POST", "/api/v1/auth/2fa/verify", step.PreAuthToken, map[string]string{"code": "000000"})
+	require.Equal(t, http.StatusTooManyRequests, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "ACCOUNT_LOCKED")
+
+	// Neither the password step nor the code step works while locked
+	w = f.loginFrom("10.0.0.1", f.user.Email, "password123")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	w = f.do("POST", "/api/v1/auth/2fa/verify", step.PreAuthToken, map[string]string{"code": "000000"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestLoginGuard_BlockedIPCantTryTwoFactorCodes(t *testing.T) {
+	f := setupTwoFactorTest(t)
+	pair := f.login(t, f.user.Email, "password123")
+	f.enrol(t, pair.AccessToken)
+	step := f.startLogin(t, f.user.Email)
+
+	// The pre-auth token is tried from an address that has already failed too often
+	for i := 0; i < 50; i++ {
+		f.db.Create(&models.LoginFailure{Email: fmt.Sprintf("guess%d@session.test", i), IPAddress: "10.0.0.9"})
+	}
+	body, _ := json.Marshal(map[string]string{"code": "000000"})
+	req, _ := http.NewRequest("POST", "/api/v1/auth/2fa/verify", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+step.PreAuthToken)
+	req.RemoteAddr = "10.0.0.9:40000"
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// Refused before the code was checked
+	var user models.User
+	f.db.First(&user, f.user.ID)
+	assert.Zero(t, user.FailedLogins)
+}
+
+func TestLoginGuard_PasswordResetLiftsLockout(t *testing.T) {
+	f := setupResetTest(t)
+	f.db.Model(&models.User{}).Where("id = ?", f.user.ID).Update("locked_until", time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusTooManyRequests, f.loginFrom("10.0.0.1", f.user.Email, "password123").Code)
+
+	f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"email": f.user.Email})
+	w := f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{
+		"email": f.user.Email, "code": f.emailedCode(t), "new_password": "brandnew1",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	f.login(t, f.user.Email, "brandnew1")
+}
+
+func TestLoginGuard_LockoutTextIsNotCharged(t *testing.T) {
+	f := setupResetTest(t)
+	f.db.Create(&models.SMSWallet{SchoolID: f.school.ID, BillingMode: models.SMSBillingPrepaid})
+	superadmin := models.User{Email: "254712000222@admin.local", PasswordHash: f.user.PasswordHash, Role: "SUPERADMIN",
+		Phone: "+254712000222", PhoneVerified: true}
+	f.db.Create(&superadmin)
+
+	// A school with no credit left, and a superadmin with no school, still hear about the lock
+	for _, email := range []string{f.parent.Email, superadmin.Email} {
+		var user models.User
+		f.db.Where("email = ?", email).First(&user)
+		for i := 0; i < 10; i++ {
+			f.waitOutDelay(user.ID)
+			f.loginFrom("10.0.0.1", email, "wrong")
+		}
+		f.db.First(&user, user.ID)
+		require.NotNil(t, user.LockedUntil, email)
+	}
+
+	services.ProcessOutbox(10)
+	sent := f.provider.Sent()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "+254712000111", sent[0].To)
+	assert.Equal(t, "+254712000222", sent[1].To)
+	assert.Contains(t, sent[0].Message, "locked")
+
+	var wallet models.SMSWallet
+	f.db.Where("school_id = ?", f.school.ID).First(&wallet)
+	assert.Zero(t, wallet.Balance)
+	var charges int64
+	f.db.Model(&models.SMSCreditTransaction{}).Count(&charges)
+	assert.Zero(t, charges)
+}
@@ -0,0 +1,194 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"schoolms-go/middleware"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"schoolms-go/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AddMembershipInput - An existing account to give a role in the current school
+type AddMembershipInput struct {
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role" binding:"required"`
+}
+
+// SwitchMembershipInput - The school and role to act as; school_id is null only for platform admins
+type SwitchMembershipInput struct {
+	SchoolID *uint  `json:"school_id"`
+	Role     string `json:"role" binding:"required"`
+}
+
+func RegisterMembershipRoutes(router *gin.RouterGroup) {
+	memberships := router.Group("/memberships")
+	memberships.Use(middleware.AuthMiddleware(), middleware.RequirePermission("users.manage"))
+	{
+		memberships.GET("", listMemberships)
+		memberships.POST("", addMembership)
+		memberships.DELETE("/:id", removeMembership)
+	}
+}
+
+// currentMembership - The school and role the request was made as
+func currentMembership(c *gin.Context) services.ActiveMembership {
+	active := services.ActiveMembership{Role: c.MustGet("role").(string)}
+	if schoolID, ok := c.Get("schoolID"); ok {
+		id := schoolID.(uint)
+		active.SchoolID = &id
+	}
+	return active
+}
+
+// myMemberships - Every school and role the signed-in user can switch to
+func myMemberships(c *gin.Context) {
+	var user models.User
+	if err := models.DB.First(&user, c.MustGet("userID").(uint)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"memberships": services.UserMemberships(user), "active": currentMembership(c)})
+}
+
+// switchMembership - Swap the access token for one acting as another of the user's schools or roles
+func switchMembership(c *gin.Context) {
+	sessionID := c.MustGet("sessionID").(uint)
+	if sessionID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sign in again to switch school or role"})
+		return
+	}
+	var input SwitchMembershipInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var user models.User
+	if err := models.DB.First(&user, c.MustGet("userID").(uint)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	token, active, err := services.SwitchMembership(user, sessionID, input.SchoolID, input.Role)
+	if errors.Is(err, services.ErrMembershipNotFound) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have that role in that school"})
+		return
+	}
+	if errors.Is(err, services.ErrMembershipTwoFactor) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "This school requires two-factor sign-in for that role; turn it on first",
+			"code":  "TWO_FACTOR_SETUP_REQUIRED",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(utils.AccessTokenTTL.Seconds()),
+		"active":       active,
+		"permissions":  append([]string{}, services.UserPermissions(user.ID, active.ID, active.Role)...),
+	})
+}
+
+// listMemberships - People from other accounts who hold a role in this school
+func listMemberships(c *gin.Context) {
+	schoolID, ok := c.Get("schoolID")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Memberships are managed from within a school"})
+		return
+	}
+
+	type row struct {
+		ID        uint      `json:"id"`
+		UserID    uint      `json:"user_id"`
+		Email     string    `json:"email"`
+		FullName  string    `json:"full_name"`
+		Role      string    `json:"role"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	rows := []row{}
+	models.DB.Table("memberships").
+		Select("memberships.id, memberships.user_id, users.email, users.full_name, memberships.role, memberships.created_at").
+		Joins("JOIN users ON users.id = memberships.user_id").
+		Where("memberships.school_id = ?", schoolID).
+		Order("users.email, memberships.role").Scan(&rows)
+	c.JSON(http.StatusOK, rows)
+}
+
+// addMembership - Give an existing account a role here, e.g. a teacher who is also a parent, or a sister school's bursar
+func addMembership(c *gin.Context) {
+	actorID := c.MustGet("userID").(uint)
+	schoolID, ok := c.Get("schoolID")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Memberships are managed from within a school"})
+		return
+	}
+	var input AddMembershipInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := models.DB.Where("email = ?", input.Email).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No account with this email; send an invite instead"})
+		return
+	}
+	if user.ID == actorID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+	if missing := permissionsNotHeld(c, services.DefaultPermissions(input.Role)); len(missing) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't grant permissions you don't have", "permissions": missing})
+		return
+	}
+
+	membership, err := services.AddMembership(user, schoolID.(uint), input.Role, actorID)
+	switch {
+	case errors.Is(err, services.ErrMembershipRole):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be one of SCHOOLADMIN, TEACHER, FINANCE or PARENT"})
+		return
+	case errors.Is(err, services.ErrMembershipExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "User already has this role in this school"})
+		return
+	}
+	models.CreateAuditLog(membership.SchoolID, actorID, models.AuditMembershipAdded, "User", user.ID,
+		"", membership.Role, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusCreated, membership)
+}
+
+// removeMembership - Take a role in this school away from another account; its tokens stop working straight away
+func removeMembership(c *gin.Context) {
+	actorID := c.MustGet("userID").(uint)
+	schoolID, ok := c.Get("schoolID")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Memberships are managed from within a school"})
+		return
+	}
+
+	var membership models.Membership
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&membership).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Membership not found"})
+		return
+	}
+	if membership.UserID == actorID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+	if missing := permissionsNotHeld(c, services.DefaultPermissions(membership.Role)); len(missing) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't change the role of someone with permissions you don't have"})
+		return
+	}
+
+	models.DB.Delete(&membership)
+	models.CreateAuditLog(membership.SchoolID, actorID, models.AuditMembershipRemoved, "User", membership.UserID,
+		membership.Role, "", c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Membership removed"})
+}
@@ -0,0 +1,164 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type membershipLogin struct {
+	tokenPair
+	Memberships []struct {
+		SchoolID   *uint    `json:"school_id"`
+		SchoolName string   `json:"school_name"`
+		Roles      []string `json:"roles"`
+	} `json:"memberships"`
+	Active struct {
+		SchoolID *uint  `json:"school_id"`
+		Role     string `json:"role"`
+	} `json:"active"`
+}
+
+func setupMembershipTest(t *testing.T) *sessionFixture {
+	f := setupSessionTest(t)
+	routes.RegisterMembershipRoutes(f.router.Group("/api/v1"))
+	return f
+}
+
+func (f *sessionFixture) membershipLogin(t *testing.T, email string) membershipLogin {
+	w := f.do("POST", "/api/v1/auth/login", "", map[string]string{"email": email, "password": "password123"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var out membershipLogin
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return out
+}
+
+// switchTo - The access token for acting as the school and role
+func (f *sessionFixture) switchTo(t *testing.T, token string, schoolID uint, role string) string {
+	w := f.do("POST", "/api/v1/auth/switch", token, map[string]interface{}{"school_id": schoolID, "role": role})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var out tokenPair
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return out.AccessToken
+}
+
+func (f *sessionFixture) role(t *testing.T, token string) string {
+	w := f.do("GET", "/api/v1/auth/permissions", token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var out struct {
+		Role string `json:"role"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return out.Role
+}
+
+func TestMemberships_TeacherWhoIsAlsoAParent(t *testing.T) {
+	f := setupMembershipTest(t)
+	admin := f.login(t, f.admin.Email, "password123")
+
+	w := f.do("POST", "/api/v1/memberships", admin.AccessToken, map[string]string{"email": f.user.Email, "role": "parent"})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var membership models.Membership
+	json.Unmarshal(w.Body.Bytes(), &membership)
+	for role, code := range map[string]int{"PARENT": http.StatusConflict, "TEACHER": http.StatusConflict, "STUDENT": http.StatusBadRequest} {
+		w = f.do("POST", "/api/v1/memberships", admin.AccessToken, map[string]string{"email": f.user.Email, "role": role})
+		assert.Equal(t, code, w.Code, role)
+	}
+
+	// One account, both roles; it signs in as the home role
+	login := f.membershipLogin(t, f.user.Email)
+	require.Len(t, login.Memberships, 1)
+	assert.Equal(t, "Session School", login.Memberships[0].SchoolName)
+	assert.Equal(t, []string{"TEACHER", "PARENT"}, login.Memberships[0].Roles)
+	assert.Equal(t, "TEACHER", login.Active.Role)
+
+	parent := f.switchTo(t, login.AccessToken, f.school.ID, "PARENT")
+	assert.Equal(t, "PARENT", f.role(t, parent))
+	assert.Contains(t, f.permissions(t, parent), "parents.view_own")
+	assert.NotContains(t, f.permissions(t, parent), "grades.create")
+	w = f.do("POST", "/api/v1/auth/switch", login.AccessToken, map[string]interface{}{"school_id": f.school.ID, "role": "FINANCE"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// The session remembers the switch when refreshing
+	w, pair := f.refresh(login.RefreshToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "PARENT", f.role(t, pair.AccessToken))
+
+	// Removing the membership cuts its tokens off, and the session falls back to the home role
+	w = f.do("DELETE", fmt.Sprintf("/api/v1/memberships/%d", membership.ID), admin.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = f.do("GET", "/api/v1/auth/permissions", pair.AccessToken, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "Membership has been removed")
+	w, pair = f.refresh(pair.RefreshToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "TEACHER", f.role(t, pair.AccessToken))
+
+	assert.Equal(t, int64(1), f.auditCount(models.AuditMembershipAdded))
+	assert.Equal(t, int64(1), f.auditCount(models.AuditMembershipRemoved))
+}
+
+func TestMemberships_BursarServingTwoSchools(t *testing.T) {
+	f := setupMembershipTest(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	bursar := models.User{Email: "bursar@session.test", PasswordHash: string(hash), Role: "FINANCE", SchoolID: &f.school.ID}
+	f.db.Create(&bursar)
+	sister := models.School{Name: "Sister School"}
+	f.db.Create(&sister)
+	sisterAdmin := models.User{Email: "admin@sister.test", PasswordHash: string(hash), Role: "SCHOOLADMIN", SchoolID: &sister.ID}
+	f.db.Create(&sisterAdmin)
+
+	// The sister school's admin adds the existing account; a teacher there can't
+	admin := f.login(t, sisterAdmin.Email, "password123")
+	w := f.do("POST", "/api/v1/memberships", admin.AccessToken, map[string]string{"email": bursar.Email, "role": "FINANCE"})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = f.do("POST", "/api/v1/memberships", admin.AccessToken, map[string]string{"email": "nobody@session.test", "role": "FINANCE"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	teacher := f.login(t, f.user.Email, "password123")
+	w = f.do("POST", "/api/v1/memberships", teacher.AccessToken, map[string]string{"email": bursar.Email, "role": "FINANCE"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = f.do("GET", "/api/v1/memberships", admin.AccessToken, nil)
+	assert.Contains(t, w.Body.String(), bursar.Email)
+	w = f.do("GET", "/api/v1/memberships", f.login(t, f.admin.Email, "password123").AccessToken, nil)
+	assert.Equal(t, "[]", w.Body.String(), "the home school lists no extra memberships")
+
+	login := f.membershipLogin(t, bursar.Email)
+	require.Len(t, login.Memberships, 2)
+	assert.Equal(t, "Sister School", login.Memberships[1].SchoolName)
+	assert.Equal(t, f.school.ID, *login.Active.SchoolID)
+
+	token := f.switchTo(t, login.AccessToken, sister.ID, "FINANCE")
+	w = f.do("GET", "/api/v1/auth/memberships", token, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`"active":{"school_id":%d,"role":"FINANCE"}`, sister.ID))
+	f.switchTo(t, token, f.school.ID, "FINANCE")
+}
+
+func TestMemberships_SwitchFollowsTargetSchoolsTwoFactorPolicy(t *testing.T) {
+	f := setupMembershipTest(t)
+	sister := models.School{Name: "Sister School", TwoFactorRoles: "SCHOOLADMIN,FINANCE"}
+	f.db.Create(&sister)
+	f.db.Create(&models.Membership{UserID: f.user.ID, SchoolID: sister.ID, Role: "FINANCE"})
+	f.db.Create(&models.Membership{UserID: f.user.ID, SchoolID: f.school.ID, Role: "PARENT"})
+
+	// The teacher signs in without a code, so can't switch into a role that needs one
+	login := f.membershipLogin(t, f.user.Email)
+	w := f.do("POST", "/api/v1/auth/switch", login.AccessToken, map[string]interface{}{"school_id": sister.ID, "role": "FINANCE"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "TWO_FACTOR_SETUP_REQUIRED")
+
+	// A switch made before the school's policy changed falls back to the home role on refresh
+	f.switchTo(t, login.AccessToken, f.school.ID, "PARENT")
+	f.db.Model(&models.School{}).Where("id = ?", f.school.ID).Update("two_factor_roles", "PARENT")
+	w, pair := f.refresh(login.RefreshToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "TEACHER", f.role(t, pair.AccessToken))
+}
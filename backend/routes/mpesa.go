@@ -1,12 +1,9 @@
 package routes
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
+	"schoolms-go/daraja"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
 	"schoolms-go/services"
@@ -16,34 +13,23 @@ import (
 )
 
 // MPESA Configuration - loaded from environment
-type MPESAConfig struct {
-	ConsumerKey    string
-	ConsumerSecret string
-	Shortcode      string
-	Passkey        string
-	CallbackURL    string
-	Environment    string // "sandbox" or "production"
-}
+type MPESAConfig = daraja.Config
 
 var mpesaConfig MPESAConfig
 
 func init() {
 	// Load from env - these should be set in production
-	mpesaConfig = MPESAConfig{
-		ConsumerKey:    getEnv("MPESA_CONSUMER_KEY", ""),
-		ConsumerSecret: getEnv("MPESA_CONSUMER_SECRET", ""),
-		Shortcode:      getEnv("MPESA_SHORTCODE", "174379"), // Sandbox default
-		Passkey:        getEnv("MPESA_PASSKEY", ""),
-		CallbackURL:    getEnv("MPESA_CALLBACK_URL", ""),
-		Environment:    getEnv("MPESA_ENV", "sandbox"),
-	}
+	mpesaConfig = daraja.ConfigFromEnv()
 }
 
-func getEnv(key, defaultVal string) string {
-	if val := os.Getenv(key); val != "" {
-		return val
-	}
-	return defaultVal
+// SetMPESAConfig - Replace the M-PESA configuration (tests and local stand-ins)
+func SetMPESAConfig(cfg MPESAConfig) {
+	mpesaConfig = cfg
+}
+
+// mpesaClient - Daraja client for the current configuration
+func mpesaClient() *daraja.Client {
+	return daraja.NewClient(mpesaConfig)
 }
 
 func RegisterMpesaRoutes(router *gin.RouterGroup) {
@@ -52,11 +38,30 @@ func RegisterMpesaRoutes(router *gin.RouterGroup) {
 		// C2B Webhooks - these are called by Safaricom, no auth required
 		mpesa.POST("/c2b/validation", c2bValidation)
 		mpesa.POST("/c2b/confirmation", c2bConfirmation)
+		mpesa.POST("/b2c/result", b2cResult)
+		mpesa.POST("/b2c/timeout", b2cTimeout)
+		mpesa.POST("/query/result", mpesaQueryResult)
+		mpesa.POST("/query/timeout", mpesaQueryTimeout)
 
 		// Internal endpoints - require auth
 		mpesa.Use(middleware.AuthMiddleware())
-		mpesa.GET("/transactions", middleware.RoleGuard("SCHOOLADMIN", "FINANCE"), listMpesaTransactions)
-		mpesa.POST("/transactions/:id/match", middleware.RoleGuard("SCHOOLADMIN", "FINANCE"), manualMatchTransaction)
+		mpesa.GET("/transactions", middleware.RequirePermission("finance.mpesa.view"), listMpesaTransactions)
+		mpesa.POST("/transactions/:id/match", middleware.RequirePermission("finance.mpesa.match"), manualMatchTransaction)
+
+		// B2C refunds - requested by one user, approved by another
+		mpesa.POST("/refunds", middleware.RequirePermission("finance.refunds.request"), requestRefund)
+		mpesa.GET("/refunds", middleware.RequirePermission("finance.refunds.view"), listRefunds)
+		mpesa.POST("/refunds/:id/approve", middleware.RequirePermission("finance.refunds.approve"), approveRefund)
+		mpesa.POST("/refunds/:id/reject", middleware.RequirePermission("finance.refunds.approve"), rejectRefund)
+
+		// Daraja tooling
+		mpesa.POST("/admin/transaction-status", middleware.RequirePermission("finance.mpesa.query"), queryTransactionStatus)
+		mpesa.GET("/admin/queries", middleware.RequirePermission("finance.mpesa.view"), listMpesaQueries)
+
+		// The paybill is shared by every school, so its balance and callback URLs are the platform's
+		mpesa.POST("/admin/account-balance", middleware.RequirePermission("platform.mpesa.manage"), queryAccountBalance)
+		mpesa.POST("/admin/register-urls", middleware.RequirePermission("platform.mpesa.manage"), registerC2BURLs)
+		mpesa.GET("/admin/platform-queries", middleware.RequirePermission("platform.mpesa.manage"), listPlatformMpesaQueries)
 	}
 }
 
@@ -95,6 +100,10 @@ func c2bValidation(c *gin.Context) {
 	var student models.Student
 	err := models.DB.Where("enrollment_number = ?", req.BillRefNumber).First(&student).Error
 
+	if err != nil && findFamilyAccount(req.BillRefNumber) != nil {
+		err = nil // Family account reference covering several siblings
+	}
+
 	if err != nil {
 		// Student not found - reject transaction
 		c.JSON(http.StatusOK, gin.H{
@@ -160,6 +169,11 @@ func c2bConfirmation(c *gin.Context) {
 	}
 
 	if err != nil {
+		if account := findFamilyAccount(req.BillRefNumber); account != nil {
+			confirmFamilyPayment(c, account, &mpesaTx)
+			return
+		}
+
 		// Student not found - log for manual matching
 		mpesaTx.Status = "UNMATCHED"
 		mpesaTx.ErrorMessage = "Student not found by admission number"
@@ -207,8 +221,8 @@ func c2bConfirmation(c *gin.Context) {
 	mpesaTx.MatchedStudentID = &student.ID
 	models.DB.Create(&mpesaTx)
 
-	// TODO: Send SMS confirmation
-	// sendSMSConfirmation(req.MSISDN, student.Name, req.TransAmount)
+	// Guardians get their confirmation SMS from the event workers
+	services.PublishPaymentEvent(payment, 0)
 
 	c.JSON(http.StatusOK, gin.H{
 		"ResultCode": 0,
@@ -268,6 +282,7 @@ func manualMatchTransaction(c *gin.Context) {
 
 	// Allocate
 	services.AllocatePaymentToVoteHeads(&payment, input.StudentID, schoolID)
+	services.PublishPaymentEvent(payment, c.MustGet("userID").(uint))
 
 	// Update transaction
 	tx.Status = "MATCHED"
@@ -277,35 +292,3 @@ func manualMatchTransaction(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Transaction matched and payment created"})
 }
-
-// --- Utility: Get OAuth Token ---
-func getMPESAAccessToken() (string, error) {
-	baseURL := "https://sandbox.safaricom.co.ke"
-	if mpesaConfig.Environment == "production" {
-		baseURL = "https://api.safaricom.co.ke"
-	}
-
-	url := baseURL + "/oauth/v1/generate?grant_type=client_credentials"
-
-	auth := base64.StdEncoding.EncodeToString(
-		[]byte(mpesaConfig.ConsumerKey + ":" + mpesaConfig.ConsumerSecret))
-
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", "Basic "+auth)
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	var result struct {
-		AccessToken string `json:"access_token"`
-	}
-	json.Unmarshal(body, &result)
-
-	return result.AccessToken, nil
-}
@@ -0,0 +1,136 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"schoolms-go/daraja"
+	"schoolms-go/models"
+	"schoolms-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// queryTransactionStatus - Ask Safaricom whether a disputed transaction ID was paid
+func queryTransactionStatus(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var input struct {
+		TransID string `json:"trans_id" binding:"required"`
+		Remarks string `json:"remarks"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query, err := services.RunTransactionStatusQuery(mpesaClient(), schoolID, userID, input.TransID, input.Remarks)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Daraja request failed: " + err.Error(), "query": query})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Status query sent; result will be stored when Safaricom responds",
+		"query":   query,
+	})
+}
+
+// queryAccountBalance - Ask Safaricom for the paybill balances
+// Stored against no school (0), like the daraja CLI's, since the paybill is shared
+func queryAccountBalance(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	query, err := services.RunAccountBalanceQuery(mpesaClient(), 0, userID)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Daraja request failed: " + err.Error(), "query": query})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Balance query sent; result will be stored when Safaricom responds",
+		"query":   query,
+	})
+}
+
+// registerC2BURLs - Register our validation and confirmation URLs with Safaricom
+// Every school's payments arrive on these URLs, so only platform admins may change them
+func registerC2BURLs(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var input struct {
+		ResponseType string `json:"response_type" binding:"omitempty,oneof=Completed Cancelled"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query, err := services.RegisterC2BURLs(mpesaClient(), 0, userID, input.ResponseType)
+	models.CreateAuditLog(0, userID, models.AuditMPESARegisterURLs, "MPESAQuery", query.ID,
+		"", query.Status, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Daraja request failed: " + err.Error(), "query": query})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "C2B URLs registered",
+		"validation_url":   mpesaClient().CallbackURL(daraja.ValidationPath),
+		"confirmation_url": mpesaClient().CallbackURL(daraja.ConfirmationPath),
+		"query":            query,
+	})
+}
+
+// listMpesaQueries - Stored Daraja queries, optionally for one transaction ID
+func listMpesaQueries(c *gin.Context) {
+	c.JSON(http.StatusOK, mpesaQueries(c, c.MustGet("schoolID").(uint)))
+}
+
+// listPlatformMpesaQueries - Queries about the shared paybill (account balance, URL registration)
+func listPlatformMpesaQueries(c *gin.Context) {
+	c.JSON(http.StatusOK, mpesaQueries(c, 0))
+}
+
+// mpesaQueries - A school's stored queries, filtered by ?trans_id= and ?type=
+func mpesaQueries(c *gin.Context, schoolID uint) []models.MPESAQuery {
+	query := models.DB.Where("school_id = ?", schoolID)
+	if transID := c.Query("trans_id"); transID != "" {
+		query = query.Where("trans_id = ?", transID)
+	}
+	if queryType := c.Query("type"); queryType != "" {
+		query = query.Where("query_type = ?", queryType)
+	}
+
+	var queries []models.MPESAQuery
+	query.Order("created_at DESC").Limit(100).Find(&queries)
+	return queries
+}
+
+// mpesaQueryResult - Async result for Transaction Status and Account Balance
+func mpesaQueryResult(c *gin.Context) {
+	completeMpesaQuery(c, false)
+}
+
+// mpesaQueryTimeout - Query expired in Safaricom's queue
+func mpesaQueryTimeout(c *gin.Context) {
+	completeMpesaQuery(c, true)
+}
+
+func completeMpesaQuery(c *gin.Context, timedOut bool) {
+	var req daraja.Callback
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 1, "ResultDesc": "Invalid request format"})
+		return
+	}
+
+	fmt.Printf("[M-PESA Query Result] Conversation: %s, Code: %d, Timeout: %v\n",
+		req.Result.ConversationID, req.Result.ResultCode, timedOut)
+
+	if _, err := services.CompleteMPESAQuery(req.Result, timedOut); err != nil {
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Unknown conversation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Accepted"})
+}
@@ -0,0 +1,97 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"schoolms-go/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaraja_TransactionStatusStoredWithResult(t *testing.T) {
+	daraja := newDarajaStandIn(t)
+	f := setupRefundTest(t)
+	f.db.AutoMigrate(&models.MPESAQuery{})
+
+	w := f.do("POST", "/api/v1/mpesa/admin/transaction-status", f.admin, map[string]interface{}{
+		"trans_id": "OLD001",
+	})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Len(t, daraja.requests, 1)
+	assert.Equal(t, "OLD001", daraja.requests[0]["TransactionID"])
+	assert.Equal(t, "https://school.example/api/v1/mpesa/query/result", daraja.requests[0]["ResultURL"])
+
+	var query models.MPESAQuery
+	f.db.First(&query)
+	assert.Equal(t, "PENDING", query.Status)
+	assert.NotNil(t, query.MPESATransactionID, "query should link the known transaction")
+
+	w = f.do("POST", "/api/v1/mpesa/query/result", "", map[string]interface{}{
+		"Result": map[string]interface{}{
+			"ResultCode": 0, "ResultDesc": "The service request is processed successfully.",
+			"ConversationID": "AG_QUERY_CONV",
+			"ResultParameters": map[string]interface{}{
+				"ResultParameter": []map[string]interface{}{
+					{"Key": "TransactionStatus", "Value": "Completed"},
+					{"Key": "Amount", "Value": 100},
+				},
+			},
+		},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	f.db.First(&query, query.ID)
+	assert.Equal(t, "COMPLETED", query.Status)
+
+	var params map[string]string
+	json.Unmarshal([]byte(query.Result), &params)
+	assert.Equal(t, "Completed", params["TransactionStatus"])
+	assert.Equal(t, "100", params["Amount"])
+
+	// Another school's transaction with a matching ID isn't linked
+	other := models.School{Name: "Other School"}
+	f.db.Create(&other)
+	f.db.Create(&models.MPESATransaction{SchoolID: other.ID, TransID: "OTHER01", TransAmount: 50, MSISDN: "254700000001"})
+	w = f.do("POST", "/api/v1/mpesa/admin/transaction-status", f.admin, map[string]interface{}{"trans_id": "OTHER01"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var foreign models.MPESAQuery
+	f.db.Where("trans_id = ?", "OTHER01").First(&foreign)
+	assert.Nil(t, foreign.MPESATransactionID)
+}
+
+func TestDaraja_SharedPaybillIsPlatformOnly(t *testing.T) {
+	daraja := newDarajaStandIn(t)
+	f := setupRefundTest(t)
+	f.db.AutoMigrate(&models.MPESAQuery{})
+	super := models.User{Email: "super@test.com", Role: "SUPERADMIN"}
+	f.db.Create(&super)
+	superToken := sessionToken(t, super)
+
+	// The paybill and its callback URLs serve every school, so school staff can't touch them
+	for _, token := range []string{f.bursar, f.admin} {
+		w := f.do("POST", "/api/v1/mpesa/admin/register-urls", token, map[string]interface{}{})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = f.do("POST", "/api/v1/mpesa/admin/account-balance", token, nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	}
+	assert.Empty(t, daraja.requests)
+
+	w := f.do("POST", "/api/v1/mpesa/admin/register-urls", superToken, map[string]interface{}{"response_type": "Cancelled"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, daraja.requests, 1)
+	assert.Equal(t, "https://school.example/api/v1/mpesa/c2b/confirmation", daraja.requests[0]["ConfirmationURL"])
+	assert.Equal(t, "Cancelled", daraja.requests[0]["ResponseType"])
+
+	var query models.MPESAQuery
+	f.db.First(&query)
+	assert.Equal(t, models.MPESAQueryRegisterURLs, query.QueryType)
+	assert.Equal(t, "COMPLETED", query.Status)
+	assert.Zero(t, query.SchoolID)
+
+	// Platform queries aren't listed to schools
+	w = f.do("GET", "/api/v1/mpesa/admin/queries", f.admin, nil)
+	assert.Equal(t, "[]", w.Body.String())
+	w = f.do("GET", "/api/v1/mpesa/admin/platform-queries", superToken, nil)
+	assert.Contains(t, w.Body.String(), models.MPESAQueryRegisterURLs)
+}
@@ -0,0 +1,333 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"schoolms-go/daraja"
+	"schoolms-go/models"
+	"schoolms-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RefundRequestInput struct {
+	StudentID uint    `json:"student_id" binding:"required"`
+	Type      string  `json:"type" binding:"required,oneof=CREDIT REVERSAL"`
+	PaymentID *uint   `json:"payment_id"` // Required for REVERSAL
+	Amount    float64 `json:"amount"`     // Required for CREDIT, defaults to payment amount for REVERSAL
+	Phone     string  `json:"phone" binding:"required"`
+	Reason    string  `json:"reason" binding:"required"`
+}
+
+// requestRefund - Finance/Admin requests a refund; money is only sent after approval
+func requestRefund(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var input RefundRequestInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var student models.Student
+	if err := models.DB.Where("id = ? AND school_id = ?", input.StudentID, schoolID).First(&student).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+		return
+	}
+
+	phone := services.NormalizeMSISDN(input.Phone)
+	if phone == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number"})
+		return
+	}
+	if !isVerifiedRefundPhone(student.ID, phone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Phone number is not a verified payer for this student"})
+		return
+	}
+
+	refund := models.Refund{
+		SchoolID:    schoolID,
+		StudentID:   student.ID,
+		Type:        input.Type,
+		Amount:      input.Amount,
+		Phone:       phone,
+		Reason:      input.Reason,
+		Status:      models.RefundPendingApproval,
+		RequestedBy: userID,
+	}
+
+	switch input.Type {
+	case models.RefundTypeReversal:
+		if input.PaymentID == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "payment_id is required for REVERSAL refunds"})
+			return
+		}
+		var payment models.Payment
+		if err := models.DB.Where("id = ? AND student_id = ? AND school_id = ?", *input.PaymentID, student.ID, schoolID).
+			First(&payment).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+			return
+		}
+		if payment.Amount <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only incoming payments can be reversed"})
+			return
+		}
+		var open int64
+		models.DB.Model(&models.Refund{}).
+			Where("payment_id = ? AND status NOT IN ?", payment.ID, []string{models.RefundRejected, models.RefundFailed}).
+			Count(&open)
+		if open > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Payment already has a refund in progress or completed"})
+			return
+		}
+		refund.PaymentID = &payment.ID
+		refund.Amount = payment.Amount
+
+	case models.RefundTypeCredit:
+		if input.Amount <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be positive"})
+			return
+		}
+		credit, err := services.GetStudentCredit(student.ID, schoolID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if input.Amount > credit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Amount exceeds available credit of KES %.2f", credit)})
+			return
+		}
+	}
+
+	if err := models.DB.Create(&refund).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create refund"})
+		return
+	}
+
+	newVal, _ := json.Marshal(refund)
+	models.CreateAuditLog(schoolID, userID, models.AuditRefundRequested, "Refund", refund.ID,
+		"", string(newVal), c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusCreated, refund)
+}
+
+// listRefunds - Refund queue for admin review
+func listRefunds(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	status := c.Query("status")
+
+	query := models.DB.Where("school_id = ?", schoolID).Preload("Student").Preload("Student.User")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var refunds []models.Refund
+	query.Order("created_at DESC").Limit(100).Find(&refunds)
+
+	c.JSON(http.StatusOK, refunds)
+}
+
+// approveRefund - Second user approves and the B2C payment is initiated
+func approveRefund(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var refund models.Refund
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&refund).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Refund not found"})
+		return
+	}
+
+	if refund.Status != models.RefundPendingApproval {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refund is not awaiting approval"})
+		return
+	}
+	if refund.RequestedBy == userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Refund must be approved by a different user"})
+		return
+	}
+
+	// Claim the refund before calling Safaricom so it cannot be approved twice
+	if err := services.ClaimRefund(&refund, userID); err != nil {
+		switch {
+		case errors.Is(err, services.ErrRefundClaimed):
+			c.JSON(http.StatusConflict, gin.H{"error": "Refund was already processed"})
+		case errors.Is(err, services.ErrRefundCredit):
+			c.JSON(http.StatusConflict, gin.H{"error": "Refund exceeds the student's available credit"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve refund"})
+		}
+		return
+	}
+
+	models.CreateAuditLog(schoolID, userID, models.AuditRefundApproved, "Refund", refund.ID,
+		models.RefundPendingApproval, models.RefundProcessing, c.ClientIP(), c.Request.UserAgent())
+
+	resp, err := mpesaClient().B2CPayment(daraja.B2CRequest{
+		Amount:   refund.Amount,
+		Phone:    refund.Phone,
+		Remarks:  fmt.Sprintf("Refund %d", refund.ID),
+		Occasion: refund.Reason,
+	})
+	if err != nil {
+		refund.Status = models.RefundFailed
+		refund.ResultDesc = err.Error()
+		models.DB.Save(&refund)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "B2C request failed: " + err.Error(), "refund": refund})
+		return
+	}
+
+	refund.ConversationID = resp.ConversationID
+	refund.OriginatorConversationID = resp.OriginatorConversationID
+	models.DB.Save(&refund)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Refund approved and sent to M-PESA",
+		"refund":  refund,
+	})
+}
+
+// rejectRefund - Reviewer declines the refund; nothing is sent
+func rejectRefund(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var refund models.Refund
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&refund).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Refund not found"})
+		return
+	}
+
+	if refund.Status != models.RefundPendingApproval {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refund is not awaiting approval"})
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	c.ShouldBindJSON(&input)
+
+	refund.Status = models.RefundRejected
+	refund.ResultDesc = input.Reason
+	models.DB.Save(&refund)
+
+	models.CreateAuditLog(schoolID, userID, models.AuditRefundRejected, "Refund", refund.ID,
+		models.RefundPendingApproval, models.RefundRejected, c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, refund)
+}
+
+// b2cResult - Final outcome of a B2C refund
+func b2cResult(c *gin.Context) {
+	var req daraja.Callback
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 1, "ResultDesc": "Invalid request format"})
+		return
+	}
+
+	fmt.Printf("[M-PESA B2C Result] Conversation: %s, Code: %d, TransID: %s\n",
+		req.Result.ConversationID, req.Result.ResultCode, req.Result.TransactionID)
+
+	refund, err := findRefundByConversation(req.Result.ConversationID, req.Result.OriginatorConversationID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Unknown conversation"})
+		return
+	}
+
+	// Safaricom may retry callbacks; only a processing refund changes state
+	if refund.Status != models.RefundProcessing && refund.Status != models.RefundTimedOut {
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Already processed"})
+		return
+	}
+
+	code := req.Result.ResultCode
+	refund.ResultCode = &code
+	refund.ResultDesc = req.Result.ResultDesc
+	refund.TransactionID = req.Result.TransactionID
+
+	if code != 0 {
+		if err := services.SettleRefund(refund, models.RefundFailed); errors.Is(err, services.ErrRefundClaimed) {
+			c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Already processed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Accepted"})
+		return
+	}
+
+	// The status check above is only a shortcut; ApplyRefund claims the refund in the ledger transaction
+	_, err = services.ApplyRefund(refund)
+	if errors.Is(err, services.ErrRefundClaimed) {
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Already processed"})
+		return
+	}
+	if err != nil {
+		// Money has left the paybill; keep it visible for manual reconciliation
+		fmt.Printf("[M-PESA B2C] Failed to apply refund %d to ledger: %v\n", refund.ID, err)
+		refund.ResultDesc = "Paid but ledger update failed: " + err.Error()
+		services.SettleRefund(refund, models.RefundCompleted)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Accepted"})
+}
+
+// b2cTimeout - Request expired in Safaricom's queue; no money was sent
+func b2cTimeout(c *gin.Context) {
+	var req daraja.Callback
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, gin.H{"ResultCode": 1, "ResultDesc": "Invalid request format"})
+		return
+	}
+
+	fmt.Printf("[M-PESA B2C Timeout] Conversation: %s\n", req.Result.ConversationID)
+
+	refund, err := findRefundByConversation(req.Result.ConversationID, req.Result.OriginatorConversationID)
+	if err == nil {
+		// Conditional, so a timeout arriving after the result doesn't undo it
+		models.DB.Model(&models.Refund{}).Where("id = ? AND status = ?", refund.ID, models.RefundProcessing).
+			Updates(map[string]interface{}{"status": models.RefundTimedOut, "result_desc": "B2C request timed out"})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ResultCode": 0, "ResultDesc": "Accepted"})
+}
+
+func findRefundByConversation(conversationID, originatorID string) (*models.Refund, error) {
+	if conversationID == "" && originatorID == "" {
+		return nil, errors.New("no conversation id")
+	}
+	var refund models.Refund
+	err := models.DB.
+		Where("(conversation_id = ? AND conversation_id != '') OR (originator_conversation_id = ? AND originator_conversation_id != '')",
+			conversationID, originatorID).
+		First(&refund).Error
+	if err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+// isVerifiedRefundPhone - A phone is verified if it has paid for this student via M-PESA
+// or is a school-verified guardian number for the student
+func isVerifiedRefundPhone(studentID uint, phone string) bool {
+	for _, guardian := range services.GuardianPhonesForStudent(studentID) {
+		if services.NormalizeMSISDN(guardian) == phone {
+			return true
+		}
+	}
+
+	var msisdns []string
+	models.DB.Model(&models.MPESATransaction{}).
+		Where("matched_student_id = ? AND status = ?", studentID, "MATCHED").
+		Distinct("msisdn").
+		Pluck("msisdn", &msisdns)
+
+	for _, m := range msisdns {
+		if services.NormalizeMSISDN(m) == phone {
+			return true
+		}
+	}
+	return false
+}
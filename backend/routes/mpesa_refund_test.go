@@ -0,0 +1,355 @@
+package routes_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// darajaStandIn - Local replacement for the Safaricom Daraja API
+type darajaStandIn struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	requests []map[string]interface{}
+}
+
+func newDarajaStandIn(t *testing.T) *darajaStandIn {
+	d := &darajaStandIn{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/v1/generate", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "test-token", "expires_in": "3599"})
+	})
+	mux.HandleFunc("/mpesa/b2c/v3/paymentrequest", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		d.mu.Lock()
+		d.requests = append(d.requests, body)
+		d.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{
+			"ConversationID":           "AG_20240101_CONV1",
+			"OriginatorConversationID": body["OriginatorConversationID"].(string),
+			"ResponseCode":             "0",
+			"ResponseDescription":      "Accept the service request successfully.",
+		})
+	})
+	for _, path := range []string{"/mpesa/transactionstatus/v1/query", "/mpesa/accountbalance/v1/query", "/mpesa/c2b/v1/registerurl"} {
+		path := path
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			body["_path"] = path
+			d.mu.Lock()
+			d.requests = append(d.requests, body)
+			d.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]string{
+				"ConversationID":           "AG_QUERY_CONV",
+				"OriginatorConversationID": "ORIG_QUERY",
+				"ResponseCode":             "0",
+				"ResponseDescription":      "success",
+			})
+		})
+	}
+	d.server = httptest.NewServer(mux)
+	t.Cleanup(d.server.Close)
+
+	routes.SetMPESAConfig(routes.MPESAConfig{
+		ConsumerKey:        "key",
+		ConsumerSecret:     "secret",
+		Shortcode:          "600000",
+		CallbackURL:        "https://school.example/api/v1/mpesa",
+		BaseURL:            d.server.URL,
+		InitiatorName:      "testapi",
+		SecurityCredential: "credential",
+	})
+	return d
+}
+
+type refundFixture struct {
+	db       *gorm.DB
+	router   *gin.Engine
+	school   models.School
+	student  models.Student
+	voteHead models.VoteHead
+	bursar   string
+	admin    string
+}
+
+func setupRefundTest(t *testing.T) *refundFixture {
+	db := setupMpesaTestDB(t)
+	db.AutoMigrate(&models.Refund{}, &models.AuditLog{})
+	t.Cleanup(func() { sqlDB, _ := db.DB(); sqlDB.Close() })
+
+	f := &refundFixture{db: db}
+	f.school = models.School{Name: "Test School"}
+	db.Create(&f.school)
+
+	bursar := models.User{Email: "bursar@test.com", Role: "FINANCE", SchoolID: &f.school.ID}
+	admin := models.User{Email: "admin@test.com", Role: "SCHOOLADMIN", SchoolID: &f.school.ID}
+	studentUser := models.User{Email: "student@test.com", Role: "STUDENT", SchoolID: &f.school.ID}
+	db.Create(&bursar)
+	db.Create(&admin)
+	db.Create(&studentUser)
+
+	f.student = models.Student{UserID: studentUser.ID, SchoolID: f.school.ID, EnrollmentNumber: "ADM001", Status: "ENROLLED"}
+	db.Create(&f.student)
+
+	f.voteHead = models.VoteHead{SchoolID: f.school.ID, Name: "Tuition", Priority: 1, IsActive: true}
+	db.Create(&f.voteHead)
+
+	// The parent has paid before from this number, which makes it a verified payer
+	db.Create(&models.MPESATransaction{
+		SchoolID: f.school.ID, TransID: "OLD001", TransAmount: 100, MSISDN: "254708374149",
+		Status: "MATCHED", MatchedStudentID: &f.student.ID,
+	})
+
+	f.bursar = sessionToken(t, bursar)
+	f.admin = sessionToken(t, admin)
+
+	gin.SetMode(gin.TestMode)
+	f.router = gin.New()
+	routes.RegisterMpesaRoutes(f.router.Group("/api/v1"))
+	return f
+}
+
+func (f *refundFixture) do(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRefund_CreditRequiresSecondApprover(t *testing.T) {
+	daraja := newDarajaStandIn(t)
+	f := setupRefundTest(t)
+
+	// Student has KES 2,000 credit
+	f.db.Create(&models.VoteHeadBalance{StudentID: f.student.ID, VoteHeadID: f.voteHead.ID, SchoolID: f.school.ID, Balance: -2000})
+
+	w := f.do("POST", "/api/v1/mpesa/refunds", f.bursar, map[string]interface{}{
+		"student_id": f.student.ID, "type": "CREDIT", "amount": 1500,
+		"phone": "0708374149", "reason": "Student transferred",
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var refund models.Refund
+	json.Unmarshal(w.Body.Bytes(), &refund)
+	assert.Equal(t, models.RefundPendingApproval, refund.Status)
+	assert.Equal(t, "254708374149", refund.Phone)
+
+	// The requester cannot approve their own refund
+	w = f.do("POST", "/api/v1/mpesa/refunds/1/approve", f.bursar, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, daraja.requests)
+
+	w = f.do("POST", "/api/v1/mpesa/refunds/1/approve", f.admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, daraja.requests, 1)
+	assert.Equal(t, "254708374149", daraja.requests[0]["PartyB"])
+	assert.Equal(t, 1500.0, daraja.requests[0]["Amount"])
+	assert.Equal(t, "https://school.example/api/v1/mpesa/b2c/result", daraja.requests[0]["ResultURL"])
+
+	// Safaricom reports success
+	w = f.do("POST", "/api/v1/mpesa/b2c/result", "", map[string]interface{}{
+		"Result": map[string]interface{}{
+			"ResultType": 0, "ResultCode": 0, "ResultDesc": "The service request is processed successfully.",
+			"ConversationID": "AG_20240101_CONV1", "TransactionID": "RFD123ABC",
+		},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	f.db.First(&refund, refund.ID)
+	assert.Equal(t, models.RefundCompleted, refund.Status)
+	assert.Equal(t, "RFD123ABC", refund.TransactionID)
+	assert.NotNil(t, refund.ReversalPaymentID)
+
+	var balance models.VoteHeadBalance
+	f.db.Where("student_id = ?", f.student.ID).First(&balance)
+	assert.Equal(t, -500.0, balance.Balance)
+
+	var reversal models.Payment
+	f.db.First(&reversal, *refund.ReversalPaymentID)
+	assert.Equal(t, -1500.0, reversal.Amount)
+	assert.Equal(t, "MPESA_REFUND", reversal.Method)
+
+	// A retried callback does not refund twice
+	f.do("POST", "/api/v1/mpesa/b2c/result", "", map[string]interface{}{
+		"Result": map[string]interface{}{"ResultCode": 0, "ConversationID": "AG_20240101_CONV1", "TransactionID": "RFD123ABC"},
+	})
+	var count int64
+	f.db.Model(&models.Payment{}).Where("method = ?", "MPESA_REFUND").Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestRefund_CreditCannotExceedBalance(t *testing.T) {
+	newDarajaStandIn(t)
+	f := setupRefundTest(t)
+
+	f.db.Create(&models.VoteHeadBalance{StudentID: f.student.ID, VoteHeadID: f.voteHead.ID, SchoolID: f.school.ID, Balance: -200})
+
+	w := f.do("POST", "/api/v1/mpesa/refunds", f.bursar, map[string]interface{}{
+		"student_id": f.student.ID, "type": "CREDIT", "amount": 1000,
+		"phone": "0708374149", "reason": "Overpaid",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRefund_ApprovalRechecksCredit(t *testing.T) {
+	daraja := newDarajaStandIn(t)
+	f := setupRefundTest(t)
+
+	// Two requests each fit the KES 1,000 credit, but not both
+	f.db.Create(&models.VoteHeadBalance{StudentID: f.student.ID, VoteHeadID: f.voteHead.ID, SchoolID: f.school.ID, Balance: -1000})
+	for i := 0; i < 2; i++ {
+		w := f.do("POST", "/api/v1/mpesa/refunds", f.bursar, map[string]interface{}{
+			"student_id": f.student.ID, "type": "CREDIT", "amount": 700,
+			"phone": "0708374149", "reason": "Overpaid",
+		})
+		require.Equal(t, http.StatusCreated, w.Code)
+	}
+
+	w := f.do("POST", "/api/v1/mpesa/refunds/1/approve", f.admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The first is still in flight, so its amount is reserved
+	w = f.do("POST", "/api/v1/mpesa/refunds/2/approve", f.admin, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "available credit")
+	assert.Len(t, daraja.requests, 1)
+
+	var second models.Refund
+	f.db.First(&second, 2)
+	assert.Equal(t, models.RefundPendingApproval, second.Status)
+}
+
+func TestRefund_UnverifiedPhoneRejected(t *testing.T) {
+	newDarajaStandIn(t)
+	f := setupRefundTest(t)
+
+	f.db.Create(&models.VoteHeadBalance{StudentID: f.student.ID, VoteHeadID: f.voteHead.ID, SchoolID: f.school.ID, Balance: -2000})
+
+	w := f.do("POST", "/api/v1/mpesa/refunds", f.bursar, map[string]interface{}{
+		"student_id": f.student.ID, "type": "CREDIT", "amount": 500,
+		"phone": "0711000000", "reason": "Overpaid",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "verified")
+}
+
+func TestRefund_ReversalRestoresBalances(t *testing.T) {
+	newDarajaStandIn(t)
+	f := setupRefundTest(t)
+
+	// Duplicate payment of 3,000 cleared 2,000 of tuition and left 1,000 credit
+	f.db.Create(&models.VoteHeadBalance{StudentID: f.student.ID, VoteHeadID: f.voteHead.ID, SchoolID: f.school.ID, Balance: -1000})
+	payment := models.Payment{StudentID: f.student.ID, SchoolID: f.school.ID, Amount: 3000, Method: "MPESA", Reference: "DUP001"}
+	f.db.Create(&payment)
+	f.db.Create(&models.PaymentAllocation{PaymentID: payment.ID, VoteHeadID: f.voteHead.ID, Amount: 2000, BalBefore: 2000, BalAfter: 0})
+
+	w := f.do("POST", "/api/v1/mpesa/refunds", f.bursar, map[string]interface{}{
+		"student_id": f.student.ID, "type": "REVERSAL", "payment_id": payment.ID,
+		"phone": "254708374149", "reason": "Paid twice",
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = f.do("POST", "/api/v1/mpesa/refunds/1/approve", f.admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var stale models.Refund
+	f.db.First(&stale, 1)
+
+	// Safaricom may deliver the same result more than once; only the first touches the ledger
+	result := map[string]interface{}{
+		"Result": map[string]interface{}{"ResultCode": 0, "ConversationID": "AG_20240101_CONV1", "TransactionID": "RFD999"},
+	}
+	assert.Contains(t, f.do("POST", "/api/v1/mpesa/b2c/result", "", result).Body.String(), "Accepted")
+	assert.Contains(t, f.do("POST", "/api/v1/mpesa/b2c/result", "", result).Body.String(), "Already processed")
+
+	// A concurrent callback that read the refund before it completed can't apply it again
+	_, err := services.ApplyRefund(&stale)
+	assert.ErrorIs(t, err, services.ErrRefundClaimed)
+
+	var balance models.VoteHeadBalance
+	f.db.Where("student_id = ?", f.student.ID).First(&balance)
+	assert.Equal(t, 2000.0, balance.Balance)
+	var refunds int64
+	f.db.Model(&models.Payment{}).Where("method = ?", "MPESA_REFUND").Count(&refunds)
+	assert.Equal(t, int64(1), refunds)
+	var refund models.Refund
+	f.db.First(&refund, 1)
+	assert.Equal(t, models.RefundCompleted, refund.Status)
+	assert.NotNil(t, refund.ReversalPaymentID)
+
+	// The same payment cannot be reversed twice
+	w = f.do("POST", "/api/v1/mpesa/refunds", f.bursar, map[string]interface{}{
+		"student_id": f.student.ID, "type": "REVERSAL", "payment_id": payment.ID,
+		"phone": "254708374149", "reason": "Paid twice",
+	})
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestRefund_TimedOutReversalBlocksAnother(t *testing.T) {
+	newDarajaStandIn(t)
+	f := setupRefundTest(t)
+
+	payment := models.Payment{StudentID: f.student.ID, SchoolID: f.school.ID, Amount: 3000, Method: "MPESA", Reference: "DUP001"}
+	f.db.Create(&payment)
+	reversal := map[string]interface{}{
+		"student_id": f.student.ID, "type": "REVERSAL", "payment_id": payment.ID,
+		"phone": "254708374149", "reason": "Paid twice",
+	}
+	assert.Equal(t, http.StatusCreated, f.do("POST", "/api/v1/mpesa/refunds", f.bursar, reversal).Code)
+	assert.Equal(t, http.StatusOK, f.do("POST", "/api/v1/mpesa/refunds/1/approve", f.admin, nil).Code)
+	f.do("POST", "/api/v1/mpesa/b2c/timeout", "", map[string]interface{}{
+		"Result": map[string]interface{}{"ResultCode": 1, "ConversationID": "AG_20240101_CONV1"},
+	})
+
+	// A late result can still pay out the timed-out reversal, so it is still open
+	w := f.do("POST", "/api/v1/mpesa/refunds", f.bursar, reversal)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestRefund_TimeoutLeavesLedgerUntouched(t *testing.T) {
+	newDarajaStandIn(t)
+	f := setupRefundTest(t)
+
+	f.db.Create(&models.VoteHeadBalance{StudentID: f.student.ID, VoteHeadID: f.voteHead.ID, SchoolID: f.school.ID, Balance: -2000})
+
+	f.do("POST", "/api/v1/mpesa/refunds", f.bursar, map[string]interface{}{
+		"student_id": f.student.ID, "type": "CREDIT", "amount": 2000,
+		"phone": "0708374149", "reason": "Left school",
+	})
+	f.do("POST", "/api/v1/mpesa/refunds/1/approve", f.admin, nil)
+
+	w := f.do("POST", "/api/v1/mpesa/b2c/timeout", "", map[string]interface{}{
+		"Result": map[string]interface{}{"ResultCode": 1, "ConversationID": "AG_20240101_CONV1"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var refund models.Refund
+	f.db.First(&refund, 1)
+	assert.Equal(t, models.RefundTimedOut, refund.Status)
+
+	var balance models.VoteHeadBalance
+	f.db.Where("student_id = ?", f.student.ID).First(&balance)
+	assert.Equal(t, -2000.0, balance.Balance)
+}
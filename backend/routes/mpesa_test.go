@@ -21,7 +21,7 @@ func setupMpesaTestDB(t *testing.T) *gorm.DB {
 
 	db.AutoMigrate(
 		&models.User{}, &models.School{}, &models.Student{}, &models.Class{},
-		&models.Payment{}, &models.MPESATransaction{},
+		&models.Payment{}, &models.MPESATransaction{}, &models.UserSession{},
 		&models.VoteHead{}, &models.VoteHeadBalance{}, &models.PaymentAllocation{},
 	)
 
@@ -4,31 +4,74 @@ import (
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type CreateNotificationInput struct {
-	TargetType string `json:"target_type" binding:"required,oneof=ALL CLASS STUDENT"`
-	TargetID   *uint  `json:"target_id"` // Required if TargetType is CLASS or STUDENT
+	TargetType string `json:"target_type" binding:"required,oneof=ALL CLASS STUDENT ROLE CLASS_PARENTS TEACHERS USERS GROUP"`
+	TargetID   *uint  `json:"target_id"`   // Required for CLASS, STUDENT, CLASS_PARENTS and GROUP; optional class for TEACHERS
+	TargetRole string `json:"target_role"` // Required for ROLE
+	UserIDs    []uint `json:"user_ids"`    // Required for USERS
 	Title      string `json:"title" binding:"required"`
 	Message    string `json:"message" binding:"required"`
 	Category   string `json:"category" binding:"required,oneof=FEE_REMINDER ANNOUNCEMENT ALERT"`
+
+	Priority    string     `json:"priority" binding:"omitempty,oneof=NORMAL HIGH URGENT"`
+	Pinned      bool       `json:"pinned"`
+	PublishAt   *time.Time `json:"publish_at"` // Omit to publish straight away
+	ExpiresAt   *time.Time `json:"expires_at"`
+	AckRequired bool       `json:"ack_required"`
+	SendSMS     bool       `json:"send_sms"`   // Text recipients when it is published
+	SendEmail   bool       `json:"send_email"` // Email recipients when it is published
+}
+
+// NotificationGroupInput - Name and members of a custom notification group
+type NotificationGroupInput struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	UserIDs     []uint `json:"user_ids"`
+}
+
+// NotificationWithRead - A notification and whether the current user has read (and acknowledged) it
+type NotificationWithRead struct {
+	models.Notification
+	IsRead       bool `json:"is_read"`
+	Acknowledged bool `json:"acknowledged"`
 }
 
+// notificationRoles - Roles a ROLE notification can address
+var notificationRoles = map[string]bool{"SCHOOLADMIN": true, "TEACHER": true, "FINANCE": true, "PARENT": true, "STUDENT": true}
+
 func RegisterNotificationRoutes(router *gin.RouterGroup) {
 	notifications := router.Group("/notifications")
 	notifications.Use(middleware.AuthMiddleware())
 	{
 		// SchoolAdmin can create and manage notifications
-		notifications.POST("", middleware.RoleGuard("SCHOOLADMIN", "TEACHER"), createNotification)
-		notifications.GET("", middleware.RoleGuard("SCHOOLADMIN", "TEACHER"), listNotifications)
-		notifications.DELETE("/:id", middleware.RoleGuard("SCHOOLADMIN"), deleteNotification)
-
-		// Students can view their notifications
-		notifications.GET("/my", middleware.RoleGuard("STUDENT"), getMyNotifications)
-		notifications.POST("/:id/read", middleware.RoleGuard("STUDENT"), markAsRead)
+		notifications.POST("", middleware.RequirePermission("notifications.send"), createNotification)
+		notifications.GET("", middleware.RequirePermission("notifications.send"), listNotifications)
+		notifications.DELETE("/:id", middleware.RequirePermission("notifications.delete"), deleteNotification)
+		notifications.GET("/:id/acknowledgements", middleware.RequirePermission("notifications.send"), getAcknowledgementReport)
+
+		// Custom groups to send to
+		notifications.GET("/groups", middleware.RequirePermission("notifications.groups.view"), listNotificationGroups)
+		notifications.GET("/groups/:id", middleware.RequirePermission("notifications.groups.view"), getNotificationGroup)
+		notifications.POST("/groups", middleware.RequirePermission("notifications.groups.manage"), createNotificationGroup)
+		notifications.PUT("/groups/:id", middleware.RequirePermission("notifications.groups.manage"), updateNotificationGroup)
+		notifications.DELETE("/groups/:id", middleware.RequirePermission("notifications.groups.manage"), deleteNotificationGroup)
+
+		// Every role has an inbox
+		notifications.GET("/inbox", getInbox)
+		notifications.GET("/unread-count", getUnreadCount)
+		notifications.GET("/my", getMyNotifications)
+		notifications.POST("/read-all", markAllAsRead)
+		notifications.POST("/:id/read", markAsRead)
+		notifications.POST("/:id/acknowledge", acknowledgeNotification)
 	}
 }
 
@@ -43,41 +86,163 @@ func createNotification(c *gin.Context) {
 		return
 	}
 
-	// Validate target_id is provided for CLASS and STUDENT types
-	if input.TargetType != "ALL" && input.TargetID == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "target_id is required for CLASS or STUDENT notifications"})
+	if msg := validateNotificationTarget(schoolID, &input); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
 		return
 	}
 
+	now := time.Now()
+	if input.PublishAt != nil && !input.PublishAt.After(now) {
+		input.PublishAt = nil
+	}
+	if input.ExpiresAt != nil {
+		publishAt := now
+		if input.PublishAt != nil {
+			publishAt = *input.PublishAt
+		}
+		if !input.ExpiresAt.After(publishAt) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be after the publish time"})
+			return
+		}
+	}
+	if input.Priority == "" {
+		input.Priority = models.NotificationPriorityNormal
+	}
+
 	notification := models.Notification{
 		SchoolID:   schoolID,
 		SenderID:   userID,
 		TargetType: input.TargetType,
 		TargetID:   input.TargetID,
+		TargetRole: input.TargetRole,
 		Title:      input.Title,
 		Message:    input.Message,
 		Category:   input.Category,
+
+		Priority:    input.Priority,
+		Pinned:      input.Pinned,
+		PublishAt:   input.PublishAt,
+		ExpiresAt:   input.ExpiresAt,
+		AckRequired: input.AckRequired,
+		SendSMS:     input.SendSMS,
+		SendEmail:   input.SendEmail,
 	}
 
-	if err := models.DB.Create(&notification).Error; err != nil {
+	err := models.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&notification).Error; err != nil {
+			return err
+		}
+		for _, id := range input.UserIDs {
+			if err := tx.Create(&models.NotificationRecipient{NotificationID: notification.ID, UserID: id}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create notification"})
 		return
 	}
 
+	// Scheduled ones are published by the notification publisher
+	if notification.PublishAt == nil {
+		services.PublishNotification(&notification)
+	}
+
 	c.JSON(http.StatusCreated, notification)
 }
 
+// validateNotificationTarget - Check the target fields for the target type; returns the problem, if any
+func validateNotificationTarget(schoolID uint, input *CreateNotificationInput) string {
+	var count int64
+	switch input.TargetType {
+	case models.NotificationTargetClass, models.NotificationTargetClassParents, models.NotificationTargetTeachers:
+		if input.TargetID == nil {
+			if input.TargetType == models.NotificationTargetTeachers {
+				return ""
+			}
+			return "target_id is required for " + input.TargetType + " notifications"
+		}
+		models.DB.Model(&models.Class{}).Where("id = ? AND school_id = ?", *input.TargetID, schoolID).Count(&count)
+		if count == 0 {
+			return "Class not found"
+		}
+	case models.NotificationTargetStudent:
+		if input.TargetID == nil {
+			return "target_id is required for STUDENT notifications"
+		}
+		models.DB.Model(&models.Student{}).Where("id = ? AND school_id = ?", *input.TargetID, schoolID).Count(&count)
+		if count == 0 {
+			return "Student not found"
+		}
+	case models.NotificationTargetGroup:
+		if input.TargetID == nil {
+			return "target_id is required for GROUP notifications"
+		}
+		models.DB.Model(&models.NotificationGroup{}).Where("id = ? AND school_id = ?", *input.TargetID, schoolID).Count(&count)
+		if count == 0 {
+			return "Group not found"
+		}
+	case models.NotificationTargetRole:
+		input.TargetRole = strings.ToUpper(input.TargetRole)
+		if !notificationRoles[input.TargetRole] {
+			return "target_role must be one of SCHOOLADMIN, TEACHER, FINANCE, PARENT, STUDENT"
+		}
+	case models.NotificationTargetUsers:
+		input.UserIDs = uniqueIDs(input.UserIDs)
+		if len(input.UserIDs) == 0 {
+			return "user_ids is required for USERS notifications"
+		}
+		if !schoolUsers(schoolID, input.UserIDs) {
+			return "Some users were not found in this school"
+		}
+	}
+
+	// Only the fields that apply to the target type are kept
+	if input.TargetType != models.NotificationTargetRole {
+		input.TargetRole = ""
+	}
+	if input.TargetType != models.NotificationTargetUsers {
+		input.UserIDs = nil
+	}
+	if input.TargetType == models.NotificationTargetAll || input.TargetType == models.NotificationTargetRole ||
+		input.TargetType == models.NotificationTargetUsers {
+		input.TargetID = nil
+	}
+	return ""
+}
+
 // listNotifications - List all notifications for the school
+// ?status=SCHEDULED, PUBLISHED or EXPIRED filters on where they are in their lifetime
 func listNotifications(c *gin.Context) {
 	schoolID := c.MustGet("schoolID").(uint)
+	now := time.Now()
+
+	query := models.DB.Where("school_id = ?", schoolID)
+	switch strings.ToUpper(c.Query("status")) {
+	case models.NotificationScheduled:
+		query = query.Where("publish_at > ?", now)
+	case models.NotificationPublished:
+		query = query.Where("publish_at IS NULL OR publish_at <= ?", now).Where("expires_at IS NULL OR expires_at > ?", now)
+	case models.NotificationExpired:
+		query = query.Where("expires_at <= ?", now)
+	}
 
 	var notifications []models.Notification
-	models.DB.Where("school_id = ?", schoolID).
-		Preload("Sender").
+	query.Preload("Sender").
 		Order("created_at DESC").
 		Find(&notifications)
 
-	c.JSON(http.StatusOK, notifications)
+	type NotificationWithStatus struct {
+		models.Notification
+		Status string `json:"status"`
+	}
+	result := make([]NotificationWithStatus, 0, len(notifications))
+	for _, n := range notifications {
+		result = append(result, NotificationWithStatus{Notification: n, Status: n.Status(now)})
+	}
+
+	c.JSON(http.StatusOK, result)
 }
 
 // deleteNotification - SchoolAdmin deletes a notification
@@ -91,94 +256,296 @@ func deleteNotification(c *gin.Context) {
 		return
 	}
 
+	models.DB.Where("notification_id = ?", notification.ID).Delete(&models.NotificationRecipient{})
+	models.DB.Where("notification_id = ?", notification.ID).Delete(&models.NotificationRead{})
+	models.DB.Where("notification_id = ?", notification.ID).Delete(&models.NotificationAcknowledgement{})
 	models.DB.Delete(&notification)
 	c.JSON(http.StatusOK, gin.H{"message": "Notification deleted"})
 }
 
-// getMyNotifications - Student gets notifications targeted at them
+// inboxAudience - The current user as a notification audience
+func inboxAudience(c *gin.Context) services.NotificationAudience {
+	return services.AudienceFor(c.MustGet("schoolID").(uint), c.MustGet("userID").(uint), c.MustGet("role").(string))
+}
+
+// inboxNotifications - The user's notifications, newest first, with read status
+func inboxNotifications(audience services.NotificationAudience, query *gorm.DB) []NotificationWithRead {
+	var notifications []models.Notification
+	query.Preload("Sender").Order(services.InboxOrder).Find(&notifications)
+
+	var readIDs, ackIDs []uint
+	models.DB.Model(&models.NotificationRead{}).Where("user_id = ?", audience.UserID).Pluck("notification_id", &readIDs)
+	models.DB.Model(&models.NotificationAcknowledgement{}).Where("user_id = ?", audience.UserID).Pluck("notification_id", &ackIDs)
+	readMap := make(map[uint]bool, len(readIDs))
+	for _, id := range readIDs {
+		readMap[id] = true
+	}
+	ackMap := make(map[uint]bool, len(ackIDs))
+	for _, id := range ackIDs {
+		ackMap[id] = true
+	}
+
+	result := make([]NotificationWithRead, 0, len(notifications))
+	for _, n := range notifications {
+		result = append(result, NotificationWithRead{Notification: n, IsRead: readMap[n.ID], Acknowledged: ackMap[n.ID]})
+	}
+	return result
+}
+
+// getInbox - The current user's notifications with the unread count
+// ?unread=true lists only unread ones; ?limit= and ?offset= page through them (default 50)
+func getInbox(c *gin.Context) {
+	audience := inboxAudience(c)
+
+	query := services.NotificationsFor(audience)
+	if c.Query("unread") == "true" {
+		query = query.Where("id NOT IN (?)",
+			models.DB.Model(&models.NotificationRead{}).Select("notification_id").Where("user_id = ?", audience.UserID))
+	}
+	var total int64
+	query.Session(&gorm.Session{}).Count(&total)
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"notifications": inboxNotifications(audience, query.Limit(limit).Offset(offset)),
+		"total":         total,
+		"unread":        services.UnreadNotificationCount(audience),
+	})
+}
+
+// getUnreadCount - Badge count for the notification bell
+func getUnreadCount(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"unread": services.UnreadNotificationCount(inboxAudience(c))})
+}
+
+// getMyNotifications - All of the current user's notifications
 func getMyNotifications(c *gin.Context) {
-	schoolID := c.MustGet("schoolID").(uint)
-	userID := c.MustGet("userID").(uint)
+	audience := inboxAudience(c)
+	c.JSON(http.StatusOK, inboxNotifications(audience, services.NotificationsFor(audience)))
+}
+
+// markAsRead - Mark one of the user's notifications as read
+func markAsRead(c *gin.Context) {
+	audience := inboxAudience(c)
 
-	// Get student's class
-	var student models.Student
-	if err := models.DB.Where("user_id = ? AND school_id = ?", userID, schoolID).First(&student).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+	var notification models.Notification
+	if err := services.NotificationsFor(audience).Where("id = ?", c.Param("id")).First(&notification).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
 		return
 	}
 
-	var notifications []models.Notification
+	services.MarkNotificationsRead(audience.UserID, []uint{notification.ID})
+	c.JSON(http.StatusOK, gin.H{"message": "Marked as read"})
+}
 
-	// Get notifications: ALL, their CLASS, or directly to them
-	query := models.DB.Where("school_id = ?", schoolID).
-		Where("target_type = ? OR (target_type = ? AND target_id = ?) OR (target_type = ? AND target_id = ?)",
-			"ALL",
-			"CLASS", student.ClassID,
-			"STUDENT", student.ID,
-		).
-		Preload("Sender").
-		Order("created_at DESC")
+// markAllAsRead - Mark every notification in the user's inbox as read
+func markAllAsRead(c *gin.Context) {
+	audience := inboxAudience(c)
 
-	query.Find(&notifications)
+	var ids []uint
+	services.NotificationsFor(audience).Pluck("id", &ids)
+	marked := services.MarkNotificationsRead(audience.UserID, ids)
 
-	// Get read status for each notification
-	var readNotifications []models.NotificationRead
-	models.DB.Where("student_id = ?", student.ID).Find(&readNotifications)
+	c.JSON(http.StatusOK, gin.H{"message": "Marked as read", "marked": marked})
+}
 
-	readMap := make(map[uint]bool)
-	for _, r := range readNotifications {
-		readMap[r.NotificationID] = true
+// acknowledgeNotification - Confirm a notification that asks for acknowledgement
+func acknowledgeNotification(c *gin.Context) {
+	audience := inboxAudience(c)
+
+	var notification models.Notification
+	if err := services.NotificationsFor(audience).Where("id = ?", c.Param("id")).First(&notification).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+	if !notification.AckRequired {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This notification doesn't need acknowledging"})
+		return
 	}
 
-	// Build response with read status
-	type NotificationWithRead struct {
-		models.Notification
-		IsRead bool `json:"is_read"`
+	ack, err := services.AcknowledgeNotification(notification.ID, audience.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to acknowledge"})
+		return
 	}
+	c.JSON(http.StatusOK, ack)
+}
 
-	result := make([]NotificationWithRead, 0)
-	for _, n := range notifications {
-		result = append(result, NotificationWithRead{
-			Notification: n,
-			IsRead:       readMap[n.ID],
-		})
+// getAcknowledgementReport - Who has and hasn't acknowledged, per class
+func getAcknowledgementReport(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var notification models.Notification
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&notification).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+	if !notification.AckRequired {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This notification doesn't need acknowledging"})
+		return
+	}
+
+	c.JSON(http.StatusOK, services.NotificationAckReport(notification))
+}
+
+// listNotificationGroups - The school's custom groups with member counts
+func listNotificationGroups(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var groups []models.NotificationGroup
+	models.DB.Where("school_id = ?", schoolID).Order("name").Find(&groups)
+
+	result := make([]gin.H, 0, len(groups))
+	for _, g := range groups {
+		var members int64
+		models.DB.Model(&models.NotificationGroupMember{}).Where("group_id = ?", g.ID).Count(&members)
+		result = append(result, gin.H{"group": g, "members": members})
 	}
 
 	c.JSON(http.StatusOK, result)
 }
 
-// markAsRead - Student marks a notification as read
-func markAsRead(c *gin.Context) {
+func getNotificationGroup(c *gin.Context) {
+	group, ok := schoolNotificationGroup(c)
+	if !ok {
+		return
+	}
+	models.DB.Preload("Members.User").First(&group, group.ID)
+	c.JSON(http.StatusOK, group)
+}
+
+// createNotificationGroup - SchoolAdmin creates a custom group
+func createNotificationGroup(c *gin.Context) {
 	schoolID := c.MustGet("schoolID").(uint)
 	userID := c.MustGet("userID").(uint)
-	notificationID := c.Param("id")
 
-	// Get student
-	var student models.Student
-	if err := models.DB.Where("user_id = ? AND school_id = ?", userID, schoolID).First(&student).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+	var input NotificationGroupInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Check notification exists
-	var notification models.Notification
-	if err := models.DB.First(&notification, notificationID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+	group := models.NotificationGroup{
+		SchoolID:    schoolID,
+		Name:        strings.TrimSpace(input.Name),
+		Description: input.Description,
+		CreatedBy:   userID,
+	}
+	saveNotificationGroup(c, &group, input.UserIDs, http.StatusCreated)
+}
+
+// updateNotificationGroup - Rename a group and replace its members
+func updateNotificationGroup(c *gin.Context) {
+	group, ok := schoolNotificationGroup(c)
+	if !ok {
+		return
+	}
+
+	var input NotificationGroupInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	group.Name = strings.TrimSpace(input.Name)
+	group.Description = input.Description
+	saveNotificationGroup(c, &group, input.UserIDs, http.StatusOK)
+}
+
+func deleteNotificationGroup(c *gin.Context) {
+	group, ok := schoolNotificationGroup(c)
+	if !ok {
+		return
+	}
+
+	var sent int64
+	models.DB.Model(&models.Notification{}).
+		Where("target_type = ? AND target_id = ?", models.NotificationTargetGroup, group.ID).Count(&sent)
+	if sent > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Notifications have been sent to this group"})
 		return
 	}
 
-	// Create or update read record
-	var read models.NotificationRead
-	result := models.DB.Where("notification_id = ? AND student_id = ?", notification.ID, student.ID).First(&read)
+	models.DB.Where("group_id = ?", group.ID).Delete(&models.NotificationGroupMember{})
+	models.DB.Delete(&group)
+	c.JSON(http.StatusOK, gin.H{"message": "Group deleted"})
+}
+
+// saveNotificationGroup - Save the group and set its members to userIDs
+func saveNotificationGroup(c *gin.Context, group *models.NotificationGroup, userIDs []uint, status int) {
+	userIDs = uniqueIDs(userIDs)
+	if !schoolUsers(group.SchoolID, userIDs) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Some users were not found in this school"})
+		return
+	}
 
-	if result.RowsAffected == 0 {
-		read = models.NotificationRead{
-			NotificationID: notification.ID,
-			StudentID:      student.ID,
-			ReadAt:         time.Now(),
+	var taken int64
+	models.DB.Model(&models.NotificationGroup{}).
+		Where("school_id = ? AND name = ? AND id <> ?", group.SchoolID, group.Name, group.ID).Count(&taken)
+	if taken > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A group with this name already exists"})
+		return
+	}
+
+	err := models.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(group).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&models.NotificationGroupMember{}).Error; err != nil {
+			return err
+		}
+		for _, id := range userIDs {
+			if err := tx.Create(&models.NotificationGroupMember{GroupID: group.ID, UserID: id}).Error; err != nil {
+				return err
+			}
 		}
-		models.DB.Create(&read)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save group"})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Marked as read"})
+	models.DB.Preload("Members.User").First(group, group.ID)
+	c.JSON(status, group)
+}
+
+// schoolNotificationGroup - The :id group if it belongs to the caller's school, else a 404 is sent
+func schoolNotificationGroup(c *gin.Context) (models.NotificationGroup, bool) {
+	var group models.NotificationGroup
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), c.MustGet("schoolID").(uint)).First(&group).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return group, false
+	}
+	return group, true
+}
+
+// schoolUsers - Whether every id is a user of the school
+func schoolUsers(schoolID uint, ids []uint) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	var count int64
+	models.DB.Model(&models.User{}).Where("id IN ? AND school_id = ?", ids, schoolID).Count(&count)
+	return count == int64(len(ids))
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	result := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if id != 0 && !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
 }
@@ -0,0 +1,349 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type notificationFixture struct {
+	*smsFixture
+	class                                      models.Class
+	student                                    models.Student
+	studentUser, parent, teacher, otherTeacher models.User
+	finance                                    models.User
+	tokens                                     map[uint]string
+}
+
+func setupNotificationTest(t *testing.T) *notificationFixture {
+	f := setupSMSTest(t)
+	f.db.AutoMigrate(&models.Class{}, &models.Timetable{}, &models.Notification{}, &models.NotificationRead{},
+		&models.NotificationRecipient{}, &models.NotificationGroup{}, &models.NotificationGroupMember{},
+		&models.NotificationAcknowledgement{}, &models.Event{}, &models.EmailSettings{}, &models.EmailLog{})
+	services.RegisterNotificationSubscribers()
+	routes.RegisterNotificationRoutes(f.router.Group("/api/v1"))
+
+	n := &notificationFixture{smsFixture: f, tokens: map[uint]string{}}
+	user := func(email, role string) models.User {
+		u := models.User{Email: email, FullName: email, Role: role, SchoolID: &f.school.ID}
+		f.db.Create(&u)
+		n.tokens[u.ID] = sessionToken(t, u)
+		return u
+	}
+	n.studentUser = user("amani@test.com", "STUDENT")
+	n.parent = user("mzazi@test.com", "PARENT")
+	n.teacher = user("mwalimu@test.com", "TEACHER")
+	n.otherTeacher = user("juma@test.com", "TEACHER")
+	n.finance = user("bursar@test.com", "FINANCE")
+
+	n.class = models.Class{Name: "Form 1A", SchoolID: f.school.ID, TeacherID: &n.teacher.ID}
+	f.db.Create(&n.class)
+	n.student = models.Student{UserID: n.studentUser.ID, ClassID: &n.class.ID, SchoolID: f.school.ID, Status: "ENROLLED"}
+	f.db.Create(&n.student)
+	f.db.Create(&models.ParentStudent{ParentID: n.parent.ID, StudentID: n.student.ID, Phone: "+254712345678", PhoneVerified: true})
+	return n
+}
+
+func (f *notificationFixture) send(t *testing.T, body map[string]interface{}) models.Notification {
+	body["message"] = "Details"
+	body["category"] = "ANNOUNCEMENT"
+	w := f.do("POST", "/api/v1/notifications", f.admin, body)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var n models.Notification
+	json.Unmarshal(w.Body.Bytes(), &n)
+	return n
+}
+
+func (f *notificationFixture) inbox(t *testing.T, user models.User) ([]string, int) {
+	w := f.do("GET", "/api/v1/notifications/inbox", f.tokens[user.ID], nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Notifications []struct {
+			Title string `json:"title"`
+		} `json:"notifications"`
+		Unread int `json:"unread"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	titles := []string{}
+	for _, n := range resp.Notifications {
+		titles = append(titles, n.Title)
+	}
+	sort.Strings(titles)
+	return titles, resp.Unread
+}
+
+func TestNotifications_InboxForEveryRole(t *testing.T) {
+	f := setupNotificationTest(t)
+
+	w := f.do("POST", "/api/v1/notifications/groups", f.admin, map[string]interface{}{
+		"name": "Bus duty", "user_ids": []uint{f.otherTeacher.ID, f.finance.ID},
+	})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var group models.NotificationGroup
+	json.Unmarshal(w.Body.Bytes(), &group)
+
+	f.send(t, map[string]interface{}{"title": "all", "target_type": "ALL"})
+	f.send(t, map[string]interface{}{"title": "class", "target_type": "CLASS", "target_id": f.class.ID})
+	f.send(t, map[string]interface{}{"title": "class-parents", "target_type": "CLASS_PARENTS", "target_id": f.class.ID})
+	f.send(t, map[string]interface{}{"title": "student", "target_type": "STUDENT", "target_id": f.student.ID})
+	f.send(t, map[string]interface{}{"title": "teachers", "target_type": "TEACHERS"})
+	f.send(t, map[string]interface{}{"title": "class-teachers", "target_type": "TEACHERS", "target_id": f.class.ID})
+	f.send(t, map[string]interface{}{"title": "finance", "target_type": "ROLE", "target_role": "finance"})
+	f.send(t, map[string]interface{}{"title": "users", "target_type": "USERS", "user_ids": []uint{f.parent.ID, f.parent.ID}})
+	f.send(t, map[string]interface{}{"title": "group", "target_type": "GROUP", "target_id": group.ID})
+
+	cases := []struct {
+		user   models.User
+		titles []string
+	}{
+		{f.studentUser, []string{"all", "class", "student"}},
+		{f.parent, []string{"all", "class-parents", "student", "users"}},
+		{f.teacher, []string{"all", "class-teachers", "teachers"}},
+		{f.otherTeacher, []string{"all", "group", "teachers"}},
+		{f.finance, []string{"all", "finance", "group"}},
+	}
+	for _, tc := range cases {
+		titles, unread := f.inbox(t, tc.user)
+		assert.Equal(t, tc.titles, titles, tc.user.Email)
+		assert.Equal(t, len(tc.titles), unread, tc.user.Email)
+	}
+}
+
+func TestNotifications_ReadReceiptsPerUser(t *testing.T) {
+	f := setupNotificationTest(t)
+
+	all := f.send(t, map[string]interface{}{"title": "all", "target_type": "ALL"})
+	student := f.send(t, map[string]interface{}{"title": "student", "target_type": "STUDENT", "target_id": f.student.ID})
+	finance := f.send(t, map[string]interface{}{"title": "finance", "target_type": "ROLE", "target_role": "FINANCE"})
+
+	w := f.do("POST", fmt.Sprintf("/api/v1/notifications/%d/read", student.ID), f.tokens[f.parent.ID], nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	f.do("POST", fmt.Sprintf("/api/v1/notifications/%d/read", student.ID), f.tokens[f.parent.ID], nil)
+
+	// Not addressed to the parent
+	w = f.do("POST", fmt.Sprintf("/api/v1/notifications/%d/read", finance.ID), f.tokens[f.parent.ID], nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = f.do("GET", "/api/v1/notifications/unread-count", f.tokens[f.parent.ID], nil)
+	assert.JSONEq(t, `{"unread": 1}`, w.Body.String())
+	// The student's receipt is separate from their parent's
+	w = f.do("GET", "/api/v1/notifications/unread-count", f.tokens[f.studentUser.ID], nil)
+	assert.JSONEq(t, `{"unread": 2}`, w.Body.String())
+
+	w = f.do("GET", "/api/v1/notifications/inbox?unread=true", f.tokens[f.parent.ID], nil)
+	assert.Contains(t, w.Body.String(), `"total":1`)
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`"id":%d`, all.ID))
+
+	w = f.do("POST", "/api/v1/notifications/read-all", f.tokens[f.studentUser.ID], nil)
+	assert.Contains(t, w.Body.String(), `"marked":2`)
+
+	var my []struct {
+		ID     uint `json:"id"`
+		IsRead bool `json:"is_read"`
+	}
+	w = f.do("GET", "/api/v1/notifications/my", f.tokens[f.studentUser.ID], nil)
+	json.Unmarshal(w.Body.Bytes(), &my)
+	assert.Len(t, my, 2)
+	for _, n := range my {
+		assert.True(t, n.IsRead)
+	}
+
+	var receipts int64
+	f.db.Model(&models.NotificationRead{}).Count(&receipts)
+	assert.Equal(t, int64(3), receipts)
+}
+
+func TestNotifications_TargetValidation(t *testing.T) {
+	f := setupNotificationTest(t)
+	otherSchool := models.School{Name: "Other"}
+	f.db.Create(&otherSchool)
+	outsider := models.User{Email: "out@test.com", Role: "PARENT", SchoolID: &otherSchool.ID}
+	f.db.Create(&outsider)
+
+	bad := []map[string]interface{}{
+		{"target_type": "CLASS"},
+		{"target_type": "CLASS_PARENTS", "target_id": 999},
+		{"target_type": "ROLE", "target_role": "SUPERADMIN"},
+		{"target_type": "USERS"},
+		{"target_type": "USERS", "user_ids": []uint{f.parent.ID, outsider.ID}},
+		{"target_type": "GROUP", "target_id": 1},
+		{"target_type": "EVERYONE"},
+	}
+	for _, body := range bad {
+		body["title"], body["message"], body["category"] = "t", "m", "ANNOUNCEMENT"
+		w := f.do("POST", "/api/v1/notifications", f.admin, body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	// Only the fields that apply are stored
+	n := f.send(t, map[string]interface{}{"title": "all", "target_type": "ALL", "target_id": f.class.ID, "target_role": "PARENT"})
+	assert.Nil(t, n.TargetID)
+	assert.Empty(t, n.TargetRole)
+}
+
+func TestNotifications_Groups(t *testing.T) {
+	f := setupNotificationTest(t)
+
+	w := f.do("POST", "/api/v1/notifications/groups", f.admin, map[string]interface{}{
+		"name": "Drama club parents", "user_ids": []uint{f.parent.ID},
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var group models.NotificationGroup
+	json.Unmarshal(w.Body.Bytes(), &group)
+	assert.Len(t, group.Members, 1)
+
+	w = f.do("POST", "/api/v1/notifications/groups", f.admin, map[string]interface{}{"name": "Drama club parents"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Teachers can see groups but not change them
+	w = f.do("GET", "/api/v1/notifications/groups", f.tokens[f.teacher.ID], nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"members":1`)
+	w = f.do("PUT", fmt.Sprintf("/api/v1/notifications/groups/%d", group.ID), f.tokens[f.teacher.ID], map[string]interface{}{"name": "x"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = f.do("PUT", fmt.Sprintf("/api/v1/notifications/groups/%d", group.ID), f.admin, map[string]interface{}{
+		"name": "Drama club", "user_ids": []uint{f.studentUser.ID, f.teacher.ID},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &group)
+	assert.Equal(t, "Drama club", group.Name)
+	assert.Len(t, group.Members, 2)
+
+	f.send(t, map[string]interface{}{"title": "rehearsal", "target_type": "GROUP", "target_id": group.ID})
+	titles, _ := f.inbox(t, f.teacher)
+	assert.Equal(t, []string{"rehearsal"}, titles)
+	titles, _ = f.inbox(t, f.parent)
+	assert.Empty(t, titles)
+
+	w = f.do("DELETE", fmt.Sprintf("/api/v1/notifications/groups/%d", group.ID), f.admin, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestNotifications_ScheduledPublishDeliversSMSAndEmail(t *testing.T) {
+	f := setupNotificationTest(t)
+	catcher, err := services.StartSMTPCatcher("127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { catcher.Close() })
+	f.db.Create(&models.EmailSettings{SchoolID: f.school.ID, Host: catcher.Host(), Port: catcher.Port(),
+		Encryption: models.EmailEncryptionNone, FromAddress: "office@test.ac.ke"})
+
+	publishAt := time.Now().Add(time.Hour).UTC()
+	n := f.send(t, map[string]interface{}{
+		"title": "Closing day", "target_type": "CLASS_PARENTS", "target_id": f.class.ID,
+		"publish_at": publishAt.Format(time.RFC3339), "send_sms": true, "send_email": true,
+	})
+	assert.Nil(t, n.PublishedAt)
+
+	services.PublishDueNotifications()
+	services.ProcessEvents(10)
+	services.ProcessOutbox(10)
+	titles, _ := f.inbox(t, f.parent)
+	assert.Empty(t, titles)
+	assert.Empty(t, f.provider.Sent())
+	w := f.do("GET", "/api/v1/notifications?status=scheduled", f.admin, nil)
+	assert.Contains(t, w.Body.String(), `"status":"SCHEDULED"`)
+
+	// Friday 7am arrives
+	f.db.Model(&models.Notification{}).Where("id = ?", n.ID).Update("publish_at", time.Now().Add(-time.Minute))
+	assert.Equal(t, 1, services.PublishDueNotifications())
+	assert.Equal(t, 0, services.PublishDueNotifications())
+	services.ProcessEvents(10)
+	services.ProcessOutbox(10)
+
+	titles, _ = f.inbox(t, f.parent)
+	assert.Equal(t, []string{"Closing day"}, titles)
+	sent := f.provider.Sent()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, "+254712345678", sent[0].To)
+	assert.Equal(t, "Closing day: Details", sent[0].Message)
+
+	emails := catcher.Messages()
+	assert.Len(t, emails, 1)
+	assert.Equal(t, []string{"mzazi@test.com"}, emails[0].To)
+	assert.Equal(t, "Closing day", emails[0].Subject)
+
+	f.db.First(&n, n.ID)
+	assert.NotNil(t, n.PublishedAt)
+	assert.NotNil(t, n.SMSJobID)
+	assert.Equal(t, 1, n.EmailsSent)
+}
+
+func TestNotifications_ExpiryAndPinnedPriority(t *testing.T) {
+	f := setupNotificationTest(t)
+
+	w := f.do("POST", "/api/v1/notifications", f.admin, map[string]interface{}{
+		"title": "x", "message": "m", "category": "ANNOUNCEMENT", "target_type": "ALL",
+		"publish_at": time.Now().Add(2 * time.Hour).Format(time.RFC3339),
+		"expires_at": time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	old := f.send(t, map[string]interface{}{"title": "old", "target_type": "ALL", "expires_at": time.Now().Add(time.Hour).Format(time.RFC3339)})
+	f.send(t, map[string]interface{}{"title": "normal", "target_type": "ALL"})
+	f.send(t, map[string]interface{}{"title": "urgent", "target_type": "ALL", "priority": "URGENT"})
+	f.send(t, map[string]interface{}{"title": "pinned", "target_type": "ALL", "pinned": true})
+	f.db.Model(&models.Notification{}).Where("id = ?", old.ID).Update("expires_at", time.Now().Add(-time.Minute))
+
+	w = f.do("GET", "/api/v1/notifications/my", f.tokens[f.parent.ID], nil)
+	var my []struct {
+		Title string `json:"title"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &my)
+	var titles []string
+	for _, n := range my {
+		titles = append(titles, n.Title)
+	}
+	assert.Equal(t, []string{"pinned", "urgent", "normal"}, titles)
+
+	w = f.do("GET", "/api/v1/notifications?status=EXPIRED", f.admin, nil)
+	assert.Contains(t, w.Body.String(), `"title":"old"`)
+	assert.NotContains(t, w.Body.String(), `"title":"normal"`)
+}
+
+func TestNotifications_AcknowledgementReportPerClass(t *testing.T) {
+	f := setupNotificationTest(t)
+
+	plain := f.send(t, map[string]interface{}{"title": "plain", "target_type": "ALL"})
+	w := f.do("POST", fmt.Sprintf("/api/v1/notifications/%d/acknowledge", plain.ID), f.tokens[f.parent.ID], nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	consent := f.send(t, map[string]interface{}{"title": "Trip consent", "target_type": "ALL", "ack_required": true})
+	for i := 0; i < 2; i++ {
+		w = f.do("POST", fmt.Sprintf("/api/v1/notifications/%d/acknowledge", consent.ID), f.tokens[f.parent.ID], nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	f.do("POST", fmt.Sprintf("/api/v1/notifications/%d/acknowledge", consent.ID), f.tokens[f.teacher.ID], nil)
+
+	w = f.do("GET", fmt.Sprintf("/api/v1/notifications/%d/acknowledgements", consent.ID), f.admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report services.AckReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 6, report.Recipients) // admin, student, parent, two teachers, bursar
+	assert.Equal(t, 2, report.Acknowledged)
+	assert.Len(t, report.Classes, 2)
+
+	class := report.Classes[0]
+	assert.Equal(t, "Form 1A", class.ClassName)
+	assert.Equal(t, 2, class.Recipients)
+	assert.Equal(t, 1, class.Acknowledged)
+	assert.Len(t, class.Pending, 1)
+	assert.Equal(t, f.studentUser.ID, class.Pending[0].UserID)
+
+	staff := report.Classes[1]
+	assert.Equal(t, uint(0), staff.ClassID)
+	assert.Equal(t, 4, staff.Recipients)
+	assert.Equal(t, 1, staff.Acknowledged)
+
+	// Acknowledging also marks it read
+	w = f.do("GET", "/api/v1/notifications/inbox", f.tokens[f.parent.ID], nil)
+	assert.Contains(t, w.Body.String(), `"is_read":true,"acknowledged":true`)
+}
@@ -10,13 +10,14 @@ import (
 
 func RegisterParentRoutes(router *gin.RouterGroup) {
 	parent := router.Group("/parent")
-	parent.Use(middleware.AuthMiddleware(), middleware.RoleGuard("PARENT"))
+	parent.Use(middleware.AuthMiddleware(), middleware.RequirePermission("parents.view_own"))
 	{
 		parent.GET("/children", getMyChildren)
 		parent.GET("/child/:studentId/grades", getChildGrades)
 		parent.GET("/child/:studentId/attendance", getChildAttendance)
 		parent.GET("/child/:studentId/fees", getChildFees)
 		parent.GET("/dashboard", getParentDashboard)
+		parent.PUT("/preferences", updateParentPreferences)
 	}
 }
 
@@ -271,3 +272,34 @@ func getParentDashboard(c *gin.Context) {
 		"total_children": len(children),
 	})
 }
+
+// updateParentPreferences - Language and channel (SMS or WhatsApp) for messages to this parent
+func updateParentPreferences(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var input struct {
+		Language       string `json:"language" binding:"omitempty,oneof=en sw"`
+		MessageChannel string `json:"message_channel" binding:"omitempty,oneof=SMS WHATSAPP"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if input.Language != "" {
+		updates["language"] = input.Language
+	}
+	if input.MessageChannel != "" {
+		updates["message_channel"] = input.MessageChannel
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+	models.DB.Model(&models.User{}).Where("id = ?", userID).Updates(updates)
+
+	var user models.User
+	models.DB.Select("id", "language", "message_channel").First(&user, userID)
+	c.JSON(http.StatusOK, gin.H{"language": user.Language, "message_channel": user.MessageChannel})
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 
 	"github.com/gin-gonic/gin"
 )
@@ -11,11 +12,12 @@ import (
 // RegisterParentLinkRoutes - Admin routes for linking parents to students
 func RegisterParentLinkRoutes(router *gin.RouterGroup) {
 	links := router.Group("/parent-links")
-	links.Use(middleware.AuthMiddleware(), middleware.RoleGuard("SCHOOLADMIN"))
+	links.Use(middleware.AuthMiddleware(), middleware.RequirePermission("parents.links.manage"))
 	{
 		links.POST("", createParentLink)
 		links.GET("", listParentLinks)
 		links.DELETE("/:id", deleteParentLink)
+		links.PUT("/:id/phone", updateGuardianPhone)
 		links.GET("/student/:studentId", getStudentParents)
 	}
 }
@@ -24,6 +26,7 @@ type ParentLinkInput struct {
 	ParentID  uint   `json:"parent_id" binding:"required"`
 	StudentID uint   `json:"student_id" binding:"required"`
 	Relation  string `json:"relation"` // FATHER, MOTHER, GUARDIAN
+	Phone     string `json:"phone"`    // Optional guardian number for this child
 }
 
 func createParentLink(c *gin.Context) {
@@ -67,6 +70,16 @@ func createParentLink(c *gin.Context) {
 		Relation:  relation,
 	}
 
+	// Numbers entered by school staff are treated as verified
+	if input.Phone != "" {
+		link.Phone = services.NormalizePhone(input.Phone)
+		if link.Phone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number"})
+			return
+		}
+		link.PhoneVerified = true
+	}
+
 	if err := models.DB.Create(&link).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create link"})
 		return
@@ -75,6 +88,42 @@ func createParentLink(c *gin.Context) {
 	c.JSON(http.StatusCreated, link)
 }
 
+// updateGuardianPhone - Set or clear the number SMS for this child goes to
+func updateGuardianPhone(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var link models.ParentStudent
+	if err := models.DB.Joins("JOIN students ON students.id = parent_students.student_id").
+		Where("parent_students.id = ? AND students.school_id = ?", c.Param("id"), schoolID).
+		First(&link).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
+		return
+	}
+
+	var input struct {
+		Phone string `json:"phone"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	link.Phone = ""
+	link.PhoneVerified = false
+	if input.Phone != "" {
+		link.Phone = services.NormalizePhone(input.Phone)
+		if link.Phone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number"})
+			return
+		}
+		link.PhoneVerified = true
+	}
+
+	models.DB.Model(&link).Select("phone", "phone_verified").Updates(&link)
+
+	c.JSON(http.StatusOK, link)
+}
+
 func listParentLinks(c *gin.Context) {
 	schoolID := c.MustGet("schoolID").(uint)
 
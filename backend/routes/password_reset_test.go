@@ -0,0 +1,252 @@
+package routes_test
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"regexp"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var resetCodePattern = regexp.MustCompile(`code (?:is )?(\d{6})`)
+
+type resetFixture struct {
+	*sessionFixture
+	catcher  *services.SMTPCatcher
+	provider *services.MemorySMSProvider
+	parent   models.User
+}
+
+func setupResetTest(t *testing.T) *resetFixture {
+	f := setupSessionTest(t)
+	f.db.AutoMigrate(&models.PasswordReset{}, &models.EmailLog{}, &models.EmailSettings{},
+		&models.SMSLog{}, &models.SMSSettings{}, &models.SMSOptOut{}, &models.SMSWallet{}, &models.SMSCreditTransaction{},
+		&models.MessageJob{}, &models.OutboundMessage{}, &models.ParentStudent{}, &models.Class{}, &models.VoteHead{}, &models.VoteHeadBalance{})
+
+	catcher, err := services.StartSMTPCatcher("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { catcher.Close() })
+	services.SetDefaultMailer(catcher.Mailer(), mail.Address{Name: "SchoolMS", Address: "noreply@schoolms.test"})
+	t.Cleanup(func() { services.SetDefaultMailer(nil, mail.Address{}) })
+
+	provider := &services.MemorySMSProvider{}
+	services.SetDefaultSMSProvider(provider)
+	t.Cleanup(func() { services.SetDefaultSMSProvider(nil) })
+
+	parent := models.User{Email: "254712000111@parent.local", PasswordHash: f.user.PasswordHash, Role: "PARENT",
+		SchoolID: &f.school.ID, Phone: "+254712000111", PhoneVerified: true}
+	f.db.Create(&parent)
+	routes.RegisterImportRoutes(f.router.Group("/api/v1"))
+	return &resetFixture{sessionFixture: f, catcher: catcher, provider: provider, parent: parent}
+}
+
+func (f *resetFixture) upload(path, token, csv string) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "students.csv")
+	part.Write([]byte(csv))
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", path, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+func (f *resetFixture) emailedCode(t *testing.T) string {
+	caught := f.catcher.Messages()
+	require.NotEmpty(t, caught)
+	code := resetCodePattern.FindStringSubmatch(caught[len(caught)-1].Text)
+	require.Len(t, code, 2)
+	return code[1]
+}
+
+func (f *resetFixture) textedCode(t *testing.T) string {
+	sent := f.provider.Sent()
+	require.NotEmpty(t, sent)
+	code := resetCodePattern.FindStringSubmatch(sent[len(sent)-1].Message)
+	require.Len(t, code, 2)
+	return code[1]
+}
+
+func TestPasswordReset_ByEmailCode(t *testing.T) {
+	f := setupResetTest(t)
+	old := f.login(t, f.user.Email, "password123")
+
+	w := f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"email": strings.ToUpper(f.user.Email)})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	caught := f.catcher.Messages()
+	require.Len(t, caught, 1)
+	assert.Equal(t, []string{f.user.Email}, caught[0].To)
+	assert.Contains(t, caught[0].Subject, "Reset your")
+	code := f.emailedCode(t)
+
+	w = f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{
+		"email": f.user.Email, "code": code, "new_password": "brandnew1",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Old password and sessions are gone, the code can't be reused
+	assert.False(t, f.authorized(old.AccessToken))
+	w = f.do("POST", "/api/v1/auth/login", "", map[string]string{"email": f.user.Email, "password": "password123"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	f.login(t, f.user.Email, "brandnew1")
+	w = f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{
+		"email": f.user.Email, "code": code, "new_password": "another1",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var actions []string
+	f.db.Model(&models.AuditLog{}).Where("user_id = ?", f.user.ID).Order("id").Pluck("action", &actions)
+	assert.Equal(t, []string{models.AuditPasswordResetRequested, models.AuditPasswordResetCompleted, models.AuditLoginFailed}, actions)
+}
+
+func TestPasswordReset_ByEmailedLinkToken(t *testing.T) {
+	f := setupResetTest(t)
+
+	f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"email": f.user.Email})
+	caught := f.catcher.Messages()
+	require.Len(t, caught, 1)
+	token := regexp.MustCompile(`reset-password\?token=([A-Za-z0-9_-]+)`).FindStringSubmatch(caught[0].Text)
+	require.Len(t, token, 2)
+
+	w := f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{"token": "wrong", "new_password": "brandnew1"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{"token": token[1], "new_password": "brandnew1"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	f.login(t, f.user.Email, "brandnew1")
+}
+
+func TestPasswordReset_BySMSForPhoneOnlyParent(t *testing.T) {
+	f := setupResetTest(t)
+
+	// Imported parents only have a placeholder email, so the code goes by SMS
+	w := f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"phone": "0712000111", "channel": "EMAIL"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, f.catcher.Messages())
+	sent := f.provider.Sent()
+	require.Len(t, sent, 1)
+	assert.Equal(t, "+254712000111", sent[0].To)
+	code := f.textedCode(t)
+
+	var logged models.SMSLog
+	f.db.First(&logged)
+	assert.NotContains(t, logged.Message, code)
+	var reset models.PasswordReset
+	f.db.First(&reset)
+	assert.Equal(t, models.ResetChannelSMS, reset.Channel)
+	assert.Equal(t, "+2547******11", reset.Destination)
+
+	w = f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{
+		"phone": "+254712000111", "code": code, "new_password": "brandnew1",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	f.login(t, f.parent.Email, "brandnew1")
+}
+
+func TestPasswordReset_UnknownAccountsLookTheSame(t *testing.T) {
+	f := setupResetTest(t)
+
+	known := f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"email": f.user.Email})
+	unknown := f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"email": "nobody@session.test"})
+	assert.Equal(t, known.Code, unknown.Code)
+	assert.Equal(t, known.Body.String(), unknown.Body.String())
+	assert.Len(t, f.catcher.Messages(), 1)
+
+	w := f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPasswordReset_AttemptAndRequestLimits(t *testing.T) {
+	f := setupResetTest(t)
+
+	f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"email": f.user.Email})
+	code := f.emailedCode(t)
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 0; i < 4; i++ {
+		w := f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{
+			"email": f.user.Email, "code": wrong, "new_password": "brandnew1",
+		})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+	w := f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{
+		"email": f.user.Email, "code": wrong, "new_password": "brandnew1",
+	})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// Locked: even the right code no longer works
+	w = f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{
+		"email": f.user.Email, "code": code, "new_password": "brandnew1",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var locked int64
+	f.db.Model(&models.AuditLog{}).Where("action = ?", models.AuditPasswordResetLocked).Count(&locked)
+	assert.Equal(t, int64(1), locked)
+
+	// A new code replaces the old one; only three are sent per hour
+	f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"email": f.user.Email})
+	first := f.emailedCode(t)
+	f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"email": f.user.Email})
+	second := f.emailedCode(t)
+	f.do("POST", "/api/v1/auth/forgot-password", "", map[string]string{"email": f.user.Email})
+	assert.Len(t, f.catcher.Messages(), 3)
+
+	if first != second {
+		w = f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{
+			"email": f.user.Email, "code": first, "new_password": "brandnew1",
+		})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+	w = f.do("POST", "/api/v1/auth/reset-password", "", map[string]string{
+		"email": f.user.Email, "code": second, "new_password": "brandnew1",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestPasswordReset_ImportedAccountsMustChangePassword(t *testing.T) {
+	f := setupResetTest(t)
+	admin := f.login(t, f.admin.Email, "password123")
+
+	w := f.upload("/api/v1/import/students", admin.AccessToken, "adm_no,name,email,parent_phone\nA100,Jane Doe,jane@student.test,0712000222\n")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var student models.User
+	require.NoError(t, f.db.Where("email = ?", "jane@student.test").First(&student).Error)
+	assert.True(t, student.MustChangePassword)
+	var parent models.User
+	require.NoError(t, f.db.Where("phone = ?", "+254712000222").First(&parent).Error)
+	assert.True(t, parent.MustChangePassword)
+
+	w = f.do("POST", "/api/v1/auth/login", "", map[string]string{"email": student.Email, "password": "changeme123"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"must_change_password":true`)
+	pair := f.login(t, student.Email, "changeme123")
+
+	// Everything but changing the password and signing out is blocked
+	w = f.do("POST", "/api/v1/import/students", pair.AccessToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "PASSWORD_CHANGE_REQUIRED")
+	assert.True(t, f.authorized(pair.AccessToken))
+
+	w = f.do("POST", "/api/v1/auth/change-password", pair.AccessToken,
+		map[string]string{"current_password": "changeme123", "new_password": "mine12345"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	f.db.First(&student, student.ID)
+	assert.False(t, student.MustChangePassword)
+	w = f.do("POST", "/api/v1/import/students", pair.AccessToken, nil)
+	assert.NotContains(t, w.Body.String(), "PASSWORD_CHANGE_REQUIRED")
+}
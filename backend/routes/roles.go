@@ -0,0 +1,266 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"schoolms-go/middleware"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CustomRoleInput - A school's own role and the permissions it grants
+type CustomRoleInput struct {
+	Name        string   `json:"name" binding:"required"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions" binding:"required"`
+}
+
+// AssignCustomRoleInput - The custom role to give a user; null puts them back on their role's defaults
+type AssignCustomRoleInput struct {
+	CustomRoleID *uint `json:"custom_role_id"`
+}
+
+func RegisterRoleRoutes(router *gin.RouterGroup) {
+	roles := router.Group("/roles")
+	roles.Use(middleware.AuthMiddleware(), middleware.RequirePermission("roles.manage"))
+	{
+		roles.GET("", listRoles)
+		roles.GET("/permissions", listPermissionCatalog)
+		roles.POST("", createCustomRole)
+		roles.PUT("/:id", updateCustomRole)
+		roles.DELETE("/:id", deleteCustomRole)
+	}
+}
+
+func customRoleJSON(role models.CustomRole, users int64) gin.H {
+	return gin.H{
+		"id":          role.ID,
+		"name":        role.Name,
+		"description": role.Description,
+		"permissions": append([]string{}, services.ParsePermissions(role.Permissions)...),
+		"user_count":  users,
+		"created_at":  role.CreatedAt,
+		"updated_at":  role.UpdatedAt,
+	}
+}
+
+// myPermissions - What the signed-in user may do, so the app can show only what works
+func myPermissions(c *gin.Context) {
+	permissions := middleware.Permissions(c)
+	c.JSON(http.StatusOK, gin.H{"role": c.MustGet("role"), "permissions": append([]string{}, permissions...)})
+}
+
+// listRoles - The built-in roles' default bundles and the school's custom roles
+func listRoles(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	builtIn := []gin.H{}
+	for _, role := range services.BuiltInRoles {
+		if role == services.RoleSuperAdmin || role == services.RoleService {
+			continue
+		}
+		builtIn = append(builtIn, gin.H{"name": role, "permissions": services.DefaultPermissions(role)})
+	}
+
+	var custom []models.CustomRole
+	models.DB.Where("school_id = ?", schoolID).Order("name").Find(&custom)
+	out := make([]gin.H, len(custom))
+	for i, role := range custom {
+		var users int64
+		models.DB.Model(&models.User{}).Where("custom_role_id = ?", role.ID).Count(&users)
+		out[i] = customRoleJSON(role, users)
+	}
+	c.JSON(http.StatusOK, gin.H{"built_in": builtIn, "custom": out})
+}
+
+// listPermissionCatalog - Every permission a custom role may include
+func listPermissionCatalog(c *gin.Context) {
+	catalog := []services.Permission{}
+	for _, p := range services.Permissions {
+		if !p.Platform() {
+			catalog = append(catalog, p)
+		}
+	}
+	c.JSON(http.StatusOK, catalog)
+}
+
+// bindCustomRole - Validate the input; users can only hand out permissions they have themselves
+func bindCustomRole(c *gin.Context) (CustomRoleInput, []string, bool) {
+	var input CustomRoleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return input, nil, false
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" || slices.Contains(services.BuiltInRoles, strings.ToUpper(input.Name)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Choose a name that isn't a built-in role"})
+		return input, nil, false
+	}
+	permissions, err := services.ValidateCustomPermissions(input.Permissions)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return input, nil, false
+	}
+	if missing := permissionsNotHeld(c, permissions); len(missing) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't grant permissions you don't have", "permissions": missing})
+		return input, nil, false
+	}
+	return input, permissions, true
+}
+
+// permissionsNotHeld - Those the current user lacks; personal ones only reach the holder's own records, so don't count
+func permissionsNotHeld(c *gin.Context, permissions []string) []string {
+	held := middleware.Permissions(c)
+	var missing []string
+	for _, p := range permissions {
+		if !services.IsPersonalPermission(p) && !slices.Contains(held, p) {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// createCustomRole - Define a role for the school, e.g. a deputy principal who can see finance but not change it
+func createCustomRole(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	input, permissions, ok := bindCustomRole(c)
+	if !ok {
+		return
+	}
+
+	role := models.CustomRole{
+		SchoolID:    schoolID,
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: strings.Join(permissions, ","),
+	}
+	if err := models.DB.Create(&role).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A role with this name already exists"})
+		return
+	}
+	models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditCustomRoleChange, "CustomRole", role.ID,
+		"", role.Name+": "+role.Permissions, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusCreated, customRoleJSON(role, 0))
+}
+
+// updateCustomRole - Rename a custom role or change its permissions; takes effect on the users' next request
+func updateCustomRole(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	var role models.CustomRole
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&role).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	input, permissions, ok := bindCustomRole(c)
+	if !ok {
+		return
+	}
+
+	old := role.Name + ": " + role.Permissions
+	role.Name, role.Description, role.Permissions = input.Name, input.Description, strings.Join(permissions, ",")
+	if err := models.DB.Save(&role).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A role with this name already exists"})
+		return
+	}
+	models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditCustomRoleChange, "CustomRole", role.ID,
+		old, role.Name+": "+role.Permissions, c.ClientIP(), c.Request.UserAgent())
+
+	var users int64
+	models.DB.Model(&models.User{}).Where("custom_role_id = ?", role.ID).Count(&users)
+	c.JSON(http.StatusOK, customRoleJSON(role, users))
+}
+
+// deleteCustomRole - Remove a custom role; its users go back to their built-in role's defaults
+func deleteCustomRole(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	var role models.CustomRole
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&role).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+
+	var released int64
+	err := models.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.User{}).Where("custom_role_id = ?", role.ID).Update("custom_role_id", nil)
+		if result.Error != nil {
+			return result.Error
+		}
+		released = result.RowsAffected
+		return tx.Delete(&role).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete role"})
+		return
+	}
+	models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditCustomRoleChange, "CustomRole", role.ID,
+		role.Name+": "+role.Permissions, "", c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted", "users_reset": released})
+}
+
+// assignCustomRole - Give a user one of the school's custom roles, or put them back on their defaults
+func assignCustomRole(c *gin.Context) {
+	actorID := c.MustGet("userID").(uint)
+	user, ok := managedUser(c)
+	if !ok {
+		return
+	}
+	var input AssignCustomRoleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if user.ID == actorID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+	if user.Role == services.RoleSuperAdmin || user.SchoolID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Platform admins can't be given a school role"})
+		return
+	}
+	if user.Role == services.RoleService {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Service accounts get their permissions from their API keys' scopes"})
+		return
+	}
+	// Nor may anyone demote a user who can do more than they can
+	if missing := permissionsNotHeld(c, services.UserPermissions(user.ID, 0, user.Role)); len(missing) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't change the role of someone with permissions you don't have"})
+		return
+	}
+
+	newName := user.Role
+	if input.CustomRoleID != nil {
+		var role models.CustomRole
+		err := models.DB.Where("id = ? AND school_id = ?", *input.CustomRoleID, *user.SchoolID).First(&role).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Custom role not found in the user's school"})
+			return
+		}
+		if missing := permissionsNotHeld(c, services.ParsePermissions(role.Permissions)); len(missing) > 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can't grant permissions you don't have", "permissions": missing})
+			return
+		}
+		newName = role.Name
+	}
+
+	oldName := user.Role
+	if user.CustomRoleID != nil {
+		var old models.CustomRole
+		if models.DB.First(&old, *user.CustomRoleID).Error == nil {
+			oldName = old.Name
+		}
+	}
+	models.DB.Model(&user).Update("custom_role_id", input.CustomRoleID)
+	models.CreateAuditLog(schoolIDOf(user), actorID, models.AuditRoleChange, "User", user.ID,
+		oldName, newName, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{
+		"message":        fmt.Sprintf("%s now has the %s role", user.Email, newName),
+		"custom_role_id": input.CustomRoleID,
+		"permissions":    services.UserPermissions(user.ID, 0, user.Role),
+	})
+}
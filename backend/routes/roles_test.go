@@ -0,0 +1,135 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupRoleTest(t *testing.T) *sessionFixture {
+	f := setupSessionTest(t)
+	f.db.AutoMigrate(&models.CustomRole{}, &models.Class{}, &models.FeeStructure{})
+	api := f.router.Group("/api/v1")
+	routes.RegisterRoleRoutes(api)
+	routes.RegisterFinanceRoutes(api)
+	return f
+}
+
+func (f *sessionFixture) permissions(t *testing.T, token string) []string {
+	w := f.do("GET", "/api/v1/auth/permissions", token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var out struct {
+		Permissions []string `json:"permissions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return out.Permissions
+}
+
+func (f *sessionFixture) createRole(t *testing.T, token, name string, permissions ...string) uint {
+	w := f.do("POST", "/api/v1/roles", token, map[string]interface{}{"name": name, "permissions": permissions})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var role struct {
+		ID uint `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &role)
+	return role.ID
+}
+
+func TestRoles_CustomRoleReplacesDefaultBundle(t *testing.T) {
+	f := setupRoleTest(t)
+	admin := f.login(t, f.admin.Email, "password123")
+	teacher := f.login(t, f.user.Email, "password123")
+
+	// Teachers may create fee structures by default (400 here is the missing body, not a 403)
+	assert.Contains(t, f.permissions(t, teacher.AccessToken), "grades.create")
+	assert.Equal(t, http.StatusBadRequest, f.do("POST", "/api/v1/finance/fees", teacher.AccessToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, f.do("GET", "/api/v1/roles", teacher.AccessToken, nil).Code)
+
+	for _, bad := range []map[string]interface{}{
+		{"name": "Bursar", "permissions": []string{"finance.everything"}},
+		{"name": "Owner", "permissions": []string{"platform.schools.manage"}},
+		{"name": "teacher", "permissions": []string{"grades.view"}},
+	} {
+		w := f.do("POST", "/api/v1/roles", admin.AccessToken, bad)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	}
+
+	// The deputy principal sees finance but can't change it
+	deputy := f.createRole(t, admin.AccessToken, "Deputy Principal", "students.view", "finance.fees.view", "finance.payments.view")
+	w := f.do("POST", "/api/v1/roles", admin.AccessToken, map[string]interface{}{"name": "Deputy Principal", "permissions": []string{"grades.view"}})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = f.do("PUT", fmt.Sprintf("/api/v1/users/%d/custom-role", f.user.ID), admin.AccessToken, map[string]interface{}{"custom_role_id": deputy})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"students.view", "finance.fees.view", "finance.payments.view"}, f.permissions(t, teacher.AccessToken))
+	assert.Equal(t, http.StatusOK, f.do("GET", "/api/v1/finance/fees", teacher.AccessToken, nil).Code)
+	w = f.do("POST", "/api/v1/finance/fees", teacher.AccessToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "finance.fees.create")
+
+	// Changes apply to the next request, without signing in again
+	w = f.do("PUT", fmt.Sprintf("/api/v1/roles/%d", deputy), admin.AccessToken, map[string]interface{}{
+		"name": "Deputy Principal", "permissions": []string{"finance.fees.view", "finance.fees.create"},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"user_count":1`)
+	assert.Equal(t, http.StatusBadRequest, f.do("POST", "/api/v1/finance/fees", teacher.AccessToken, nil).Code)
+
+	w = f.do("GET", "/api/v1/roles", admin.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"Deputy Principal"`)
+	assert.Contains(t, w.Body.String(), `"name":"FINANCE"`)
+	assert.NotContains(t, w.Body.String(), "platform.schools.manage")
+
+	// Deleting the role puts its users back on their defaults
+	w = f.do("DELETE", fmt.Sprintf("/api/v1/roles/%d", deputy), admin.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"users_reset":1`)
+	assert.Contains(t, f.permissions(t, teacher.AccessToken), "grades.create")
+
+	var changes, assignments int64
+	f.db.Model(&models.AuditLog{}).Where("action = ?", models.AuditCustomRoleChange).Count(&changes)
+	f.db.Model(&models.AuditLog{}).Where("action = ?", models.AuditRoleChange).Count(&assignments)
+	assert.Equal(t, int64(3), changes)
+	assert.Equal(t, int64(1), assignments)
+}
+
+func TestRoles_CannotGrantMoreThanYouHave(t *testing.T) {
+	f := setupRoleTest(t)
+	admin := f.login(t, f.admin.Email, "password123")
+
+	// A registrar who may manage roles, but has no finance access
+	registrar := f.createRole(t, admin.AccessToken, "Registrar", "roles.manage", "students.view", "users.manage")
+	w := f.do("PUT", fmt.Sprintf("/api/v1/users/%d/custom-role", f.user.ID), admin.AccessToken, map[string]interface{}{"custom_role_id": registrar})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	token := f.login(t, f.user.Email, "password123").AccessToken
+
+	w = f.do("POST", "/api/v1/roles", token, map[string]interface{}{"name": "Clerk", "permissions": []string{"students.view"}})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = f.do("POST", "/api/v1/roles", token, map[string]interface{}{"name": "Bursar", "permissions": []string{"finance.reports.view"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "finance.reports.view")
+
+	// Nor hand out an existing role that holds more, or change their own role
+	bursar := f.createRole(t, admin.AccessToken, "Bursar", "finance.reports.view")
+	w = f.do("PUT", fmt.Sprintf("/api/v1/users/%d/custom-role", f.admin.ID), token, map[string]interface{}{"custom_role_id": bursar})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	clerk := models.CustomRole{}
+	f.db.Where("name = ?", "Clerk").First(&clerk)
+	w = f.do("PUT", fmt.Sprintf("/api/v1/users/%d/custom-role", f.admin.ID), token, map[string]interface{}{"custom_role_id": clerk.ID})
+	assert.Equal(t, http.StatusForbidden, w.Code, "can't demote the admin either")
+	w = f.do("PUT", fmt.Sprintf("/api/v1/users/%d/custom-role", f.user.ID), token, map[string]interface{}{"custom_role_id": nil})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Roles from another school can't be used
+	other := models.CustomRole{SchoolID: f.school.ID + 1, Name: "Elsewhere", Permissions: "students.view"}
+	f.db.Create(&other)
+	w = f.do("PUT", fmt.Sprintf("/api/v1/users/%d/custom-role", f.user.ID), admin.AccessToken, map[string]interface{}{"custom_role_id": other.ID})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
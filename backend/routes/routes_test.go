@@ -43,7 +43,7 @@ func (s *TestSuite) SetupSuite() {
 		&models.Attendance{}, &models.Timetable{}, &models.ParentStudent{},
 		&models.VoteHead{}, &models.FeeItem{}, &models.VoteHeadBalance{}, &models.PaymentAllocation{}, &models.MPESATransaction{},
 		&models.IntakeGroup{}, &models.Course{}, &models.Module{}, &models.IndustrialAttachment{},
-		&models.AuditLog{},
+		&models.AuditLog{}, &models.UserSession{}, &models.LoginFailure{}, &models.Membership{},
 	)
 
 	models.DB = db
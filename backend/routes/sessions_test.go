@@ -0,0 +1,264 @@
+package routes_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"schoolms-go/utils"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type sessionFixture struct {
+	db     *gorm.DB
+	router *gin.Engine
+	school models.School
+	admin  models.User
+	user   models.User
+}
+
+func setupSessionTest(t *testing.T) *sessionFixture {
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	db.AutoMigrate(&models.User{}, &models.School{}, &models.Student{}, &models.Invite{},
+		&models.UserSession{}, &models.AuditLog{}, &models.LoginFailure{}, &models.Membership{})
+	models.DB = db
+
+	f := &sessionFixture{db: db, router: gin.New(), school: models.School{Name: "Session School"}}
+	db.Create(&f.school)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	f.admin = models.User{Email: "admin@session.test", PasswordHash: string(hash), Role: "SCHOOLADMIN", SchoolID: &f.school.ID}
+	f.user = models.User{Email: "teacher@session.test", PasswordHash: string(hash), Role: "TEACHER", SchoolID: &f.school.ID}
+	db.Create(&f.admin)
+	db.Create(&f.user)
+
+	api := f.router.Group("/api/v1")
+	routes.RegisterAuthRoutes(api)
+	routes.RegisterUserRoutes(api)
+	return f
+}
+
+// sessionToken - An access token for a new session, as signing in would issue
+func sessionToken(t *testing.T, user models.User) string {
+	pair, _, err := services.StartSession(user, "127.0.0.1", "test")
+	require.NoError(t, err)
+	return pair.AccessToken
+}
+
+func (f *sessionFixture) do(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func (f *sessionFixture) login(t *testing.T, email, password string) tokenPair {
+	w := f.do("POST", "/api/v1/auth/login", "", map[string]string{"email": email, "password": password})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var pair tokenPair
+	json.Unmarshal(w.Body.Bytes(), &pair)
+	require.NotEmpty(t, pair.AccessToken)
+	require.NotEmpty(t, pair.RefreshToken)
+	return pair
+}
+
+func (f *sessionFixture) refresh(refreshToken string) (*httptest.ResponseRecorder, tokenPair) {
+	w := f.do("POST", "/api/v1/auth/refresh", "", map[string]string{"refresh_token": refreshToken})
+	var pair tokenPair
+	json.Unmarshal(w.Body.Bytes(), &pair)
+	return w, pair
+}
+
+// authorized - Whether the access token is still accepted
+func (f *sessionFixture) authorized(token string) bool {
+	return f.do("GET", "/api/v1/auth/sessions", token, nil).Code == http.StatusOK
+}
+
+func TestSessions_LoginIssuesShortLivedAccessAndRotatingRefresh(t *testing.T) {
+	f := setupSessionTest(t)
+
+	first := f.login(t, f.user.Email, "password123")
+	assert.Equal(t, 900, first.ExpiresIn)
+	assert.True(t, f.authorized(first.AccessToken))
+
+	w, second := f.refresh(first.RefreshToken)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.True(t, f.authorized(second.AccessToken))
+
+	var stored models.UserSession
+	f.db.First(&stored)
+	assert.NotContains(t, []string{stored.RefreshTokenHash, stored.PreviousTokenHash}, second.RefreshToken)
+
+	// The rotated-out token is refused, and replaying it kills the session
+	w, _ = f.refresh(first.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.False(t, f.authorized(second.AccessToken))
+	w, _ = f.refresh(second.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	f.db.First(&stored, stored.ID)
+	assert.Equal(t, models.SessionRevokedTokenReuse, stored.RevokedReason)
+
+	w, _ = f.refresh("not-a-token")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// A validly signed token without a session can't be revoked, so it is refused
+	sessionless, _ := utils.GenerateAccessToken(f.user.ID, f.user.Role, f.user.SchoolID, 0, 0)
+	assert.False(t, f.authorized(sessionless))
+}
+
+func TestSessions_LogoutAndLogoutAll(t *testing.T) {
+	f := setupSessionTest(t)
+
+	laptop := f.login(t, f.user.Email, "password123")
+	phone := f.login(t, f.user.Email, "password123")
+
+	w := f.do("POST", "/api/v1/auth/logout", laptop.AccessToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, f.authorized(laptop.AccessToken))
+	w, _ = f.refresh(laptop.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.True(t, f.authorized(phone.AccessToken))
+
+	// The refresh token alone signs a device out, as the app does once its access token has expired
+	desktop := f.login(t, f.user.Email, "password123")
+	w = f.do("POST", "/api/v1/auth/logout", "", map[string]string{"refresh_token": desktop.RefreshToken})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, f.authorized(desktop.AccessToken))
+	w = f.do("POST", "/api/v1/auth/logout", "", map[string]string{"refresh_token": desktop.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	tablet := f.login(t, f.user.Email, "password123")
+	w = f.do("POST", "/api/v1/auth/logout-all", tablet.AccessToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"revoked":2`)
+	assert.False(t, f.authorized(phone.AccessToken))
+	assert.False(t, f.authorized(tablet.AccessToken))
+
+	var audit models.AuditLog
+	assert.NoError(t, f.db.Where("action = ?", models.AuditSessionsRevoked).First(&audit).Error)
+}
+
+func TestSessions_ListAndRevokeADevice(t *testing.T) {
+	f := setupSessionTest(t)
+
+	laptop := f.login(t, f.user.Email, "password123")
+	phone := f.login(t, f.user.Email, "password123")
+	other := f.login(t, f.admin.Email, "password123")
+
+	w := f.do("GET", "/api/v1/auth/sessions", laptop.AccessToken, nil)
+	var sessions []struct {
+		ID      uint `json:"id"`
+		Current bool `json:"current"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &sessions)
+	require.Len(t, sessions, 2)
+
+	var phoneID uint
+	for _, s := range sessions {
+		if !s.Current {
+			phoneID = s.ID
+		}
+	}
+	require.NotZero(t, phoneID)
+
+	// Someone else's session can't be touched
+	var adminSession models.UserSession
+	f.db.Where("user_id = ?", f.admin.ID).First(&adminSession)
+	w = f.do("DELETE", fmt.Sprintf("/api/v1/auth/sessions/%d", adminSession.ID), laptop.AccessToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.True(t, f.authorized(other.AccessToken))
+
+	w = f.do("DELETE", fmt.Sprintf("/api/v1/auth/sessions/%d", phoneID), laptop.AccessToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, f.authorized(phone.AccessToken))
+	assert.True(t, f.authorized(laptop.AccessToken))
+}
+
+func TestSessions_PasswordChangeRevokesOtherDevices(t *testing.T) {
+	f := setupSessionTest(t)
+
+	laptop := f.login(t, f.user.Email, "password123")
+	phone := f.login(t, f.user.Email, "password123")
+
+	w := f.do("POST", "/api/v1/auth/change-password", laptop.AccessToken,
+		map[string]string{"current_password": "wrong", "new_password": "newpassword"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.True(t, f.authorized(phone.AccessToken))
+
+	w = f.do("POST", "/api/v1/auth/change-password", laptop.AccessToken,
+		map[string]string{"current_password": "password123", "new_password": "newpassword"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, f.authorized(laptop.AccessToken))
+	assert.False(t, f.authorized(phone.AccessToken))
+	w, _ = f.refresh(phone.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = f.do("POST", "/api/v1/auth/login", "", map[string]string{"email": f.user.Email, "password": "password123"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	f.login(t, f.user.Email, "newpassword")
+}
+
+func TestSessions_DeactivationCutsOffAccess(t *testing.T) {
+	f := setupSessionTest(t)
+
+	admin := f.login(t, f.admin.Email, "password123")
+	teacher := f.login(t, f.user.Email, "password123")
+
+	// Admins of another school can't see the user
+	otherSchool := models.School{Name: "Other"}
+	f.db.Create(&otherSchool)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	f.db.Create(&models.User{Email: "other@session.test", PasswordHash: string(hash), Role: "SCHOOLADMIN", SchoolID: &otherSchool.ID})
+	other := f.login(t, "other@session.test", "password123")
+	w := f.do("POST", fmt.Sprintf("/api/v1/users/%d/deactivate", f.user.ID), other.AccessToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = f.do("POST", fmt.Sprintf("/api/v1/users/%d/deactivate", f.admin.ID), admin.AccessToken, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = f.do("POST", fmt.Sprintf("/api/v1/users/%d/deactivate", f.user.ID), teacher.AccessToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = f.do("POST", fmt.Sprintf("/api/v1/users/%d/deactivate", f.user.ID), admin.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"sessions_revoked":1`)
+	assert.False(t, f.authorized(teacher.AccessToken))
+	w, _ = f.refresh(teacher.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = f.do("POST", "/api/v1/auth/login", "", map[string]string{"email": f.user.Email, "password": "password123"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = f.do("POST", fmt.Sprintf("/api/v1/users/%d/reactivate", f.user.ID), admin.AccessToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	f.login(t, f.user.Email, "password123")
+
+	var count int64
+	f.db.Model(&models.AuditLog{}).Where("action IN ?", []string{models.AuditUserDeactivated, models.AuditUserReactivated}).Count(&count)
+	assert.Equal(t, int64(2), count)
+}
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"errors"
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
@@ -11,12 +12,33 @@ import (
 
 func RegisterSMSRoutes(router *gin.RouterGroup) {
 	sms := router.Group("/sms")
-	sms.Use(middleware.AuthMiddleware(), middleware.RoleGuard("SCHOOLADMIN"))
 	{
+		// Provider callbacks - no auth, guarded by SMS_CALLBACK_TOKEN
+		sms.POST("/callbacks/delivery", smsDeliveryReport)
+		sms.POST("/callbacks/inbound", smsInbound)
+
+		sms.Use(middleware.AuthMiddleware(), middleware.RequirePermission("sms.manage"))
 		sms.POST("/send", sendSingleSMS)
 		sms.POST("/broadcast", sendBroadcastSMS)
+		sms.POST("/broadcast/estimate", estimateBroadcastSMS)
 		sms.POST("/fee-reminders", sendFeeReminders)
+		sms.POST("/fee-reminders/estimate", estimateFeeReminders)
 		sms.GET("/logs", getSMSLogs)
+		sms.GET("/jobs", listMessageJobs)
+		sms.GET("/jobs/:id", getMessageJob)
+		sms.GET("/wallet", getSMSWallet)
+		sms.GET("/wallet/statement", getSMSStatement)
+		sms.GET("/settings", getSMSSettings)
+		sms.PUT("/settings", updateSMSSettings)
+		sms.GET("/templates", listMessageTemplates)
+		sms.PUT("/templates/:name", saveMessageTemplate)
+		sms.DELETE("/templates/:name", resetMessageTemplate)
+		sms.POST("/templates/preview", previewMessageTemplate)
+		sms.GET("/inbox", listInboundMessages)
+		sms.POST("/inbox/:id/read", markInboundMessageRead)
+		sms.GET("/opt-outs", listSMSOptOuts)
+		sms.POST("/opt-outs", createSMSOptOut)
+		sms.DELETE("/opt-outs/:id", deleteSMSOptOut)
 	}
 }
 
@@ -34,21 +56,25 @@ func sendSingleSMS(c *gin.Context) {
 		return
 	}
 
-	result := services.SendSMS(input.Phone, input.Message)
+	result := services.SendSchoolSMS(schoolID, input.Phone, input.Message)
 	services.LogSMSSent(schoolID, input.Phone, input.Message, result)
 
 	c.JSON(http.StatusOK, gin.H{
-		"success": result.Success,
-		"status":  result.Status,
-		"cost":    result.Cost,
-		"error":   result.Error,
+		"success":  result.Success,
+		"status":   result.Status,
+		"cost":     result.Cost,
+		"error":    result.Error,
+		"provider": result.Provider,
+		"segments": result.Segments,
+		"charged":  result.Charged,
 	})
 }
 
 type BroadcastInput struct {
-	Message string `json:"message" binding:"required"`
-	Target  string `json:"target" binding:"required"` // STUDENTS, PARENTS, ALL
-	ClassID *uint  `json:"class_id"`                  // Optional filter
+	Message   string `json:"message" binding:"required"`
+	MessageSW string `json:"message_sw"`                // Optional Swahili text for Swahili-speaking recipients
+	Target    string `json:"target" binding:"required"` // STUDENTS, PARENTS, ALL
+	ClassID   *uint  `json:"class_id"`                  // Optional filter
 }
 
 func sendBroadcastSMS(c *gin.Context) {
@@ -60,12 +86,48 @@ func sendBroadcastSMS(c *gin.Context) {
 		return
 	}
 
-	// Get school name
-	var school models.School
-	models.DB.First(&school, schoolID)
+	messages, err := broadcastMessages(schoolID, input)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Queue for the outbox workers; survives restarts and retries failures
+	job, ok := enqueueSMSJob(c, models.MessageJobBroadcast, messages)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "Broadcast queued",
+		"job_id":     job.ID,
+		"recipients": len(messages),
+	})
+}
+
+// estimateBroadcastSMS - Recipients, SMS parts and cost of a broadcast without sending it
+func estimateBroadcastSMS(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var input BroadcastInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	messages, err := broadcastMessages(schoolID, input)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondSMSEstimate(c, schoolID, messages)
+}
 
-	// Collect phone numbers based on target
-	var phones []string
+// broadcastMessages - One message per distinct number, in each recipient's language
+func broadcastMessages(schoolID uint, input BroadcastInput) ([]services.SMSMessage, error) {
+	// Collect phone numbers and languages based on target
+	type recipient struct{ phone, language string }
+	var recipients []recipient
 
 	if input.Target == "STUDENTS" || input.Target == "ALL" {
 		var students []models.Student
@@ -76,8 +138,8 @@ func sendBroadcastSMS(c *gin.Context) {
 		query.Preload("User").Find(&students)
 
 		for _, s := range students {
-			if s.User.Email != "" { // Using email as phone placeholder
-				phones = append(phones, s.User.Email)
+			if s.User.Phone != "" && s.User.PhoneVerified {
+				recipients = append(recipients, recipient{s.User.Phone, s.User.Language})
 			}
 		}
 	}
@@ -89,102 +151,158 @@ func sendBroadcastSMS(c *gin.Context) {
 			Preload("Parent").Find(&links)
 
 		for _, l := range links {
-			if l.Parent.Email != "" {
-				phones = append(phones, l.Parent.Email)
+			if phone := services.GuardianPhone(l); phone != "" {
+				recipients = append(recipients, recipient{phone, l.Parent.Language})
 			}
 		}
 	}
 
-	// Remove duplicates
+	// Remove duplicates and build messages in each recipient's language
 	phoneMap := make(map[string]bool)
-	uniquePhones := []string{}
-	for _, p := range phones {
-		if !phoneMap[p] {
-			phoneMap[p] = true
-			uniquePhones = append(uniquePhones, p)
+	var messages []services.SMSMessage
+	for _, r := range recipients {
+		if phoneMap[r.phone] {
+			continue
 		}
-	}
+		phoneMap[r.phone] = true
 
-	// Build messages
-	messages := make([]services.SMSMessage, len(uniquePhones))
-	for i, phone := range uniquePhones {
-		messages[i] = services.SMSMessage{
-			To:      phone,
-			Message: school.Name + ": " + input.Message,
+		text := input.Message
+		if r.language == models.LanguageSwahili && input.MessageSW != "" {
+			text = input.MessageSW
 		}
-	}
-
-	// Send (async in background)
-	go func() {
-		results := services.SendBulkSMS(messages)
-		for i, r := range results {
-			services.LogSMSSent(schoolID, uniquePhones[i], input.Message, r)
+		message, err := services.RenderMessage(schoolID, models.TemplateBroadcast, r.language, services.MergeFields{"message": text})
+		if err != nil {
+			return nil, err
 		}
-	}()
+		messages = append(messages, services.SMSMessage{To: r.phone, Message: message})
+	}
+	return messages, nil
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":    "Broadcast queued",
-		"recipients": len(uniquePhones),
-	})
+type FeeReminderInput struct {
+	MinBalance float64 `json:"min_balance"` // Only students owing >= this
+	DueDate    string  `json:"due_date"`    // Fills {{due_date}} in the template
 }
 
 func sendFeeReminders(c *gin.Context) {
 	schoolID := c.MustGet("schoolID").(uint)
 
-	var input struct {
-		MinBalance float64 `json:"min_balance"` // Only students owing >= this
+	var input FeeReminderInput
+	c.ShouldBindJSON(&input)
+
+	messages, defaulters, noPhone, err := feeReminderMessages(schoolID, input)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+
+	job, ok := enqueueSMSJob(c, models.MessageJobFeeReminder, messages)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"total_defaulters": defaulters,
+		"reminders_queued": len(messages),
+		"without_phone":    noPhone,
+		"job_id":           job.ID,
+	})
+}
+
+// estimateFeeReminders - What a fee reminder run would cost
+func estimateFeeReminders(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var input FeeReminderInput
 	c.ShouldBindJSON(&input)
 
+	messages, _, _, err := feeReminderMessages(schoolID, input)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondSMSEstimate(c, schoolID, messages)
+}
+
+// feeReminderMessages - Reminders to every verified guardian of a defaulter, in their language
+func feeReminderMessages(schoolID uint, input FeeReminderInput) ([]services.SMSMessage, int, int, error) {
 	if input.MinBalance == 0 {
 		input.MinBalance = 1000 // Default 1000 KES
 	}
 
 	// Get students with outstanding balances
 	type StudentBalance struct {
-		StudentID   uint
-		StudentName string
-		ParentPhone string
-		Balance     float64
+		StudentID uint
+		Balance   float64
 	}
 
 	var balances []StudentBalance
 	models.DB.Raw(`
 		SELECT 
 			s.id as student_id,
-			u.email as student_name,
-			u.email as parent_phone,
 			COALESCE(SUM(vhb.balance), 0) as balance
 		FROM students s
-		JOIN users u ON u.id = s.user_id
 		LEFT JOIN vote_head_balances vhb ON vhb.student_id = s.id
 		WHERE s.school_id = ?
-		GROUP BY s.id, u.email
+		GROUP BY s.id
 		HAVING COALESCE(SUM(vhb.balance), 0) >= ?
 	`, schoolID, input.MinBalance).Scan(&balances)
 
-	// Send reminders
-	var sent int
+	var messages []services.SMSMessage
+	noPhone := 0
 	for _, b := range balances {
-		if b.ParentPhone != "" {
-			result := services.SendFeeReminder(b.ParentPhone, b.StudentName, b.Balance)
-			services.LogSMSSent(schoolID, b.ParentPhone, "Fee reminder", result)
-			if result.Success {
-				sent++
+		guardians := services.GuardiansForStudent(b.StudentID)
+		if len(guardians) == 0 {
+			noPhone++
+			continue
+		}
+
+		var student models.Student
+		models.DB.Preload("User").Preload("Class").First(&student, b.StudentID)
+		fields := services.StudentMergeFields(student, b.Balance)
+		fields["due_date"] = input.DueDate
+
+		for _, g := range guardians {
+			message, err := services.GuardianMessage(schoolID, g, models.TemplateFeeReminder, fields)
+			if err != nil {
+				return nil, 0, 0, err
 			}
+			messages = append(messages, message)
 		}
 	}
+	return messages, len(balances), noPhone, nil
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"total_defaulters": len(balances),
-		"reminders_sent":   sent,
-	})
+// enqueueSMSJob - Queue a batch, answering 402 with the estimate if the wallet can't cover it
+func enqueueSMSJob(c *gin.Context, kind string, messages []services.SMSMessage) (*models.MessageJob, bool) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	job, err := services.EnqueueMessages(schoolID, c.MustGet("userID").(uint), kind, messages)
+	if errors.Is(err, services.ErrInsufficientSMSCredit) {
+		estimate, _ := services.EstimateSMSCost(schoolID, messages)
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient SMS credit", "estimate": estimate})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue messages"})
+		return nil, false
+	}
+	return job, true
+}
+
+func respondSMSEstimate(c *gin.Context, schoolID uint, messages []services.SMSMessage) {
+	estimate, err := services.EstimateSMSCost(schoolID, messages)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load SMS wallet"})
+		return
+	}
+	c.JSON(http.StatusOK, estimate)
 }
 
 func getSMSLogs(c *gin.Context) {
 	schoolID := c.MustGet("schoolID").(uint)
 
-	var logs []services.SMSLog
+	var logs []models.SMSLog
 	models.DB.Where("school_id = ?", schoolID).
 		Order("created_at DESC").
 		Limit(100).
@@ -192,3 +310,117 @@ func getSMSLogs(c *gin.Context) {
 
 	c.JSON(http.StatusOK, logs)
 }
+
+// listMessageJobs - Recent broadcasts and reminder runs
+func listMessageJobs(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var jobs []models.MessageJob
+	models.DB.Where("school_id = ?", schoolID).Order("created_at DESC").Limit(50).Find(&jobs)
+
+	c.JSON(http.StatusOK, jobs)
+}
+
+// getMessageJob - Progress of one job, with failed recipients for follow-up
+func getMessageJob(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var job models.MessageJob
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	var failed []models.OutboundMessage
+	models.DB.Where("job_id = ? AND status = ?", job.ID, models.OutboxFailed).Limit(100).Find(&failed)
+
+	var retrying int64
+	models.DB.Model(&models.OutboundMessage{}).
+		Where("job_id = ? AND status = ? AND attempts > 0", job.ID, models.OutboxQueued).
+		Count(&retrying)
+
+	c.JSON(http.StatusOK, gin.H{
+		"job":      job,
+		"progress": services.JobProgress(job),
+		"pending":  job.Total - job.Sent - job.Failed,
+		"retrying": retrying,
+		"failed":   failed,
+	})
+}
+
+// getSMSSettings - The school's SMS provider, or the server default if none is set
+func getSMSSettings(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var settings models.SMSSettings
+	if err := models.DB.Where("school_id = ?", schoolID).First(&settings).Error; err != nil {
+		provider := ""
+		if p := services.DefaultSMSProvider(); p != nil {
+			provider = p.Name()
+		}
+		c.JSON(http.StatusOK, gin.H{"configured": false, "default_provider": provider})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"configured":        true,
+		"settings":          settings,
+		"has_api_key":       settings.APIKey != "",
+		"has_gateway_token": settings.GatewayToken != "",
+	})
+}
+
+// updateSMSSettings - Choose the provider and credentials used for this school's SMS
+func updateSMSSettings(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var input struct {
+		Provider     string `json:"provider" binding:"required,oneof=AFRICASTALKING HTTP"`
+		SenderID     string `json:"sender_id"`
+		Username     string `json:"username"`
+		APIKey       string `json:"api_key"`
+		Environment  string `json:"environment" binding:"omitempty,oneof=sandbox production"`
+		GatewayURL   string `json:"gateway_url"`
+		GatewayToken string `json:"gateway_token"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var settings models.SMSSettings
+	models.DB.Where("school_id = ?", schoolID).First(&settings)
+	oldProvider := settings.Provider
+
+	settings.SchoolID = schoolID
+	settings.Provider = input.Provider
+	settings.SenderID = input.SenderID
+	settings.Username = input.Username
+	settings.Environment = input.Environment
+	settings.GatewayURL = input.GatewayURL
+	settings.UpdatedBy = userID
+	// Secrets are write-only; leaving them blank keeps the stored value
+	if input.APIKey != "" {
+		settings.APIKey = input.APIKey
+	}
+	if input.GatewayToken != "" {
+		settings.GatewayToken = input.GatewayToken
+	}
+
+	if _, err := services.NewSMSProvider(settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.DB.Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save SMS settings"})
+		return
+	}
+	services.InvalidateSMSProvider(schoolID)
+
+	models.CreateAuditLog(schoolID, userID, models.AuditSMSSettingsChange, "SMSSettings", settings.ID,
+		oldProvider, settings.Provider, c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, settings)
+}
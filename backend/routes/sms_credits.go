@@ -0,0 +1,175 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getSMSWallet - Credit balance, price and recent movements for the school
+func getSMSWallet(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	wallet, err := services.GetSMSWallet(schoolID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load SMS wallet"})
+		return
+	}
+
+	var transactions []models.SMSCreditTransaction
+	models.DB.Where("school_id = ?", schoolID).Order("created_at DESC, id DESC").Limit(50).Find(&transactions)
+
+	c.JSON(http.StatusOK, gin.H{
+		"wallet":            wallet,
+		"price_per_segment": services.SMSPrice(wallet),
+		"transactions":      transactions,
+	})
+}
+
+// getSMSStatement - The school's own usage statement (?month=YYYY-MM, default this month)
+func getSMSStatement(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	month, ok := statementMonth(c)
+	if !ok {
+		return
+	}
+
+	statement, err := services.MonthlySMSStatement(schoolID, month)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build statement"})
+		return
+	}
+	c.JSON(http.StatusOK, statement)
+}
+
+// topUpSMSCredit - Superadmin adds credit once a school has paid (negative amounts correct mistakes)
+func topUpSMSCredit(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	school, ok := superadminSchool(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Amount      float64 `json:"amount" binding:"required"`
+		Reference   string  `json:"reference"` // Receipt or invoice number
+		Description string  `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	txn, err := services.TopUpSMSCredit(school.ID, input.Amount, input.Reference, input.Description, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to top up SMS credit"})
+		return
+	}
+
+	models.CreateAuditLog(school.ID, userID, models.AuditSMSCreditTopUp, "SMSWallet", txn.ID,
+		fmt.Sprintf("%.2f", txn.BalanceAfter-txn.Amount), fmt.Sprintf("%.2f", txn.BalanceAfter), c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, txn)
+}
+
+// updateSMSWallet - Superadmin sets a school's billing mode and price
+func updateSMSWallet(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	school, ok := superadminSchool(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		BillingMode     string   `json:"billing_mode" binding:"omitempty,oneof=PREPAID POSTPAID"`
+		PricePerSegment *float64 `json:"price_per_segment" binding:"omitempty,min=0"` // 0 uses the platform default
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	wallet, err := services.GetSMSWallet(school.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load SMS wallet"})
+		return
+	}
+	old := wallet
+
+	if input.BillingMode != "" {
+		wallet.BillingMode = input.BillingMode
+	}
+	if input.PricePerSegment != nil {
+		wallet.PricePerSegment = *input.PricePerSegment
+	}
+	models.DB.Model(&wallet).Select("billing_mode", "price_per_segment").Updates(&wallet)
+
+	models.CreateAuditLog(school.ID, userID, models.AuditSMSBillingChange, "SMSWallet", wallet.ID,
+		fmt.Sprintf("%s @ %.4f", old.BillingMode, old.PricePerSegment),
+		fmt.Sprintf("%s @ %.4f", wallet.BillingMode, wallet.PricePerSegment),
+		c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, wallet)
+}
+
+// listSMSStatements - Every school's statement for a month, for invoicing
+func listSMSStatements(c *gin.Context) {
+	month, ok := statementMonth(c)
+	if !ok {
+		return
+	}
+
+	var schools []models.School
+	models.DB.Order("name").Find(&schools)
+
+	statements := make([]services.SMSStatement, 0, len(schools))
+	var totalDue, totalCost float64
+	for _, school := range schools {
+		statement, err := services.MonthlySMSStatement(school.ID, month)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build statements"})
+			return
+		}
+		statements = append(statements, statement)
+		totalDue += statement.AmountDue
+		totalCost += statement.ProviderCost
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"month":               month.Format("2006-01"),
+		"statements":          statements,
+		"total_amount_due":    totalDue,
+		"total_provider_cost": totalCost,
+	})
+}
+
+func statementMonth(c *gin.Context) (time.Time, bool) {
+	value := c.Query("month")
+	if value == "" {
+		return time.Now(), true
+	}
+	month, err := time.ParseInLocation("2006-01", value, time.Local)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "month must be YYYY-MM"})
+		return month, false
+	}
+	return month, true
+}
+
+func superadminSchool(c *gin.Context) (models.School, bool) {
+	var school models.School
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || models.DB.First(&school, id).Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "School not found"})
+		return school, false
+	}
+	return school, true
+}
@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"schoolms-go/models"
+	"schoolms-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// smsCallbackRefused - Status and error for a callback without the shared token, or 0 if it may proceed
+// Providers can't sign callbacks, so SMS_CALLBACK_TOKEN in the URL is the only proof a callback is real.
+// Without it configured every callback is refused: anyone could fake delivery reports, replies or STOPs
+func smsCallbackRefused(c *gin.Context) (int, string) {
+	token := os.Getenv("SMS_CALLBACK_TOKEN")
+	if token == "" {
+		return http.StatusServiceUnavailable, "SMS callbacks are not configured"
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(token)) != 1 {
+		return http.StatusUnauthorized, "Invalid callback token"
+	}
+	return 0, ""
+}
+
+// DeliveryReportInput - Africa's Talking posts a form; the HTTP gateway may post JSON
+type DeliveryReportInput struct {
+	ID            string `form:"id" json:"id"`
+	Status        string `form:"status" json:"status"`
+	PhoneNumber   string `form:"phoneNumber" json:"phone_number"`
+	FailureReason string `form:"failureReason" json:"failure_reason"`
+}
+
+// smsDeliveryReport - Final delivery status for a message we sent
+func smsDeliveryReport(c *gin.Context) {
+	if status, message := smsCallbackRefused(c); status != 0 {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+
+	var input DeliveryReportInput
+	if err := c.ShouldBind(&input); err != nil || input.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery report"})
+		return
+	}
+
+	fmt.Printf("[SMS Delivery] ID: %s, Status: %s, Reason: %s\n", input.ID, input.Status, input.FailureReason)
+
+	// Always acknowledge so the provider doesn't keep retrying reports we can't match
+	if _, err := services.HandleDeliveryReport(input.ID, input.Status, input.FailureReason); err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": "Unknown message"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Recorded"})
+}
+
+// InboundSMSInput - Reply from a parent to the school's shortcode
+type InboundSMSInput struct {
+	ID   string `form:"id" json:"id"`
+	From string `form:"from" json:"from"`
+	To   string `form:"to" json:"to"`
+	Text string `form:"text" json:"text"`
+}
+
+// smsInbound - Store replies; STOP opts the number out
+func smsInbound(c *gin.Context) {
+	if status, message := smsCallbackRefused(c); status != 0 {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+
+	var input InboundSMSInput
+	if err := c.ShouldBind(&input); err != nil || input.From == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid inbound message"})
+		return
+	}
+
+	fmt.Printf("[SMS Inbound] From: %s, To: %s\n", input.From, input.To)
+
+	if _, err := services.HandleInboundSMS(input.From, input.To, input.Text, input.ID); err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": "Ignored: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Received"})
+}
+
+// listInboundMessages - Replies from parents, newest first
+func listInboundMessages(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	query := models.DB.Where("school_id = ?", schoolID).Preload("User")
+	if c.Query("unread") == "true" {
+		query = query.Where("is_read = ?", false)
+	}
+
+	var messages []models.InboundMessage
+	query.Order("received_at DESC").Limit(100).Find(&messages)
+
+	var unread int64
+	models.DB.Model(&models.InboundMessage{}).Where("school_id = ? AND is_read = ?", schoolID, false).Count(&unread)
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages": messages,
+		"unread":   unread,
+	})
+}
+
+func markInboundMessageRead(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	result := models.DB.Model(&models.InboundMessage{}).
+		Where("id = ? AND school_id = ?", c.Param("id"), schoolID).
+		Update("is_read", true)
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Marked as read"})
+}
+
+func listSMSOptOuts(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var optOuts []models.SMSOptOut
+	models.DB.Where("school_id = ?", schoolID).Order("created_at DESC").Find(&optOuts)
+
+	c.JSON(http.StatusOK, optOuts)
+}
+
+// createSMSOptOut - Admin records a parent's request not to be texted
+func createSMSOptOut(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var input struct {
+		Phone string `json:"phone" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	phone := services.NormalizePhone(input.Phone)
+	if phone == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid phone number"})
+		return
+	}
+
+	if err := services.OptOutPhone(schoolID, phone, "ADMIN"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save opt-out"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Number opted out", "phone": phone})
+}
+
+// deleteSMSOptOut - Resume texting a number (e.g. parent asked in person)
+func deleteSMSOptOut(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	result := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).Delete(&models.SMSOptOut{})
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Opt-out not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Opt-out removed"})
+}
@@ -0,0 +1,169 @@
+package routes
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var templateNamePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]{1,49}$`)
+
+// listMessageTemplates - Built-in templates (customised or not) plus the school's own
+func listMessageTemplates(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var saved []models.MessageTemplate
+	models.DB.Where("school_id = ?", schoolID).Order("name").Find(&saved)
+
+	savedByName := make(map[string]bool)
+	templates := make([]gin.H, 0, len(saved))
+	for _, t := range saved {
+		savedByName[t.Name] = true
+		templates = append(templates, gin.H{"template": t, "customised": true})
+	}
+	for _, name := range services.DefaultTemplateNames() {
+		if !savedByName[name] {
+			t, _ := services.GetTemplate(schoolID, name)
+			templates = append(templates, gin.H{"template": t, "customised": false})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"templates":    templates,
+		"merge_fields": services.TemplateFields,
+	})
+}
+
+type MessageTemplateInput struct {
+	BodyEN string `json:"body_en" binding:"required"`
+	BodySW string `json:"body_sw"`
+}
+
+// saveMessageTemplate - Create or replace a school's template
+func saveMessageTemplate(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+	name := strings.ToUpper(c.Param("name"))
+
+	if !templateNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Template name must be letters, digits and underscores"})
+		return
+	}
+
+	var input MessageTemplateInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if unknown := services.UnknownTemplateFields(input.BodyEN + " " + input.BodySW); len(unknown) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown merge fields", "fields": unknown})
+		return
+	}
+
+	var tmpl models.MessageTemplate
+	models.DB.Where("school_id = ? AND name = ?", schoolID, name).First(&tmpl)
+	tmpl.SchoolID = schoolID
+	tmpl.Name = name
+	tmpl.BodyEN = input.BodyEN
+	tmpl.BodySW = input.BodySW
+	tmpl.UpdatedBy = userID
+
+	if err := models.DB.Save(&tmpl).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tmpl)
+}
+
+// resetMessageTemplate - Delete the school's version, reverting to the built-in text
+func resetMessageTemplate(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	result := models.DB.Where("school_id = ? AND name = ?", schoolID, strings.ToUpper(c.Param("name"))).
+		Delete(&models.MessageTemplate{})
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template reset to default"})
+}
+
+type TemplatePreviewInput struct {
+	Name      string               `json:"name"`    // Saved or built-in template
+	BodyEN    string               `json:"body_en"` // Or an unsaved draft
+	BodySW    string               `json:"body_sw"`
+	Language  string               `json:"language" binding:"omitempty,oneof=en sw"`
+	StudentID *uint                `json:"student_id"` // Fill fields from a real student
+	Fields    services.MergeFields `json:"fields"`     // Explicit values win
+}
+
+// previewMessageTemplate - Render a template and report how many SMS parts it costs
+func previewMessageTemplate(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var input TemplatePreviewInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var tmpl models.MessageTemplate
+	switch {
+	case input.BodyEN != "":
+		tmpl = models.MessageTemplate{BodyEN: input.BodyEN, BodySW: input.BodySW}
+	case input.Name != "":
+		var err error
+		if tmpl, err = services.GetTemplate(schoolID, strings.ToUpper(input.Name)); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name or body_en is required"})
+		return
+	}
+
+	fields := services.MergeFields{}
+	if input.StudentID != nil {
+		var student models.Student
+		if err := models.DB.Where("id = ? AND school_id = ?", *input.StudentID, schoolID).
+			Preload("User").Preload("Class").First(&student).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+			return
+		}
+		var balance float64
+		models.DB.Model(&models.VoteHeadBalance{}).Where("student_id = ?", student.ID).
+			Select("COALESCE(SUM(balance), 0)").Scan(&balance)
+		fields = services.StudentMergeFields(student, balance)
+	}
+	for k, v := range input.Fields {
+		fields[k] = v
+	}
+
+	language := input.Language
+	if language == "" {
+		language = models.LanguageEnglish
+	}
+
+	body := services.TemplateBody(tmpl, language)
+	rendered := services.RenderBody(body, services.WithSchoolFields(schoolID, fields))
+	segments, encoding := services.SMSSegments(rendered)
+	cost := math.Round(float64(segments)*services.SMSCostPerSegment()*100) / 100
+
+	c.JSON(http.StatusOK, gin.H{
+		"text":           rendered,
+		"language":       language,
+		"characters":     len([]rune(rendered)),
+		"segments":       segments,
+		"encoding":       encoding,
+		"cost":           cost,
+		"unknown_fields": services.UnknownTemplateFields(body),
+	})
+}
@@ -0,0 +1,404 @@
+package routes_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type smsFixture struct {
+	*refundFixture
+	provider *services.MemorySMSProvider
+	admin    string
+}
+
+func setupSMSTest(t *testing.T) *smsFixture {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	assert.NoError(t, err)
+	db.AutoMigrate(
+		&models.User{}, &models.School{}, &models.Student{}, &models.ParentStudent{},
+		&models.SMSLog{}, &models.SMSSettings{}, &models.AuditLog{},
+		&models.MessageJob{}, &models.OutboundMessage{}, &models.SMSOptOut{}, &models.InboundMessage{},
+		&models.MessageTemplate{}, &models.SMSWallet{}, &models.SMSCreditTransaction{}, &models.UserSession{},
+	)
+	models.DB = db
+	t.Cleanup(func() { sqlDB, _ := db.DB(); sqlDB.Close() })
+
+	provider := &services.MemorySMSProvider{}
+	services.SetDefaultSMSProvider(provider)
+	t.Cleanup(func() { services.SetDefaultSMSProvider(nil) })
+	t.Setenv("SMS_CALLBACK_TOKEN", "cb-secret")
+
+	school := models.School{Name: "Test School"}
+	db.Create(&school)
+	admin := models.User{Email: "admin@test.com", Role: "SCHOOLADMIN", SchoolID: &school.ID}
+	db.Create(&admin)
+	token := sessionToken(t, admin)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	routes.RegisterSMSRoutes(router.Group("/api/v1"))
+
+	return &smsFixture{
+		refundFixture: &refundFixture{db: db, router: router, school: school},
+		provider:      provider,
+		admin:         token,
+	}
+}
+
+func TestSMS_SendUsesConfiguredProviderAndLogs(t *testing.T) {
+	f := setupSMSTest(t)
+
+	w := f.do("POST", "/api/v1/sms/send", f.admin, map[string]string{"phone": "0712345678", "message": "Hello parent"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	sent := f.provider.Sent()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, "+254712345678", sent[0].To)
+
+	w = f.do("GET", "/api/v1/sms/logs", f.admin, nil)
+	var logs []models.SMSLog
+	json.Unmarshal(w.Body.Bytes(), &logs)
+	assert.Len(t, logs, 1)
+	assert.Equal(t, models.SMSProviderMemory, logs[0].Provider)
+	assert.NotEmpty(t, logs[0].ProviderMessageID)
+}
+
+func TestSMS_SettingsHideSecretsAndValidate(t *testing.T) {
+	f := setupSMSTest(t)
+
+	w := f.do("PUT", "/api/v1/sms/settings", f.admin, map[string]string{"provider": "HTTP"})
+	assert.Equal(t, http.StatusBadRequest, w.Code) // gateway_url missing
+	w = f.do("PUT", "/api/v1/sms/settings", f.admin, map[string]string{"provider": "MEMORY"})
+	assert.Equal(t, http.StatusBadRequest, w.Code) // Tests only, never stored per school
+
+	w = f.do("PUT", "/api/v1/sms/settings", f.admin, map[string]string{
+		"provider": "HTTP", "gateway_url": "https://sms.example/send", "gateway_token": "s3cret",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "s3cret")
+
+	w = f.do("GET", "/api/v1/sms/settings", f.admin, nil)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.Equal(t, true, resp["configured"])
+	assert.Equal(t, true, resp["has_gateway_token"])
+}
+
+func TestSMS_BroadcastReturnsPollableJob(t *testing.T) {
+	f := setupSMSTest(t)
+
+	parent := models.User{Email: "parent@test.com", Role: "PARENT", SchoolID: &f.school.ID}
+	studentUser := models.User{Email: "student@test.com", Role: "STUDENT", SchoolID: &f.school.ID}
+	f.db.Create(&parent)
+	f.db.Create(&studentUser)
+	student := models.Student{UserID: studentUser.ID, SchoolID: f.school.ID, Status: "ENROLLED"}
+	f.db.Create(&student)
+	f.db.Create(&models.ParentStudent{ParentID: parent.ID, StudentID: student.ID, Phone: "+254712345678", PhoneVerified: true})
+
+	w := f.do("POST", "/api/v1/sms/broadcast", f.admin, map[string]string{"message": "School closes Friday", "target": "PARENTS"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var queued struct {
+		JobID uint `json:"job_id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &queued)
+	assert.NotZero(t, queued.JobID)
+	assert.Empty(t, f.provider.Sent()) // Nothing sent inside the request
+
+	services.ProcessOutbox(10)
+
+	w = f.do("GET", fmt.Sprintf("/api/v1/sms/jobs/%d", queued.JobID), f.admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var progress struct {
+		Job      models.MessageJob `json:"job"`
+		Progress int               `json:"progress"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &progress)
+	assert.Equal(t, models.JobCompleted, progress.Job.Status)
+	assert.Equal(t, 1, progress.Job.Sent)
+	assert.Equal(t, 100, progress.Progress)
+	assert.Equal(t, "+254712345678", f.provider.Sent()[0].To)
+}
+
+func TestSMS_FeeRemindersGoToGuardianFromImport(t *testing.T) {
+	f := setupSMSTest(t)
+	f.db.AutoMigrate(&models.Class{}, &models.VoteHead{}, &models.VoteHeadBalance{})
+	routes.RegisterImportRoutes(f.router.Group("/api/v1"))
+	f.db.Create(&models.VoteHead{SchoolID: f.school.ID, Name: "Tuition", Priority: 1, IsActive: true})
+
+	routes.RegisterParentLinkRoutes(f.router.Group("/api/v1"))
+	existing := models.User{Email: "wanjiku@test.com", Role: "PARENT", SchoolID: &f.school.ID, Phone: "+254722000111", PhoneVerified: true}
+	f.db.Create(&existing)
+
+	csv := "adm_no,name,parent_phone,balance\n" +
+		"ADM001,Amani Otieno,0712 345 678,5000\n" +
+		"ADM002,Baraka Otieno,+254712345678,3000\n" +
+		"ADM003,Chebet Kip,not-a-phone,3000\n" +
+		"ADM004,Dalia Wanjiku,0722000111,3000\n"
+	w := f.upload("/api/v1/import/students", csv)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result routes.ImportResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, 3, result.Imported)
+	assert.Len(t, result.Errors, 1)
+
+	// An existing parent's number is reported, not linked
+	require.Len(t, result.GuardianMatches, 1)
+	assert.Equal(t, existing.ID, result.GuardianMatches[0].ParentID)
+	assert.Equal(t, "ADM004", result.GuardianMatches[0].AdmNo)
+	var existingLinks int64
+	f.db.Model(&models.ParentStudent{}).Where("parent_id = ?", existing.ID).Count(&existingLinks)
+	assert.Zero(t, existingLinks)
+
+	// Siblings share one parent account made by the import, with the number unverified
+	var parent models.User
+	f.db.Where("role = ? AND id <> ?", "PARENT", existing.ID).First(&parent)
+	assert.Equal(t, "+254712345678", parent.Phone)
+	assert.False(t, parent.PhoneVerified)
+	var links []models.ParentStudent
+	f.db.Where("parent_id = ?", parent.ID).Find(&links)
+	require.Len(t, links, 2)
+
+	w = f.do("POST", "/api/v1/sms/fee-reminders", f.admin, map[string]float64{"min_balance": 1000})
+	services.ProcessOutbox(10)
+	assert.Empty(t, f.provider.Sent())
+
+	// Staff confirm the number on each link
+	for _, link := range links {
+		assert.False(t, link.PhoneVerified)
+		w = f.do("PUT", fmt.Sprintf("/api/v1/parent-links/%d/phone", link.ID), f.admin, map[string]string{"phone": link.Phone})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w = f.do("POST", "/api/v1/sms/fee-reminders", f.admin, map[string]float64{"min_balance": 1000})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	services.ProcessOutbox(10)
+
+	sent := f.provider.Sent()
+	assert.Len(t, sent, 2)
+	for _, m := range sent {
+		assert.Equal(t, "+254712345678", m.To)
+	}
+}
+
+func (f *smsFixture) upload(path, csv string) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "students.csv")
+	part.Write([]byte(csv))
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", path, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+f.admin)
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+func (f *smsFixture) postForm(path string, form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestSMS_DeliveryReportUpdatesLog(t *testing.T) {
+	f := setupSMSTest(t)
+
+	f.do("POST", "/api/v1/sms/send", f.admin, map[string]string{"phone": "0712345678", "message": "Fees due"})
+	var log models.SMSLog
+	f.db.First(&log)
+
+	w := f.postForm("/api/v1/sms/callbacks/delivery?token=cb-secret", url.Values{
+		"id": {log.ProviderMessageID}, "status": {"Failed"}, "phoneNumber": {"+254712345678"}, "failureReason": {"AbsentSubscriber"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	f.db.First(&log, log.ID)
+	assert.Equal(t, models.DeliveryFailed, log.DeliveryStatus)
+	assert.Equal(t, "AbsentSubscriber", log.FailureReason)
+}
+
+func TestSMS_InboundStopOptsOutAndRepliesReachInbox(t *testing.T) {
+	f := setupSMSTest(t)
+
+	parent := models.User{Email: "parent@test.com", Role: "PARENT", SchoolID: &f.school.ID, Phone: "+254712345678", PhoneVerified: true}
+	f.db.Create(&parent)
+
+	w := f.postForm("/api/v1/sms/callbacks/inbound?token=cb-secret", url.Values{"from": {"+254712345678"}, "to": {"22384"}, "text": {"When does term start?"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = f.do("GET", "/api/v1/sms/inbox", f.admin, nil)
+	var inbox struct {
+		Messages []models.InboundMessage `json:"messages"`
+		Unread   int                     `json:"unread"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &inbox)
+	assert.Len(t, inbox.Messages, 1)
+	assert.Equal(t, 1, inbox.Unread)
+	assert.Equal(t, parent.ID, *inbox.Messages[0].UserID)
+
+	f.postForm("/api/v1/sms/callbacks/inbound?token=cb-secret", url.Values{"from": {"0712345678"}, "to": {"22384"}, "text": {" stop "}})
+	assert.True(t, services.IsOptedOut(f.school.ID, "0712345678"))
+
+	w = f.do("POST", "/api/v1/sms/send", f.admin, map[string]string{"phone": "0712345678", "message": "Hello"})
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.Equal(t, false, resp["success"])
+	assert.Empty(t, f.provider.Sent())
+}
+
+func TestSMS_CallbackTokenRequired(t *testing.T) {
+	f := setupSMSTest(t)
+
+	w := f.postForm("/api/v1/sms/callbacks/inbound", url.Values{"from": {"0712345678"}, "text": {"hi"}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = f.postForm("/api/v1/sms/callbacks/inbound?token=cb-secret", url.Values{"from": {"0712345678"}, "text": {"hi"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Without a token configured nothing can prove a callback is real, so every one is refused
+	t.Setenv("SMS_CALLBACK_TOKEN", "")
+	w = f.postForm("/api/v1/sms/callbacks/delivery", url.Values{"id": {"ATXid_1"}, "status": {"Success"}})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = f.postForm("/api/v1/sms/callbacks/inbound?token=", url.Values{"from": {"0712345678"}, "text": {"STOP"}})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.False(t, services.IsOptedOut(f.school.ID, "0712345678"))
+}
+
+func TestSMS_TemplatesRenderInGuardianLanguage(t *testing.T) {
+	f := setupSMSTest(t)
+	f.db.AutoMigrate(&models.Class{}, &models.VoteHead{}, &models.VoteHeadBalance{})
+	f.db.Model(&f.school).Update("paybill", "522522")
+
+	w := f.do("PUT", "/api/v1/sms/templates/fee_reminder", f.admin, map[string]string{"body_en": "Dear {{parent_name}}"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = f.do("PUT", "/api/v1/sms/templates/fee_reminder", f.admin, map[string]string{
+		"body_en": "{{student_name}} owes KES {{balance}} by {{due_date}}. Paybill {{paybill}}",
+		"body_sw": "{{student_name}} anadaiwa KES {{balance}} kufikia {{due_date}}. Paybill {{paybill}}",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	parent := models.User{Email: "mzazi@test.com", Role: "PARENT", SchoolID: &f.school.ID, Language: models.LanguageSwahili}
+	studentUser := models.User{Email: "amani@test.com", FullName: "Amani Otieno", Role: "STUDENT", SchoolID: &f.school.ID}
+	f.db.Create(&parent)
+	f.db.Create(&studentUser)
+	student := models.Student{UserID: studentUser.ID, SchoolID: f.school.ID, EnrollmentNumber: "ADM001", Status: "ENROLLED"}
+	f.db.Create(&student)
+	f.db.Create(&models.ParentStudent{ParentID: parent.ID, StudentID: student.ID, Phone: "+254712345678", PhoneVerified: true})
+	f.db.Create(&models.VoteHeadBalance{StudentID: student.ID, VoteHeadID: 1, Balance: 12500})
+
+	w = f.do("POST", "/api/v1/sms/templates/preview", f.admin, map[string]interface{}{
+		"name": "FEE_REMINDER", "language": "sw", "student_id": student.ID, "fields": map[string]string{"due_date": "5 Jan"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var preview struct {
+		Text     string `json:"text"`
+		Segments int    `json:"segments"`
+		Encoding string `json:"encoding"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	assert.Equal(t, "Amani Otieno anadaiwa KES 12,500.00 kufikia 5 Jan. Paybill 522522", preview.Text)
+	assert.Equal(t, 1, preview.Segments)
+	assert.Equal(t, "GSM-7", preview.Encoding)
+
+	w = f.do("POST", "/api/v1/sms/fee-reminders", f.admin, map[string]interface{}{"min_balance": 1000, "due_date": "5 Jan"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	services.ProcessOutbox(10)
+
+	sent := f.provider.Sent()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, preview.Text, sent[0].Message)
+
+	// Resetting falls back to the built-in wording
+	w = f.do("DELETE", "/api/v1/sms/templates/FEE_REMINDER", f.admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = f.do("POST", "/api/v1/sms/templates/preview", f.admin, map[string]interface{}{"name": "FEE_REMINDER", "language": "sw", "student_id": student.ID})
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	assert.Contains(t, preview.Text, "ana salio la karo")
+}
+
+func TestSMS_PrepaidSchoolNeedsCreditForBroadcast(t *testing.T) {
+	f := setupSMSTest(t)
+	t.Setenv("SMS_COST_PER_SEGMENT", "1")
+	routes.RegisterSuperAdminRoutes(f.router.Group("/api/v1"))
+
+	super := models.User{Email: "super@test.com", Role: "SUPERADMIN"}
+	f.db.Create(&super)
+	superToken := sessionToken(t, super)
+
+	parent := models.User{Email: "parent@test.com", Role: "PARENT", SchoolID: &f.school.ID}
+	studentUser := models.User{Email: "student@test.com", Role: "STUDENT", SchoolID: &f.school.ID}
+	f.db.Create(&parent)
+	f.db.Create(&studentUser)
+	student := models.Student{UserID: studentUser.ID, SchoolID: f.school.ID, Status: "ENROLLED"}
+	f.db.Create(&student)
+	f.db.Create(&models.ParentStudent{ParentID: parent.ID, StudentID: student.ID, Phone: "+254712345678", PhoneVerified: true})
+
+	walletPath := fmt.Sprintf("/api/v1/superadmin/schools/%d/sms-wallet", f.school.ID)
+	w := f.do("PUT", walletPath, f.admin, map[string]string{"billing_mode": "PREPAID"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = f.do("PUT", walletPath, superToken, map[string]string{"billing_mode": "PREPAID"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	broadcast := map[string]string{"message": "School closes Friday", "target": "PARENTS"}
+	w = f.do("POST", "/api/v1/sms/broadcast/estimate", f.admin, broadcast)
+	var estimate services.SMSEstimate
+	json.Unmarshal(w.Body.Bytes(), &estimate)
+	assert.Equal(t, 1, estimate.Messages)
+	assert.Equal(t, 1.0, estimate.Cost)
+	assert.False(t, estimate.Sufficient)
+
+	w = f.do("POST", "/api/v1/sms/broadcast", f.admin, broadcast)
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+
+	w = f.do("POST", fmt.Sprintf("/api/v1/superadmin/schools/%d/sms-credits", f.school.ID), superToken,
+		map[string]interface{}{"amount": 100, "reference": "RCPT-001"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = f.do("POST", "/api/v1/sms/broadcast", f.admin, broadcast)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	services.ProcessOutbox(10)
+
+	w = f.do("GET", "/api/v1/sms/wallet", f.admin, nil)
+	var wallet struct {
+		Wallet       models.SMSWallet              `json:"wallet"`
+		Transactions []models.SMSCreditTransaction `json:"transactions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &wallet)
+	assert.Equal(t, 99.0, wallet.Wallet.Balance)
+	assert.Len(t, wallet.Transactions, 2)
+
+	w = f.do("GET", "/api/v1/superadmin/sms-statements", superToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var statements struct {
+		Statements []services.SMSStatement `json:"statements"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &statements)
+	assert.Len(t, statements.Statements, 1)
+	assert.Equal(t, 100.0, statements.Statements[0].TopUps)
+	assert.Equal(t, 1.0, statements.Statements[0].Charges)
+	assert.Equal(t, int64(1), statements.Statements[0].MessagesSent)
+	assert.Zero(t, statements.Statements[0].AmountDue) // Prepaid schools have already paid
+
+	w = f.do("GET", "/api/v1/sms/wallet/statement?month=2026-13", f.admin, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,261 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"schoolms-go/middleware"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SSOProviderInput - An OpenID Connect provider for the school
+type SSOProviderInput struct {
+	Name           string   `json:"name" binding:"required"`
+	Issuer         string   `json:"issuer" binding:"required"`
+	ClientID       string   `json:"client_id" binding:"required"`
+	ClientSecret   string   `json:"client_secret"` // Kept as is when left empty on update
+	AllowedDomains []string `json:"allowed_domains" binding:"required"`
+	AutoProvision  bool     `json:"auto_provision"`
+	DefaultRole    string   `json:"default_role"`
+	Enabled        *bool    `json:"enabled"`
+}
+
+// SSOCallbackInput - What the provider sent back to the frontend's /sso/callback page
+type SSOCallbackInput struct {
+	State string `json:"state" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+}
+
+func RegisterSSORoutes(router *gin.RouterGroup) {
+	auth := router.Group("/auth/sso")
+	{
+		auth.GET("/providers", listSignInProviders)
+		auth.GET("/:id/start", startSSOLogin)
+		auth.POST("/callback", ssoCallback)
+	}
+
+	providers := router.Group("/sso/providers")
+	providers.Use(middleware.AuthMiddleware(), middleware.RequirePermission("sso.manage"))
+	{
+		providers.GET("", listSSOProviders)
+		providers.POST("", createSSOProvider)
+		providers.PUT("/:id", updateSSOProvider)
+		providers.DELETE("/:id", deleteSSOProvider)
+	}
+}
+
+// listSignInProviders - Buttons for the login page: the enabled providers for an email's domain or a school
+func listSignInProviders(c *gin.Context) {
+	email := strings.ToLower(strings.TrimSpace(c.Query("email")))
+	if email == "" && c.Query("school_id") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email or school_id is required"})
+		return
+	}
+
+	var providers []models.SSOProvider
+	query := models.DB.Where("enabled = ?", true)
+	if schoolID := c.Query("school_id"); schoolID != "" {
+		query = query.Where("school_id = ?", schoolID)
+	}
+	query.Order("id").Find(&providers)
+	out := []gin.H{}
+	for _, p := range providers {
+		if email == "" || services.SSODomainAllowed(p, email) {
+			out = append(out, gin.H{"id": p.ID, "name": p.Name, "school_id": p.SchoolID})
+		}
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// startSSOLogin - The URL to send the user to; the provider returns them to /sso/callback on the frontend
+func startSSOLogin(c *gin.Context) {
+	var provider models.SSOProvider
+	if err := models.DB.Where("id = ? AND enabled = ?", c.Param("id"), true).First(&provider).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sign-in provider not found"})
+		return
+	}
+	authURL, err := services.StartSSOLogin(provider, c.Query("login_hint"))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not reach the sign-in provider"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+// ssoCallback - Finish a single sign-on: redeem the code, find or create the account, then log in as usual
+func ssoCallback(c *gin.Context) {
+	var input SSOCallbackInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	provider, identity, err := services.CompleteSSOLogin(input.State, input.Code)
+	if err == nil {
+		var created bool
+		var user models.User
+		if user, created, err = services.SSOUser(provider, identity); err == nil {
+			if created {
+				models.CreateAuditLog(provider.SchoolID, user.ID, models.AuditSSOUserProvisioned, "User", user.ID,
+					"", fmt.Sprintf(`{"provider":%q,"role":%q}`, provider.Name, user.Role), c.ClientIP(), c.Request.UserAgent())
+			}
+			models.CreateAuditLog(provider.SchoolID, user.ID, models.AuditSSOLogin, "User", user.ID,
+				"", fmt.Sprintf(`{"provider":%q,"subject":%q}`, provider.Name, identity.Subject), c.ClientIP(), c.Request.UserAgent())
+			continueLogin(c, user, gin.H{"sso_provider": provider.Name, "account_created": created})
+			return
+		}
+	}
+
+	switch {
+	case errors.Is(err, services.ErrSSOStateInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sign-in expired or was already used; start again"})
+	case errors.Is(err, services.ErrSSOProviderUnavailable):
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not reach the sign-in provider"})
+	case errors.Is(err, services.ErrSSOTokenInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "The sign-in provider's response could not be verified"})
+	case errors.Is(err, services.ErrSSOEmailNotVerified):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your email address is not verified with the sign-in provider"})
+	case errors.Is(err, services.ErrSSODomainNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Accounts from this email domain can't sign in here"})
+	case errors.Is(err, services.ErrSSONoAccount):
+		c.JSON(http.StatusForbidden, gin.H{"error": "No account for " + identity.Email + " at this school; ask your school admin for an invite"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Sign-in failed"})
+	}
+}
+
+func ssoProviderJSON(p models.SSOProvider) gin.H {
+	return gin.H{
+		"id":                p.ID,
+		"name":              p.Name,
+		"issuer":            p.Issuer,
+		"client_id":         p.ClientID,
+		"client_secret_set": p.ClientSecret != "",
+		"allowed_domains":   append([]string{}, services.ParseSSODomains(p.AllowedDomains)...),
+		"auto_provision":    p.AutoProvision,
+		"default_role":      p.DefaultRole,
+		"enabled":           p.Enabled,
+		"redirect_uri":      services.SSORedirectURI(),
+		"created_at":        p.CreatedAt,
+		"updated_at":        p.UpdatedAt,
+	}
+}
+
+// listSSOProviders - The school's sign-in providers
+func listSSOProviders(c *gin.Context) {
+	var providers []models.SSOProvider
+	models.DB.Where("school_id = ?", c.MustGet("schoolID").(uint)).Order("id").Find(&providers)
+	out := make([]gin.H, len(providers))
+	for i, p := range providers {
+		out[i] = ssoProviderJSON(p)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// bindSSOProvider - Validate the input onto the provider; the issuer must serve a discovery document
+func bindSSOProvider(c *gin.Context, provider *models.SSOProvider) bool {
+	var input SSOProviderInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	issuer, err := url.Parse(strings.TrimRight(strings.TrimSpace(input.Issuer), "/"))
+	local := err == nil && (issuer.Hostname() == "localhost" || issuer.Hostname() == "127.0.0.1")
+	if err != nil || issuer.Host == "" || (issuer.Scheme != "https" && !(issuer.Scheme == "http" && local)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "issuer must be an https URL"})
+		return false
+	}
+	domains := services.ParseSSODomains(strings.Join(input.AllowedDomains, ","))
+	if len(domains) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "List at least one email domain that may sign in"})
+		return false
+	}
+	role := strings.ToUpper(input.DefaultRole)
+	if role == "" {
+		role = services.RoleTeacher
+	}
+	if !slices.Contains(services.SSORoles, role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "default_role must be TEACHER or FINANCE"})
+		return false
+	}
+	if input.ClientSecret == "" && provider.ClientSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "client_secret is required"})
+		return false
+	}
+	if _, err := services.DiscoverOIDC(issuer.String()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not load the provider's OpenID configuration: " + err.Error()})
+		return false
+	}
+
+	provider.Name = strings.TrimSpace(input.Name)
+	provider.Issuer = issuer.String()
+	provider.ClientID = strings.TrimSpace(input.ClientID)
+	if input.ClientSecret != "" {
+		provider.ClientSecret = input.ClientSecret
+	}
+	provider.AllowedDomains = strings.Join(domains, ",")
+	provider.AutoProvision = input.AutoProvision
+	provider.DefaultRole = role
+	if input.Enabled != nil {
+		provider.Enabled = *input.Enabled
+	}
+	return true
+}
+
+// createSSOProvider - Let the school's staff sign in with Google Workspace, Microsoft 365 or another provider
+func createSSOProvider(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	provider := models.SSOProvider{SchoolID: schoolID, Enabled: true}
+	if !bindSSOProvider(c, &provider) {
+		return
+	}
+	if err := models.DB.Create(&provider).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save provider"})
+		return
+	}
+	models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditSSOProviderChange, "SSOProvider", provider.ID,
+		"", provider.Name+": "+provider.AllowedDomains, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusCreated, ssoProviderJSON(provider))
+}
+
+// updateSSOProvider - Change a provider's settings, or switch it off
+func updateSSOProvider(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	var provider models.SSOProvider
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&provider).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Provider not found"})
+		return
+	}
+	old := provider.Name + ": " + provider.AllowedDomains
+	if !bindSSOProvider(c, &provider) {
+		return
+	}
+	if err := models.DB.Save(&provider).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save provider"})
+		return
+	}
+	models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditSSOProviderChange, "SSOProvider", provider.ID,
+		old, provider.Name+": "+provider.AllowedDomains, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, ssoProviderJSON(provider))
+}
+
+// deleteSSOProvider - Remove a provider; its users sign in with a password (or reset it) from then on
+func deleteSSOProvider(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	var provider models.SSOProvider
+	if err := models.DB.Where("id = ? AND school_id = ?", c.Param("id"), schoolID).First(&provider).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Provider not found"})
+		return
+	}
+	models.DB.Where("provider_id = ?", provider.ID).Delete(&models.SSOLoginState{})
+	models.DB.Delete(&provider)
+	models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditSSOProviderChange, "SSOProvider", provider.ID,
+		provider.Name+": "+provider.AllowedDomains, "", c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Provider deleted"})
+}
@@ -0,0 +1,214 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type ssoFixture struct {
+	*sessionFixture
+	idp      *services.OIDCMock
+	provider uint
+}
+
+func setupSSOTest(t *testing.T, autoProvision bool) *ssoFixture {
+	f := &ssoFixture{sessionFixture: setupSessionTest(t), idp: services.StartOIDCMock("schoolms", "shh")}
+	t.Cleanup(f.idp.Close)
+	f.db.AutoMigrate(&models.SSOProvider{}, &models.SSOLoginState{}, &models.SSOIdentityLink{})
+	routes.RegisterSSORoutes(f.router.Group("/api/v1"))
+
+	admin := f.login(t, f.admin.Email, "password123")
+	w := f.do("POST", "/api/v1/sso/providers", admin.AccessToken, map[string]interface{}{
+		"name": "Workspace", "issuer": f.idp.Issuer(), "client_id": "schoolms", "client_secret": "shh",
+		"allowed_domains": []string{"@Session.test"}, "auto_provision": autoProvision,
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var provider struct {
+		ID uint `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &provider)
+	f.provider = provider.ID
+	return f
+}
+
+// authorizationURL - Where the login page would send the browser
+func (f *ssoFixture) authorizationURL(t *testing.T) string {
+	w := f.do("GET", fmt.Sprintf("/api/v1/auth/sso/%d/start", f.provider), "", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var out struct {
+		URL string `json:"authorization_url"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return out.URL
+}
+
+// signIn - Sign in at the provider with the claims and hand the result to our callback
+func (f *ssoFixture) signIn(t *testing.T, claims map[string]interface{}) (string, string) {
+	state, code, err := f.idp.Authorize(f.authorizationURL(t), claims)
+	require.NoError(t, err)
+	return state, code
+}
+
+func (f *ssoFixture) callback(state, code string) *httptest.ResponseRecorder {
+	return f.do("POST", "/api/v1/auth/sso/callback", "", map[string]string{"state": state, "code": code})
+}
+
+func TestSSO_SignsInExistingStaffAndProvisionsNewOnes(t *testing.T) {
+	f := setupSSOTest(t, true)
+
+	w := f.do("GET", "/api/v1/auth/sso/providers?email=teacher@session.test", "", nil)
+	assert.Contains(t, w.Body.String(), `"name":"Workspace"`)
+	w = f.do("GET", "/api/v1/auth/sso/providers?email=someone@gmail.com", "", nil)
+	assert.Equal(t, "[]", w.Body.String())
+
+	authURL := f.authorizationURL(t)
+	q, _ := url.Parse(authURL)
+	assert.Equal(t, "S256", q.Query().Get("code_challenge_method"))
+	assert.Equal(t, services.SSORedirectURI(), q.Query().Get("redirect_uri"))
+
+	// An existing teacher is matched by email and gets our normal tokens
+	state, code := f.signIn(t, map[string]interface{}{"email": "Teacher@Session.test", "email_verified": true})
+	w = f.callback(state, code)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var login struct {
+		tokenPair
+		User struct {
+			ID uint `json:"id"`
+		} `json:"user"`
+		Created bool `json:"account_created"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &login)
+	assert.Equal(t, f.user.ID, login.User.ID)
+	assert.False(t, login.Created)
+	assert.True(t, f.authorized(login.AccessToken))
+
+	// The state works once
+	assert.Equal(t, http.StatusBadRequest, f.callback(state, code).Code)
+
+	// Someone new from the school's domain gets an account in the default role
+	state, code = f.signIn(t, map[string]interface{}{"email": "new.teacher@session.test", "name": "New Teacher"})
+	w = f.callback(state, code)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"account_created":true`)
+	var created models.User
+	require.NoError(t, f.db.Where("email = ?", "new.teacher@session.test").First(&created).Error)
+	assert.Equal(t, "TEACHER", created.Role)
+	assert.Equal(t, f.school.ID, *created.SchoolID)
+	assert.Equal(t, "New Teacher", created.FullName)
+	assert.Equal(t, http.StatusUnauthorized, f.loginFrom("10.0.0.1", created.Email, "!sso").Code)
+
+	// Other domains and unverified emails are refused
+	state, code = f.signIn(t, map[string]interface{}{"email": "someone@gmail.com"})
+	assert.Equal(t, http.StatusForbidden, f.callback(state, code).Code)
+	state, code = f.signIn(t, map[string]interface{}{"email": "other@session.test", "email_verified": false})
+	assert.Equal(t, http.StatusForbidden, f.callback(state, code).Code)
+
+	assert.Equal(t, int64(2), f.auditCount(models.AuditSSOLogin))
+	assert.Equal(t, int64(1), f.auditCount(models.AuditSSOUserProvisioned))
+}
+
+func TestSSO_RejectsForgedTokensAndOtherSchoolsAccounts(t *testing.T) {
+	f := setupSSOTest(t, false)
+
+	for name, claims := range map[string]map[string]interface{}{
+		"wrong audience": {"email": "teacher@session.test", "aud": "someone-else"},
+		"wrong issuer":   {"email": "teacher@session.test", "iss": "https://evil.example"},
+		"wrong nonce":    {"email": "teacher@session.test", "nonce": "replayed"},
+		"expired":        {"email": "teacher@session.test", "exp": 1},
+	} {
+		state, code := f.signIn(t, claims)
+		assert.Equal(t, http.StatusUnauthorized, f.callback(state, code).Code, name)
+	}
+
+	// A code redeemed with the wrong state, or never issued, fails too
+	state, _ := f.signIn(t, map[string]interface{}{"email": "teacher@session.test"})
+	assert.Equal(t, http.StatusUnauthorized, f.callback(state, "made-up").Code)
+	assert.Equal(t, http.StatusBadRequest, f.callback("made-up", "made-up").Code)
+
+	// Without auto-provisioning only existing accounts of this school may sign in
+	state, code := f.signIn(t, map[string]interface{}{"email": "new.teacher@session.test"})
+	assert.Equal(t, http.StatusForbidden, f.callback(state, code).Code)
+	other := models.School{Name: "Other School"}
+	f.db.Create(&other)
+	stranger := models.User{Email: "stranger@session.test", PasswordHash: "x", Role: "TEACHER", SchoolID: &other.ID}
+	f.db.Create(&stranger)
+	state, code = f.signIn(t, map[string]interface{}{"email": stranger.Email, "email_verified": true})
+	assert.Equal(t, http.StatusForbidden, f.callback(state, code).Code)
+
+	// Even if they also hold a role here, as the session would open on their home school
+	f.db.Create(&models.Membership{UserID: stranger.ID, SchoolID: f.school.ID, Role: "TEACHER"})
+	state, code = f.signIn(t, map[string]interface{}{"email": stranger.Email, "email_verified": true})
+	assert.Equal(t, http.StatusForbidden, f.callback(state, code).Code)
+
+	// Single sign-on is for staff; admins keep their password and two-factor
+	state, code = f.signIn(t, map[string]interface{}{"email": f.admin.Email, "email_verified": true})
+	assert.Equal(t, http.StatusForbidden, f.callback(state, code).Code)
+
+	// Providers must restrict domains and be reachable
+	admin := f.login(t, f.admin.Email, "password123")
+	w := f.do("POST", "/api/v1/sso/providers", admin.AccessToken, map[string]interface{}{
+		"name": "Open", "issuer": f.idp.Issuer(), "client_id": "schoolms", "client_secret": "shh", "allowed_domains": []string{},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = f.do("POST", "/api/v1/sso/providers", admin.AccessToken, map[string]interface{}{
+		"name": "Plain", "issuer": "http://idp.example", "client_id": "schoolms", "client_secret": "shh", "allowed_domains": []string{"session.test"},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = f.do("GET", "/api/v1/sso/providers", admin.AccessToken, nil)
+	assert.Contains(t, w.Body.String(), `"client_secret_set":true`)
+	assert.NotContains(t, w.Body.String(), "shh")
+}
+
+func TestSSO_BindsAccountToProviderSubject(t *testing.T) {
+	f := setupSSOTest(t, false)
+
+	state, code := f.signIn(t, map[string]interface{}{"email": f.user.Email, "email_verified": "true", "sub": "idp-123"})
+	require.Equal(t, http.StatusOK, f.callback(state, code).Code)
+	var link models.SSOIdentityLink
+	require.NoError(t, f.db.Where("user_id = ?", f.user.ID).First(&link).Error)
+	assert.Equal(t, "idp-123", link.Subject)
+
+	// The bound identity still signs in after its email changes at the provider
+	state, code = f.signIn(t, map[string]interface{}{"email": "renamed@session.test", "sub": "idp-123"})
+	w := f.callback(state, code)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`"id":%d`, f.user.ID))
+
+	// Another identity given the same address doesn't get the account
+	state, code = f.signIn(t, map[string]interface{}{"email": f.user.Email, "email_verified": true, "sub": "idp-456"})
+	assert.Equal(t, http.StatusForbidden, f.callback(state, code).Code)
+}
+
+func TestSSO_ExistingAccountsNeedAVerifiedEmail(t *testing.T) {
+	f := setupSSOTest(t, true)
+
+	// A provider that doesn't vouch for the address can't be used to take over the account
+	for _, verified := range []interface{}{nil, false, "false", "yes"} {
+		claims := map[string]interface{}{"email": f.user.Email, "sub": "idp-789"}
+		if verified != nil {
+			claims["email_verified"] = verified
+		}
+		state, code := f.signIn(t, claims)
+		w := f.callback(state, code)
+		assert.Equal(t, http.StatusForbidden, w.Code, "email_verified %v", verified)
+		assert.Contains(t, w.Body.String(), "not verified")
+	}
+	var links int64
+	f.db.Model(&models.SSOIdentityLink{}).Count(&links)
+	assert.Zero(t, links)
+
+	state, code := f.signIn(t, map[string]interface{}{"email": f.user.Email, "sub": "idp-789", "email_verified": "true"})
+	w := f.callback(state, code)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`"id":%d`, f.user.ID))
+}
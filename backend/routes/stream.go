@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"schoolms-go/middleware"
+	"schoolms-go/services"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamRetry - How long browsers wait before reconnecting a dropped stream
+const streamRetry = 3 * time.Second
+
+func RegisterStreamRoutes(router *gin.RouterGroup) {
+	// Server-Sent Events; EventSource can't send headers, so it connects with ?ticket= from POST /stream/ticket
+	router.POST("/stream/ticket", middleware.AuthMiddleware(), issueStreamTicket)
+	router.GET("/stream", middleware.StreamTicketAuth(), streamEvents)
+}
+
+// issueStreamTicket - A single-use ticket for the next EventSource connection, valid for 30 seconds
+func issueStreamTicket(c *gin.Context) {
+	sessionID := c.GetUint("sessionID")
+	if sessionID == 0 {
+		// API keys can send headers, and have no session to tie a ticket to
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stream tickets are for signed-in users; send the API key as a header"})
+		return
+	}
+	var schoolID *uint
+	if id, ok := c.Get("schoolID"); ok {
+		sid := id.(uint)
+		schoolID = &sid
+	}
+	ticket, err := services.IssueStreamTicket(c.GetUint("userID"), sessionID, c.GetUint("membershipID"), c.GetString("role"), schoolID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue stream ticket"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ticket": ticket, "expires_in": int(services.StreamTicketTTL.Seconds())})
+}
+
+// streamStillAuthorized - Whether the connection's session (or API key) still works
+// Checked on every heartbeat, so logging out everywhere, revoking a session or removing a membership closes open streams
+func streamStillAuthorized(c *gin.Context) bool {
+	if keyID, ok := c.Get("apiKeyID"); ok {
+		return services.APIKeyActive(keyID.(uint))
+	}
+	return services.SessionActive(c.GetUint("sessionID"), c.GetUint("userID"), c.GetUint("membershipID"))
+}
+
+// streamEvents - Push notifications, payments, attendance and tickets for the current user as they happen
+// Reconnecting clients send Last-Event-ID (or ?last_event_id=) and get what they missed;
+// a "reset" event means too much was missed and the client should refetch
+func streamEvents(c *gin.Context) {
+	client := services.StreamClient{
+		UserID: c.MustGet("userID").(uint),
+		Role:   c.MustGet("role").(string),
+	}
+	if schoolID, ok := c.Get("schoolID"); ok {
+		client.SchoolID = schoolID.(uint)
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	messages, missed, cancel := services.GetStreamBroker().Subscribe(client, services.ParseLastEventID(lastEventID))
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Don't let nginx buffer the stream
+	c.Status(http.StatusOK)
+
+	io.WriteString(c.Writer, "retry: "+strconv.FormatInt(streamRetry.Milliseconds(), 10)+"\n\n")
+	if missed {
+		io.WriteString(c.Writer, services.FormatSSE(0, "reset", `{"reason":"missed events"}`))
+	}
+	ready, _ := json.Marshal(gin.H{"user_id": client.UserID, "role": client.Role, "school_id": client.SchoolID})
+	io.WriteString(c.Writer, services.FormatSSE(0, "ready", string(ready)))
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(services.StreamHeartbeat())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				// Dropped for falling behind; the client reconnects and replays
+				return
+			}
+			data, _ := json.Marshal(msg)
+			io.WriteString(c.Writer, services.FormatSSE(msg.ID, msg.Type, string(data)))
+		case <-heartbeat.C:
+			if !streamStillAuthorized(c) {
+				// The browser's reconnect reuses the spent ticket and is refused, and the session can't get another
+				io.WriteString(c.Writer, services.FormatSSE(0, "revoked", `{"reason":"session ended"}`))
+				c.Writer.Flush()
+				return
+			}
+			io.WriteString(c.Writer, ": ping\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,260 @@
+package routes_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	ID, Event, Data string
+	Comment         bool
+}
+
+type sseClient struct {
+	events chan sseEvent
+	cancel context.CancelFunc
+}
+
+// openStream - Connect to /stream and parse events in the background
+func openStream(t *testing.T, server *httptest.Server, query string, header http.Header) *sseClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/v1/stream?"+query, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	client := &sseClient{events: make(chan sseEvent, 100), cancel: cancel}
+	t.Cleanup(func() { cancel(); resp.Body.Close() })
+	go func() {
+		defer close(client.events)
+		scanner := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if ev != (sseEvent{}) {
+					client.events <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, ":"):
+				client.events <- sseEvent{Comment: true}
+			case strings.HasPrefix(line, "id: "):
+				ev.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				ev.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				ev.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return client
+}
+
+// next - The next named event, skipping heartbeats and the retry hint
+func (s *sseClient) next(t *testing.T) sseEvent {
+	for {
+		select {
+		case ev, ok := <-s.events:
+			require.True(t, ok, "stream closed")
+			if ev.Comment || ev.Event == "" {
+				continue
+			}
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+}
+
+func setupStreamTest(t *testing.T) (*notificationFixture, *httptest.Server) {
+	f := setupNotificationTest(t)
+	f.db.AutoMigrate(&models.Attendance{}, &models.Ticket{}, &models.StreamTicket{})
+	services.SetStreamBroker(services.NewMemoryBroker())
+	services.RegisterStreamSubscribers()
+
+	api := f.router.Group("/api/v1")
+	routes.RegisterStreamRoutes(api)
+	routes.RegisterAttendanceRoutes(api)
+	routes.RegisterTicketRoutes(api)
+
+	server := httptest.NewServer(f.router)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+// streamTicket - A single-use ticket for connecting as the token's session
+func (f *notificationFixture) streamTicket(t *testing.T, token string) string {
+	w := f.do("POST", "/api/v1/stream/ticket", token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Ticket string `json:"ticket"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	require.NotEmpty(t, resp.Ticket)
+	return resp.Ticket
+}
+
+func TestStream_RequiresToken(t *testing.T) {
+	_, server := setupStreamTest(t)
+
+	resp, err := http.Get(server.URL + "/api/v1/stream")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/api/v1/stream?ticket=garbage")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestStream_TicketsAreSingleUseAndKeepTokensOutOfURLs(t *testing.T) {
+	f, server := setupStreamTest(t)
+
+	// The access token itself is no longer accepted in the URL
+	resp, err := http.Get(server.URL + "/api/v1/stream?token=" + f.admin)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	ticket := f.streamTicket(t, f.admin)
+	s := openStream(t, server, "ticket="+ticket, nil)
+	assert.Equal(t, "ready", s.next(t).Event)
+
+	resp, err = http.Get(server.URL + "/api/v1/stream?ticket=" + ticket)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Nor can a ticket outlive the session it was issued for
+	ticket = f.streamTicket(t, f.tokens[f.parent.ID])
+	services.RevokeUserSessions(f.parent.ID, models.SessionRevokedLogoutAll, 0)
+	resp, err = http.Get(server.URL + "/api/v1/stream?ticket=" + ticket)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestStream_ClosesWhenTheSessionIsRevoked(t *testing.T) {
+	f, server := setupStreamTest(t)
+	services.SetStreamHeartbeat(20 * time.Millisecond)
+	t.Cleanup(func() { services.SetStreamHeartbeat(25 * time.Second) })
+
+	s := openStream(t, server, "ticket="+f.streamTicket(t, f.tokens[f.parent.ID]), nil)
+	assert.Equal(t, "ready", s.next(t).Event)
+
+	// Logged out everywhere: the open stream mustn't keep receiving events
+	services.RevokeUserSessions(f.parent.ID, models.SessionRevokedLogoutAll, 0)
+	assert.Equal(t, "revoked", s.next(t).Event)
+	select {
+	case _, ok := <-s.events:
+		assert.False(t, ok, "stream still open")
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream still open")
+	}
+}
+
+func TestStream_PushesEventsToTheirAudience(t *testing.T) {
+	f, server := setupStreamTest(t)
+
+	admin := openStream(t, server, "ticket="+f.streamTicket(t, f.admin), nil)
+	parent := openStream(t, server, "", http.Header{"Authorization": {"Bearer " + f.tokens[f.parent.ID]}})
+	teacher := openStream(t, server, "ticket="+f.streamTicket(t, f.tokens[f.teacher.ID]), nil)
+	for _, s := range []*sseClient{admin, parent, teacher} {
+		assert.Equal(t, "ready", s.next(t).Event)
+	}
+
+	// Notification to the class's parents
+	f.send(t, map[string]interface{}{"title": "Closing day", "target_type": "CLASS_PARENTS", "target_id": f.class.ID})
+	ev := parent.next(t)
+	assert.Equal(t, "notification", ev.Event)
+	assert.NotEmpty(t, ev.ID)
+	assert.Contains(t, ev.Data, `"title":"Closing day"`)
+
+	// Payment confirmed (e.g. an M-PESA callback) goes to finance and the family
+	services.PublishPaymentEvent(models.Payment{ID: 9, SchoolID: f.school.ID, StudentID: f.student.ID, Amount: 2500, Method: "MPESA", Reference: "QK12AB"}, 0)
+	services.ProcessEvents(10)
+	ev = admin.next(t)
+	assert.Equal(t, "payment", ev.Event)
+	assert.Contains(t, ev.Data, `"reference":"QK12AB"`)
+	assert.Equal(t, "payment", parent.next(t).Event)
+
+	// Attendance register submitted by the class teacher
+	w := f.do("POST", "/api/v1/attendance/bulk", f.tokens[f.teacher.ID], map[string]interface{}{
+		"class_id": f.class.ID, "date": "2026-10-19",
+		"records": []map[string]interface{}{{"student_id": f.student.ID, "status": "PRESENT"}},
+	})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	ev = admin.next(t)
+	assert.Equal(t, "attendance", ev.Event)
+	assert.Contains(t, ev.Data, `"counts":{"PRESENT":1}`)
+	assert.Equal(t, "attendance", teacher.next(t).Event)
+
+	// Ticket raised by the admin
+	w = f.do("POST", "/api/v1/tickets", f.admin, map[string]interface{}{
+		"subject": "Printer", "description": "Broken", "category": "TECHNICAL",
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	ev = admin.next(t)
+	assert.Equal(t, "ticket", ev.Event)
+	assert.Contains(t, ev.Data, `"action":"created"`)
+
+	// Nothing else reached the parent or teacher
+	for _, s := range []*sseClient{parent, teacher} {
+		select {
+		case ev := <-s.events:
+			assert.True(t, ev.Comment, "unexpected %s event", ev.Event)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestStream_HeartbeatAndReconnectReplay(t *testing.T) {
+	f, server := setupStreamTest(t)
+	services.SetStreamHeartbeat(20 * time.Millisecond)
+	t.Cleanup(func() { services.SetStreamHeartbeat(25 * time.Second) })
+
+	s := openStream(t, server, "ticket="+f.streamTicket(t, f.tokens[f.parent.ID]), nil)
+	assert.Equal(t, "ready", s.next(t).Event)
+	select {
+	case ev := <-s.events:
+		assert.True(t, ev.Comment)
+	case <-time.After(time.Second):
+		t.Fatal("no heartbeat")
+	}
+
+	f.send(t, map[string]interface{}{"title": "one", "target_type": "ALL"})
+	first := s.next(t)
+	s.cancel()
+
+	// Sent while disconnected
+	f.send(t, map[string]interface{}{"title": "two", "target_type": "ALL"})
+	f.send(t, map[string]interface{}{"title": "three", "target_type": "ALL"})
+
+	s = openStream(t, server, "ticket="+f.streamTicket(t, f.tokens[f.parent.ID]), http.Header{"Last-Event-ID": {first.ID}})
+	assert.Equal(t, "ready", s.next(t).Event)
+	assert.Contains(t, s.next(t).Data, `"title":"two"`)
+	assert.Contains(t, s.next(t).Data, `"title":"three"`)
+
+	// Too old to replay
+	s = openStream(t, server, fmt.Sprintf("ticket=%s&last_event_id=%d", f.streamTicket(t, f.tokens[f.parent.ID]), 1), nil)
+	assert.Equal(t, "reset", s.next(t).Event)
+}
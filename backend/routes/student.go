@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -30,20 +31,19 @@ func RegisterStudentRoutes(router *gin.RouterGroup) {
 	students.Use(middleware.AuthMiddleware())
 	{
 		// Student can view their own profile
-		students.GET("/me", middleware.RoleGuard("STUDENT"), getMyProfile)
+		students.GET("/me", middleware.RequirePermission("students.view_own"), getMyProfile)
 
 		// Admin/Teacher/Finance routes
-		adminRoutes := students.Group("")
-		adminRoutes.Use(middleware.RoleGuard("SCHOOLADMIN", "TEACHER", "FINANCE"))
-		{
-			adminRoutes.GET("", listStudents)
-			adminRoutes.GET("/analytics", getStudentAnalytics)
-			adminRoutes.GET("/:id", getStudent)
-			adminRoutes.GET("/:id/financial-report", getStudentFinancialReport)
-			adminRoutes.PUT("/:id", updateStudent)
-			adminRoutes.POST("/:id/admit", admitStudent)
-			adminRoutes.POST("/:id/discharge", dischargeStudent)
-		}
+		view := middleware.RequirePermission("students.view")
+		students.GET("", view, listStudents)
+		students.GET("/analytics", view, getStudentAnalytics)
+		students.GET("/:id", view, getStudent)
+		students.GET("/:id/financial-report", view, getStudentFinancialReport)
+
+		manage := middleware.RequirePermission("students.manage")
+		students.PUT("/:id", manage, updateStudent)
+		students.POST("/:id/admit", manage, admitStudent)
+		students.POST("/:id/discharge", manage, dischargeStudent)
 	}
 }
 
@@ -306,6 +306,11 @@ func dischargeStudent(c *gin.Context) {
 
 	models.DB.Save(&student)
 
+	services.PublishEvent(schoolID, c.MustGet("userID").(uint), models.EventStudentDischarged, student.ID, map[string]string{
+		"reason": input.Reason,
+		"date":   now.Format("02 Jan 2006"),
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Student discharged successfully",
 		"student": student,
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 	"schoolms-go/utils"
 
 	"github.com/gin-gonic/gin"
@@ -23,18 +24,22 @@ type UpdateSchoolInput struct {
 	Address            string `json:"address"`
 	ContactInfo        string `json:"contact_info"`
 	SubscriptionStatus string `json:"subscription_status"` // ACTIVE, INACTIVE, TRIAL
+	Paybill            string `json:"paybill"`             // Shown in fee SMS
 }
 
 func RegisterSuperAdminRoutes(router *gin.RouterGroup) {
 	// Protected group for Superadmin only
 	super := router.Group("/superadmin")
-	super.Use(middleware.AuthMiddleware(), middleware.RoleGuard("SUPERADMIN"))
+	super.Use(middleware.AuthMiddleware(), middleware.RequirePermission("platform.schools.manage"))
 	{
 		super.POST("/schools", createSchoolAndAdmin)
 		super.GET("/schools", listSchools)
 		super.PUT("/schools/:id", updateSchool)
 		super.DELETE("/schools/:id", deleteSchool)
 		super.POST("/schools/:id/reset-password", resetSchoolAdminPassword)
+		super.POST("/schools/:id/sms-credits", topUpSMSCredit)
+		super.PUT("/schools/:id/sms-wallet", updateSMSWallet)
+		super.GET("/sms-statements", listSMSStatements)
 	}
 }
 
@@ -85,6 +90,8 @@ func createSchoolAndAdmin(c *gin.Context) {
 			PasswordHash: hashedPassword,
 			Role:         "SCHOOLADMIN",
 			SchoolID:     &school.ID,
+			// The temporary password above is the same for every school
+			MustChangePassword: true,
 		}
 
 		// Check for existing user
@@ -167,6 +174,9 @@ func updateSchool(c *gin.Context) {
 	if input.SubscriptionStatus != "" {
 		school.SubscriptionStatus = input.SubscriptionStatus
 	}
+	if input.Paybill != "" {
+		school.Paybill = input.Paybill
+	}
 
 	if err := models.DB.Save(&school).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update school"})
@@ -246,10 +256,12 @@ func resetSchoolAdminPassword(c *gin.Context) {
 	}
 
 	admin.PasswordHash = hashedPassword
+	admin.MustChangePassword = true
 	if err := models.DB.Save(&admin).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
 		return
 	}
+	services.RevokeUserSessions(admin.ID, models.SessionRevokedPasswordChanged, 0)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":      "Password reset successfully",
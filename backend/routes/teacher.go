@@ -10,7 +10,7 @@ import (
 
 func RegisterTeacherRoutes(router *gin.RouterGroup) {
 	teachers := router.Group("/teachers")
-	teachers.Use(middleware.AuthMiddleware(), middleware.RoleGuard("TEACHER"))
+	teachers.Use(middleware.AuthMiddleware(), middleware.RequirePermission("teachers.view_own"))
 	{
 		teachers.GET("/me", getTeacherProfile)
 		teachers.GET("/my-classes", getMyClasses)
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"schoolms-go/middleware"
 	"schoolms-go/models"
+	"schoolms-go/services"
 
 	"github.com/gin-gonic/gin"
 )
@@ -25,17 +26,17 @@ func RegisterTicketRoutes(router *gin.RouterGroup) {
 	tickets.Use(middleware.AuthMiddleware())
 	{
 		// SchoolAdmin and Students can create tickets
-		tickets.POST("", middleware.RoleGuard("SCHOOLADMIN", "STUDENT"), createTicket)
+		tickets.POST("", middleware.RequirePermission("tickets.create"), createTicket)
 
 		// Students can view their own tickets
-		tickets.GET("/my", middleware.RoleGuard("STUDENT"), getMyTickets)
+		tickets.GET("/my", middleware.RequirePermission("tickets.view_own"), getMyTickets)
 
 		// Admin roles can list all
-		tickets.GET("", middleware.RoleGuard("SCHOOLADMIN", "SUPERADMIN"), listTickets)
+		tickets.GET("", middleware.RequirePermission("tickets.view"), listTickets)
 		tickets.GET("/:id", getTicket)
 
 		// SuperAdmin can update tickets
-		tickets.PUT("/:id", middleware.RoleGuard("SUPERADMIN"), updateTicket)
+		tickets.PUT("/:id", middleware.RequirePermission("tickets.manage"), updateTicket)
 	}
 }
 
@@ -69,6 +70,7 @@ func createTicket(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create ticket"})
 		return
 	}
+	services.StreamTicketChanged(ticket, "created")
 
 	c.JSON(http.StatusCreated, ticket)
 }
@@ -154,6 +156,7 @@ func updateTicket(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update ticket"})
 		return
 	}
+	services.StreamTicketChanged(ticket, "updated")
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Ticket updated successfully",
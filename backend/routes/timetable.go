@@ -13,13 +13,13 @@ func RegisterTimetableRoutes(router *gin.RouterGroup) {
 	timetable.Use(middleware.AuthMiddleware())
 	{
 		// Admin manages timetable
-		timetable.POST("", middleware.RoleGuard("SCHOOLADMIN"), createTimetableEntry)
-		timetable.PUT("/:id", middleware.RoleGuard("SCHOOLADMIN"), updateTimetableEntry)
-		timetable.DELETE("/:id", middleware.RoleGuard("SCHOOLADMIN"), deleteTimetableEntry)
+		timetable.POST("", middleware.RequirePermission("timetable.manage"), createTimetableEntry)
+		timetable.PUT("/:id", middleware.RequirePermission("timetable.manage"), updateTimetableEntry)
+		timetable.DELETE("/:id", middleware.RequirePermission("timetable.manage"), deleteTimetableEntry)
 
 		// Everyone can view
-		timetable.GET("/class/:classId", middleware.RoleGuard("SCHOOLADMIN", "TEACHER", "STUDENT", "PARENT"), getClassTimetable)
-		timetable.GET("/teacher", middleware.RoleGuard("TEACHER"), getTeacherTimetable)
+		timetable.GET("/class/:classId", middleware.RequirePermission("timetable.view"), getClassTimetable)
+		timetable.GET("/teacher", middleware.RequirePermission("timetable.view_own"), getTeacherTimetable)
 	}
 }
 
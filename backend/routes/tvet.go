@@ -13,24 +13,24 @@ func RegisterTVETRoutes(router *gin.RouterGroup) {
 	tvet.Use(middleware.AuthMiddleware())
 	{
 		// Intake Groups
-		tvet.POST("/intakes", middleware.RoleGuard("SCHOOLADMIN"), createIntake)
-		tvet.GET("/intakes", middleware.RoleGuard("SCHOOLADMIN", "TEACHER"), listIntakes)
-		tvet.PUT("/intakes/:id", middleware.RoleGuard("SCHOOLADMIN"), updateIntake)
+		tvet.POST("/intakes", middleware.RequirePermission("tvet.manage"), createIntake)
+		tvet.GET("/intakes", middleware.RequirePermission("tvet.intakes.view"), listIntakes)
+		tvet.PUT("/intakes/:id", middleware.RequirePermission("tvet.manage"), updateIntake)
 
 		// Courses
-		tvet.POST("/courses", middleware.RoleGuard("SCHOOLADMIN"), createCourse)
+		tvet.POST("/courses", middleware.RequirePermission("tvet.manage"), createCourse)
 		tvet.GET("/courses", listCourses)
-		tvet.PUT("/courses/:id", middleware.RoleGuard("SCHOOLADMIN"), updateCourse)
+		tvet.PUT("/courses/:id", middleware.RequirePermission("tvet.manage"), updateCourse)
 
 		// Modules
-		tvet.POST("/modules", middleware.RoleGuard("SCHOOLADMIN"), createModule)
+		tvet.POST("/modules", middleware.RequirePermission("tvet.manage"), createModule)
 		tvet.GET("/courses/:courseId/modules", getModulesByCourse)
 
 		// Industrial Attachments
-		tvet.POST("/attachments", middleware.RoleGuard("SCHOOLADMIN", "TEACHER"), createAttachment)
-		tvet.GET("/attachments", middleware.RoleGuard("SCHOOLADMIN", "TEACHER"), listAttachments)
+		tvet.POST("/attachments", middleware.RequirePermission("tvet.attachments.manage"), createAttachment)
+		tvet.GET("/attachments", middleware.RequirePermission("tvet.attachments.manage"), listAttachments)
 		tvet.GET("/attachments/:id", getAttachment)
-		tvet.PUT("/attachments/:id", middleware.RoleGuard("SCHOOLADMIN", "TEACHER"), updateAttachment)
+		tvet.PUT("/attachments/:id", middleware.RequirePermission("tvet.attachments.manage"), updateAttachment)
 		tvet.GET("/students/:studentId/attachments", getStudentAttachments)
 	}
 }
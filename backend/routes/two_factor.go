@@ -0,0 +1,285 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"schoolms-go/utils"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TwoFactorCodeInput - A code from the authenticator app, or a recovery code where accepted
+type TwoFactorCodeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// DisableTwoFactorInput - Turning two-factor off needs the password and a code
+type DisableTwoFactorInput struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// TwoFactorPolicyInput - Roles in the school that must use two-factor sign-in
+type TwoFactorPolicyInput struct {
+	Roles []string `json:"roles"`
+}
+
+// twoFactorUser - The user making the request, if their token may be used here
+// Setup and enable accept a full session or a setup pre-auth token; verify only a pre-auth token
+func twoFactorUser(c *gin.Context, purposes ...string) (models.User, bool) {
+	var user models.User
+	if !slices.Contains(purposes, c.GetString("preAuth")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "This token can't be used here"})
+		return user, false
+	}
+	if err := models.DB.First(&user, c.MustGet("userID").(uint)).Error; err != nil || user.DeactivatedAt != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return user, false
+	}
+	return user, true
+}
+
+// twoFactorStatus - Whether two-factor is on for the current user and whether their role requires it
+func twoFactorStatus(c *gin.Context) {
+	var user models.User
+	if err := models.DB.First(&user, c.MustGet("userID").(uint)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":             user.TOTPEnabledAt != nil,
+		"enabled_at":          user.TOTPEnabledAt,
+		"required":            services.TwoFactorRequired(user),
+		"recovery_codes_left": services.RecoveryCodesLeft(user.ID),
+	})
+}
+
+// setupTwoFactor - A new secret and QR code for the authenticator app
+func setupTwoFactor(c *gin.Context) {
+	user, ok := twoFactorUser(c, "", utils.PurposeTwoFactorSetup)
+	if !ok {
+		return
+	}
+	setup, err := services.BeginTOTPSetup(&user)
+	if errors.Is(err, services.ErrTwoFactorAlreadyOn) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor is already enabled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor setup"})
+		return
+	}
+	c.JSON(http.StatusOK, setup)
+}
+
+// enableTwoFactor - Confirm the app works and switch two-factor on; returns the recovery codes once
+// When reached with a setup pre-auth token this also finishes the login
+func enableTwoFactor(c *gin.Context) {
+	user, ok := twoFactorUser(c, "", utils.PurposeTwoFactorSetup)
+	if !ok {
+		return
+	}
+	var input TwoFactorCodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := services.EnableTOTP(&user, input.Code)
+	switch {
+	case errors.Is(err, services.ErrTwoFactorAlreadyOn):
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor is already enabled"})
+		return
+	case errors.Is(err, services.ErrTwoFactorNotSetUp):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+		return
+	case errors.Is(err, services.ErrTwoFactorCodeInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor"})
+		return
+	}
+	models.CreateAuditLog(schoolIDOf(user), user.ID, models.AuditTwoFactorEnabled, "User", user.ID,
+		"", "", c.ClientIP(), c.Request.UserAgent())
+
+	if c.GetString("preAuth") == utils.PurposeTwoFactorSetup {
+		completeLogin(c, user, gin.H{"recovery_codes": codes})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor enabled", "recovery_codes": codes})
+}
+
+// verifyTwoFactor - Second step of login: an authenticator or recovery code for the pre-auth token
+func verifyTwoFactor(c *gin.Context) {
+	user, ok := twoFactorUser(c, utils.PurposeTwoFactor)
+	if !ok {
+		return
+	}
+	var input TwoFactorCodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Wrong codes count towards the same IP block and lockout as wrong passwords
+	if wait := services.LoginIPBlocked(c.ClientIP()); wait > 0 {
+		loginBlocked(c, services.LoginBlock{RetryAfter: wait})
+		return
+	}
+	if block, blocked := services.LoginAccountBlocked(user); blocked {
+		loginBlocked(c, block)
+		return
+	}
+	usedRecovery, ok := services.VerifySecondFactor(&user, input.Code)
+	if !ok {
+		if services.RecordLoginFailure(&user, user.Email, "two_factor", c.ClientIP(), c.Request.UserAgent()) {
+			loginBlocked(c, services.LoginBlock{RetryAfter: time.Until(*user.LockedUntil), Locked: true})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return
+	}
+	if !usedRecovery {
+		completeLogin(c, user, nil)
+		return
+	}
+	left := services.RecoveryCodesLeft(user.ID)
+	models.CreateAuditLog(schoolIDOf(user), user.ID, models.AuditRecoveryCodeUsed, "User", user.ID,
+		"", "", c.ClientIP(), c.Request.UserAgent())
+	completeLogin(c, user, gin.H{"recovery_codes_left": left})
+}
+
+// disableTwoFactor - Switch two-factor off, unless the user's role requires it
+func disableTwoFactor(c *gin.Context) {
+	var input DisableTwoFactorInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var user models.User
+	if err := models.DB.First(&user, c.MustGet("userID").(uint)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.TOTPEnabledAt == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor is not enabled"})
+		return
+	}
+	if services.TwoFactorRequiredByAnyMembership(user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your school requires two-factor for your role"})
+		return
+	}
+	if !models.CheckPasswordHash(input.Password, user.PasswordHash) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return
+	}
+	if _, ok := services.VerifySecondFactor(&user, input.Code); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return
+	}
+
+	if err := services.DisableTOTP(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor"})
+		return
+	}
+	models.CreateAuditLog(schoolIDOf(user), user.ID, models.AuditTwoFactorDisabled, "User", user.ID,
+		"", "", c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor disabled"})
+}
+
+// regenerateRecoveryCodes - Replace the recovery codes, e.g. after using some; needs an authenticator code
+func regenerateRecoveryCodes(c *gin.Context) {
+	var input TwoFactorCodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var user models.User
+	if err := models.DB.First(&user, c.MustGet("userID").(uint)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.TOTPEnabledAt == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor is not enabled"})
+		return
+	}
+	if !services.VerifyTOTP(&user, input.Code) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return
+	}
+	codes, err := services.GenerateRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// getTwoFactorPolicy - Roles in the school that must use two-factor
+func getTwoFactorPolicy(c *gin.Context) {
+	var school models.School
+	if err := models.DB.First(&school, c.MustGet("schoolID").(uint)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "School not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"roles":           append([]string{}, services.ParseRoleList(school.TwoFactorRoles)...),
+		"available_roles": services.TwoFactorRoles,
+	})
+}
+
+// updateTwoFactorPolicy - Choose which roles must use two-factor; they set it up at their next login
+func updateTwoFactorPolicy(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	var input TwoFactorPolicyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	roles := []string{}
+	for _, r := range services.ParseRoleList(strings.Join(input.Roles, ",")) {
+		if !slices.Contains(services.TwoFactorRoles, r) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor can't be required for role " + r})
+			return
+		}
+		if !slices.Contains(roles, r) {
+			roles = append(roles, r)
+		}
+	}
+
+	var school models.School
+	if err := models.DB.First(&school, schoolID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "School not found"})
+		return
+	}
+	old := school.TwoFactorRoles
+	school.TwoFactorRoles = strings.Join(roles, ",")
+	models.DB.Model(&school).Update("two_factor_roles", school.TwoFactorRoles)
+
+	models.CreateAuditLog(schoolID, c.MustGet("userID").(uint), models.AuditTwoFactorPolicyChange, "School", schoolID,
+		old, school.TwoFactorRoles, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+// resetUserTwoFactor - Clear a user's two-factor (lost phone and recovery codes) and sign them out everywhere
+func resetUserTwoFactor(c *gin.Context) {
+	user, ok := managedUser(c)
+	if !ok {
+		return
+	}
+	if err := services.DisableTOTP(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor"})
+		return
+	}
+	revoked := services.RevokeUserSessions(user.ID, models.SessionRevokedLogoutAll, 0)
+	models.CreateAuditLog(schoolIDOf(user), c.MustGet("userID").(uint), models.AuditTwoFactorReset, "User", user.ID,
+		"", user.Email, c.ClientIP(), c.Request.UserAgent())
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor reset; the user sets it up again at next login if required", "sessions_revoked": revoked})
+}
@@ -0,0 +1,202 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"schoolms-go/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type twoFactorLogin struct {
+	TwoFactorRequired      bool   `json:"two_factor_required"`
+	TwoFactorSetupRequired bool   `json:"two_factor_setup_required"`
+	PreAuthToken           string `json:"pre_auth_token"`
+	AccessToken            string `json:"access_token"`
+}
+
+func setupTwoFactorTest(t *testing.T) *sessionFixture {
+	f := setupSessionTest(t)
+	f.db.AutoMigrate(&models.RecoveryCode{}, &models.EmailLog{}, &models.EmailSettings{}, &models.MessageJob{}, &models.OutboundMessage{})
+	return f
+}
+
+func (f *sessionFixture) startLogin(t *testing.T, email string) twoFactorLogin {
+	w := f.do("POST", "/api/v1/auth/login", "", map[string]string{"email": email, "password": "password123"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var out twoFactorLogin
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return out
+}
+
+// enrol - Set up and enable two-factor; returns the secret and recovery codes
+func (f *sessionFixture) enrol(t *testing.T, token string) (string, []string) {
+	w := f.do("POST", "/api/v1/auth/2fa/setup", token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var setup struct {
+		Secret     string `json:"secret"`
+		OTPAuthURL string `json:"otpauth_url"`
+		QRCode     string `json:"qr_code"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &setup)
+	require.NotEmpty(t, setup.Secret)
+	assert.True(t, strings.HasPrefix(setup.OTPAuthURL, "otpauth://totp/SchoolMS:"))
+	assert.True(t, strings.HasPrefix(setup.QRCode, "data:image/png;base64,"))
+
+	code, _ := totp.GenerateCode(setup.Secret, time.Now())
+	w = f.do("POST", "/api/v1/auth/2fa/enable", token, map[string]string{"code": code})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var enabled struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &enabled)
+	require.Len(t, enabled.RecoveryCodes, 10)
+	return setup.Secret, enabled.RecoveryCodes
+}
+
+func TestTwoFactor_EnrolAndTwoStepLogin(t *testing.T) {
+	f := setupTwoFactorTest(t)
+	pair := f.login(t, f.admin.Email, "password123")
+
+	w := f.do("POST", "/api/v1/auth/2fa/setup", pair.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = f.do("POST", "/api/v1/auth/2fa/enable", pair.AccessToken, map[string]string{"code": "123456"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	secret, recovery := f.enrol(t, pair.AccessToken)
+	w = f.do("GET", "/api/v1/auth/2fa", pair.AccessToken, nil)
+	assert.Contains(t, w.Body.String(), `"enabled":true`)
+	assert.Contains(t, w.Body.String(), `"recovery_codes_left":10`)
+	w = f.do("POST", "/api/v1/auth/2fa/setup", pair.AccessToken, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// The password alone now only gets a pre-auth token
+	step := f.startLogin(t, f.admin.Email)
+	assert.True(t, step.TwoFactorRequired)
+	assert.False(t, step.TwoFactorSetupRequired)
+	assert.Empty(t, step.AccessToken)
+	require.NotEmpty(t, step.PreAuthToken)
+	assert.False(t, f.authorized(step.PreAuthToken))
+
+	// The code used to enable can't be replayed; the next one works
+	used, _ := totp.GenerateCode(secret, time.Now())
+	w = f.do("POST", "/api/v1/auth/2fa/verify", step.PreAuthToken, map[string]string{"code": used})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	next, _ := totp.GenerateCode(secret, time.Now().Add(30*time.Second))
+	w = f.do("POST", "/api/v1/auth/2fa/verify", step.PreAuthToken, map[string]string{"code": next})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var done tokenPair
+	json.Unmarshal(w.Body.Bytes(), &done)
+	assert.True(t, f.authorized(done.AccessToken))
+
+	// Full tokens can't be used on the verify step
+	w = f.do("POST", "/api/v1/auth/2fa/verify", done.AccessToken, map[string]string{"code": next})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Recovery codes work once, in any case and without the dash
+	step = f.startLogin(t, f.admin.Email)
+	w = f.do("POST", "/api/v1/auth/2fa/verify", step.PreAuthToken,
+		map[string]string{"code": strings.ToUpper(strings.ReplaceAll(recovery[0], "-", ""))})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"recovery_codes_left":9`)
+	w = f.do("POST", "/api/v1/auth/2fa/verify", step.PreAuthToken, map[string]string{"code": recovery[0]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	var actions []string
+	f.db.Model(&models.AuditLog{}).Where("user_id = ?", f.admin.ID).Order("id").Pluck("action", &actions)
+	assert.Equal(t, []string{models.AuditTwoFactorEnabled, models.AuditLoginFailed, models.AuditRecoveryCodeUsed, models.AuditLoginFailed}, actions)
+
+	// Turning it off needs the password and a code
+	w = f.do("POST", "/api/v1/auth/2fa/disable", done.AccessToken, map[string]string{"password": "wrong", "code": recovery[1]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = f.do("POST", "/api/v1/auth/2fa/disable", done.AccessToken, map[string]string{"password": "password123", "code": recovery[1]})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	f.login(t, f.admin.Email, "password123")
+}
+
+func TestTwoFactor_SchoolPolicyForcesSetupAtLogin(t *testing.T) {
+	f := setupTwoFactorTest(t)
+	admin := f.login(t, f.admin.Email, "password123")
+	teacher := f.login(t, f.user.Email, "password123")
+
+	w := f.do("PUT", "/api/v1/users/two-factor-policy", admin.AccessToken, map[string]interface{}{"roles": []string{"PARENT"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = f.do("PUT", "/api/v1/users/two-factor-policy", teacher.AccessToken, map[string]interface{}{"roles": []string{"TEACHER"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = f.do("PUT", "/api/v1/users/two-factor-policy", admin.AccessToken, map[string]interface{}{"roles": []string{"finance", "TEACHER", "TEACHER"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = f.do("GET", "/api/v1/users/two-factor-policy", admin.AccessToken, nil)
+	assert.Contains(t, w.Body.String(), `"roles":["FINANCE","TEACHER"]`)
+
+	// Admins aren't covered by this policy and still sign in with a password
+	assert.NotEmpty(t, f.startLogin(t, f.admin.Email).AccessToken)
+
+	step := f.startLogin(t, f.user.Email)
+	assert.True(t, step.TwoFactorSetupRequired)
+	assert.Empty(t, step.AccessToken)
+	w = f.do("POST", "/api/v1/auth/2fa/verify", step.PreAuthToken, map[string]string{"code": "123456"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = f.do("POST", "/api/v1/auth/2fa/setup", step.PreAuthToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &setup)
+	code, _ := totp.GenerateCode(setup.Secret, time.Now())
+	w = f.do("POST", "/api/v1/auth/2fa/enable", step.PreAuthToken, map[string]string{"code": code})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var finished struct {
+		AccessToken   string   `json:"access_token"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &finished)
+	assert.Len(t, finished.RecoveryCodes, 10)
+	assert.True(t, f.authorized(finished.AccessToken))
+
+	// Required, so it can't be switched off
+	w = f.do("POST", "/api/v1/auth/2fa/disable", finished.AccessToken,
+		map[string]string{"password": "password123", "code": finished.RecoveryCodes[0]})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Lost phone: the admin resets it, which signs the teacher out and sends them back to setup
+	w = f.do("POST", fmt.Sprintf("/api/v1/users/%d/2fa/reset", f.user.ID), admin.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.False(t, f.authorized(finished.AccessToken))
+	assert.False(t, f.authorized(teacher.AccessToken))
+	assert.True(t, f.startLogin(t, f.user.Email).TwoFactorSetupRequired)
+
+	var count int64
+	f.db.Model(&models.RecoveryCode{}).Where("user_id = ?", f.user.ID).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestTwoFactor_RegenerateRecoveryCodes(t *testing.T) {
+	f := setupTwoFactorTest(t)
+	pair := f.login(t, f.admin.Email, "password123")
+	secret, old := f.enrol(t, pair.AccessToken)
+
+	w := f.do("POST", "/api/v1/auth/2fa/recovery-codes", pair.AccessToken, map[string]string{"code": old[0]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "recovery codes can't mint new ones")
+
+	code, _ := totp.GenerateCode(secret, time.Now().Add(30*time.Second))
+	w = f.do("POST", "/api/v1/auth/2fa/recovery-codes", pair.AccessToken, map[string]string{"code": code})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var fresh struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &fresh)
+	assert.Len(t, fresh.RecoveryCodes, 10)
+
+	step := f.startLogin(t, f.admin.Email)
+	w = f.do("POST", "/api/v1/auth/2fa/verify", step.PreAuthToken, map[string]string{"code": old[1]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = f.do("POST", "/api/v1/auth/2fa/verify", step.PreAuthToken, map[string]string{"code": fresh.RecoveryCodes[0]})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
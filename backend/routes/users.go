@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"net/http"
+	"schoolms-go/middleware"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterUserRoutes(router *gin.RouterGroup) {
+	users := router.Group("/users")
+	users.Use(middleware.AuthMiddleware())
+	manage := middleware.RequirePermission("users.manage")
+	{
+		users.POST("/:id/deactivate", manage, deactivateUser)
+		users.POST("/:id/reactivate", manage, reactivateUser)
+		users.POST("/:id/2fa/reset", manage, resetUserTwoFactor)
+		users.POST("/:id/unlock", manage, unlockUser)
+		users.PUT("/:id/custom-role", middleware.RequirePermission("roles.manage"), assignCustomRole)
+	}
+
+	policy := router.Group("/users/two-factor-policy")
+	policy.Use(middleware.AuthMiddleware(), middleware.RequirePermission("security.policy.manage"))
+	{
+		policy.GET("", getTwoFactorPolicy)
+		policy.PUT("", updateTwoFactorPolicy)
+	}
+}
+
+// managedUser - The user in the path, if the caller may manage them (school admins only their own school)
+func managedUser(c *gin.Context) (models.User, bool) {
+	var user models.User
+	query := models.DB.Where("id = ?", c.Param("id"))
+	if c.MustGet("role").(string) != "SUPERADMIN" {
+		query = query.Where("school_id = ?", c.MustGet("schoolID").(uint))
+	}
+	if err := query.First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return user, false
+	}
+	return user, true
+}
+
+// deactivateUser - Stop a user signing in and revoke all their sessions, e.g. when a teacher leaves
+func deactivateUser(c *gin.Context) {
+	actorID := c.MustGet("userID").(uint)
+	user, ok := managedUser(c)
+	if !ok {
+		return
+	}
+	if user.ID == actorID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot deactivate your own account"})
+		return
+	}
+
+	revoked := int64(0)
+	if user.DeactivatedAt == nil {
+		now := time.Now()
+		models.DB.Model(&user).Update("deactivated_at", now)
+		revoked = services.RevokeUserSessions(user.ID, models.SessionRevokedUserDeactivated, 0)
+		models.CreateAuditLog(schoolIDOf(user), actorID, models.AuditUserDeactivated, "User", user.ID,
+			"", user.Email, c.ClientIP(), c.Request.UserAgent())
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User deactivated", "sessions_revoked": revoked})
+}
+
+// reactivateUser - Let a deactivated user sign in again
+func reactivateUser(c *gin.Context) {
+	user, ok := managedUser(c)
+	if !ok {
+		return
+	}
+	if user.DeactivatedAt != nil {
+		models.DB.Model(&user).Update("deactivated_at", nil)
+		models.CreateAuditLog(schoolIDOf(user), c.MustGet("userID").(uint), models.AuditUserReactivated, "User", user.ID,
+			"", user.Email, c.ClientIP(), c.Request.UserAgent())
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User reactivated"})
+}
+
+func schoolIDOf(user models.User) uint {
+	if user.SchoolID == nil {
+		return 0
+	}
+	return *user.SchoolID
+}
+
+// unlockUser - Lift a lockout from failed logins before it runs out
+func unlockUser(c *gin.Context) {
+	user, ok := managedUser(c)
+	if !ok {
+		return
+	}
+	services.ClearLoginFailures(user.ID)
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		models.CreateAuditLog(schoolIDOf(user), c.MustGet("userID").(uint), models.AuditAccountUnlocked, "User", user.ID,
+			"", user.Email, c.ClientIP(), c.Request.UserAgent())
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+}
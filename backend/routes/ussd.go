@@ -0,0 +1,40 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"schoolms-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterUSSDRoutes(router *gin.RouterGroup) {
+	// Gateway callback - no auth, guarded by SMS_CALLBACK_TOKEN
+	router.POST("/ussd", ussdSession)
+}
+
+// USSDInput - Africa's Talking posts each step of a session as a form
+type USSDInput struct {
+	SessionID   string `form:"sessionId" json:"session_id"`
+	ServiceCode string `form:"serviceCode" json:"service_code"`
+	PhoneNumber string `form:"phoneNumber" json:"phone_number"`
+	Text        string `form:"text" json:"text"` // Everything typed so far, joined with "*"
+}
+
+// ussdSession - Reply with the next menu screen as plain text
+func ussdSession(c *gin.Context) {
+	if status, _ := smsCallbackRefused(c); status != 0 {
+		c.String(status, "END Not authorised")
+		return
+	}
+
+	var input USSDInput
+	if err := c.ShouldBind(&input); err != nil || input.PhoneNumber == "" {
+		c.String(http.StatusBadRequest, "END Invalid request")
+		return
+	}
+
+	fmt.Printf("[USSD] Session: %s, Phone: %s, Text: %q\n", input.SessionID, input.PhoneNumber, input.Text)
+
+	c.String(http.StatusOK, services.HandleUSSD(input.PhoneNumber, input.Text).String())
+}
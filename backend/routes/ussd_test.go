@@ -0,0 +1,37 @@
+package routes_test
+
+import (
+	"net/http"
+	"net/url"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUSSD_GatewayGetsPlainTextScreens(t *testing.T) {
+	f := setupSMSTest(t)
+	routes.RegisterUSSDRoutes(f.router.Group("/api/v1"))
+
+	parent := models.User{Email: "parent@test.com", Role: "PARENT", SchoolID: &f.school.ID, Phone: "+254700000001"}
+	studentUser := models.User{Email: "amani@test.com", FullName: "Amani Otieno", Role: "STUDENT", SchoolID: &f.school.ID}
+	f.db.Create(&parent)
+	f.db.Create(&studentUser)
+	student := models.Student{UserID: studentUser.ID, SchoolID: f.school.ID, EnrollmentNumber: "ADM001", Status: "ENROLLED"}
+	f.db.Create(&student)
+	f.db.Create(&models.ParentStudent{ParentID: parent.ID, StudentID: student.ID, Phone: "+254712345678", PhoneVerified: true})
+
+	w := f.postForm("/api/v1/ussd?token=cb-secret", url.Values{"sessionId": {"ATUid_1"}, "serviceCode": {"*384*123#"}, "phoneNumber": {"+254712345678"}, "text": {""}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Equal(t, "CON Amani Otieno\n1. Fee balance\n2. Last payment\n3. Attendance this week\n4. Latest results", w.Body.String())
+
+	// An unverified number on the parent's own account doesn't unlock anything
+	w = f.postForm("/api/v1/ussd?token=cb-secret", url.Values{"sessionId": {"ATUid_2"}, "phoneNumber": {"+254700000001"}, "text": {""}})
+	assert.Equal(t, "END This number is not registered with any school. Please contact the school office.", w.Body.String())
+
+	w = f.postForm("/api/v1/ussd", url.Values{"sessionId": {"ATUid_3"}, "phoneNumber": {"+254712345678"}, "text": {"1"}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "END Not authorised", w.Body.String())
+}
@@ -11,26 +11,28 @@ import (
 
 func RegisterVoteHeadRoutes(router *gin.RouterGroup) {
 	vh := router.Group("/vote-heads")
-	vh.Use(middleware.AuthMiddleware(), middleware.RoleGuard("SCHOOLADMIN", "FINANCE"))
+	vh.Use(middleware.AuthMiddleware())
+	view := middleware.RequirePermission("finance.vote_heads.view")
+	manage := middleware.RequirePermission("finance.vote_heads.manage")
 	{
-		vh.POST("", createVoteHead)
-		vh.GET("", listVoteHeads)
-		vh.PUT("/:id", updateVoteHead)
-		vh.DELETE("/:id", deleteVoteHead)
-		vh.PUT("/reorder", reorderVoteHeads)
+		vh.POST("", manage, createVoteHead)
+		vh.GET("", view, listVoteHeads)
+		vh.PUT("/:id", manage, updateVoteHead)
+		vh.DELETE("/:id", manage, deleteVoteHead)
+		vh.PUT("/reorder", manage, reorderVoteHeads)
 	}
 
 	// Fee items (vote head breakdown in fee structures)
-	router.Group("/fee-structures").Use(middleware.AuthMiddleware(), middleware.RoleGuard("SCHOOLADMIN", "FINANCE")).
-		POST("/:id/items", addFeeItem).
-		GET("/:id/items", getFeeItems)
+	router.Group("/fee-structures").Use(middleware.AuthMiddleware()).
+		POST("/:id/items", manage, addFeeItem).
+		GET("/:id/items", view, getFeeItems)
 
 	// Student vote head balances
 	students := router.Group("/students")
 	students.Use(middleware.AuthMiddleware())
 	{
-		students.GET("/:id/vote-head-balances", middleware.RoleGuard("SCHOOLADMIN", "FINANCE", "PARENT"), getStudentVoteHeadBalances)
-		students.POST("/:id/initialize-balances", middleware.RoleGuard("SCHOOLADMIN"), initializeBalances)
+		students.GET("/:id/vote-head-balances", middleware.RequirePermission("finance.vote_heads.balances.view"), getStudentVoteHeadBalances)
+		students.POST("/:id/initialize-balances", middleware.RequirePermission("finance.vote_heads.balances.initialize"), initializeBalances)
 	}
 }
 
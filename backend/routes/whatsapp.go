@@ -0,0 +1,193 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"schoolms-go/middleware"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterWhatsAppRoutes(router *gin.RouterGroup) {
+	whatsapp := router.Group("/whatsapp")
+	{
+		// Cloud API webhook - verified with WHATSAPP_VERIFY_TOKEN, signed with WHATSAPP_APP_SECRET
+		whatsapp.GET("/webhook", verifyWhatsAppWebhook)
+		whatsapp.POST("/webhook", whatsAppWebhook)
+
+		whatsapp.Use(middleware.AuthMiddleware(), middleware.RequirePermission("whatsapp.manage"))
+		whatsapp.GET("/settings", getWhatsAppSettings)
+		whatsapp.PUT("/settings", updateWhatsAppSettings)
+		whatsapp.GET("/templates", listWhatsAppTemplates)
+		whatsapp.PUT("/templates/:name", saveWhatsAppTemplate)
+	}
+}
+
+// verifyWhatsAppWebhook - Echo the challenge when Meta subscribes the webhook
+func verifyWhatsAppWebhook(c *gin.Context) {
+	token := os.Getenv("WHATSAPP_VERIFY_TOKEN")
+	if c.Query("hub.mode") != "subscribe" || token == "" ||
+		subtle.ConstantTimeCompare([]byte(c.Query("hub.verify_token")), []byte(token)) != 1 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Verification failed"})
+		return
+	}
+	c.String(http.StatusOK, c.Query("hub.challenge"))
+}
+
+// whatsAppWebhook - Parent replies and delivery statuses
+func whatsAppWebhook(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
+		return
+	}
+	if !services.VerifyWhatsAppSignature(body, c.GetHeader("X-Hub-Signature-256")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+		return
+	}
+
+	replies, statuses, err := services.HandleWhatsAppWebhook(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
+		return
+	}
+
+	fmt.Printf("[WhatsApp Webhook] %d replies, %d statuses\n", replies, statuses)
+
+	// Always acknowledge so Meta doesn't keep retrying
+	c.JSON(http.StatusOK, gin.H{"replies": replies, "statuses": statuses})
+}
+
+// getWhatsAppSettings - The school's WhatsApp number (the token is never returned)
+func getWhatsAppSettings(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var settings models.WhatsAppSettings
+	if err := models.DB.Where("school_id = ?", schoolID).First(&settings).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"configured": false, "default_available": services.WhatsAppProviderForSchool(0) != nil})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"configured":       true,
+		"settings":         settings,
+		"has_access_token": settings.AccessToken != "",
+	})
+}
+
+// updateWhatsAppSettings - Set the Cloud API number this school sends from
+func updateWhatsAppSettings(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+
+	var input struct {
+		PhoneNumberID     string `json:"phone_number_id" binding:"required"`
+		BusinessAccountID string `json:"business_account_id"`
+		AccessToken       string `json:"access_token"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var settings models.WhatsAppSettings
+	models.DB.Where("school_id = ?", schoolID).First(&settings)
+	oldNumber := settings.PhoneNumberID
+
+	settings.SchoolID = schoolID
+	settings.PhoneNumberID = strings.TrimSpace(input.PhoneNumberID)
+	settings.BusinessAccountID = input.BusinessAccountID
+	settings.UpdatedBy = userID
+	// The token is write-only; leaving it blank keeps the stored value
+	if input.AccessToken != "" {
+		settings.AccessToken = input.AccessToken
+	}
+	if settings.AccessToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "access_token is required"})
+		return
+	}
+
+	var taken int64
+	models.DB.Model(&models.WhatsAppSettings{}).
+		Where("phone_number_id = ? AND school_id <> ?", settings.PhoneNumberID, schoolID).Count(&taken)
+	if taken > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "This WhatsApp number is used by another school"})
+		return
+	}
+
+	if err := models.DB.Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save WhatsApp settings"})
+		return
+	}
+
+	models.CreateAuditLog(schoolID, userID, models.AuditWhatsAppSettingsChange, "WhatsAppSettings", settings.ID,
+		oldNumber, settings.PhoneNumberID, c.ClientIP(), c.Request.UserAgent())
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// listWhatsAppTemplates - Approved template used for each message that can go out on WhatsApp
+func listWhatsAppTemplates(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+
+	var templates []gin.H
+	for _, name := range services.WhatsAppTemplateNames() {
+		tmpl, _ := services.GetWhatsAppTemplate(schoolID, name)
+		templates = append(templates, gin.H{
+			"name":          name,
+			"template_name": tmpl.TemplateName,
+			"params":        strings.Split(tmpl.Params, ","),
+			"customized":    tmpl.ID != 0,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"templates": templates, "fields": services.TemplateFields})
+}
+
+// saveWhatsAppTemplate - Point a message at the school's own approved template
+func saveWhatsAppTemplate(c *gin.Context) {
+	schoolID := c.MustGet("schoolID").(uint)
+	userID := c.MustGet("userID").(uint)
+	name := strings.ToUpper(c.Param("name"))
+
+	if _, ok := services.GetWhatsAppTemplate(0, name); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "This message can't be sent on WhatsApp"})
+		return
+	}
+
+	var input struct {
+		TemplateName string   `json:"template_name" binding:"required"`
+		Params       []string `json:"params"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, p := range input.Params {
+		if _, ok := services.TemplateFields[p]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown merge field: " + p})
+			return
+		}
+	}
+
+	var tmpl models.WhatsAppTemplate
+	models.DB.Where("school_id = ? AND name = ?", schoolID, name).First(&tmpl)
+	tmpl.SchoolID = schoolID
+	tmpl.Name = name
+	tmpl.TemplateName = strings.TrimSpace(input.TemplateName)
+	tmpl.Params = strings.Join(input.Params, ",")
+	tmpl.UpdatedBy = userID
+
+	if err := models.DB.Save(&tmpl).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tmpl)
+}
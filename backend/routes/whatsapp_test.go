@@ -0,0 +1,114 @@
+package routes_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"schoolms-go/models"
+	"schoolms-go/routes"
+	"schoolms-go/services"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWhatsApp_FeeReminderOnPreferredChannel(t *testing.T) {
+	f := setupSMSTest(t)
+	f.db.AutoMigrate(&models.WhatsAppSettings{}, &models.WhatsAppTemplate{}, &models.Class{}, &models.VoteHead{}, &models.VoteHeadBalance{})
+
+	mock := services.StartWhatsAppCloudMock()
+	defer mock.Close()
+	t.Setenv("WHATSAPP_API_URL", mock.URL())
+
+	api := f.router.Group("/api/v1")
+	routes.RegisterWhatsAppRoutes(api)
+	routes.RegisterParentRoutes(api)
+
+	w := f.do("PUT", "/api/v1/whatsapp/settings", f.admin, map[string]string{"phone_number_id": "100200300", "access_token": "EAAG-secret"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = f.do("GET", "/api/v1/whatsapp/settings", f.admin, nil)
+	assert.NotContains(t, w.Body.String(), "EAAG-secret")
+
+	w = f.do("PUT", "/api/v1/whatsapp/templates/fee_reminder", f.admin, map[string]interface{}{
+		"template_name": "karo_reminder", "params": []string{"student_name", "balance"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Two guardians: one prefers WhatsApp, one keeps SMS
+	wa := models.User{Email: "wa@test.com", Role: "PARENT", SchoolID: &f.school.ID, Phone: "+254711111111", PhoneVerified: true}
+	sms := models.User{Email: "sms@test.com", Role: "PARENT", SchoolID: &f.school.ID, Phone: "+254722222222", PhoneVerified: true}
+	studentUser := models.User{Email: "amani@test.com", FullName: "Amani Otieno", Role: "STUDENT", SchoolID: &f.school.ID}
+	f.db.Create(&wa)
+	f.db.Create(&sms)
+	f.db.Create(&studentUser)
+	student := models.Student{UserID: studentUser.ID, SchoolID: f.school.ID, EnrollmentNumber: "ADM001", Status: "ENROLLED"}
+	f.db.Create(&student)
+	f.db.Create(&models.ParentStudent{ParentID: wa.ID, StudentID: student.ID})
+	f.db.Create(&models.ParentStudent{ParentID: sms.ID, StudentID: student.ID})
+	f.db.Create(&models.VoteHeadBalance{StudentID: student.ID, SchoolID: f.school.ID, VoteHeadID: 1, Balance: 4000})
+
+	parentToken := sessionToken(t, wa)
+	w = f.do("PUT", "/api/v1/parent/preferences", parentToken, map[string]string{"message_channel": "WHATSAPP"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"language":"en"`) // Unchanged
+
+	w = f.do("POST", "/api/v1/sms/fee-reminders", f.admin, map[string]float64{"min_balance": 1000})
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	services.ProcessOutbox(10)
+
+	sent := mock.Sent()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, "254711111111", sent[0].To)
+	assert.Equal(t, "karo_reminder", sent[0].Template)
+	assert.Equal(t, []string{"Amani Otieno", "4,000.00"}, sent[0].Params)
+
+	assert.Len(t, f.provider.Sent(), 1)
+	assert.Equal(t, "+254722222222", f.provider.Sent()[0].To)
+}
+
+func TestWhatsApp_WebhookVerificationAndSignedReplies(t *testing.T) {
+	f := setupSMSTest(t)
+	f.db.AutoMigrate(&models.WhatsAppSettings{})
+	routes.RegisterWhatsAppRoutes(f.router.Group("/api/v1"))
+
+	t.Setenv("WHATSAPP_VERIFY_TOKEN", "verify-me")
+	t.Setenv("WHATSAPP_APP_SECRET", "app-secret")
+	f.db.Create(&models.WhatsAppSettings{SchoolID: f.school.ID, PhoneNumberID: "555", AccessToken: "t"})
+
+	w := f.do("GET", "/api/v1/whatsapp/webhook?hub.mode=subscribe&hub.verify_token=verify-me&hub.challenge=12345", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "12345", w.Body.String())
+	w = f.do("GET", "/api/v1/whatsapp/webhook?hub.mode=subscribe&hub.verify_token=wrong&hub.challenge=1", "", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	body := `{"entry":[{"changes":[{"value":{"metadata":{"phone_number_id":"555"},
+		"messages":[{"from":"254733333333","id":"wamid.in","type":"button","button":{"text":"Call me"}}]}}]}]}`
+	post := func(signature string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/v1/whatsapp/webhook", strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", signature)
+		w := httptest.NewRecorder()
+		f.router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("sha256=deadbeef").Code)
+
+	mac := hmac.New(sha256.New, []byte("app-secret"))
+	mac.Write([]byte(body))
+	w = post("sha256=" + hex.EncodeToString(mac.Sum(nil)))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = f.do("GET", "/api/v1/sms/inbox", f.admin, nil)
+	var inbox struct {
+		Messages []models.InboundMessage `json:"messages"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &inbox)
+	assert.Len(t, inbox.Messages, 1)
+	assert.Equal(t, "Call me", inbox.Messages[0].Text)
+	assert.Equal(t, models.ChannelWhatsApp, inbox.Messages[0].Channel)
+	assert.Equal(t, "+254733333333", inbox.Messages[0].From)
+}
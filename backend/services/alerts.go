@@ -0,0 +1,162 @@
+package services
+
+import (
+	"fmt"
+	"schoolms-go/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultAlertRules - What guardians are told until a school sets its own rules
+var defaultAlertRules = map[string]models.AlertRule{
+	models.EventPaymentRecorded:   {Enabled: true, SendSMS: true},
+	models.EventAttendanceAbsent:  {Enabled: true, SendSMS: true, ConsecutiveAbsences: 1},
+	models.EventGradePublished:    {Enabled: true, SendNotification: true},
+	models.EventStudentDischarged: {Enabled: true, SendSMS: true, SendNotification: true},
+}
+
+// alertTemplates - Message template used for each event's SMS and notification
+var alertTemplates = map[string]string{
+	models.EventPaymentRecorded:   models.TemplatePaymentConfirmation,
+	models.EventAttendanceAbsent:  models.TemplateAttendanceAlert,
+	models.EventGradePublished:    models.TemplateGradePublished,
+	models.EventStudentDischarged: models.TemplateStudentDischarged,
+}
+
+var alertTitles = map[string]string{
+	models.EventPaymentRecorded:   "Payment received",
+	models.EventAttendanceAbsent:  "Absence alert",
+	models.EventGradePublished:    "New grade",
+	models.EventStudentDischarged: "Student discharged",
+}
+
+var registerAlertsOnce sync.Once
+
+// RegisterAlertSubscribers - Subscribe guardian alerts to student events (safe to call twice)
+func RegisterAlertSubscribers() {
+	registerAlertsOnce.Do(func() {
+		for eventType := range defaultAlertRules {
+			Subscribe(eventType, handleAlertEvent)
+		}
+	})
+}
+
+// AlertEventTypes - Events that can alert guardians, sorted
+func AlertEventTypes() []string {
+	types := make([]string, 0, len(defaultAlertRules))
+	for t := range defaultAlertRules {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// GetAlertRule - The school's rule for an event, or the built-in default
+func GetAlertRule(schoolID uint, eventType string) (models.AlertRule, bool) {
+	var rule models.AlertRule
+	if models.DB.Where("school_id = ? AND event_type = ?", schoolID, eventType).First(&rule).Error == nil {
+		return rule, true
+	}
+	rule, ok := defaultAlertRules[eventType]
+	rule.SchoolID = schoolID
+	rule.EventType = eventType
+	return rule, ok
+}
+
+// handleAlertEvent - Tell a student's guardians about an event, as the school's rule says
+func handleAlertEvent(event models.Event, data map[string]string) error {
+	rule, ok := GetAlertRule(event.SchoolID, event.Type)
+	if !ok || !rule.Enabled || (!rule.SendSMS && !rule.SendNotification) {
+		return nil
+	}
+
+	var student models.Student
+	if err := models.DB.Preload("User").Preload("Class").First(&student, event.StudentID).Error; err != nil {
+		return fmt.Errorf("student %d not found", event.StudentID)
+	}
+
+	var balance float64
+	models.DB.Model(&models.VoteHeadBalance{}).Where("student_id = ?", student.ID).
+		Select("COALESCE(SUM(balance), 0)").Scan(&balance)
+
+	fields := StudentMergeFields(student, balance)
+	for k, v := range data {
+		fields[k] = v
+	}
+
+	if event.Type == models.EventAttendanceAbsent {
+		absences := consecutiveAbsences(student.ID, data["date"])
+		if absences < rule.ConsecutiveAbsences || absences == 0 {
+			return nil
+		}
+		fields["absences"] = fmt.Sprint(absences)
+		if day, err := time.Parse("2006-01-02", data["date"]); err == nil {
+			fields["date"] = day.Format("02 Jan 2006")
+		}
+	}
+
+	template := alertTemplates[event.Type]
+
+	if rule.SendSMS {
+		var messages []SMSMessage
+		for _, g := range GuardiansForStudent(student.ID) {
+			msg, err := GuardianMessage(event.SchoolID, g, template, fields)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, msg)
+		}
+		if len(messages) > 0 {
+			if _, err := EnqueueMessages(event.SchoolID, event.ActorID, models.MessageJobAlert, messages); err != nil {
+				return fmt.Errorf("queue SMS: %w", err)
+			}
+		}
+	}
+
+	if rule.SendNotification {
+		text, err := RenderMessage(event.SchoolID, template, models.LanguageEnglish, fields)
+		if err != nil {
+			return err
+		}
+		notification := models.Notification{
+			SchoolID:   event.SchoolID,
+			SenderID:   event.ActorID,
+			TargetType: "STUDENT",
+			TargetID:   &student.ID,
+			Title:      alertTitles[event.Type],
+			Message:    text,
+			Category:   "ALERT",
+		}
+		if err := models.DB.Create(&notification).Error; err != nil {
+			return fmt.Errorf("create notification: %w", err)
+		}
+		PublishNotification(&notification)
+	}
+	return nil
+}
+
+// consecutiveAbsences - Days absent in a row up to date, or 0 if the student
+// wasn't absent that day (e.g. the mark was corrected before the event ran)
+func consecutiveAbsences(studentID uint, date string) int {
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0
+	}
+
+	var records []models.Attendance
+	models.DB.Where("student_id = ? AND date < ?", studentID, day.AddDate(0, 0, 1)).
+		Order("date DESC").Limit(60).Find(&records)
+
+	if len(records) == 0 || records[0].Date.Format("2006-01-02") != date {
+		return 0
+	}
+	count := 0
+	for _, r := range records {
+		if r.Status != "ABSENT" {
+			break
+		}
+		count++
+	}
+	return count
+}
@@ -0,0 +1,293 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"schoolms-go/models"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const announcementPollInterval = 30 * time.Second
+
+// PublishNotification - Mark a notification published, push it to connected recipients and queue its SMS/email delivery
+// Returns false when it had already been published
+func PublishNotification(n *models.Notification) bool {
+	now := time.Now()
+	claim := models.DB.Model(&models.Notification{}).
+		Where("id = ? AND published_at IS NULL", n.ID).
+		Update("published_at", now)
+	if claim.RowsAffected == 0 {
+		return false
+	}
+	n.PublishedAt = &now
+	StreamNotificationPublished(*n)
+
+	if n.SendSMS || n.SendEmail {
+		PublishEvent(n.SchoolID, n.SenderID, models.EventNotificationPublished, 0,
+			map[string]string{"notification_id": strconv.FormatUint(uint64(n.ID), 10)})
+	}
+	return true
+}
+
+// PublishDueNotifications - Publish scheduled notifications whose time has come; returns how many
+func PublishDueNotifications() int {
+	var due []models.Notification
+	models.DB.Where("published_at IS NULL AND publish_at IS NOT NULL AND publish_at <= ?", time.Now()).
+		Order("publish_at").Limit(100).Find(&due)
+
+	published := 0
+	for i := range due {
+		if PublishNotification(&due[i]) {
+			published++
+		}
+	}
+	return published
+}
+
+// StartNotificationPublisher - Publish scheduled notifications until ctx is cancelled
+func StartNotificationPublisher(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(announcementPollInterval)
+		defer ticker.Stop()
+		for {
+			if n := PublishDueNotifications(); n > 0 {
+				log.Printf("[Notifications] Published %d scheduled notifications", n)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+var notificationSubscribersOnce sync.Once
+
+// RegisterNotificationSubscribers - Deliver published notifications to SMS and email subscribers; safe to call more than once
+func RegisterNotificationSubscribers() {
+	notificationSubscribersOnce.Do(func() {
+		Subscribe(models.EventNotificationPublished, deliverNotification)
+	})
+}
+
+// deliverNotification - Text and email the recipients of a notification that was just published
+func deliverNotification(event models.Event, data map[string]string) error {
+	var n models.Notification
+	if err := models.DB.First(&n, data["notification_id"]).Error; err != nil {
+		return fmt.Errorf("notification %s: %w", data["notification_id"], err)
+	}
+	if n.Status(time.Now()) == models.NotificationExpired {
+		return nil
+	}
+	recipients := NotificationRecipients(n)
+
+	if n.SendSMS && n.SMSJobID == nil {
+		text := n.Title + ": " + n.Message
+		if n.AckRequired {
+			text += " Please acknowledge in SchoolMS."
+		}
+		var messages []SMSMessage
+		for _, phone := range recipientPhones(recipients) {
+			messages = append(messages, SMSMessage{To: phone, Message: text})
+		}
+		if len(messages) > 0 {
+			job, err := EnqueueMessages(n.SchoolID, n.SenderID, models.MessageJobAnnouncement, messages)
+			if err != nil {
+				return fmt.Errorf("queue SMS: %w", err)
+			}
+			models.DB.Model(&n).Update("sms_job_id", job.ID)
+		}
+	}
+
+	if n.SendEmail && n.EmailsSent == 0 {
+		msg, err := RenderEmail(n.SchoolID, models.EmailTemplateAnnouncement, MergeFields{
+			"title":   n.Title,
+			"message": n.Message,
+			"link":    AppURL("/dashboard/notifications"),
+		})
+		if err != nil {
+			return err
+		}
+		sent := 0
+		for _, email := range recipientEmails(recipients) {
+			msg.To = []string{email}
+			if SendSchoolEmail(n.SchoolID, models.EmailTemplateAnnouncement, msg).Success {
+				sent++
+			}
+		}
+		models.DB.Model(&n).Update("emails_sent", sent)
+	}
+	return nil
+}
+
+// recipientPhones - Verified numbers for the users, parents' per-child numbers included, without duplicates
+func recipientPhones(users []models.User) []string {
+	var parentIDs []uint
+	for _, u := range users {
+		if u.Role == "PARENT" {
+			parentIDs = append(parentIDs, u.ID)
+		}
+	}
+	var links []models.ParentStudent
+	if len(parentIDs) > 0 {
+		models.DB.Where("parent_id IN ?", parentIDs).Preload("Parent").Order("id").Find(&links)
+	}
+
+	seen := map[string]bool{}
+	var phones []string
+	add := func(phone string) {
+		if phone != "" && !seen[phone] {
+			seen[phone] = true
+			phones = append(phones, phone)
+		}
+	}
+	for _, u := range users {
+		if u.Phone != "" && u.PhoneVerified {
+			add(u.Phone)
+		}
+	}
+	for _, link := range links {
+		add(GuardianPhone(link))
+	}
+	return phones
+}
+
+// recipientEmails - Real email addresses of the users, skipping generated .local ones
+func recipientEmails(users []models.User) []string {
+	seen := map[string]bool{}
+	var emails []string
+	for _, u := range users {
+		email := strings.ToLower(strings.TrimSpace(u.Email))
+		if email == "" || strings.HasSuffix(email, ".local") || seen[email] {
+			continue
+		}
+		seen[email] = true
+		emails = append(emails, email)
+	}
+	return emails
+}
+
+// AcknowledgeNotification - Record that the user acknowledged the notification; also marks it read
+func AcknowledgeNotification(notificationID, userID uint) (models.NotificationAcknowledgement, error) {
+	var ack models.NotificationAcknowledgement
+	if models.DB.Where("notification_id = ? AND user_id = ?", notificationID, userID).First(&ack).Error == nil {
+		return ack, nil
+	}
+	ack = models.NotificationAcknowledgement{NotificationID: notificationID, UserID: userID, AcknowledgedAt: time.Now()}
+	if err := models.DB.Create(&ack).Error; err != nil {
+		return ack, err
+	}
+	MarkNotificationsRead(userID, []uint{notificationID})
+	return ack, nil
+}
+
+// AckRecipient - A recipient who hasn't acknowledged yet
+type AckRecipient struct {
+	UserID   uint   `json:"user_id"`
+	FullName string `json:"full_name"`
+	Role     string `json:"role"`
+}
+
+// AckClassReport - Acknowledgements from one class's students and parents; ClassID 0 is staff and others
+type AckClassReport struct {
+	ClassID      uint           `json:"class_id"`
+	ClassName    string         `json:"class_name"`
+	Recipients   int            `json:"recipients"`
+	Acknowledged int            `json:"acknowledged"`
+	Pending      []AckRecipient `json:"pending"`
+}
+
+// AckReport - Who has acknowledged a notification, overall and per class
+type AckReport struct {
+	NotificationID uint             `json:"notification_id"`
+	Recipients     int              `json:"recipients"`
+	Acknowledged   int              `json:"acknowledged"`
+	Classes        []AckClassReport `json:"classes"`
+}
+
+// NotificationAckReport - Acknowledgements grouped by class; a parent counts once in each child's class
+func NotificationAckReport(n models.Notification) AckReport {
+	recipients := NotificationRecipients(n)
+	report := AckReport{NotificationID: n.ID, Recipients: len(recipients), Classes: []AckClassReport{}}
+
+	var acks []models.NotificationAcknowledgement
+	models.DB.Where("notification_id = ?", n.ID).Find(&acks)
+	acked := make(map[uint]bool, len(acks))
+	for _, a := range acks {
+		acked[a.UserID] = true
+	}
+
+	// Classes each recipient belongs to through a student
+	var students []models.Student
+	models.DB.Where("school_id = ? AND class_id IS NOT NULL", n.SchoolID).Find(&students)
+	studentClass := make(map[uint]uint, len(students))
+	userClasses := map[uint][]uint{}
+	for _, s := range students {
+		studentClass[s.ID] = *s.ClassID
+		userClasses[s.UserID] = appendUnique(userClasses[s.UserID], *s.ClassID)
+	}
+	var links []models.ParentStudent
+	models.DB.Where("student_id IN ?", mapKeys(studentClass)).Find(&links)
+	for _, link := range links {
+		userClasses[link.ParentID] = appendUnique(userClasses[link.ParentID], studentClass[link.StudentID])
+	}
+
+	byClass := map[uint]*AckClassReport{}
+	for _, u := range recipients {
+		done := acked[u.ID]
+		if done {
+			report.Acknowledged++
+		}
+		classes := userClasses[u.ID]
+		if len(classes) == 0 {
+			classes = []uint{0}
+		}
+		for _, classID := range classes {
+			row := byClass[classID]
+			if row == nil {
+				row = &AckClassReport{ClassID: classID, Pending: []AckRecipient{}}
+				byClass[classID] = row
+			}
+			row.Recipients++
+			if done {
+				row.Acknowledged++
+			} else {
+				row.Pending = append(row.Pending, AckRecipient{UserID: u.ID, FullName: u.FullName, Role: u.Role})
+			}
+		}
+	}
+
+	var classes []models.Class
+	models.DB.Where("id IN ?", mapKeys(byClass)).Find(&classes)
+	for _, c := range classes {
+		byClass[c.ID].ClassName = c.Name
+	}
+	if row := byClass[0]; row != nil {
+		row.ClassName = "Staff and others"
+	}
+	for _, row := range byClass {
+		report.Classes = append(report.Classes, *row)
+	}
+	sort.Slice(report.Classes, func(i, j int) bool {
+		a, b := report.Classes[i], report.Classes[j]
+		if (a.ClassID == 0) != (b.ClassID == 0) {
+			return b.ClassID == 0
+		}
+		return a.ClassName < b.ClassName
+	})
+	return report
+}
+
+func mapKeys[V any](m map[uint]V) []uint {
+	ids := make([]uint, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
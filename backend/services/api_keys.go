@@ -0,0 +1,118 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"schoolms-go/models"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	APIKeyPrefix        = "smk_" // Lets AuthMiddleware tell a key from a JWT
+	apiKeyTouchInterval = time.Minute
+	serviceAccountHash  = "!service" // Never matches a password; service accounts only use API keys
+)
+
+var (
+	ErrAPIKeyInvalid = errors.New("invalid, expired or revoked API key")
+	ErrAPIKeyScope   = errors.New("API keys can't be given this scope")
+)
+
+// apiKeyForbiddenScopes - A key can't mint other keys, so a leaked key can be revoked for good
+var apiKeyForbiddenScopes = []string{"api_keys.manage"}
+
+// IsAPIKey - Whether a bearer token is an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// CreateServiceAccount - The identity a school's integration acts as; audit logs name it
+func CreateServiceAccount(schoolID uint, name string) (models.User, error) {
+	suffix, err := newRefreshToken()
+	if err != nil {
+		return models.User{}, err
+	}
+	account := models.User{
+		Email:        fmt.Sprintf("service-%d-%s@service.local", schoolID, strings.ToLower(suffix[:10])),
+		FullName:     name,
+		PasswordHash: serviceAccountHash,
+		Role:         RoleService,
+		SchoolID:     &schoolID,
+	}
+	return account, models.DB.Create(&account).Error
+}
+
+// ValidateAPIKeyScopes - Scopes are permissions a custom role could have, less the forbidden ones
+func ValidateAPIKeyScopes(scopes []string) ([]string, error) {
+	valid, err := ValidateCustomPermissions(scopes)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range valid {
+		if slices.Contains(apiKeyForbiddenScopes, s) {
+			return nil, fmt.Errorf("%w: %s", ErrAPIKeyScope, s)
+		}
+	}
+	return valid, nil
+}
+
+// CreateAPIKey - A new key for the service account; the key is returned once and only its hash is stored
+func CreateAPIKey(account models.User, name string, scopes []string, expiresAt time.Time, createdByID uint) (string, models.APIKey, error) {
+	secret, err := newRefreshToken()
+	if err != nil {
+		return "", models.APIKey{}, err
+	}
+	key := APIKeyPrefix + secret
+	record := models.APIKey{
+		SchoolID:         *account.SchoolID,
+		ServiceAccountID: account.ID,
+		Name:             name,
+		Prefix:           key[:len(APIKeyPrefix)+6],
+		KeyHash:          hashToken(key),
+		Scopes:           strings.Join(scopes, ","),
+		ExpiresAt:        expiresAt,
+		CreatedByID:      createdByID,
+	}
+	if err := models.DB.Create(&record).Error; err != nil {
+		return "", record, err
+	}
+	return key, record, nil
+}
+
+// AuthenticateAPIKey - The key and its service account, if the key is live; records when and where it was used
+func AuthenticateAPIKey(key, ip string) (models.APIKey, models.User, error) {
+	var record models.APIKey
+	var account models.User
+	if !IsAPIKey(key) || models.DB.Where("key_hash = ?", hashToken(key)).First(&record).Error != nil {
+		return record, account, ErrAPIKeyInvalid
+	}
+	now := time.Now()
+	if record.RevokedAt != nil || !record.ExpiresAt.After(now) {
+		return record, account, ErrAPIKeyInvalid
+	}
+	err := models.DB.Where("id = ? AND role = ? AND deactivated_at IS NULL", record.ServiceAccountID, RoleService).First(&account).Error
+	if err != nil {
+		return record, account, ErrAPIKeyInvalid
+	}
+
+	// Written at most once a minute, so busy integrations don't write on every request
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) > apiKeyTouchInterval || record.LastUsedIP != ip {
+		models.DB.Model(&record).Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": ip})
+	}
+	return record, account, nil
+}
+
+// APIKeyActive - Whether a key that authenticated earlier still works (not revoked or expired)
+func APIKeyActive(id uint) bool {
+	var count int64
+	models.DB.Model(&models.APIKey{}).Where("id = ? AND revoked_at IS NULL AND expires_at > ?", id, time.Now()).Count(&count)
+	return count > 0
+}
+
+// RevokeAPIKey - Stop a key working; returns false if it was already revoked
+func RevokeAPIKey(id uint) bool {
+	return models.DB.Model(&models.APIKey{}).Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).RowsAffected > 0
+}
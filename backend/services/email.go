@@ -0,0 +1,402 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"schoolms-go/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const smtpTimeout = 30 * time.Second
+
+// EmailAttachment - A file sent with an email
+type EmailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// EmailMessage - One email with HTML and plain-text bodies
+type EmailMessage struct {
+	To          []string
+	Subject     string
+	HTML        string
+	Text        string
+	Attachments []EmailAttachment
+}
+
+// EmailResult - Result of sending an email
+type EmailResult struct {
+	Success   bool   `json:"success"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Mailer - Delivers a built message
+type Mailer interface {
+	Send(from mail.Address, msg EmailMessage) (string, error)
+}
+
+// SMTPMailer - Sends through an SMTP server
+type SMTPMailer struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string // NONE, STARTTLS, TLS
+}
+
+// Send - Deliver msg and return its Message-ID
+func (m *SMTPMailer) Send(from mail.Address, msg EmailMessage) (string, error) {
+	if len(msg.To) == 0 {
+		return "", errors.New("no recipients")
+	}
+	data, messageID, err := BuildMIMEMessage(from, msg)
+	if err != nil {
+		return "", err
+	}
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	if m.Encryption == models.EmailEncryptionTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: m.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return "", err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	defer client.Close()
+
+	if m.Encryption == models.EmailEncryptionSTARTTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return "", fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if m.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return "", errors.New("server does not support authentication")
+		}
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return "", fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return "", err
+	}
+	for _, to := range msg.To {
+		if err := client.Rcpt(to); err != nil {
+			return "", fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	client.Quit()
+	return messageID, nil
+}
+
+// BuildMIMEMessage - RFC 5322 message with text and HTML alternatives plus attachments
+func BuildMIMEMessage(from mail.Address, msg EmailMessage) ([]byte, string, error) {
+	messageID := fmt.Sprintf("<%s@%s>", randomID(), domainOf(from.Address))
+
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+	header("From", from.String())
+	header("To", strings.Join(msg.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID)
+	header("MIME-Version", "1.0")
+
+	mixed := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	buf.WriteString("\r\n")
+
+	// Text and HTML are alternatives of the same body
+	var alt bytes.Buffer
+	altWriter := multipart.NewWriter(&alt)
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		if part.body == "" {
+			continue
+		}
+		w, err := altWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		qp := quotedprintable.NewWriter(w)
+		qp.Write([]byte(part.body))
+		qp.Close()
+	}
+	altWriter.Close()
+
+	body, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + altWriter.Boundary()},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	body.Write(alt.Bytes())
+
+	for _, a := range msg.Attachments {
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": a.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			w.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		w.Write([]byte(encoded + "\r\n"))
+	}
+	mixed.Close()
+
+	return buf.Bytes(), messageID, nil
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func domainOf(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 && i < len(address)-1 {
+		return address[i+1:]
+	}
+	return "localhost"
+}
+
+var (
+	mailerMu      sync.RWMutex
+	defaultMailer Mailer
+	defaultFrom   mail.Address
+)
+
+func init() {
+	defaultMailer, defaultFrom = mailerFromEnv()
+}
+
+// mailerFromEnv - Server-wide SMTP server from SMTP_* variables; nil without SMTP_HOST
+func mailerFromEnv() (Mailer, mail.Address) {
+	from := mail.Address{Name: os.Getenv("SMTP_FROM_NAME"), Address: os.Getenv("SMTP_FROM")}
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, from
+	}
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil || port <= 0 {
+		port = 587
+	}
+	encryption := strings.ToUpper(os.Getenv("SMTP_ENCRYPTION"))
+	if encryption == "" {
+		encryption = DefaultEmailEncryption(port)
+	}
+	if from.Address == "" {
+		from.Address = "no-reply@" + host
+	}
+	return &SMTPMailer{
+		Host:       host,
+		Port:       port,
+		Username:   os.Getenv("SMTP_USERNAME"),
+		Password:   os.Getenv("SMTP_PASSWORD"),
+		Encryption: encryption,
+	}, from
+}
+
+// DefaultEmailEncryption - Usual encryption for a port: 465 is TLS, 25 and 1025 are plain
+func DefaultEmailEncryption(port int) string {
+	switch port {
+	case 465:
+		return models.EmailEncryptionTLS
+	case 25, 1025:
+		return models.EmailEncryptionNone
+	default:
+		return models.EmailEncryptionSTARTTLS
+	}
+}
+
+// SetDefaultMailer - Replace the server-wide mailer (tests, local development)
+func SetDefaultMailer(m Mailer, from mail.Address) {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+	defaultMailer = m
+	defaultFrom = from
+}
+
+// NewMailer - Build a mailer from a school's stored settings
+func NewMailer(settings models.EmailSettings) Mailer {
+	return &SMTPMailer{
+		Host:       settings.Host,
+		Port:       settings.Port,
+		Username:   settings.Username,
+		Password:   settings.Password,
+		Encryption: settings.Encryption,
+	}
+}
+
+// MailerForSchool - The school's own SMTP server and sender, or the server default
+// sent under the school's name
+func MailerForSchool(schoolID uint) (Mailer, mail.Address) {
+	var settings models.EmailSettings
+	if schoolID != 0 && models.DB.Where("school_id = ?", schoolID).First(&settings).Error == nil {
+		return NewMailer(settings), mail.Address{Name: settings.FromName, Address: settings.FromAddress}
+	}
+
+	mailerMu.RLock()
+	m, from := defaultMailer, defaultFrom
+	mailerMu.RUnlock()
+
+	if from.Name == "" && schoolID != 0 {
+		var school models.School
+		models.DB.Select("id", "name").First(&school, schoolID)
+		from.Name = school.Name
+	}
+	return m, from
+}
+
+// SendSchoolEmail - Send through the school's mailer and record it in the email log
+func SendSchoolEmail(schoolID uint, template string, msg EmailMessage) EmailResult {
+	var result EmailResult
+	mailer, from := MailerForSchool(schoolID)
+
+	var recipients []string
+	for _, to := range msg.To {
+		if addr, err := mail.ParseAddress(strings.TrimSpace(to)); err == nil {
+			recipients = append(recipients, addr.Address)
+		}
+	}
+	msg.To = recipients
+
+	switch {
+	case mailer == nil:
+		result.Error = "Email not configured"
+	case len(recipients) == 0:
+		result.Error = "No valid email address"
+	default:
+		id, err := mailer.Send(from, msg)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Success, result.MessageID = true, id
+		}
+	}
+
+	LogEmail(schoolID, template, msg, result)
+	return result
+}
+
+// LogEmail - Record an email attempt
+func LogEmail(schoolID uint, template string, msg EmailMessage, result EmailResult) {
+	var names []string
+	for _, a := range msg.Attachments {
+		names = append(names, a.Filename)
+	}
+	entry := models.EmailLog{
+		SchoolID:    schoolID,
+		To:          strings.Join(msg.To, ", "),
+		Subject:     msg.Subject,
+		Template:    template,
+		Attachments: strings.Join(names, ", "),
+		Status:      models.EmailSent,
+		Error:       result.Error,
+		MessageID:   result.MessageID,
+	}
+	if !result.Success {
+		entry.Status = models.EmailFailed
+	}
+	if err := models.DB.Create(&entry).Error; err != nil {
+		log.Printf("[Email] Failed to log email to %s: %v", entry.To, err)
+	}
+}
+
+// GuardianEmailsForStudent - Real email addresses of a student's guardians
+// Accounts created from a phone number during import have placeholder addresses and are skipped
+func GuardianEmailsForStudent(studentID uint) []string {
+	var links []models.ParentStudent
+	models.DB.Where("student_id = ?", studentID).Preload("Parent").Order("id").Find(&links)
+
+	seen := make(map[string]bool)
+	var emails []string
+	for _, link := range links {
+		email := strings.ToLower(strings.TrimSpace(link.Parent.Email))
+		if email == "" || strings.HasSuffix(email, ".local") || seen[email] {
+			continue
+		}
+		seen[email] = true
+		emails = append(emails, email)
+	}
+	return emails
+}
+
+// AppURL - Link into the web app (APP_URL, default http://localhost:3000)
+func AppURL(path string) string {
+	base := strings.TrimRight(os.Getenv("APP_URL"), "/")
+	if base == "" {
+		base = "http://localhost:3000"
+	}
+	return base + path
+}
+
+// SendInviteEmail - Email an invite code to the person being invited
+func SendInviteEmail(invite models.Invite, to string) EmailResult {
+	msg, err := RenderEmail(invite.SchoolID, models.EmailTemplateInvite, MergeFields{
+		"role":        strings.ToLower(invite.Role),
+		"invite_code": invite.Code.String(),
+		"link":        AppURL("/register?code=" + invite.Code.String()),
+		"expires":     invite.ExpiresAt.Format("02 Jan 2006 15:04"),
+	})
+	if err != nil {
+		return EmailResult{Error: err.Error()}
+	}
+	msg.To = []string{to}
+	return SendSchoolEmail(invite.SchoolID, models.EmailTemplateInvite, msg)
+}
@@ -0,0 +1,321 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"schoolms-go/models"
+	"strings"
+	"time"
+)
+
+// ReceiptNumber - Printed receipt number of a payment
+func ReceiptNumber(paymentID uint) string {
+	return fmt.Sprintf("RCP-%06d", paymentID)
+}
+
+// ReceiptHTML - Printable receipt for a payment; format is "a4" or "thermal"
+func ReceiptHTML(payment models.Payment, format string) string {
+	var student models.Student
+	models.DB.Where("id = ?", payment.StudentID).Preload("User").First(&student)
+
+	var school models.School
+	models.DB.Where("id = ?", payment.SchoolID).First(&school)
+
+	var allocations []models.PaymentAllocation
+	models.DB.Where("payment_id = ?", payment.ID).Preload("VoteHead").Find(&allocations)
+
+	// Build vote head breakdown HTML
+	voteHeadRows := ""
+	for _, alloc := range allocations {
+		voteHeadRows += fmt.Sprintf("<tr><td>%s</td><td style='text-align:right'>KES %.2f</td></tr>",
+			html.EscapeString(alloc.VoteHead.Name), alloc.Amount)
+	}
+
+	var width, padding string
+	if format == "thermal" {
+		width = "80mm"
+		padding = "5px"
+	} else {
+		width = "210mm"
+		padding = "20px"
+	}
+
+	return fmt.Sprintf(`
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <title>Receipt #%s</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 0; padding: %s; width: %s; }
+        .header { text-align: center; margin-bottom: 20px; }
+        .header h1 { margin: 0; font-size: 1.5em; }
+        .header p { margin: 5px 0; color: #666; }
+        table { width: 100%%; border-collapse: collapse; margin: 15px 0; }
+        th, td { padding: 8px; border-bottom: 1px solid #ddd; text-align: left; }
+        .total { font-weight: bold; font-size: 1.2em; }
+        .footer { margin-top: 30px; text-align: center; font-size: 0.9em; color: #666; }
+        .signature { margin-top: 50px; border-top: 1px solid #000; width: 200px; text-align: center; }
+        @media print { body { width: auto; } }
+    </style>
+</head>
+<body>
+    <div class="header">
+        <h1>%s</h1>
+        <p>Official Fee Receipt</p>
+    </div>
+
+    <table>
+        <tr><th>Receipt No:</th><td>%s</td></tr>
+        <tr><th>Date:</th><td>%s</td></tr>
+        <tr><th>Student:</th><td>%s (%s)</td></tr>
+        <tr><th>Payment Method:</th><td>%s</td></tr>
+        <tr><th>Reference:</th><td>%s</td></tr>
+    </table>
+
+    <h3>Vote Head Breakdown</h3>
+    <table>
+        <thead><tr><th>Vote Head</th><th style='text-align:right'>Amount</th></tr></thead>
+        <tbody>%s</tbody>
+    </table>
+
+    <table>
+        <tr class="total"><td>TOTAL PAID</td><td style='text-align:right'>KES %.2f</td></tr>
+    </table>
+
+    <div class="footer">
+        <p>Thank you for your payment!</p>
+        <div class="signature">Served By: _____________</div>
+    </div>
+</body>
+</html>`,
+		ReceiptNumber(payment.ID), padding, width,
+		html.EscapeString(school.Name),
+		ReceiptNumber(payment.ID),
+		payment.CreatedAt.Format("2006-01-02 15:04"),
+		html.EscapeString(student.User.Email), html.EscapeString(student.EnrollmentNumber),
+		html.EscapeString(payment.Method),
+		html.EscapeString(payment.Reference),
+		voteHeadRows,
+		payment.Amount)
+}
+
+// FeeStatementHTML - Balance per vote head and every payment, for printing or attaching
+func FeeStatementHTML(student models.Student) (string, float64, error) {
+	breakdown, total, err := GetStudentVoteHeadBreakdown(student.ID, student.SchoolID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var payments []models.Payment
+	models.DB.Where("student_id = ?", student.ID).Order("created_at, id").Find(&payments)
+
+	var b strings.Builder
+	documentHeader(&b, student, "Fee Statement")
+
+	b.WriteString("<h3>Payments</h3><table><thead><tr><th>Date</th><th>Receipt</th><th>Method</th><th>Reference</th><th class='num'>Amount</th></tr></thead><tbody>")
+	var paid float64
+	for _, p := range payments {
+		fmt.Fprintf(&b, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td class='num'>%s</td></tr>",
+			p.CreatedAt.Format("2006-01-02"), ReceiptNumber(p.ID), html.EscapeString(p.Method),
+			html.EscapeString(p.Reference), FormatKES(p.Amount))
+		paid += p.Amount
+	}
+	fmt.Fprintf(&b, "</tbody><tfoot><tr class='total'><td colspan='4'>TOTAL PAID</td><td class='num'>KES %s</td></tr></tfoot></table>", FormatKES(paid))
+
+	b.WriteString("<h3>Balance by Vote Head</h3><table><thead><tr><th>Vote Head</th><th class='num'>Balance</th></tr></thead><tbody>")
+	for _, line := range breakdown {
+		balance, _ := line["balance"].(float64)
+		name, _ := line["vote_head_name"].(string)
+		fmt.Fprintf(&b, "<tr><td>%s</td><td class='num'>%s</td></tr>", html.EscapeString(name), FormatKES(balance))
+	}
+	fmt.Fprintf(&b, "</tbody><tfoot><tr class='total'><td>BALANCE DUE</td><td class='num'>KES %s</td></tr></tfoot></table>", FormatKES(total))
+
+	documentFooter(&b)
+	return b.String(), total, nil
+}
+
+// ReportCardHTML - Every grade for one term, with the average
+func ReportCardHTML(student models.Student, term string, year int) (string, error) {
+	var grades []models.Grade
+	models.DB.Where("student_id = ? AND term = ? AND year = ?", student.ID, term, year).Order("subject").Find(&grades)
+	if len(grades) == 0 {
+		return "", errors.New("no grades recorded for this term")
+	}
+
+	var b strings.Builder
+	documentHeader(&b, student, fmt.Sprintf("Report Card - %s %d", html.EscapeString(term), year))
+
+	b.WriteString("<table><thead><tr><th>Subject</th><th class='num'>Score</th><th class='num'>%</th><th>Comment</th></tr></thead><tbody>")
+	var score, maxScore float64
+	for _, g := range grades {
+		percent := 0.0
+		if g.MaxScore > 0 {
+			percent = g.Score / g.MaxScore * 100
+		}
+		fmt.Fprintf(&b, "<tr><td>%s</td><td class='num'>%g/%g</td><td class='num'>%.0f</td><td>%s</td></tr>",
+			html.EscapeString(g.Subject), g.Score, g.MaxScore, percent, html.EscapeString(g.Comment))
+		score += g.Score
+		maxScore += g.MaxScore
+	}
+	b.WriteString("</tbody>")
+	if maxScore > 0 {
+		fmt.Fprintf(&b, "<tfoot><tr class='total'><td>AVERAGE</td><td class='num'>%g/%g</td><td class='num'>%.0f</td><td></td></tr></tfoot>",
+			score, maxScore, score/maxScore*100)
+	}
+	b.WriteString("</table>")
+
+	documentFooter(&b)
+	return b.String(), nil
+}
+
+// documentHeader - Shared head and student block of statements and report cards
+func documentHeader(b *strings.Builder, student models.Student, title string) {
+	var school models.School
+	models.DB.Where("id = ?", student.SchoolID).First(&school)
+
+	className := ""
+	if student.Class != nil {
+		className = student.Class.Name
+	}
+
+	fmt.Fprintf(b, `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <title>%s</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 0; padding: 20px; width: 210mm; }
+        .header { text-align: center; margin-bottom: 20px; }
+        .header h1 { margin: 0; font-size: 1.5em; }
+        .header p { margin: 5px 0; color: #666; }
+        table { width: 100%%; border-collapse: collapse; margin: 15px 0; }
+        th, td { padding: 8px; border-bottom: 1px solid #ddd; text-align: left; }
+        .num { text-align: right; }
+        .total { font-weight: bold; }
+        .footer { margin-top: 30px; text-align: center; font-size: 0.9em; color: #666; }
+        @media print { body { width: auto; } }
+    </style>
+</head>
+<body>
+    <div class="header">
+        <h1>%s</h1>
+        <p>%s</p>
+    </div>
+    <table>
+        <tr><th>Student:</th><td>%s</td></tr>
+        <tr><th>Adm No:</th><td>%s</td></tr>
+        <tr><th>Class:</th><td>%s</td></tr>
+        <tr><th>Date:</th><td>%s</td></tr>
+    </table>
+`, title, html.EscapeString(school.Name), title,
+		html.EscapeString(StudentMergeFields(student, 0)["student_name"]),
+		html.EscapeString(student.EnrollmentNumber), html.EscapeString(className),
+		time.Now().Format("2006-01-02"))
+}
+
+func documentFooter(b *strings.Builder) {
+	b.WriteString(`    <div class="footer"><p>Generated by the school office.</p></div>
+</body>
+</html>`)
+}
+
+// studentForDocument - Student with the relations documents print
+func studentForDocument(studentID uint) (models.Student, error) {
+	var student models.Student
+	err := models.DB.Preload("User").Preload("Class").First(&student, studentID).Error
+	return student, err
+}
+
+// studentBalance - Total owed across vote heads
+func studentBalance(studentID uint) float64 {
+	var balance float64
+	models.DB.Model(&models.VoteHeadBalance{}).Where("student_id = ?", studentID).
+		Select("COALESCE(SUM(balance), 0)").Scan(&balance)
+	return balance
+}
+
+// recipientsOrGuardians - Explicit addresses, or the student's guardians when none were given
+func recipientsOrGuardians(to []string, studentID uint) []string {
+	if len(to) > 0 {
+		return to
+	}
+	return GuardianEmailsForStudent(studentID)
+}
+
+// EmailReceipt - Send a payment's receipt, attached as HTML
+func EmailReceipt(payment models.Payment, to []string) EmailResult {
+	student, err := studentForDocument(payment.StudentID)
+	if err != nil {
+		return EmailResult{Error: "Student not found"}
+	}
+
+	fields := StudentMergeFields(student, studentBalance(student.ID))
+	fields["amount"] = FormatKES(payment.Amount)
+	fields["receipt_no"] = ReceiptNumber(payment.ID)
+
+	msg, err := RenderEmail(payment.SchoolID, models.EmailTemplateReceipt, fields)
+	if err != nil {
+		return EmailResult{Error: err.Error()}
+	}
+	msg.To = recipientsOrGuardians(to, student.ID)
+	msg.Attachments = []EmailAttachment{{
+		Filename:    ReceiptNumber(payment.ID) + ".html",
+		ContentType: "text/html; charset=utf-8",
+		Data:        []byte(ReceiptHTML(payment, "a4")),
+	}}
+	return SendSchoolEmail(payment.SchoolID, models.EmailTemplateReceipt, msg)
+}
+
+// EmailFeeStatement - Send a student's fee statement, attached as HTML
+func EmailFeeStatement(student models.Student, to []string) EmailResult {
+	statement, balance, err := FeeStatementHTML(student)
+	if err != nil {
+		return EmailResult{Error: "Could not build statement"}
+	}
+
+	msg, err := RenderEmail(student.SchoolID, models.EmailTemplateFeeStatement, StudentMergeFields(student, balance))
+	if err != nil {
+		return EmailResult{Error: err.Error()}
+	}
+	msg.To = recipientsOrGuardians(to, student.ID)
+	msg.Attachments = []EmailAttachment{{
+		Filename:    "statement-" + fileSafe(student.EnrollmentNumber) + ".html",
+		ContentType: "text/html; charset=utf-8",
+		Data:        []byte(statement),
+	}}
+	return SendSchoolEmail(student.SchoolID, models.EmailTemplateFeeStatement, msg)
+}
+
+// EmailReportCard - Send a student's report card for one term, attached as HTML
+func EmailReportCard(student models.Student, term string, year int, to []string) EmailResult {
+	card, err := ReportCardHTML(student, term, year)
+	if err != nil {
+		return EmailResult{Error: err.Error()}
+	}
+
+	fields := StudentMergeFields(student, 0)
+	fields["term"] = fmt.Sprintf("%s %d", term, year)
+	msg, err := RenderEmail(student.SchoolID, models.EmailTemplateReportCard, fields)
+	if err != nil {
+		return EmailResult{Error: err.Error()}
+	}
+	msg.To = recipientsOrGuardians(to, student.ID)
+	msg.Attachments = []EmailAttachment{{
+		Filename:    fmt.Sprintf("report-card-%s-%s-%d.html", fileSafe(student.EnrollmentNumber), fileSafe(term), year),
+		ContentType: "text/html; charset=utf-8",
+		Data:        []byte(card),
+	}}
+	return SendSchoolEmail(student.SchoolID, models.EmailTemplateReportCard, msg)
+}
+
+// fileSafe - "ADM/001" -> "ADM-001"
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, s)
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"fmt"
+	"html"
+	"schoolms-go/models"
+	"strings"
+)
+
+// emailTemplate - Subject, plain-text and HTML bodies using {{field}} placeholders
+type emailTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+var emailTemplates = map[string]emailTemplate{
+	models.EmailTemplateInvite: {
+		Subject: "You're invited to join {{school_name}}",
+		Text: "Hello,\n\nYou have been invited to join {{school_name}} as {{role}}.\n\n" +
+			"Your invite code is: {{invite_code}}\n\nUse it to register: {{link}}\n\nThe code expires on {{expires}}.",
+		HTML: `<p>Hello,</p><p>You have been invited to join <strong>{{school_name}}</strong> as {{role}}.</p>` +
+			`<p style="font-size:1.3em;letter-spacing:1px"><strong>{{invite_code}}</strong></p>` +
+			`<p><a href="{{link}}">Register with this code</a></p><p>The code expires on {{expires}}.</p>`,
+	},
+	models.EmailTemplatePasswordReset: {
+		Subject: "Reset your {{school_name}} password",
+		Text: "Hello {{name}},\n\nWe received a request to reset your password. Open this link to choose a new one:\n\n{{link}}\n\n" +
+			"Or enter the code {{reset_code}}. It expires at {{expires}}.\n\nIf you didn't ask for this, ignore this email.",
+		HTML: `<p>Hello {{name}},</p><p>We received a request to reset your password.</p>` +
+			`<p><a href="{{link}}">Choose a new password</a></p><p>Or enter the code <strong>{{reset_code}}</strong>. It expires at {{expires}}.</p>` +
+			`<p>If you didn't ask for this, ignore this email.</p>`,
+	},
+	models.EmailTemplateAccountLocked: {
+		Subject: "Your {{school_name}} account was locked",
+		Text: "Hello {{name}},\n\nAfter {{attempts}} failed sign-in attempts, the last from {{ip}}, your account is locked until {{until}}.\n\n" +
+			"If this wasn't you, someone may be guessing your password. Choose a new one: {{link}}",
+		HTML: `<p>Hello {{name}},</p><p>After {{attempts}} failed sign-in attempts, the last from {{ip}}, your account is locked until {{until}}.</p>` +
+			`<p>If this wasn't you, someone may be guessing your password. <a href="{{link}}">Choose a new one</a>.</p>`,
+	},
+	models.EmailTemplateReceipt: {
+		Subject: "Receipt {{receipt_no}} for {{student_name}}",
+		Text: "Dear parent,\n\nWe received KES {{amount}} for {{student_name}} ({{adm_no}}). " +
+			"Your receipt {{receipt_no}} is attached.\n\nBalance: KES {{balance}}\n\nThank you.\n{{school_name}}",
+		HTML: `<p>Dear parent,</p><p>We received <strong>KES {{amount}}</strong> for {{student_name}} ({{adm_no}}). ` +
+			`Your receipt {{receipt_no}} is attached.</p><p>Balance: KES {{balance}}</p><p>Thank you.</p>`,
+	},
+	models.EmailTemplateFeeStatement: {
+		Subject: "Fee statement for {{student_name}}",
+		Text: "Dear parent,\n\nThe fee statement for {{student_name}} ({{adm_no}}) is attached. " +
+			"The outstanding balance is KES {{balance}}.\n\nPay via M-PESA Paybill {{paybill}}, account {{adm_no}}.\n{{school_name}}",
+		HTML: `<p>Dear parent,</p><p>The fee statement for {{student_name}} ({{adm_no}}) is attached. ` +
+			`The outstanding balance is <strong>KES {{balance}}</strong>.</p><p>Pay via M-PESA Paybill {{paybill}}, account {{adm_no}}.</p>`,
+	},
+	models.EmailTemplateReportCard: {
+		Subject: "{{term}} report card for {{student_name}}",
+		Text:    "Dear parent,\n\nThe {{term}} report card for {{student_name}} ({{adm_no}}) is attached.\n\n{{school_name}}",
+		HTML:    `<p>Dear parent,</p><p>The {{term}} report card for {{student_name}} ({{adm_no}}) is attached.</p>`,
+	},
+	models.EmailTemplateAnnouncement: {
+		Subject: "{{title}}",
+		Text:    "{{message}}\n\nView it in SchoolMS: {{link}}\n\n{{school_name}}",
+		HTML: `<h2 style="margin-top:0">{{title}}</h2><p style="white-space:pre-line">{{message}}</p>` +
+			`<p><a href="{{link}}">View it in SchoolMS</a></p>`,
+	},
+	models.EmailTemplateTest: {
+		Subject: "Test email from {{school_name}}",
+		Text:    "This is a test email. If you can read it, {{school_name}}'s email settings work.",
+		HTML:    `<p>This is a test email. If you can read it, {{school_name}}'s email settings work.</p>`,
+	},
+}
+
+// RenderEmail - Subject and bodies of a named email template
+// Field values are escaped in the HTML body
+func RenderEmail(schoolID uint, name string, fields MergeFields) (EmailMessage, error) {
+	tmpl, ok := emailTemplates[name]
+	if !ok {
+		return EmailMessage{}, fmt.Errorf("email template %s not found", name)
+	}
+	if schoolID != 0 {
+		fields = WithSchoolFields(schoolID, fields)
+	}
+	if fields["school_name"] == "" {
+		fields["school_name"] = "SchoolMS"
+	}
+
+	escaped := MergeFields{}
+	for k, v := range fields {
+		escaped[k] = html.EscapeString(v)
+	}
+
+	return EmailMessage{
+		Subject: RenderBody(tmpl.Subject, fields),
+		Text:    RenderBody(tmpl.Text, fields),
+		HTML:    emailLayout(escaped["school_name"], RenderBody(tmpl.HTML, escaped)),
+	}, nil
+}
+
+// emailLayout - Wrap an HTML body in the shared header and footer
+func emailLayout(schoolName, body string) string {
+	var b strings.Builder
+	b.WriteString(`<!DOCTYPE html><html><head><meta charset="UTF-8"></head>`)
+	b.WriteString(`<body style="font-family:Arial,sans-serif;color:#222;max-width:600px;margin:0 auto;padding:20px">`)
+	fmt.Fprintf(&b, `<h2 style="border-bottom:2px solid #2b6cb0;padding-bottom:8px">%s</h2>`, schoolName)
+	b.WriteString(body)
+	fmt.Fprintf(&b, `<p style="margin-top:30px;font-size:0.85em;color:#777">Sent by %s</p></body></html>`, schoolName)
+	return b.String()
+}
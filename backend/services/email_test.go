@@ -0,0 +1,96 @@
+package services_test
+
+import (
+	"net/mail"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startCatcher(t *testing.T) *services.SMTPCatcher {
+	catcher, err := services.StartSMTPCatcher("127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { catcher.Close() })
+	return catcher
+}
+
+func TestSMTPMailer_DeliversAlternativesAndAttachments(t *testing.T) {
+	catcher := startCatcher(t)
+
+	id, err := catcher.Mailer().Send(mail.Address{Name: "Shule Bora", Address: "office@shule.ac.ke"}, services.EmailMessage{
+		To:      []string{"parent@example.com"},
+		Subject: "Risiti ya malipo – Term 1",
+		Text:    "Plain body",
+		HTML:    "<p>HTML body</p>",
+		Attachments: []services.EmailAttachment{
+			{Filename: "RCP-000001.html", ContentType: "text/html", Data: []byte("<h1>Receipt</h1>")},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, id, "@shule.ac.ke>")
+
+	caught := catcher.Messages()
+	assert.Len(t, caught, 1)
+	assert.Equal(t, "office@shule.ac.ke", caught[0].From)
+	assert.Equal(t, []string{"parent@example.com"}, caught[0].To)
+	assert.Equal(t, "Risiti ya malipo – Term 1", caught[0].Subject)
+	assert.Equal(t, "Plain body", caught[0].Text)
+	assert.Equal(t, "<p>HTML body</p>", caught[0].HTML)
+	assert.Len(t, caught[0].Attachments, 1)
+	assert.Equal(t, "RCP-000001.html", caught[0].Attachments[0].Filename)
+	assert.Equal(t, "<h1>Receipt</h1>", string(caught[0].Attachments[0].Data))
+}
+
+func TestRenderEmail_EscapesFieldsInHTMLOnly(t *testing.T) {
+	msg, err := services.RenderEmail(0, models.EmailTemplateInvite, services.MergeFields{
+		"school_name": "Shule <Bora>",
+		"role":        "teacher",
+		"invite_code": "abc-123",
+		"link":        "http://localhost:3000/register?code=abc-123",
+		"expires":     "20 Oct 2026 10:00",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "You're invited to join Shule <Bora>", msg.Subject)
+	assert.Contains(t, msg.Text, "Your invite code is: abc-123")
+	assert.Contains(t, msg.HTML, "Shule &lt;Bora&gt;")
+	assert.NotContains(t, msg.HTML, "<Bora>")
+
+	_, err = services.RenderEmail(0, "NOPE", nil)
+	assert.Error(t, err)
+}
+
+func TestSendSchoolEmail_UsesSchoolSettingsAndLogs(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { sqlDB, _ := db.DB(); sqlDB.Close() }()
+	db.AutoMigrate(&models.EmailSettings{}, &models.EmailLog{})
+
+	catcher := startCatcher(t)
+	services.SetDefaultMailer(nil, mail.Address{})
+
+	school := models.School{Name: "Test School"}
+	db.Create(&school)
+
+	// No school settings and no server default: logged as failed
+	result := services.SendSchoolEmail(school.ID, models.EmailTemplateTest, services.EmailMessage{To: []string{"a@example.com"}, Subject: "Hi", Text: "Hi"})
+	assert.False(t, result.Success)
+	assert.Equal(t, "Email not configured", result.Error)
+
+	db.Create(&models.EmailSettings{SchoolID: school.ID, Host: catcher.Host(), Port: catcher.Port(),
+		Encryption: models.EmailEncryptionNone, FromAddress: "bursar@test.ac.ke", FromName: "Bursar"})
+
+	result = services.SendSchoolEmail(school.ID, models.EmailTemplateTest, services.EmailMessage{
+		To: []string{"Parent <a@example.com>", "not-an-address"}, Subject: "Hi", Text: "Hi",
+	})
+	assert.True(t, result.Success, result.Error)
+	assert.Equal(t, []string{"a@example.com"}, catcher.Messages()[0].To)
+
+	var logs []models.EmailLog
+	db.Order("id").Find(&logs)
+	assert.Len(t, logs, 2)
+	assert.Equal(t, models.EmailFailed, logs[0].Status)
+	assert.Equal(t, models.EmailSent, logs[1].Status)
+	assert.Equal(t, "a@example.com", logs[1].To)
+	assert.Equal(t, result.MessageID, logs[1].MessageID)
+}
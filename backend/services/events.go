@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"schoolms-go/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventPollInterval = 5 * time.Second
+	eventBatchSize    = 50
+	eventStaleAfter   = 5 * time.Minute // PROCESSING longer than this was interrupted by a restart
+)
+
+// EventHandler - Reacts to one event; data is the event's payload
+type EventHandler func(event models.Event, data map[string]string) error
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   = map[string][]EventHandler{}
+
+	// eventWake - Nudges idle workers when an event is published
+	eventWake = make(chan struct{}, 1)
+)
+
+// Subscribe - Run handler for every event of this type
+func Subscribe(eventType string, handler EventHandler) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers[eventType] = append(subscribers[eventType], handler)
+}
+
+// PublishEvent - Queue an event; subscribers run on the event workers, not in the request
+func PublishEvent(schoolID, actorID uint, eventType string, studentID uint, data map[string]string) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	event := models.Event{
+		SchoolID:  schoolID,
+		Type:      eventType,
+		StudentID: studentID,
+		ActorID:   actorID,
+		Payload:   string(payload),
+		Status:    models.EventPending,
+	}
+	if err := models.DB.Create(&event).Error; err != nil {
+		log.Printf("[Events] Failed to queue %s for student %d: %v", eventType, studentID, err)
+		return err
+	}
+
+	select {
+	case eventWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// PublishPaymentEvent - Queue PAYMENT_RECORDED for a payment that was just saved
+func PublishPaymentEvent(payment models.Payment, actorID uint) error {
+	return PublishEvent(payment.SchoolID, actorID, models.EventPaymentRecorded, payment.StudentID, map[string]string{
+		"payment_id": fmt.Sprint(payment.ID),
+		"amount":     FormatKES(payment.Amount),
+		"reference":  payment.Reference,
+		"method":     payment.Method,
+	})
+}
+
+// StartEventWorkers - Run n event workers until ctx is cancelled
+func StartEventWorkers(ctx context.Context, n int) {
+	if recovered := RecoverStaleEvents(); recovered > 0 {
+		log.Printf("[Events] Re-queued %d events interrupted by shutdown", recovered)
+	}
+
+	for i := 0; i < n; i++ {
+		go func() {
+			ticker := time.NewTicker(eventPollInterval)
+			defer ticker.Stop()
+			for {
+				for ProcessEvents(eventBatchSize) > 0 {
+					if ctx.Err() != nil {
+						return
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				case <-eventWake:
+				}
+			}
+		}()
+	}
+}
+
+// RecoverStaleEvents - Put events stuck in PROCESSING back on the queue
+func RecoverStaleEvents() int64 {
+	result := models.DB.Model(&models.Event{}).
+		Where("status = ? AND updated_at < ?", models.EventProcessing, time.Now().Add(-eventStaleAfter)).
+		Update("status", models.EventPending)
+	return result.RowsAffected
+}
+
+// ProcessEvents - Claim and dispatch up to limit pending events, oldest first
+func ProcessEvents(limit int) int {
+	var pending []models.Event
+	models.DB.Where("status = ?", models.EventPending).Order("id").Limit(limit).Find(&pending)
+
+	handled := 0
+	for _, event := range pending {
+		claim := models.DB.Model(&models.Event{}).
+			Where("id = ? AND status = ?", event.ID, models.EventPending).
+			Updates(map[string]interface{}{"status": models.EventProcessing, "updated_at": time.Now()})
+		if claim.RowsAffected == 0 {
+			continue
+		}
+
+		dispatchEvent(event)
+		handled++
+	}
+	return handled
+}
+
+// dispatchEvent - Run every subscriber; one failing doesn't stop the others
+func dispatchEvent(event models.Event) {
+	data := map[string]string{}
+	json.Unmarshal([]byte(event.Payload), &data)
+
+	subscribersMu.RLock()
+	handlers := subscribers[event.Type]
+	subscribersMu.RUnlock()
+
+	var errs []string
+	for _, handle := range handlers {
+		if err := handle(event, data); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"status": models.EventProcessed, "processed_at": now, "error": ""}
+	if len(errs) > 0 {
+		updates["status"] = models.EventFailed
+		updates["error"] = strings.Join(errs, "; ")
+		log.Printf("[Events] %s #%d failed: %s", event.Type, event.ID, updates["error"])
+	}
+	models.DB.Model(&models.Event{}).Where("id = ?", event.ID).Updates(updates)
+}
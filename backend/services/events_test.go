@@ -0,0 +1,40 @@
+package services_test
+
+import (
+	"errors"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvents_QueuedUntilProcessedAndFailuresRecorded(t *testing.T) {
+	db := setupTestDB(t)
+	db.AutoMigrate(&models.Event{})
+	defer func() { sqlDB, _ := db.DB(); sqlDB.Close() }()
+
+	var seen []string
+	services.Subscribe("TEST_EVENT", func(event models.Event, data map[string]string) error {
+		seen = append(seen, data["note"])
+		if data["note"] == "bad" {
+			return errors.New("handler broke")
+		}
+		return nil
+	})
+
+	assert.NoError(t, services.PublishEvent(1, 7, "TEST_EVENT", 3, map[string]string{"note": "ok"}))
+	assert.NoError(t, services.PublishEvent(1, 7, "TEST_EVENT", 3, map[string]string{"note": "bad"}))
+	assert.Empty(t, seen) // Nothing runs at publish time
+
+	assert.Equal(t, 2, services.ProcessEvents(10))
+	assert.Equal(t, []string{"ok", "bad"}, seen)
+	assert.Equal(t, 0, services.ProcessEvents(10))
+
+	var events []models.Event
+	db.Order("id").Find(&events)
+	assert.Equal(t, models.EventProcessed, events[0].Status)
+	assert.NotNil(t, events[0].ProcessedAt)
+	assert.Equal(t, models.EventFailed, events[1].Status)
+	assert.Equal(t, "handler broke", events[1].Error)
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"schoolms-go/models"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SiblingDebt - One child's outstanding balance within a family account
+type SiblingDebt struct {
+	StudentID uint
+	Balance   float64   // Outstanding (positive = owes)
+	OwedSince time.Time // When the oldest outstanding fee was charged
+}
+
+// FamilyShare - Portion of a family payment going to one child
+type FamilyShare struct {
+	StudentID uint
+	Amount    float64
+}
+
+// GetFamilySiblings - Students linked to the parent in this school, with their debts
+func GetFamilySiblings(parentID, schoolID uint) ([]SiblingDebt, error) {
+	var links []models.ParentStudent
+	err := models.DB.Joins("JOIN students ON students.id = parent_students.student_id").
+		Where("parent_students.parent_id = ? AND students.school_id = ?", parentID, schoolID).
+		Where("students.status != ?", "DISCHARGED").
+		Order("parent_students.student_id ASC").
+		Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+
+	siblings := make([]SiblingDebt, 0, len(links))
+	for _, link := range links {
+		var balances []models.VoteHeadBalance
+		models.DB.Where("student_id = ? AND school_id = ?", link.StudentID, schoolID).Find(&balances)
+
+		debt := SiblingDebt{StudentID: link.StudentID}
+		for _, b := range balances {
+			debt.Balance += b.Balance
+			// Not LastUpdated: every payment resets it, which would order by least recently paid
+			charged := b.ChargedAt
+			if charged.IsZero() {
+				charged = b.LastUpdated // Balances from before charged_at was recorded
+			}
+			if b.Balance > 0 && (debt.OwedSince.IsZero() || charged.Before(debt.OwedSince)) {
+				debt.OwedSince = charged
+			}
+		}
+		siblings = append(siblings, debt)
+	}
+
+	return siblings, nil
+}
+
+// SplitFamilyPayment - Divides an amount across siblings by the account's rule
+// OLDEST_DEBT: siblings are paid in full in order of how long they have owed
+// PROPORTIONAL: each sibling gets a share matching their part of the total debt
+// Any excess over the family's total debt is left as credit on the first sibling
+// in OLDEST_DEBT order, and shared proportionally otherwise
+func SplitFamilyPayment(amount float64, siblings []SiblingDebt, rule string) ([]FamilyShare, error) {
+	if amount <= 0 {
+		return nil, errors.New("payment amount must be positive")
+	}
+	if len(siblings) == 0 {
+		return nil, errors.New("family account has no linked students")
+	}
+
+	switch rule {
+	case models.SplitProportional:
+		return splitProportional(amount, siblings), nil
+	case models.SplitOldestDebt, "":
+		return splitOldestDebt(amount, siblings), nil
+	default:
+		return nil, fmt.Errorf("unknown split rule %q", rule)
+	}
+}
+
+func splitOldestDebt(amount float64, siblings []SiblingDebt) []FamilyShare {
+	ordered := make([]SiblingDebt, len(siblings))
+	copy(ordered, siblings)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if (a.Balance > 0) != (b.Balance > 0) {
+			return a.Balance > 0 // Debtors before those already cleared
+		}
+		if !a.OwedSince.Equal(b.OwedSince) {
+			return a.OwedSince.Before(b.OwedSince)
+		}
+		return a.StudentID < b.StudentID
+	})
+
+	shares := make([]FamilyShare, len(ordered))
+	remaining := amount
+	for i, s := range ordered {
+		shares[i].StudentID = s.StudentID
+		if s.Balance <= 0 || remaining <= 0 {
+			continue
+		}
+		take := math.Min(s.Balance, remaining)
+		shares[i].Amount = take
+		remaining -= take
+	}
+
+	if remaining > 0 {
+		shares[0].Amount += remaining
+	}
+
+	return nonZeroShares(shares)
+}
+
+func splitProportional(amount float64, siblings []SiblingDebt) []FamilyShare {
+	var totalDebt float64
+	for _, s := range siblings {
+		if s.Balance > 0 {
+			totalDebt += s.Balance
+		}
+	}
+
+	shares := make([]FamilyShare, len(siblings))
+	allocated := 0.0
+	for i, s := range siblings {
+		shares[i].StudentID = s.StudentID
+		var share float64
+		if totalDebt > 0 {
+			if s.Balance > 0 {
+				share = amount * s.Balance / totalDebt
+			}
+		} else {
+			share = amount / float64(len(siblings)) // Nobody owes: split evenly as credit
+		}
+		share = math.Floor(share*100) / 100 // Whole cents
+		shares[i].Amount = share
+		allocated += share
+	}
+
+	// Rounding remainder goes to the largest share so totals reconcile exactly
+	if rem := math.Round((amount-allocated)*100) / 100; rem != 0 {
+		largest := 0
+		for i := range shares {
+			if shares[i].Amount > shares[largest].Amount {
+				largest = i
+			}
+		}
+		shares[largest].Amount = math.Round((shares[largest].Amount+rem)*100) / 100
+	}
+
+	return nonZeroShares(shares)
+}
+
+func nonZeroShares(shares []FamilyShare) []FamilyShare {
+	result := make([]FamilyShare, 0, len(shares))
+	for _, s := range shares {
+		if s.Amount > 0 {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// AllocateFamilyPayment - Splits a family payment into one Payment per child
+// Each child's payment is then allocated to vote heads as usual. Everything is written in one
+// transaction: on error nothing is recorded, so the M-PESA transaction can safely be matched by hand
+func AllocateFamilyPayment(account *models.FamilyAccount, amount float64, method, reference string) ([]models.Payment, error) {
+	siblings, err := GetFamilySiblings(account.ParentID, account.SchoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	shares, err := SplitFamilyPayment(amount, siblings, account.SplitRule)
+	if err != nil {
+		return nil, err
+	}
+
+	payments := make([]models.Payment, 0, len(shares))
+	err = models.DB.Transaction(func(tx *gorm.DB) error {
+		for _, share := range shares {
+			payment := models.Payment{
+				StudentID:       share.StudentID,
+				SchoolID:        account.SchoolID,
+				Amount:          share.Amount,
+				Method:          method,
+				Reference:       reference,
+				FamilyAccountID: &account.ID,
+			}
+			if err := tx.Create(&payment).Error; err != nil {
+				return err
+			}
+
+			_, err := allocatePaymentToVoteHeads(tx, &payment, share.StudentID, account.SchoolID)
+			if errors.Is(err, ErrNoFeeStructure) {
+				// As for a single payment: kept, just not broken down by vote head
+				fmt.Printf("[Family Payment] No vote heads to allocate for student %d: %v\n", share.StudentID, err)
+			} else if err != nil {
+				return err
+			}
+			payments = append(payments, payment)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return payments, nil
+}
@@ -0,0 +1,63 @@
+package services_test
+
+import (
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitFamilyPayment_OldestDebtFirst(t *testing.T) {
+	now := time.Now()
+	siblings := []services.SiblingDebt{
+		{StudentID: 1, Balance: 3000, OwedSince: now},
+		{StudentID: 2, Balance: 5000, OwedSince: now.AddDate(0, -2, 0)},
+		{StudentID: 3, Balance: 0},
+	}
+
+	shares, err := services.SplitFamilyPayment(6000, siblings, models.SplitOldestDebt)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []services.FamilyShare{
+		{StudentID: 2, Amount: 5000},
+		{StudentID: 1, Amount: 1000},
+	}, shares)
+}
+
+func TestSplitFamilyPayment_OverpaymentCreditsOldestDebtor(t *testing.T) {
+	now := time.Now()
+	siblings := []services.SiblingDebt{
+		{StudentID: 1, Balance: 1000, OwedSince: now.AddDate(0, -1, 0)},
+		{StudentID: 2, Balance: 500, OwedSince: now},
+	}
+
+	shares, err := services.SplitFamilyPayment(2000, siblings, models.SplitOldestDebt)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []services.FamilyShare{
+		{StudentID: 1, Amount: 1500},
+		{StudentID: 2, Amount: 500},
+	}, shares)
+}
+
+func TestSplitFamilyPayment_Proportional(t *testing.T) {
+	siblings := []services.SiblingDebt{
+		{StudentID: 1, Balance: 1000},
+		{StudentID: 2, Balance: 2000},
+		{StudentID: 3, Balance: -500}, // In credit, gets nothing
+	}
+
+	shares, err := services.SplitFamilyPayment(1000, siblings, models.SplitProportional)
+
+	assert.NoError(t, err)
+	assert.Len(t, shares, 2)
+	assert.Equal(t, 333.33, shares[0].Amount)
+	assert.Equal(t, 666.67, shares[1].Amount)
+}
+
+func TestSplitFamilyPayment_NoSiblings(t *testing.T) {
+	_, err := services.SplitFamilyPayment(1000, nil, models.SplitOldestDebt)
+	assert.Error(t, err)
+}
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"schoolms-go/models"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	InviteDefaultTTL = 48 * time.Hour
+	InviteMaxTTL     = 30 * 24 * time.Hour
+	InviteMaxUses    = 500 // A shared code, e.g. for a staff meeting, can't be passed around indefinitely
+)
+
+var (
+	ErrInviteInvalid = errors.New("invalid or used invite code")
+	ErrInviteExpired = errors.New("invite code expired")
+	ErrInviteRevoked = errors.New("invite code has been revoked")
+	ErrInviteLink    = errors.New("invite can't be linked to that record")
+	ErrInviteClaimed = errors.New("that account has already been claimed")
+	ErrInviteOptions = errors.New("invalid invite options")
+)
+
+// InviteOptions - What an invite is for, who it is sent to and how long it lasts
+type InviteOptions struct {
+	Role        string
+	StudentID   *uint
+	ParentID    *uint
+	MaxUses     int           // 0 means 1
+	TTL         time.Duration // 0 means InviteDefaultTTL
+	Email       string
+	Phone       string
+	CreatedByID uint
+}
+
+// InviteStatus - active, used, expired or revoked
+func InviteStatus(invite models.Invite) string {
+	switch {
+	case invite.RevokedAt != nil:
+		return "revoked"
+	case invite.IsUsed:
+		return "used"
+	case !invite.ExpiresAt.After(time.Now()):
+		return "expired"
+	}
+	return "active"
+}
+
+// Claimable - Whether an account made for someone (e.g. by an import) is still waiting for them to sign in
+func Claimable(user models.User) bool {
+	return user.LastLoginAt == nil && user.DeactivatedAt == nil
+}
+
+// InviteLinkedUser - The account a linked invite hands over at signup, if it has one
+// STUDENT invites claim the student's account and PARENT invites with a parent claim the guardian's;
+// a PARENT invite with only a student gets a new account linked to that student
+func InviteLinkedUser(invite models.Invite) (models.User, bool, error) {
+	var user models.User
+	switch {
+	case invite.ParentID != nil:
+		err := models.DB.Where("id = ? AND role = ? AND school_id = ?", *invite.ParentID, RoleParent, invite.SchoolID).First(&user).Error
+		if err != nil {
+			return user, false, ErrInviteLink
+		}
+	case invite.StudentID != nil && invite.Role == RoleStudent:
+		var student models.Student
+		if err := models.DB.Preload("User").Where("id = ? AND school_id = ?", *invite.StudentID, invite.SchoolID).First(&student).Error; err != nil {
+			return user, false, ErrInviteLink
+		}
+		user = student.User
+	default:
+		return user, false, nil
+	}
+	if !Claimable(user) {
+		return user, true, ErrInviteClaimed
+	}
+	return user, true, nil
+}
+
+// validateInviteLink - Linked records must be in the school and match the role
+func validateInviteLink(schoolID uint, opts InviteOptions) error {
+	if opts.StudentID == nil && opts.ParentID == nil {
+		return nil
+	}
+	if opts.MaxUses > 1 {
+		return fmt.Errorf("%w: invites linked to a record are single-use", ErrInviteOptions)
+	}
+	switch opts.Role {
+	case RoleStudent:
+		if opts.ParentID != nil {
+			return ErrInviteLink
+		}
+	case RoleParent:
+		if opts.StudentID != nil {
+			var count int64
+			models.DB.Model(&models.Student{}).Where("id = ? AND school_id = ?", *opts.StudentID, schoolID).Count(&count)
+			if count == 0 {
+				return ErrInviteLink
+			}
+		}
+	default:
+		return ErrInviteLink
+	}
+	_, _, err := InviteLinkedUser(models.Invite{SchoolID: schoolID, Role: opts.Role, StudentID: opts.StudentID, ParentID: opts.ParentID})
+	return err
+}
+
+// CreateInvite - A new invite code for the school
+func CreateInvite(schoolID uint, opts InviteOptions) (models.Invite, error) {
+	if opts.MaxUses == 0 {
+		opts.MaxUses = 1
+	}
+	if opts.TTL == 0 {
+		opts.TTL = InviteDefaultTTL
+	}
+	if opts.MaxUses < 1 || opts.MaxUses > InviteMaxUses {
+		return models.Invite{}, fmt.Errorf("%w: max_uses must be between 1 and %d", ErrInviteOptions, InviteMaxUses)
+	}
+	if opts.TTL < time.Hour || opts.TTL > InviteMaxTTL {
+		return models.Invite{}, fmt.Errorf("%w: expires_in_hours must be between 1 and %d", ErrInviteOptions, int(InviteMaxTTL.Hours()))
+	}
+	if err := validateInviteLink(schoolID, opts); err != nil {
+		return models.Invite{}, err
+	}
+
+	invite := models.Invite{
+		Code:        uuid.New(),
+		Role:        opts.Role,
+		SchoolID:    schoolID,
+		ExpiresAt:   time.Now().Add(opts.TTL),
+		MaxUses:     opts.MaxUses,
+		StudentID:   opts.StudentID,
+		ParentID:    opts.ParentID,
+		Email:       opts.Email,
+		Phone:       opts.Phone,
+		CreatedByID: opts.CreatedByID,
+	}
+	return invite, models.DB.Create(&invite).Error
+}
+
+// FindInvite - The invite for a code, if it can still be used
+func FindInvite(code string) (models.Invite, error) {
+	var invite models.Invite
+	if _, err := uuid.Parse(code); err != nil {
+		return invite, ErrInviteInvalid
+	}
+	if err := models.DB.Where("code = ? AND is_used = ?", code, false).First(&invite).Error; err != nil {
+		return invite, ErrInviteInvalid
+	}
+	if invite.RevokedAt != nil {
+		return invite, ErrInviteRevoked
+	}
+	if invite.ExpiresAt.Before(time.Now()) {
+		return invite, ErrInviteExpired
+	}
+	return invite, nil
+}
+
+// UseInvite - Count one signup against the invite inside the signup's transaction
+// The conditional update means two signups racing for the last use can't both succeed
+func UseInvite(tx *gorm.DB, invite models.Invite) error {
+	result := tx.Model(&models.Invite{}).
+		Where("id = ? AND is_used = ? AND revoked_at IS NULL AND use_count < max_uses", invite.ID, false).
+		Updates(map[string]interface{}{
+			"use_count": gorm.Expr("use_count + 1"),
+			"is_used":   gorm.Expr("use_count + 1 >= max_uses"),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteInvalid
+	}
+	return nil
+}
+
+// RevokeOtherLinkedInvites - Once a record is claimed, other invites for it (e.g. a resend) must not claim it again
+func RevokeOtherLinkedInvites(tx *gorm.DB, invite models.Invite) error {
+	query := tx.Model(&models.Invite{}).Where("id <> ? AND is_used = ? AND revoked_at IS NULL AND role = ?", invite.ID, false, invite.Role)
+	if invite.ParentID != nil {
+		query = query.Where("parent_id = ?", *invite.ParentID)
+	} else {
+		query = query.Where("student_id = ?", *invite.StudentID)
+	}
+	return query.Update("revoked_at", time.Now()).Error
+}
+
+// RevokeInvite - Stop an invite working; returns false if it was already revoked
+func RevokeInvite(id uint) bool {
+	return models.DB.Model(&models.Invite{}).Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).RowsAffected > 0
+}
+
+// InviteSMS - The text sent with an invite; the link carries the code
+func InviteSMS(invite models.Invite) string {
+	var school models.School
+	models.DB.Select("name").First(&school, invite.SchoolID)
+	return fmt.Sprintf("%s: you're invited to register as %s before %s. Open %s",
+		school.Name, strings.ToLower(invite.Role), invite.ExpiresAt.Format("02 Jan 2006"),
+		AppURL("/register?code="+invite.Code.String()))
+}
+
+// SendInviteSMS - Text an invite code to the person being invited
+func SendInviteSMS(invite models.Invite, to string) SMSResult {
+	result := SendSchoolSMS(invite.SchoolID, to, InviteSMS(invite))
+	LogSMSSent(invite.SchoolID, to, "Invite code", result)
+	return result
+}
+
+// InviteEmail - The address to email an invite to, skipping placeholders such as imported guardians' @parent.local
+func InviteEmail(user models.User) string {
+	if hasRealEmail(user) {
+		return user.Email
+	}
+	return ""
+}
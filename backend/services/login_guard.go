@@ -0,0 +1,169 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"schoolms-go/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Login throttling. Checks run before the password hash is compared, so a blocked
+// guess costs no bcrypt work
+const (
+	loginIPWindow          = 15 * time.Minute
+	loginIPMaxFailures     = 50 // Failed logins from one IP within the window before it is blocked
+	loginFreeFailures      = 3  // Failures in a row before delays start
+	loginBaseDelay         = time.Second
+	loginMaxDelay          = 2 * time.Minute
+	loginLockoutFailures   = 10 // Failures in a row that lock the account
+	loginLockoutDuration   = 15 * time.Minute
+	loginFailureRetainTime = 24 * time.Hour
+)
+
+// LoginBlock - Why a sign-in attempt was refused before the password was checked
+type LoginBlock struct {
+	RetryAfter time.Duration
+	Locked     bool // The account is locked, rather than just slowed down
+}
+
+// LoginIPBlocked - How long an IP address must wait after too many failed logins; zero if it may try
+func LoginIPBlocked(ip string) time.Duration {
+	now := time.Now()
+	var failures []time.Time
+	models.DB.Model(&models.LoginFailure{}).
+		Where("ip_address = ? AND created_at > ?", ip, now.Add(-loginIPWindow)).
+		Order("created_at DESC").Limit(loginIPMaxFailures).Pluck("created_at", &failures)
+	if len(failures) < loginIPMaxFailures {
+		return 0
+	}
+	// Unblocked once the oldest of the last loginIPMaxFailures leaves the window
+	return failures[len(failures)-1].Add(loginIPWindow).Sub(now)
+}
+
+// LoginAccountBlocked - Whether the account is locked or must wait after recent failures
+func LoginAccountBlocked(user models.User) (LoginBlock, bool) {
+	now := time.Now()
+	if user.LockedUntil != nil && user.LockedUntil.After(now) {
+		return LoginBlock{RetryAfter: user.LockedUntil.Sub(now), Locked: true}, true
+	}
+	if user.LastFailedLoginAt == nil {
+		return LoginBlock{}, false
+	}
+	if wait := user.LastFailedLoginAt.Add(loginDelay(user.FailedLogins)).Sub(now); wait > 0 {
+		return LoginBlock{RetryAfter: wait}, true
+	}
+	return LoginBlock{}, false
+}
+
+// loginDelay - Wait before the next attempt: none for the first few failures, then doubling
+func loginDelay(failures int) time.Duration {
+	if failures < loginFreeFailures {
+		return 0
+	}
+	delay := loginBaseDelay * time.Duration(math.Pow(2, float64(failures-loginFreeFailures)))
+	return min(delay, loginMaxDelay)
+}
+
+// RecordLoginFailure - Count a wrong password or code; user is nil when no account has the email
+// Locks the account after loginLockoutFailures in a row and tells its owner. Returns true if it was locked
+func RecordLoginFailure(user *models.User, email, reason, ip, userAgent string) bool {
+	now := time.Now()
+	failure := models.LoginFailure{Email: email, IPAddress: ip}
+	if user != nil {
+		failure.UserID = &user.ID
+	}
+	models.DB.Create(&failure)
+	models.DB.Where("created_at < ?", now.Add(-loginFailureRetainTime)).Delete(&models.LoginFailure{})
+
+	var count int64
+	models.DB.Model(&models.LoginFailure{}).
+		Where("ip_address = ? AND created_at > ?", ip, now.Add(-loginIPWindow)).Count(&count)
+	if count == loginIPMaxFailures {
+		models.CreateAuditLog(0, 0, models.AuditLoginIPBlocked, "LoginFailure", failure.ID,
+			"", fmt.Sprintf(`{"ip":%q,"failures":%d}`, ip, count), ip, userAgent)
+	}
+	if user == nil {
+		return false
+	}
+
+	schoolID := uint(0)
+	if user.SchoolID != nil {
+		schoolID = *user.SchoolID
+	}
+	models.DB.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"failed_logins":        gorm.Expr("failed_logins + 1"),
+		"last_failed_login_at": now,
+	})
+	models.DB.Model(&models.User{}).Select("failed_logins").Where("id = ?", user.ID).Row().Scan(&user.FailedLogins)
+	user.LastFailedLoginAt = &now
+	models.CreateAuditLog(schoolID, user.ID, models.AuditLoginFailed, "User", user.ID,
+		"", fmt.Sprintf(`{"reason":%q,"failures":%d}`, reason, user.FailedLogins), ip, userAgent)
+
+	if user.FailedLogins < loginLockoutFailures {
+		return false
+	}
+	until := now.Add(loginLockoutDuration)
+	claim := models.DB.Model(&models.User{}).
+		Where("id = ? AND (locked_until IS NULL OR locked_until <= ?)", user.ID, now).
+		Updates(map[string]interface{}{"locked_until": until, "failed_logins": 0, "last_failed_login_at": nil})
+	if claim.RowsAffected == 0 {
+		return false // Locked already by a concurrent attempt
+	}
+	attempts := user.FailedLogins
+	user.LockedUntil, user.FailedLogins, user.LastFailedLoginAt = &until, 0, nil
+	models.CreateAuditLog(schoolID, user.ID, models.AuditAccountLocked, "User", user.ID,
+		"", fmt.Sprintf(`{"until":%q,"failures":%d}`, until.Format(time.RFC3339), attempts), ip, userAgent)
+	if err := notifyAccountLocked(schoolID, *user, attempts, ip, until); err != nil {
+		log.Printf("[LoginGuard] Could not queue the lockout notice for user %d: %v", user.ID, err)
+	}
+	return true
+}
+
+// RecordLoginSuccess - Clear the failure count once the user signs in
+func RecordLoginSuccess(user models.User) {
+	if user.FailedLogins == 0 && user.LastFailedLoginAt == nil && user.LockedUntil == nil {
+		return
+	}
+	ClearLoginFailures(user.ID)
+}
+
+// ClearLoginFailures - Unlock the account and forget its failed logins
+func ClearLoginFailures(userID uint) {
+	models.DB.Model(&models.User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"failed_logins": 0, "last_failed_login_at": nil, "locked_until": nil})
+}
+
+// notifyAccountLocked - Queue an email to the owner of a locked account, or a text if they have no real email
+// It goes through the outbox so the failed sign-in isn't held up by the mail or SMS provider
+func notifyAccountLocked(schoolID uint, user models.User, attempts int, ip string, until time.Time) error {
+	channels := ResetChannels(user)
+	if len(channels) == 0 {
+		return ErrResetNoChannel
+	}
+	if channels[0] == models.ResetChannelSMS {
+		message := fmt.Sprintf("SchoolMS: your account was locked until %s after %d failed sign-in attempts. "+
+			"If this wasn't you, reset your password.", until.Format("15:04"), attempts)
+		_, err := EnqueueMessages(schoolID, user.ID, models.MessageJobSecurity, []SMSMessage{{To: user.Phone, Message: message}})
+		return err
+	}
+
+	name := user.FullName
+	if name == "" {
+		name = "there"
+	}
+	msg, err := RenderEmail(schoolID, models.EmailTemplateAccountLocked, MergeFields{
+		"name":     name,
+		"attempts": fmt.Sprint(attempts),
+		"ip":       ip,
+		"until":    until.Format("15:04"),
+		"link":     AppURL("/forgot-password"),
+	})
+	if err != nil {
+		return err
+	}
+	msg.To = []string{user.Email}
+	return EnqueueEmail(schoolID, models.EmailTemplateAccountLocked, msg)
+}
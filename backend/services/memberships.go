@@ -0,0 +1,148 @@
+package services
+
+import (
+	"errors"
+	"schoolms-go/models"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrMembershipNotFound  = errors.New("you don't have that role in that school")
+	ErrMembershipExists    = errors.New("user already has this role in this school")
+	ErrMembershipRole      = errors.New("role can't be added as a membership")
+	ErrMembershipTwoFactor = errors.New("two-factor sign-in is required for this school and role")
+)
+
+// MembershipRoles - Roles that can be added to an existing account; students need their own student record
+var MembershipRoles = []string{RoleSchoolAdmin, RoleTeacher, RoleFinance, RoleParent}
+
+// SchoolMembership - A school a user belongs to and the roles they hold there
+type SchoolMembership struct {
+	SchoolID   *uint    `json:"school_id"`
+	SchoolName string   `json:"school_name,omitempty"`
+	Roles      []string `json:"roles"`
+}
+
+// ActiveMembership - The school and role a session is acting as
+type ActiveMembership struct {
+	ID       uint   `json:"-"` // 0 for the user's home school and role
+	SchoolID *uint  `json:"school_id"`
+	Role     string `json:"role"`
+}
+
+// HomeMembership - The school and role on the User row
+func HomeMembership(user models.User) ActiveMembership {
+	return ActiveMembership{SchoolID: user.SchoolID, Role: user.Role}
+}
+
+// UserMemberships - Every school and role the user holds, home school and role first
+func UserMemberships(user models.User) []SchoolMembership {
+	out := []SchoolMembership{{SchoolID: user.SchoolID, Roles: []string{user.Role}}}
+
+	var extra []models.Membership
+	models.DB.Where("user_id = ?", user.ID).Order("school_id, id").Find(&extra)
+	for _, m := range extra {
+		i := slices.IndexFunc(out, func(s SchoolMembership) bool { return s.SchoolID != nil && *s.SchoolID == m.SchoolID })
+		if i < 0 {
+			schoolID := m.SchoolID
+			out = append(out, SchoolMembership{SchoolID: &schoolID})
+			i = len(out) - 1
+		}
+		out[i].Roles = append(out[i].Roles, m.Role)
+	}
+
+	for i := range out {
+		if out[i].SchoolID != nil {
+			models.DB.Model(&models.School{}).Where("id = ?", *out[i].SchoolID).Pluck("name", &out[i].SchoolName)
+		}
+	}
+	return out
+}
+
+// FindMembership - The user's membership with this school and role
+func FindMembership(user models.User, schoolID *uint, role string) (ActiveMembership, error) {
+	role = strings.ToUpper(role)
+	home := HomeMembership(user)
+	if role == home.Role && sameSchool(schoolID, home.SchoolID) {
+		return home, nil
+	}
+	if schoolID == nil {
+		return ActiveMembership{}, ErrMembershipNotFound
+	}
+	var m models.Membership
+	if err := models.DB.Where("user_id = ? AND school_id = ? AND role = ?", user.ID, *schoolID, role).First(&m).Error; err != nil {
+		return ActiveMembership{}, ErrMembershipNotFound
+	}
+	return ActiveMembership{ID: m.ID, SchoolID: &m.SchoolID, Role: m.Role}, nil
+}
+
+// MembershipActive - Whether a membership a token was issued for still exists
+func MembershipActive(membershipID, userID uint) bool {
+	var count int64
+	models.DB.Model(&models.Membership{}).Where("id = ? AND user_id = ?", membershipID, userID).Count(&count)
+	return count > 0
+}
+
+// sessionMembership - What a session acts as; the home membership if its membership was removed,
+// or now needs two-factor the user hasn't set up
+func sessionMembership(user models.User, session models.UserSession) ActiveMembership {
+	if session.MembershipID == 0 {
+		return HomeMembership(user)
+	}
+	var m models.Membership
+	err := models.DB.Where("id = ? AND user_id = ?", session.MembershipID, user.ID).First(&m).Error
+	active := ActiveMembership{ID: m.ID, SchoolID: &m.SchoolID, Role: m.Role}
+	if err != nil || !twoFactorSatisfied(user, active) {
+		models.DB.Model(&models.UserSession{}).Where("id = ?", session.ID).Update("membership_id", 0)
+		return HomeMembership(user)
+	}
+	return active
+}
+
+// twoFactorSatisfied - Whether the user may act as the membership under its school's two-factor policy
+// Users with two-factor on entered a code to sign in, so only those without it can fall short
+func twoFactorSatisfied(user models.User, active ActiveMembership) bool {
+	return user.TOTPEnabledAt != nil || !TwoFactorRequiredFor(active)
+}
+
+// SwitchMembership - Make the session act as another of the user's memberships; returns a new access token
+// The session remembers it, so refreshing keeps the switched school and role. A membership whose school
+// requires two-factor for the role is refused until the user turns two-factor on (ErrMembershipTwoFactor)
+func SwitchMembership(user models.User, sessionID uint, schoolID *uint, role string) (string, ActiveMembership, error) {
+	active, err := FindMembership(user, schoolID, role)
+	if err != nil {
+		return "", active, err
+	}
+	if !twoFactorSatisfied(user, active) {
+		return "", active, ErrMembershipTwoFactor
+	}
+	if err := models.DB.Model(&models.UserSession{}).Where("id = ?", sessionID).Update("membership_id", active.ID).Error; err != nil {
+		return "", active, err
+	}
+	token, err := accessToken(user, sessionID, active)
+	return token, active, err
+}
+
+// AddMembership - Give an existing account a role in a school
+func AddMembership(user models.User, schoolID uint, role string, addedByID uint) (models.Membership, error) {
+	role = strings.ToUpper(role)
+	if !slices.Contains(MembershipRoles, role) || user.Role == RoleSuperAdmin || user.Role == RoleService {
+		return models.Membership{}, ErrMembershipRole
+	}
+	if _, err := FindMembership(user, &schoolID, role); err == nil {
+		return models.Membership{}, ErrMembershipExists
+	}
+	m := models.Membership{UserID: user.ID, SchoolID: schoolID, Role: role, AddedByID: addedByID}
+	if err := models.DB.Create(&m).Error; err != nil {
+		return m, ErrMembershipExists
+	}
+	return m, nil
+}
+
+func sameSchool(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
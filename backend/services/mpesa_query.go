@@ -0,0 +1,113 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"schoolms-go/daraja"
+	"schoolms-go/models"
+)
+
+// RunTransactionStatusQuery - Asks Safaricom whether a transaction ID was paid
+// The query is stored PENDING until the result callback arrives
+func RunTransactionStatusQuery(client *daraja.Client, schoolID, userID uint, transID, remarks string) (*models.MPESAQuery, error) {
+	query := models.MPESAQuery{
+		SchoolID:    schoolID,
+		QueryType:   models.MPESAQueryTransactionStatus,
+		TransID:     transID,
+		RequestedBy: userID,
+	}
+
+	var tx models.MPESATransaction
+	if err := models.DB.Where("trans_id = ? AND school_id = ?", transID, schoolID).First(&tx).Error; err == nil {
+		query.MPESATransactionID = &tx.ID
+	}
+
+	resp, err := client.TransactionStatus(transID, remarks)
+	return saveMPESAQuery(&query, resp, err)
+}
+
+// RunAccountBalanceQuery - Asks Safaricom for the paybill balances
+func RunAccountBalanceQuery(client *daraja.Client, schoolID, userID uint) (*models.MPESAQuery, error) {
+	query := models.MPESAQuery{
+		SchoolID:    schoolID,
+		QueryType:   models.MPESAQueryAccountBalance,
+		RequestedBy: userID,
+	}
+
+	resp, err := client.AccountBalance("")
+	return saveMPESAQuery(&query, resp, err)
+}
+
+// RegisterC2BURLs - Registers validation/confirmation URLs; completes synchronously
+func RegisterC2BURLs(client *daraja.Client, schoolID, userID uint, responseType string) (*models.MPESAQuery, error) {
+	query := models.MPESAQuery{
+		SchoolID:    schoolID,
+		QueryType:   models.MPESAQueryRegisterURLs,
+		RequestedBy: userID,
+	}
+
+	resp, err := client.RegisterC2BURLs(responseType)
+	if err == nil {
+		query.Status = "COMPLETED"
+		query.ResultDesc = resp.ResponseDescription
+		query.Response = resp.Raw
+		models.DB.Create(&query)
+		return &query, nil
+	}
+	return saveMPESAQuery(&query, resp, err)
+}
+
+func saveMPESAQuery(query *models.MPESAQuery, resp *daraja.Response, err error) (*models.MPESAQuery, error) {
+	if resp != nil {
+		query.Response = resp.Raw
+		query.ConversationID = resp.ConversationID
+		query.OriginatorConversationID = resp.OriginatorConversationID
+	}
+
+	if err != nil {
+		query.Status = "FAILED"
+		query.ResultDesc = err.Error()
+	} else if query.Status == "" {
+		query.Status = "PENDING"
+	}
+
+	models.DB.Create(query)
+	return query, err
+}
+
+// CompleteMPESAQuery - Stores the asynchronous result (or timeout) of a query
+func CompleteMPESAQuery(result daraja.CallbackResult, timedOut bool) (*models.MPESAQuery, error) {
+	if result.ConversationID == "" && result.OriginatorConversationID == "" {
+		return nil, errors.New("no conversation id")
+	}
+
+	var query models.MPESAQuery
+	err := models.DB.
+		Where("(conversation_id = ? AND conversation_id != '') OR (originator_conversation_id = ? AND originator_conversation_id != '')",
+			result.ConversationID, result.OriginatorConversationID).
+		First(&query).Error
+	if err != nil {
+		return nil, err
+	}
+
+	code := result.ResultCode
+	query.ResultCode = &code
+	query.ResultDesc = result.ResultDesc
+
+	switch {
+	case timedOut:
+		query.Status = "TIMED_OUT"
+	case code == 0:
+		query.Status = "COMPLETED"
+	default:
+		query.Status = "FAILED"
+	}
+
+	if params := result.Params(); len(params) > 0 {
+		encoded, _ := json.Marshal(params)
+		query.Result = string(encoded)
+	}
+
+	models.DB.Save(&query)
+	return &query, nil
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"schoolms-go/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// NotificationAudience - Who a user is, as far as notification targeting goes
+type NotificationAudience struct {
+	SchoolID   uint
+	UserID     uint
+	Role       string
+	StudentIDs []uint // The student themself, or a parent's children
+	ClassIDs   []uint // Those students' classes
+	TeachesIDs []uint // Classes a teacher is class teacher of or has on the timetable
+}
+
+// AudienceFor - Look up the students and classes a user's notifications can be addressed through
+func AudienceFor(schoolID, userID uint, role string) NotificationAudience {
+	audience := NotificationAudience{SchoolID: schoolID, UserID: userID, Role: role}
+
+	var students []models.Student
+	switch role {
+	case "STUDENT":
+		models.DB.Where("user_id = ? AND school_id = ?", userID, schoolID).Find(&students)
+	case "PARENT":
+		models.DB.Where("school_id = ? AND id IN (?)", schoolID,
+			models.DB.Model(&models.ParentStudent{}).Select("student_id").Where("parent_id = ?", userID)).
+			Find(&students)
+	case "TEACHER":
+		models.DB.Model(&models.Class{}).Where("school_id = ? AND teacher_id = ?", schoolID, userID).
+			Pluck("id", &audience.TeachesIDs)
+		var timetabled []uint
+		models.DB.Model(&models.Timetable{}).Where("school_id = ? AND teacher_id = ?", schoolID, userID).
+			Distinct().Pluck("class_id", &timetabled)
+		audience.TeachesIDs = appendUnique(audience.TeachesIDs, timetabled...)
+	}
+
+	for _, s := range students {
+		audience.StudentIDs = append(audience.StudentIDs, s.ID)
+		if s.ClassID != nil {
+			audience.ClassIDs = appendUnique(audience.ClassIDs, *s.ClassID)
+		}
+	}
+	return audience
+}
+
+// NotificationsFor - Query for the school's notifications addressed to the audience
+func NotificationsFor(audience NotificationAudience) *gorm.DB {
+	conditions := models.DB.Where("target_type = ?", models.NotificationTargetAll).
+		Or("target_type = ? AND target_role = ?", models.NotificationTargetRole, audience.Role).
+		Or("target_type = ? AND id IN (?)", models.NotificationTargetUsers,
+			models.DB.Model(&models.NotificationRecipient{}).Select("notification_id").Where("user_id = ?", audience.UserID)).
+		Or("target_type = ? AND target_id IN (?)", models.NotificationTargetGroup,
+			models.DB.Model(&models.NotificationGroupMember{}).Select("group_id").Where("user_id = ?", audience.UserID))
+
+	if len(audience.StudentIDs) > 0 {
+		conditions = conditions.Or("target_type = ? AND target_id IN ?", models.NotificationTargetStudent, audience.StudentIDs)
+	}
+	if len(audience.ClassIDs) > 0 {
+		classTarget := models.NotificationTargetClass
+		if audience.Role == "PARENT" {
+			classTarget = models.NotificationTargetClassParents
+		}
+		conditions = conditions.Or("target_type = ? AND target_id IN ?", classTarget, audience.ClassIDs)
+	}
+	if audience.Role == "TEACHER" {
+		conditions = conditions.Or("target_type = ? AND target_id IS NULL", models.NotificationTargetTeachers)
+		if len(audience.TeachesIDs) > 0 {
+			conditions = conditions.Or("target_type = ? AND target_id IN ?", models.NotificationTargetTeachers, audience.TeachesIDs)
+		}
+	}
+
+	now := time.Now()
+	return models.DB.Model(&models.Notification{}).Where("school_id = ?", audience.SchoolID).Where(conditions).
+		Where("publish_at IS NULL OR publish_at <= ?", now).
+		Where("expires_at IS NULL OR expires_at > ?", now)
+}
+
+// InboxOrder - Pinned first, then by priority, then newest
+const InboxOrder = "pinned DESC, CASE priority WHEN 'URGENT' THEN 0 WHEN 'HIGH' THEN 1 ELSE 2 END, COALESCE(publish_at, created_at) DESC, id DESC"
+
+// NotificationRecipients - Users a notification is addressed to, as it stands now
+func NotificationRecipients(n models.Notification) []models.User {
+	students := func(where string, args ...interface{}) *gorm.DB {
+		return models.DB.Model(&models.Student{}).Where("school_id = ?", n.SchoolID).Where(where, args...)
+	}
+	parentsOf := func(studentIDs *gorm.DB) *gorm.DB {
+		return models.DB.Model(&models.ParentStudent{}).Select("parent_id").Where("student_id IN (?)", studentIDs)
+	}
+
+	query := models.DB.Where("school_id = ?", n.SchoolID)
+	switch n.TargetType {
+	case models.NotificationTargetAll:
+		query = query.Where("role <> ?", "SUPERADMIN")
+	case models.NotificationTargetRole:
+		query = query.Where("role = ?", n.TargetRole)
+	case models.NotificationTargetClass:
+		query = query.Where("id IN (?)", students("class_id = ?", n.TargetID).Select("user_id"))
+	case models.NotificationTargetStudent:
+		query = query.Where("id IN (?) OR id IN (?)",
+			students("id = ?", n.TargetID).Select("user_id"), parentsOf(students("id = ?", n.TargetID).Select("id")))
+	case models.NotificationTargetClassParents:
+		query = query.Where("role = ? AND id IN (?)", "PARENT", parentsOf(students("class_id = ?", n.TargetID).Select("id")))
+	case models.NotificationTargetTeachers:
+		query = query.Where("role = ?", "TEACHER")
+		if n.TargetID != nil {
+			query = query.Where("id IN (?) OR id IN (?)",
+				models.DB.Model(&models.Class{}).Select("teacher_id").Where("id = ?", *n.TargetID),
+				models.DB.Model(&models.Timetable{}).Select("teacher_id").Where("class_id = ?", *n.TargetID))
+		}
+	case models.NotificationTargetUsers:
+		query = query.Where("id IN (?)", models.DB.Model(&models.NotificationRecipient{}).Select("user_id").Where("notification_id = ?", n.ID))
+	case models.NotificationTargetGroup:
+		query = query.Where("id IN (?)", models.DB.Model(&models.NotificationGroupMember{}).Select("user_id").Where("group_id = ?", n.TargetID))
+	default:
+		return nil
+	}
+
+	var users []models.User
+	query.Order("id").Find(&users)
+	return users
+}
+
+// UnreadNotificationCount - How many of the audience's notifications the user hasn't read
+func UnreadNotificationCount(audience NotificationAudience) int64 {
+	var count int64
+	NotificationsFor(audience).
+		Where("id NOT IN (?)", models.DB.Model(&models.NotificationRead{}).Select("notification_id").Where("user_id = ?", audience.UserID)).
+		Count(&count)
+	return count
+}
+
+// MarkNotificationsRead - Record read receipts for the user, skipping ones already read
+func MarkNotificationsRead(userID uint, notificationIDs []uint) int {
+	var already []uint
+	models.DB.Model(&models.NotificationRead{}).
+		Where("user_id = ? AND notification_id IN ?", userID, notificationIDs).
+		Pluck("notification_id", &already)
+	read := make(map[uint]bool, len(already))
+	for _, id := range already {
+		read[id] = true
+	}
+
+	marked := 0
+	now := time.Now()
+	for _, id := range notificationIDs {
+		if read[id] {
+			continue
+		}
+		read[id] = true
+		if models.DB.Create(&models.NotificationRead{NotificationID: id, UserID: userID, ReadAt: now}).Error == nil {
+			marked++
+		}
+	}
+	return marked
+}
+
+func appendUnique(ids []uint, more ...uint) []uint {
+	for _, id := range more {
+		found := false
+		for _, existing := range ids {
+			if existing == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
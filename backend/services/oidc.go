@@ -0,0 +1,391 @@
+package services
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"schoolms-go/models"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	ssoStateTTL        = 10 * time.Minute // Time the user has to sign in at the provider
+	oidcConfigCacheTTL = time.Hour
+	ssoPasswordHash    = "!sso" // Never matches a password; the account signs in through its provider until reset
+)
+
+var (
+	ErrSSOProviderUnavailable = errors.New("could not reach the identity provider")
+	ErrSSOStateInvalid        = errors.New("sign-in expired or was already used")
+	ErrSSOTokenInvalid        = errors.New("identity provider returned an invalid ID token")
+	ErrSSOEmailNotVerified    = errors.New("identity provider has not verified this email")
+	ErrSSODomainNotAllowed    = errors.New("email domain may not sign in with this provider")
+	ErrSSONoAccount           = errors.New("no account for this email at this school")
+)
+
+// SSORoles - Roles that may sign in through a school's provider, and be given to accounts it creates
+// Single sign-on is for staff; admins, parents and students sign in with a password
+var SSORoles = []string{RoleTeacher, RoleFinance}
+
+// OIDCConfig - The parts of a provider's discovery document we use
+type OIDCConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// SSOIdentity - Who the provider says signed in
+type SSOIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	Name          string
+	EmailVerified bool // The provider said so explicitly; needed before the email can match an existing account
+}
+
+type idTokenClaims struct {
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"` // Usually a bool; some providers send "true"
+	Name          string      `json:"name"`
+	Nonce         string      `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+var oidcCache = struct {
+	sync.Mutex
+	configs map[string]cachedOIDCConfig
+	keys    map[string]map[string]*rsa.PublicKey // jwks_uri -> kid -> key
+}{configs: map[string]cachedOIDCConfig{}, keys: map[string]map[string]*rsa.PublicKey{}}
+
+type cachedOIDCConfig struct {
+	config  OIDCConfig
+	fetched time.Time
+}
+
+// SSORedirectURI - Where providers send users back to; register it with the provider
+func SSORedirectURI() string {
+	return AppURL("/sso/callback")
+}
+
+// DiscoverOIDC - The provider's endpoints from {issuer}/.well-known/openid-configuration, cached for an hour
+func DiscoverOIDC(issuer string) (OIDCConfig, error) {
+	issuer = strings.TrimRight(issuer, "/")
+	oidcCache.Lock()
+	cached, ok := oidcCache.configs[issuer]
+	oidcCache.Unlock()
+	if ok && time.Since(cached.fetched) < oidcConfigCacheTTL {
+		return cached.config, nil
+	}
+
+	var config OIDCConfig
+	if err := getJSON(issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return config, fmt.Errorf("%w: %v", ErrSSOProviderUnavailable, err)
+	}
+	if strings.TrimRight(config.Issuer, "/") != issuer || config.AuthorizationEndpoint == "" ||
+		config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return config, fmt.Errorf("%w: incomplete discovery document for %s", ErrSSOProviderUnavailable, issuer)
+	}
+
+	oidcCache.Lock()
+	oidcCache.configs[issuer] = cachedOIDCConfig{config: config, fetched: time.Now()}
+	oidcCache.Unlock()
+	return config, nil
+}
+
+// StartSSOLogin - The provider's sign-in URL, using the authorization code flow with PKCE
+func StartSSOLogin(provider models.SSOProvider, loginHint string) (string, error) {
+	config, err := DiscoverOIDC(provider.Issuer)
+	if err != nil {
+		return "", err
+	}
+	state, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	models.DB.Where("expires_at < ?", time.Now()).Delete(&models.SSOLoginState{})
+	login := models.SSOLoginState{
+		ProviderID:   provider.ID,
+		StateHash:    hashToken(state),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(ssoStateTTL),
+	}
+	if err := models.DB.Create(&login).Error; err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.ClientID},
+		"redirect_uri":          {SSORedirectURI()},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if loginHint != "" {
+		query.Set("login_hint", loginHint)
+	}
+	separator := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return config.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// CompleteSSOLogin - Redeem the code the provider sent back and verify the ID token
+// The state works once, so a callback URL that leaks can't be replayed
+func CompleteSSOLogin(state, code string) (models.SSOProvider, SSOIdentity, error) {
+	var provider models.SSOProvider
+	var login models.SSOLoginState
+	if state == "" || models.DB.Where("state_hash = ?", hashToken(state)).First(&login).Error != nil {
+		return provider, SSOIdentity{}, ErrSSOStateInvalid
+	}
+	if models.DB.Delete(&models.SSOLoginState{}, login.ID).RowsAffected == 0 || login.ExpiresAt.Before(time.Now()) {
+		return provider, SSOIdentity{}, ErrSSOStateInvalid
+	}
+	if models.DB.Where("id = ? AND enabled = ?", login.ProviderID, true).First(&provider).Error != nil {
+		return provider, SSOIdentity{}, ErrSSOStateInvalid
+	}
+
+	config, err := DiscoverOIDC(provider.Issuer)
+	if err != nil {
+		return provider, SSOIdentity{}, err
+	}
+	rawIDToken, err := redeemSSOCode(config, provider, code, login.CodeVerifier)
+	if err != nil {
+		return provider, SSOIdentity{}, err
+	}
+	claims, err := verifyIDToken(config, provider.ClientID, login.Nonce, rawIDToken)
+	if err != nil {
+		return provider, SSOIdentity{}, err
+	}
+
+	identity := SSOIdentity{
+		Issuer:        config.Issuer,
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(strings.TrimSpace(claims.Email)),
+		Name:          claims.Name,
+		EmailVerified: claims.EmailVerified == true || claims.EmailVerified == "true",
+	}
+	if identity.Subject == "" || identity.Email == "" {
+		return provider, identity, fmt.Errorf("%w: no subject or email claim", ErrSSOTokenInvalid)
+	}
+	if verified, ok := claims.EmailVerified.(bool); (ok && !verified) || claims.EmailVerified == "false" {
+		return provider, identity, ErrSSOEmailNotVerified
+	}
+	if !SSODomainAllowed(provider, identity.Email) {
+		return provider, identity, ErrSSODomainNotAllowed
+	}
+	return provider, identity, nil
+}
+
+// SSODomainAllowed - Whether the email's domain is one the provider accepts
+func SSODomainAllowed(provider models.SSOProvider, email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	return slices.Contains(ParseSSODomains(provider.AllowedDomains), strings.ToLower(email[at+1:]))
+}
+
+// ParseSSODomains - Domains from a comma-separated list, lower-cased
+func ParseSSODomains(list string) []string {
+	var domains []string
+	for _, d := range strings.Split(list, ",") {
+		if d = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(d), "@"))); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// SSOUser - The account to sign in, or one created for it; returns true if the account was created
+// An identity already bound to an account signs in as that account. Otherwise the email is matched
+// to a staff account of the provider's school and bound to it. The session opens on the user's home
+// school and role, so only accounts whose home school is the provider's may sign in through it.
+// The email only matches an existing account if the provider marked it verified; a provider that
+// omits email_verified could otherwise let anyone who sets that address take the account over
+func SSOUser(provider models.SSOProvider, identity SSOIdentity) (models.User, bool, error) {
+	var user models.User
+	var link models.SSOIdentityLink
+	if models.DB.Where("issuer = ? AND subject = ?", identity.Issuer, identity.Subject).First(&link).Error == nil {
+		if models.DB.First(&user, link.UserID).Error != nil || !ssoEligible(provider, user) {
+			return user, false, ErrSSONoAccount
+		}
+		return user, false, nil
+	}
+
+	if models.DB.Where("LOWER(email) = ?", identity.Email).First(&user).Error == nil {
+		if !ssoEligible(provider, user) {
+			return user, false, ErrSSONoAccount
+		}
+		if !identity.EmailVerified {
+			return user, false, ErrSSOEmailNotVerified
+		}
+		// Bound to another identity at this provider, e.g. the address was reassigned to someone new
+		var bound int64
+		models.DB.Model(&models.SSOIdentityLink{}).Where("user_id = ? AND issuer = ?", user.ID, identity.Issuer).Count(&bound)
+		if bound > 0 {
+			return user, false, ErrSSONoAccount
+		}
+		link = models.SSOIdentityLink{UserID: user.ID, Issuer: identity.Issuer, Subject: identity.Subject}
+		return user, false, models.DB.Create(&link).Error
+	}
+
+	if !provider.AutoProvision || !slices.Contains(SSORoles, provider.DefaultRole) {
+		return user, false, ErrSSONoAccount
+	}
+	schoolID := provider.SchoolID
+	user = models.User{
+		Email:        identity.Email,
+		FullName:     identity.Name,
+		PasswordHash: ssoPasswordHash,
+		Role:         provider.DefaultRole,
+		SchoolID:     &schoolID,
+	}
+	err := models.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.SSOIdentityLink{UserID: user.ID, Issuer: identity.Issuer, Subject: identity.Subject}).Error
+	})
+	if err != nil {
+		return user, false, err
+	}
+	return user, true, nil
+}
+
+// ssoEligible - Staff whose home school is the provider's
+func ssoEligible(provider models.SSOProvider, user models.User) bool {
+	return user.SchoolID != nil && *user.SchoolID == provider.SchoolID && slices.Contains(SSORoles, user.Role)
+}
+
+// redeemSSOCode - Swap the authorization code (and PKCE verifier) for the ID token
+func redeemSSOCode(config OIDCConfig, provider models.SSOProvider, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {SSORedirectURI()},
+		"client_id":     {provider.ClientID},
+		"client_secret": {provider.ClientSecret},
+		"code_verifier": {verifier},
+	}
+	resp, err := httpClient(nil).PostForm(config.TokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrSSOProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("%w: token endpoint said %d %s %s", ErrSSOTokenInvalid, resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken - Check the signature against the provider's keys, and the issuer, audience, expiry and nonce
+func verifyIDToken(config OIDCConfig, clientID, nonce, raw string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return oidcKey(config.JWKSURI, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(config.Issuer),
+		jwt.WithAudience(clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSSOTokenInvalid, err)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrSSOTokenInvalid)
+	}
+	return claims, nil
+}
+
+// oidcKey - The provider's signing key by ID; the key set is fetched again for an unknown ID, as providers rotate keys
+func oidcKey(jwksURI, kid string) (*rsa.PublicKey, error) {
+	oidcCache.Lock()
+	key, ok := oidcCache.keys[jwksURI][kid]
+	oidcCache.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("fetch signing keys: %v", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	oidcCache.Lock()
+	oidcCache.keys[jwksURI] = keys
+	oidcCache.Unlock()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func getJSON(url string, out interface{}) error {
+	resp, err := httpClient(nil).Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
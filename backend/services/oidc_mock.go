@@ -0,0 +1,176 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const oidcMockKeyID = "mock-key"
+
+// OIDCMock - Local stand-in for an OpenID Connect identity provider, for tests and development
+// It serves discovery, the signing keys and the token endpoint; Authorize plays the user signing in
+type OIDCMock struct {
+	ClientID     string
+	ClientSecret string
+	server       *httptest.Server
+	key          *rsa.PrivateKey
+	mu           sync.Mutex
+	grants       map[string]oidcMockGrant
+}
+
+type oidcMockGrant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	claims      map[string]interface{}
+}
+
+// StartOIDCMock - Serve an identity provider for the client on a local port
+func StartOIDCMock(clientID, clientSecret string) *OIDCMock {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	m := &OIDCMock{ClientID: clientID, ClientSecret: clientSecret, key: key, grants: map[string]oidcMockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+// Issuer - The issuer URL to configure the provider with
+func (m *OIDCMock) Issuer() string { return m.server.URL }
+
+// Close - Stop the server
+func (m *OIDCMock) Close() { m.server.Close() }
+
+// Authorize - Sign in at the provider with the authorization URL our API built, as the user with these
+// claims (email, name, email_verified; iss, aud or nonce override the real ones). Returns the state and
+// code the provider would send back to the redirect URI
+func (m *OIDCMock) Authorize(authorizationURL string, claims map[string]interface{}) (string, string, error) {
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	switch {
+	case !strings.HasPrefix(authorizationURL, m.Issuer()+"/authorize"):
+		return "", "", errors.New("not this provider's authorization endpoint")
+	case q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		return "", "", errors.New("authorization code flow with S256 PKCE required")
+	case q.Get("client_id") != m.ClientID:
+		return "", "", errors.New("unknown client")
+	case !strings.Contains(q.Get("scope"), "openid"):
+		return "", "", errors.New("openid scope required")
+	}
+
+	code, err := newRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+	m.mu.Lock()
+	m.grants[code] = oidcMockGrant{
+		clientID:    q.Get("client_id"),
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		claims:      claims,
+	}
+	m.mu.Unlock()
+	return q.Get("state"), code, nil
+}
+
+func (m *OIDCMock) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(OIDCConfig{
+		Issuer:                m.Issuer(),
+		AuthorizationEndpoint: m.Issuer() + "/authorize",
+		TokenEndpoint:         m.Issuer() + "/token",
+		JWKSURI:               m.Issuer() + "/jwks",
+	})
+}
+
+func (m *OIDCMock) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := m.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": oidcMockKeyID,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+func (m *OIDCMock) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(reason string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": reason})
+	}
+	r.ParseForm()
+	m.mu.Lock()
+	grant, ok := m.grants[r.PostForm.Get("code")]
+	delete(m.grants, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code" || !ok:
+		fail("unknown or used code")
+		return
+	case r.PostForm.Get("client_id") != grant.clientID || r.PostForm.Get("client_secret") != m.ClientSecret:
+		fail("client authentication failed")
+		return
+	case r.PostForm.Get("redirect_uri") != grant.redirectURI:
+		fail("redirect_uri mismatch")
+		return
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge:
+		fail("PKCE verification failed")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   m.Issuer(),
+		"aud":   grant.clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": grant.nonce,
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	if _, ok := claims["sub"]; !ok {
+		claims["sub"] = claims["email"]
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = oidcMockKeyID
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
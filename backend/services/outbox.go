@@ -0,0 +1,504 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"schoolms-go/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	outboxMaxAttempts  = 5
+	outboxBaseBackoff  = 30 * time.Second
+	outboxMaxBackoff   = time.Hour
+	outboxPollInterval = 5 * time.Second
+	outboxBatchSize    = 50
+	outboxStaleAfter   = 5 * time.Minute // SENDING longer than this was interrupted by a restart
+	outboxRecoverEvery = time.Minute     // How often workers look for interrupted messages
+)
+
+// outboxWake - Nudges idle workers when new messages are queued
+var outboxWake = make(chan struct{}, 1)
+
+// EnqueueMessages - Persist a batch of SMS as a job; workers deliver them in the background
+// Numbers that can't be formatted are recorded as FAILED straight away. The cost of the
+// rest is reserved from the school's SMS wallet, so a prepaid school can't queue more
+// than it has credit for (ErrInsufficientSMSCredit). Security notices aren't charged: a school
+// out of credit, or a superadmin with no school (and no wallet), must still hear about a lockout
+func EnqueueMessages(schoolID, createdBy uint, kind string, messages []SMSMessage) (*models.MessageJob, error) {
+	charged := kind != models.MessageJobSecurity
+	var wallet models.SMSWallet
+	var err error
+	if charged {
+		if wallet, err = GetSMSWallet(schoolID); err != nil {
+			return nil, err
+		}
+	}
+
+	job := models.MessageJob{
+		SchoolID:  schoolID,
+		Kind:      kind,
+		Status:    models.JobQueued,
+		Total:     len(messages),
+		CreatedBy: createdBy,
+	}
+
+	now := time.Now()
+	err = models.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&job).Error; err != nil {
+			return err
+		}
+
+		rows := make([]models.OutboundMessage, 0, len(messages))
+		var reserved float64
+		var segments int
+		for _, m := range messages {
+			row := models.OutboundMessage{
+				SchoolID:      schoolID,
+				JobID:         &job.ID,
+				To:            m.To,
+				Message:       m.Message,
+				Status:        models.OutboxQueued,
+				MaxAttempts:   outboxMaxAttempts,
+				NextAttemptAt: now,
+			}
+			if NormalizePhone(m.To) == "" {
+				row.Status = models.OutboxFailed
+				row.LastError = "Invalid phone number"
+				job.Failed++
+			} else if IsOptedOut(schoolID, m.To) {
+				row.Status = models.OutboxFailed
+				row.LastError = "Recipient opted out"
+				job.Failed++
+			} else if m.WhatsApp != nil {
+				// Nothing is reserved for WhatsApp; the SMS is charged only if it falls back
+				params, _ := json.Marshal(m.WhatsApp.Params)
+				row.Channel = models.ChannelWhatsApp
+				row.Template = m.WhatsApp.Name
+				row.TemplateLanguage = m.WhatsApp.Language
+				row.TemplateParams = string(params)
+			} else if charged {
+				parts, charge := SMSChargeFor(wallet, m.Message)
+				row.Charge = charge
+				reserved += charge
+				segments += parts
+			}
+			rows = append(rows, row)
+		}
+		if err := ChargeSMSCredit(tx, schoolID, roundKES(reserved), segments, &job.ID, kind+" job"); err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			if err := tx.CreateInBatches(&rows, 100).Error; err != nil {
+				return err
+			}
+		}
+		if job.Failed == job.Total {
+			job.Status = models.JobCompleted
+		}
+		return tx.Save(&job).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wakeOutbox()
+	return &job, nil
+}
+
+// EnqueueEmail - Queue an email for the outbox workers, one row per recipient
+// For notices that mustn't hold up the request, such as a lockout warning; attachments aren't queued
+func EnqueueEmail(schoolID uint, template string, msg EmailMessage) error {
+	now := time.Now()
+	rows := make([]models.OutboundMessage, 0, len(msg.To))
+	for _, to := range msg.To {
+		rows = append(rows, models.OutboundMessage{
+			SchoolID:      schoolID,
+			To:            to,
+			Channel:       models.ChannelEmail,
+			Template:      template,
+			Subject:       msg.Subject,
+			Message:       msg.Text,
+			HTML:          msg.HTML,
+			Status:        models.OutboxQueued,
+			MaxAttempts:   outboxMaxAttempts,
+			NextAttemptAt: now,
+		})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := models.DB.Create(&rows).Error; err != nil {
+		return err
+	}
+	wakeOutbox()
+	return nil
+}
+
+// wakeOutbox - Nudge an idle worker, if none is already due to wake
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// StartOutboxWorkers - Run n delivery workers until ctx is cancelled
+// Interrupted messages are re-queued on a ticker rather than only at startup: after a quick restart
+// they aren't stale yet, and would otherwise stay SENDING with their job never completing
+func StartOutboxWorkers(ctx context.Context, n int) {
+	recoverStaleOutbox()
+	go func() {
+		ticker := time.NewTicker(outboxRecoverEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				recoverStaleOutbox()
+			}
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		go func() {
+			ticker := time.NewTicker(outboxPollInterval)
+			defer ticker.Stop()
+			for {
+				// Keep draining while there is work, then wait for a tick or a wake-up
+				for ProcessOutbox(outboxBatchSize) > 0 {
+					if ctx.Err() != nil {
+						return
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				case <-outboxWake:
+				}
+			}
+		}()
+	}
+}
+
+func recoverStaleOutbox() {
+	if recovered := RecoverStaleOutbox(); recovered > 0 {
+		log.Printf("[Outbox] Re-queued %d messages interrupted mid-send", recovered)
+		wakeOutbox()
+	}
+}
+
+// RecoverStaleOutbox - Put messages stuck in SENDING back on the queue
+func RecoverStaleOutbox() int64 {
+	result := models.DB.Model(&models.OutboundMessage{}).
+		Where("status = ? AND updated_at < ?", models.OutboxSending, time.Now().Add(-outboxStaleAfter)).
+		Updates(map[string]interface{}{"status": models.OutboxQueued, "next_attempt_at": time.Now()})
+	return result.RowsAffected
+}
+
+// ProcessOutbox - Claim and deliver up to limit due messages; returns how many were handled
+func ProcessOutbox(limit int) int {
+	var due []models.OutboundMessage
+	models.DB.Where("status = ? AND next_attempt_at <= ?", models.OutboxQueued, time.Now()).
+		Order("next_attempt_at, id").
+		Limit(limit).
+		Find(&due)
+
+	handled := 0
+	for i := range due {
+		msg := &due[i]
+
+		// Claim it; another worker may have got there first
+		claim := models.DB.Model(&models.OutboundMessage{}).
+			Where("id = ? AND status = ?", msg.ID, models.OutboxQueued).
+			Updates(map[string]interface{}{"status": models.OutboxSending, "updated_at": time.Now()})
+		if claim.RowsAffected == 0 {
+			continue
+		}
+		if msg.JobID != nil {
+			models.DB.Model(&models.MessageJob{}).
+				Where("id = ? AND status = ?", *msg.JobID, models.JobQueued).
+				Update("status", models.JobRunning)
+		}
+
+		deliverOutboundMessage(msg)
+		handled++
+	}
+	return handled
+}
+
+func deliverOutboundMessage(msg *models.OutboundMessage) {
+	if msg.Channel == models.ChannelEmail {
+		deliverEmail(msg)
+		return
+	}
+
+	// The recipient may have replied STOP while this was queued
+	if IsOptedOut(msg.SchoolID, msg.To) {
+		models.DB.Model(&models.OutboundMessage{}).Where("id = ?", msg.ID).
+			Updates(map[string]interface{}{"status": models.OutboxFailed, "last_error": "Recipient opted out"})
+		RefundSMSCredit(msg.SchoolID, msg.Charge, msg.JobID, "Opted out: "+msg.To)
+		if msg.JobID != nil {
+			recordJobProgress(*msg.JobID, false)
+		}
+		return
+	}
+
+	if msg.Channel == models.ChannelWhatsApp && !deliverWhatsApp(msg) {
+		return
+	}
+
+	provider := SMSProviderForSchool(msg.SchoolID)
+	if provider != nil {
+		rateLimiterFor(provider.Name()).Wait()
+	}
+
+	result := SendSMSWith(provider, msg.To, msg.Message)
+	if result.Success {
+		result.Charged = msg.Charge
+	}
+	LogSMSSent(msg.SchoolID, msg.To, msg.Message, result)
+
+	msg.Attempts++
+	msg.Provider = result.Provider
+	updates := map[string]interface{}{
+		"attempts": msg.Attempts,
+		"provider": msg.Provider,
+	}
+
+	switch {
+	case result.Success:
+		now := time.Now()
+		updates["status"] = models.OutboxSent
+		updates["sent_at"] = now
+		updates["provider_message_id"] = result.MessageID
+		updates["last_error"] = ""
+		msg.Status = models.OutboxSent
+	case msg.Attempts >= msg.MaxAttempts:
+		updates["status"] = models.OutboxFailed
+		updates["last_error"] = smsFailureReason(result)
+		msg.Status = models.OutboxFailed
+		RefundSMSCredit(msg.SchoolID, msg.Charge, msg.JobID, "Undelivered: "+msg.To)
+	default:
+		updates["status"] = models.OutboxQueued
+		updates["last_error"] = smsFailureReason(result)
+		updates["next_attempt_at"] = time.Now().Add(OutboxBackoff(msg.Attempts))
+		msg.Status = models.OutboxQueued
+	}
+	models.DB.Model(&models.OutboundMessage{}).Where("id = ?", msg.ID).Updates(updates)
+
+	if msg.JobID != nil && msg.Status != models.OutboxQueued {
+		recordJobProgress(*msg.JobID, msg.Status == models.OutboxSent)
+	}
+}
+
+// deliverEmail - Send a queued email through the school's mailer, retrying like an SMS
+func deliverEmail(msg *models.OutboundMessage) {
+	result := SendSchoolEmail(msg.SchoolID, msg.Template, EmailMessage{
+		To: []string{msg.To}, Subject: msg.Subject, HTML: msg.HTML, Text: msg.Message,
+	})
+
+	msg.Attempts++
+	updates := map[string]interface{}{"attempts": msg.Attempts}
+	switch {
+	case result.Success:
+		msg.Status = models.OutboxSent
+		updates["sent_at"] = time.Now()
+		updates["provider_message_id"] = result.MessageID
+		updates["last_error"] = ""
+	case msg.Attempts >= msg.MaxAttempts:
+		msg.Status = models.OutboxFailed
+		updates["last_error"] = result.Error
+	default:
+		msg.Status = models.OutboxQueued
+		updates["last_error"] = result.Error
+		updates["next_attempt_at"] = time.Now().Add(OutboxBackoff(msg.Attempts))
+	}
+	updates["status"] = msg.Status
+	models.DB.Model(&models.OutboundMessage{}).Where("id = ?", msg.ID).Updates(updates)
+}
+
+// deliverWhatsApp - Send a WhatsApp template message; when WhatsApp can't deliver it the
+// row is switched to SMS and charged, and true is returned so the SMS goes out now
+func deliverWhatsApp(msg *models.OutboundMessage) bool {
+	result := SMSResult{Success: false, Error: "WhatsApp not configured", Provider: models.SMSProviderWhatsApp}
+	if provider := WhatsAppProviderForSchool(msg.SchoolID); provider != nil {
+		var params []string
+		json.Unmarshal([]byte(msg.TemplateParams), &params)
+		rateLimiterFor(provider.Name()).Wait()
+		result = provider.SendTemplate(msg.To, WhatsAppTemplateMessage{Name: msg.Template, Language: msg.TemplateLanguage, Params: params})
+		result.Provider = provider.Name()
+	}
+	LogSMSSent(msg.SchoolID, msg.To, msg.Message, result)
+
+	if result.Success {
+		now := time.Now()
+		msg.Attempts++
+		msg.Status = models.OutboxSent
+		models.DB.Model(&models.OutboundMessage{}).Where("id = ?", msg.ID).Updates(map[string]interface{}{
+			"status":              models.OutboxSent,
+			"attempts":            msg.Attempts,
+			"provider":            result.Provider,
+			"provider_message_id": result.MessageID,
+			"sent_at":             now,
+			"last_error":          "",
+		})
+		if msg.JobID != nil {
+			recordJobProgress(*msg.JobID, true)
+		}
+		return false
+	}
+
+	// Fall back to SMS, charging for it now
+	reason := "WhatsApp: " + smsFailureReason(result)
+	wallet, err := GetSMSWallet(msg.SchoolID)
+	var segments int
+	var charge float64
+	if err == nil {
+		segments, charge = SMSChargeFor(wallet, msg.Message)
+		err = models.DB.Transaction(func(tx *gorm.DB) error {
+			return ChargeSMSCredit(tx, msg.SchoolID, charge, segments, msg.JobID, "SMS fallback to "+msg.To)
+		})
+	}
+	if err != nil {
+		msg.Status = models.OutboxFailed
+		models.DB.Model(&models.OutboundMessage{}).Where("id = ?", msg.ID).Updates(map[string]interface{}{
+			"status":     models.OutboxFailed,
+			"last_error": reason + "; SMS fallback: " + err.Error(),
+		})
+		if msg.JobID != nil {
+			recordJobProgress(*msg.JobID, false)
+		}
+		return false
+	}
+
+	msg.Channel = models.ChannelSMS
+	msg.Charge = charge
+	models.DB.Model(&models.OutboundMessage{}).Where("id = ?", msg.ID).Updates(map[string]interface{}{
+		"channel":    models.ChannelSMS,
+		"charge":     charge,
+		"last_error": reason,
+	})
+	return true
+}
+
+func smsFailureReason(result SMSResult) string {
+	if result.Error != "" {
+		return result.Error
+	}
+	if result.Status != "" {
+		return result.Status
+	}
+	return "Unknown error"
+}
+
+// recordJobProgress - Count a finished message and close the job when all are done
+func recordJobProgress(jobID uint, sent bool) {
+	column := "failed"
+	if sent {
+		column = "sent"
+	}
+	models.DB.Model(&models.MessageJob{}).Where("id = ?", jobID).
+		Update(column, gorm.Expr(column+" + 1"))
+	models.DB.Model(&models.MessageJob{}).
+		Where("id = ? AND sent + failed >= total", jobID).
+		Update("status", models.JobCompleted)
+}
+
+// OutboxBackoff - Delay before the next attempt: 30s, 1m, 2m, 4m... capped at an hour
+func OutboxBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	d := time.Duration(float64(outboxBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if d > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return d
+}
+
+// rateLimiter - Spaces out sends to one provider across all workers
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (r *rateLimiter) Wait() {
+	if r.interval <= 0 {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   = map[string]*rateLimiter{}
+)
+
+// defaultSMSRates - Messages per second each provider accepts; 0 means unlimited
+var defaultSMSRates = map[string]float64{
+	models.SMSProviderAfricasTalking: 10,
+	models.SMSProviderHTTP:           10,
+}
+
+// SetSMSRateLimit - Override how many messages per second a provider is sent
+func SetSMSRateLimit(provider string, perSecond float64) {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	rateLimiters[provider] = newRateLimiter(perSecond)
+}
+
+func rateLimiterFor(provider string) *rateLimiter {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+
+	if l, ok := rateLimiters[provider]; ok {
+		return l
+	}
+
+	// SMS_RATE_AFRICASTALKING=20 overrides the built-in default
+	rate := defaultSMSRates[provider]
+	if v, err := strconv.ParseFloat(os.Getenv("SMS_RATE_"+strings.ToUpper(provider)), 64); err == nil {
+		rate = v
+	}
+	l := newRateLimiter(rate)
+	rateLimiters[provider] = l
+	return l
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// JobProgress - Percentage of a job's messages that have finished
+func JobProgress(job models.MessageJob) int {
+	if job.Total == 0 {
+		return 100
+	}
+	return (job.Sent + job.Failed) * 100 / job.Total
+}
@@ -0,0 +1,98 @@
+package services_test
+
+import (
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyProvider - Fails the first send to each number listed in failOnce
+type flakyProvider struct {
+	mu       sync.Mutex
+	failOnce map[string]bool
+	sent     []string
+}
+
+func (p *flakyProvider) Name() string { return "FLAKY" }
+
+func (p *flakyProvider) Send(to, message string) services.SMSResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failOnce[to] {
+		delete(p.failOnce, to)
+		return services.SMSResult{Success: false, Error: "gateway timeout"}
+	}
+	p.sent = append(p.sent, to)
+	return services.SMSResult{Success: true, Status: "Success", MessageID: "id-" + to}
+}
+
+func TestOutbox_RetriesWithBackoffAndTracksJob(t *testing.T) {
+	db := setupTestDB(t)
+	db.AutoMigrate(&models.SMSSettings{}, &models.SMSLog{}, &models.MessageJob{}, &models.OutboundMessage{}, &models.SMSWallet{}, &models.SMSCreditTransaction{})
+	defer func() { sqlDB, _ := db.DB(); sqlDB.Close() }()
+
+	provider := &flakyProvider{failOnce: map[string]bool{"+254700000002": true}}
+	services.SetDefaultSMSProvider(provider)
+	defer services.SetDefaultSMSProvider(nil)
+
+	job, err := services.EnqueueMessages(1, 1, models.MessageJobBroadcast, []services.SMSMessage{
+		{To: "0700000001", Message: "Hello"},
+		{To: "0700000002", Message: "Hello"},
+		{To: "not-a-phone", Message: "Hello"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, job.Total)
+	assert.Equal(t, 1, job.Failed) // Invalid number never reaches the queue
+
+	assert.Equal(t, 2, services.ProcessOutbox(10))
+	assert.Equal(t, []string{"+254700000001"}, provider.sent)
+
+	var retry models.OutboundMessage
+	db.Where("\"to\" = ?", "0700000002").First(&retry)
+	assert.Equal(t, models.OutboxQueued, retry.Status)
+	assert.Equal(t, 1, retry.Attempts)
+	assert.Equal(t, "gateway timeout", retry.LastError)
+	assert.True(t, retry.NextAttemptAt.After(time.Now().Add(20*time.Second)))
+
+	// Not due yet, so nothing happens
+	assert.Equal(t, 0, services.ProcessOutbox(10))
+
+	var running models.MessageJob
+	db.First(&running, job.ID)
+	assert.Equal(t, models.JobRunning, running.Status)
+	assert.Equal(t, 66, services.JobProgress(running))
+
+	db.Model(&retry).Update("next_attempt_at", time.Now().Add(-time.Second))
+	assert.Equal(t, 1, services.ProcessOutbox(10))
+
+	var done models.MessageJob
+	db.First(&done, job.ID)
+	assert.Equal(t, models.JobCompleted, done.Status)
+	assert.Equal(t, 2, done.Sent)
+	assert.Equal(t, 1, done.Failed)
+}
+
+func TestOutbox_RecoversMessagesInterruptedByRestart(t *testing.T) {
+	db := setupTestDB(t)
+	db.AutoMigrate(&models.MessageJob{}, &models.OutboundMessage{})
+	defer func() { sqlDB, _ := db.DB(); sqlDB.Close() }()
+
+	msg := models.OutboundMessage{SchoolID: 1, To: "0700000001", Message: "Hi", Status: models.OutboxSending, MaxAttempts: 5}
+	db.Create(&msg)
+	db.Model(&msg).UpdateColumn("updated_at", time.Now().Add(-time.Hour))
+
+	assert.Equal(t, int64(1), services.RecoverStaleOutbox())
+
+	db.First(&msg, msg.ID)
+	assert.Equal(t, models.OutboxQueued, msg.Status)
+}
+
+func TestOutboxBackoff_DoublesAndCaps(t *testing.T) {
+	assert.Equal(t, 30*time.Second, services.OutboxBackoff(1))
+	assert.Equal(t, 2*time.Minute, services.OutboxBackoff(3))
+	assert.Equal(t, time.Hour, services.OutboxBackoff(20))
+}
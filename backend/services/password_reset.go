@@ -0,0 +1,246 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"schoolms-go/models"
+	"strings"
+	"time"
+)
+
+const (
+	passwordResetTTL         = 15 * time.Minute
+	passwordResetMaxAttempts = 5 // Wrong codes before the reset is locked
+	passwordResetHourlyLimit = 3 // Codes sent per user per hour
+)
+
+var (
+	ErrResetCodeInvalid     = errors.New("invalid or expired reset code")
+	ErrResetTooManyAttempts = errors.New("too many wrong codes")
+	ErrResetRateLimited     = errors.New("too many reset requests")
+	ErrResetNoChannel       = errors.New("no verified email or phone to send a code to")
+)
+
+// FindUserForReset - The account a forgot-password request is for, by email or verified phone
+func FindUserForReset(email, phone string) (models.User, bool) {
+	var user models.User
+	query := models.DB.Where("deactivated_at IS NULL")
+	switch {
+	case strings.TrimSpace(email) != "":
+		query = query.Where("LOWER(email) = ?", strings.ToLower(strings.TrimSpace(email)))
+	case NormalizePhone(phone) != "":
+		query = query.Where("phone = ? AND phone_verified = ?", NormalizePhone(phone), true)
+	default:
+		return user, false
+	}
+	return user, query.Order("id").First(&user).Error == nil
+}
+
+// ResetChannels - Where a code can be sent: a real email address and/or a verified phone
+func ResetChannels(user models.User) []string {
+	var channels []string
+	if hasRealEmail(user) {
+		channels = append(channels, models.ResetChannelEmail)
+	}
+	if user.Phone != "" && user.PhoneVerified {
+		channels = append(channels, models.ResetChannelSMS)
+	}
+	return channels
+}
+
+// RequestPasswordReset - Send the user a one-time code by the preferred channel, falling back to the other
+// Earlier unused codes stop working once the new one is sent
+func RequestPasswordReset(user models.User, preferred, ip string) (models.PasswordReset, error) {
+	var reset models.PasswordReset
+	channels := ResetChannels(user)
+	if len(channels) == 0 {
+		return reset, ErrResetNoChannel
+	}
+	if containsString(channels, preferred) && channels[0] != preferred {
+		channels[0], channels[1] = channels[1], channels[0]
+	}
+
+	var recent int64
+	models.DB.Model(&models.PasswordReset{}).
+		Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-time.Hour)).Count(&recent)
+	if recent >= passwordResetHourlyLimit {
+		return reset, ErrResetRateLimited
+	}
+
+	code, err := newResetCode()
+	if err != nil {
+		return reset, err
+	}
+	token, err := newRefreshToken()
+	if err != nil {
+		return reset, err
+	}
+
+	now := time.Now()
+	reset = models.PasswordReset{
+		UserID:    user.ID,
+		CodeHash:  resetCodeHash(user.ID, code),
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(passwordResetTTL),
+		IPAddress: ip,
+	}
+	schoolID := uint(0)
+	if user.SchoolID != nil {
+		schoolID = *user.SchoolID
+	}
+	for _, channel := range channels {
+		reset.Channel = channel
+		if channel == models.ResetChannelEmail {
+			reset.Destination = maskEmail(user.Email)
+			err = sendResetEmail(schoolID, user, code, token, reset.ExpiresAt)
+		} else {
+			reset.Destination = maskPhone(user.Phone)
+			err = sendResetSMS(schoolID, user, code)
+		}
+		if err == nil {
+			break
+		}
+		log.Printf("[PasswordReset] %s to user %d failed: %v", channel, user.ID, err)
+	}
+	if err != nil {
+		return reset, err
+	}
+
+	models.DB.Model(&models.PasswordReset{}).
+		Where("user_id = ? AND used_at IS NULL", user.ID).Update("used_at", now)
+	return reset, models.DB.Create(&reset).Error
+}
+
+// VerifyResetCode - The user's pending reset if code matches; wrong codes count towards the attempt limit
+func VerifyResetCode(userID uint, code string) (models.PasswordReset, error) {
+	var reset models.PasswordReset
+	if err := models.DB.Where("user_id = ? AND used_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("id DESC").First(&reset).Error; err != nil {
+		return reset, ErrResetCodeInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(reset.CodeHash), []byte(resetCodeHash(userID, strings.TrimSpace(code)))) == 1 {
+		return reset, nil
+	}
+
+	reset.Attempts++
+	updates := map[string]interface{}{"attempts": reset.Attempts}
+	if reset.Attempts >= passwordResetMaxAttempts {
+		updates["used_at"] = time.Now()
+	}
+	models.DB.Model(&reset).Updates(updates)
+	if reset.Attempts >= passwordResetMaxAttempts {
+		return reset, ErrResetTooManyAttempts
+	}
+	return reset, ErrResetCodeInvalid
+}
+
+// VerifyResetToken - The pending reset for the token in an emailed link
+func VerifyResetToken(token string) (models.PasswordReset, error) {
+	var reset models.PasswordReset
+	if token == "" || models.DB.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), time.Now()).
+		First(&reset).Error != nil {
+		return reset, ErrResetCodeInvalid
+	}
+	return reset, nil
+}
+
+// CompletePasswordReset - Set the new password, use up the reset and sign the user out everywhere
+// A lockout from failed logins is lifted too, since the owner has proved who they are
+func CompletePasswordReset(reset models.PasswordReset, newPassword string) error {
+	claim := models.DB.Model(&models.PasswordReset{}).
+		Where("id = ? AND used_at IS NULL", reset.ID).Update("used_at", time.Now())
+	if claim.RowsAffected == 0 {
+		return ErrResetCodeInvalid
+	}
+	hash, err := models.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	err = models.DB.Model(&models.User{}).Where("id = ?", reset.UserID).
+		Updates(map[string]interface{}{
+			"password_hash": hash, "must_change_password": false,
+			"failed_logins": 0, "last_failed_login_at": nil, "locked_until": nil,
+		}).Error
+	if err != nil {
+		return err
+	}
+	RevokeUserSessions(reset.UserID, models.SessionRevokedPasswordChanged, 0)
+	return nil
+}
+
+func sendResetEmail(schoolID uint, user models.User, code, token string, expires time.Time) error {
+	name := user.FullName
+	if name == "" {
+		name = "there"
+	}
+	msg, err := RenderEmail(schoolID, models.EmailTemplatePasswordReset, MergeFields{
+		"name":       name,
+		"link":       AppURL("/reset-password?token=" + token),
+		"reset_code": code,
+		"expires":    expires.Format("15:04"),
+	})
+	if err != nil {
+		return err
+	}
+	msg.To = []string{user.Email}
+	if result := SendSchoolEmail(schoolID, models.EmailTemplatePasswordReset, msg); !result.Success {
+		return fmt.Errorf("send reset email: %s", result.Error)
+	}
+	return nil
+}
+
+func sendResetSMS(schoolID uint, user models.User, code string) error {
+	message := fmt.Sprintf("Your SchoolMS password reset code is %s. It expires in %d minutes. Don't share it with anyone.",
+		code, int(passwordResetTTL.Minutes()))
+	var result SMSResult
+	if schoolID != 0 {
+		result = SendSchoolSMS(schoolID, user.Phone, message)
+	} else {
+		result = SendSMS(user.Phone, message)
+	}
+	// The code itself is kept out of the SMS log
+	LogSMSSent(schoolID, user.Phone, "Password reset code", result)
+	if !result.Success {
+		return fmt.Errorf("send reset SMS: %s", result.Error)
+	}
+	return nil
+}
+
+func newResetCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// resetCodeHash - Codes are salted with the user so equal codes don't share a hash
+func resetCodeHash(userID uint, code string) string {
+	return hashToken(fmt.Sprintf("%d:%s", userID, code))
+}
+
+func hasRealEmail(user models.User) bool {
+	email := strings.ToLower(strings.TrimSpace(user.Email))
+	return email != "" && !strings.HasSuffix(email, ".local")
+}
+
+// maskEmail - j***@example.com
+func maskEmail(email string) string {
+	at := strings.Index(email, "@")
+	if at < 1 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// maskPhone - +2547******78
+func maskPhone(phone string) string {
+	if len(phone) < 7 {
+		return "***"
+	}
+	return phone[:5] + strings.Repeat("*", len(phone)-7) + phone[len(phone)-2:]
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"schoolms-go/models"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrUnknownPermission  = errors.New("unknown permission")
+	ErrPlatformPermission = errors.New("permission is reserved for platform admins")
+)
+
+// Built-in roles
+const (
+	RoleSuperAdmin  = "SUPERADMIN"
+	RoleSchoolAdmin = "SCHOOLADMIN"
+	RoleTeacher     = "TEACHER"
+	RoleFinance     = "FINANCE"
+	RoleParent      = "PARENT"
+	RoleStudent     = "STUDENT"
+	RoleService     = "SERVICE" // Integrations signing in with an API key; the key's scopes are its permissions
+)
+
+// BuiltInRoles - Every built-in role, most privileged first
+var BuiltInRoles = []string{RoleSuperAdmin, RoleSchoolAdmin, RoleTeacher, RoleFinance, RoleParent, RoleStudent, RoleService}
+
+// Permission - Something a user may do, checked by middleware.RequirePermission
+// Roles is the default bundle: the built-in roles that have it unless given a custom role
+type Permission struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Roles       []string `json:"default_roles"`
+}
+
+// Platform - Only platform admins have it; schools can't put it in a custom role
+func (p Permission) Platform() bool {
+	return len(p.Roles) == 1 && p.Roles[0] == RoleSuperAdmin
+}
+
+// IsPersonalPermission - Access to the user's own records (*_own); it grants nothing over anyone else
+func IsPersonalPermission(name string) bool {
+	return strings.HasSuffix(name, "_own")
+}
+
+const (
+	sa  = RoleSchoolAdmin
+	tch = RoleTeacher
+	fin = RoleFinance
+	par = RoleParent
+	stu = RoleStudent
+	sup = RoleSuperAdmin
+)
+
+// Permissions - The catalogue, grouped by area; the default bundles match what each role could do before custom roles
+var Permissions = []Permission{
+	{"users.manage", "Deactivate, reactivate and unlock users and reset their two-factor", []string{sa, sup}},
+	{"roles.manage", "Create custom roles and give them to users", []string{sa}},
+	{"security.policy.manage", "Choose which roles must use two-factor sign-in", []string{sa}},
+	{"api_keys.manage", "Create and revoke API keys and service accounts for integrations", []string{sa}},
+	{"sso.manage", "Configure single sign-on with Google Workspace, Microsoft 365 or another OpenID Connect provider", []string{sa}},
+	{"audit.view", "View and export the audit log", []string{sa, sup}},
+	{"invites.manage", "Create and list invite codes", []string{sa}},
+	{"data.import", "Import students and guardians from CSV", []string{sa}},
+	{"analytics.view", "View dashboard, enrolment, finance and attendance analytics", []string{sa, fin}},
+	{"alerts.manage", "Configure guardian alerts and view the event log", []string{sa}},
+
+	{"students.view", "List students and view profiles, analytics and financial reports", []string{sa, tch, fin}},
+	{"students.manage", "Edit, admit and discharge students", []string{sa, tch, fin}},
+	{"students.view_own", "A student's own profile", []string{stu}},
+	{"parents.links.manage", "Link guardians to students and update their phones", []string{sa}},
+	{"classes.view", "List classes", []string{sa, tch, fin}},
+	{"classes.create", "Create classes", []string{sa}},
+	{"teachers.view_own", "A teacher's own profile, classes and students", []string{tch}},
+	{"parents.view_own", "A guardian's children, their grades, attendance and fees, and their own preferences", []string{par}},
+
+	{"attendance.mark", "Mark attendance", []string{tch, sa}},
+	{"attendance.class.view", "View a class's attendance", []string{tch, sa, fin}},
+	{"attendance.student.view", "View a student's attendance", []string{tch, sa, par}},
+	{"attendance.stats.view", "View attendance statistics", []string{tch, sa}},
+	{"attendance.view_own", "A student's own attendance", []string{stu}},
+
+	{"grades.create", "Enter grades", []string{tch, sa}},
+	{"grades.view", "View class grades and report cards", []string{tch, sa}},
+	{"grades.publish", "Email report cards to guardians", []string{tch, sa}},
+	{"grades.view_own", "A student's own grades", []string{stu}},
+	{"content.manage", "Upload and delete class materials", []string{tch, sa}},
+
+	{"timetable.manage", "Create, edit and delete timetable entries", []string{sa}},
+	{"timetable.view", "View class timetables", []string{sa, tch, stu, par}},
+	{"timetable.view_own", "A teacher's own timetable", []string{tch}},
+
+	{"tvet.manage", "Manage intakes, courses and modules", []string{sa}},
+	{"tvet.intakes.view", "List intakes", []string{sa, tch}},
+	{"tvet.attachments.manage", "Record and update industrial attachments", []string{sa, tch}},
+
+	{"finance.fees.view", "View fee structures", []string{sa, tch, fin}},
+	{"finance.fees.create", "Create fee structures", []string{sa, tch, fin}},
+	{"finance.payments.view", "View payments, balances, receipts and statements", []string{sa, tch, fin}},
+	{"finance.payments.create", "Record payments", []string{sa, tch, fin}},
+	{"finance.documents.send", "Email receipts and fee statements", []string{sa, tch, fin}},
+	{"finance.balance.view_own", "A student's own fee balance", []string{stu}},
+	{"finance.vote_heads.view", "View vote heads and fee structure items", []string{sa, fin}},
+	{"finance.vote_heads.manage", "Create, edit, reorder and delete vote heads and fee items", []string{sa, fin}},
+	{"finance.vote_heads.balances.view", "View a student's vote head balances", []string{sa, fin, par}},
+	{"finance.vote_heads.balances.initialize", "Initialise a student's vote head balances", []string{sa}},
+	{"finance.family_accounts.view", "List family accounts", []string{sa, fin}},
+	{"finance.family_accounts.manage", "Create and edit family accounts", []string{sa, fin}},
+	{"finance.family_accounts.view_own", "A guardian's own family account", []string{par}},
+	{"finance.family_accounts.receipts.view", "View family payment receipts", []string{sa, fin, par}},
+	{"finance.reports.view", "View and print the defaulters report", []string{sa, fin}},
+	{"finance.mpesa.view", "View M-PESA transactions and status queries", []string{sa, fin}},
+	{"finance.mpesa.match", "Match M-PESA transactions to students by hand", []string{sa, fin}},
+	{"finance.mpesa.query", "Query M-PESA transaction status", []string{sa, fin}},
+	{"finance.refunds.view", "List refunds", []string{sa, fin}},
+	{"finance.refunds.request", "Request refunds", []string{sa, fin}},
+	{"finance.refunds.approve", "Approve or reject refunds", []string{sa, fin}},
+
+	{"notifications.send", "Send notifications and see who acknowledged them", []string{sa, tch}},
+	{"notifications.delete", "Delete notifications", []string{sa}},
+	{"notifications.groups.view", "View notification groups", []string{sa, tch}},
+	{"notifications.groups.manage", "Create, edit and delete notification groups", []string{sa}},
+	{"sms.manage", "Send SMS and manage SMS settings, templates, inbox and opt-outs", []string{sa}},
+	{"email.manage", "Manage email settings and view the email log", []string{sa}},
+	{"whatsapp.manage", "Manage WhatsApp settings and templates", []string{sa}},
+
+	{"tickets.create", "Open support tickets", []string{sa, stu}},
+	{"tickets.view", "List support tickets", []string{sa, sup}},
+	{"tickets.view_own", "A student's own tickets", []string{stu}},
+	{"tickets.manage", "Update support tickets", []string{sup}},
+	{"platform.schools.manage", "Create and manage schools, their admins and SMS billing", []string{sup}},
+	{"platform.mpesa.manage", "Query the shared M-PESA paybill's balance and register its callback URLs", []string{sup}},
+}
+
+// IsPermission - Whether the name is in the catalogue
+func IsPermission(name string) bool {
+	_, ok := findPermission(name)
+	return ok
+}
+
+func findPermission(name string) (Permission, bool) {
+	for _, p := range Permissions {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Permission{}, false
+}
+
+// DefaultPermissions - The built-in bundle of a role
+func DefaultPermissions(role string) []string {
+	var names []string
+	for _, p := range Permissions {
+		if slices.Contains(p.Roles, role) {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// UserPermissions - What a user may do: their custom role's permissions if they have one, else their role's defaults
+// Custom roles apply to the home membership; other memberships (membershipID != 0) get the role's defaults
+func UserPermissions(userID, membershipID uint, role string) []string {
+	if membershipID != 0 {
+		return DefaultPermissions(role)
+	}
+	var user models.User
+	if models.DB.Select("id", "custom_role_id").First(&user, userID).Error != nil || user.CustomRoleID == nil {
+		return DefaultPermissions(role)
+	}
+	var custom models.CustomRole
+	if models.DB.First(&custom, *user.CustomRoleID).Error != nil {
+		return nil
+	}
+	return ParsePermissions(custom.Permissions)
+}
+
+// HasPermission - Whether the user may do it
+func HasPermission(userID, membershipID uint, role, permission string) bool {
+	return slices.Contains(UserPermissions(userID, membershipID, role), permission)
+}
+
+// ParsePermissions - Permission names from a comma-separated list
+func ParsePermissions(list string) []string {
+	var names []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			names = append(names, p)
+		}
+	}
+	return names
+}
+
+// ValidateCustomPermissions - Catalogue order without duplicates; platform permissions can't be given to school roles
+func ValidateCustomPermissions(names []string) ([]string, error) {
+	for _, name := range names {
+		p, ok := findPermission(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownPermission, name)
+		}
+		if p.Platform() {
+			return nil, fmt.Errorf("%w: %s", ErrPlatformPermission, name)
+		}
+	}
+	var valid []string
+	for _, p := range Permissions {
+		if slices.ContainsFunc(names, func(n string) bool { return strings.TrimSpace(n) == p.Name }) {
+			valid = append(valid, p.Name)
+		}
+	}
+	return valid, nil
+}
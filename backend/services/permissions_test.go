@@ -0,0 +1,37 @@
+package services_test
+
+import (
+	"errors"
+	"schoolms-go/services"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionCatalogue(t *testing.T) {
+	seen := map[string]bool{}
+	for _, p := range services.Permissions {
+		assert.False(t, seen[p.Name], "duplicate %s", p.Name)
+		seen[p.Name] = true
+		assert.NotEmpty(t, p.Roles, "%s has no default role", p.Name)
+		assert.Equal(t, strings.ToLower(p.Name), p.Name)
+	}
+
+	assert.Contains(t, services.DefaultPermissions("TEACHER"), "grades.publish")
+	assert.NotContains(t, services.DefaultPermissions("TEACHER"), "finance.reports.view")
+	assert.Contains(t, services.DefaultPermissions("PARENT"), "parents.view_own")
+	assert.Empty(t, services.DefaultPermissions("JANITOR"))
+}
+
+func TestValidateCustomPermissions(t *testing.T) {
+	valid, err := services.ValidateCustomPermissions([]string{"grades.view", " finance.fees.view", "grades.view"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"grades.view", "finance.fees.view"}, valid, "catalogue order, no duplicates")
+
+	_, err = services.ValidateCustomPermissions([]string{"finance.everything"})
+	assert.True(t, errors.Is(err, services.ErrUnknownPermission))
+	_, err = services.ValidateCustomPermissions([]string{"platform.schools.manage"})
+	assert.True(t, errors.Is(err, services.ErrPlatformPermission))
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"schoolms-go/models"
+	"strings"
+)
+
+// eastAfricanNumbering - Mobile prefixes and national number lengths by country code
+var eastAfricanNumbering = map[string]struct {
+	length   int
+	prefixes string // First digit of a mobile number
+}{
+	"254": {9, "71"},  // Kenya
+	"255": {9, "67"},  // Tanzania
+	"256": {9, "7"},   // Uganda
+	"250": {9, "7"},   // Rwanda
+	"257": {8, "67"},  // Burundi
+	"211": {9, "9"},   // South Sudan
+	"251": {9, "97"},  // Ethiopia
+	"252": {9, "679"}, // Somalia
+}
+
+// NormalizePhone - Phone number in E.164 (+254712345678), or "" if invalid
+// Local numbers (07..., 01..., 7...) are taken to be Kenyan; East African
+// country codes are checked for mobile prefix and length, other
+// international numbers only for E.164 length
+func NormalizePhone(phone string) string {
+	phone = strings.TrimSpace(phone)
+	international := strings.HasPrefix(phone, "+") || strings.HasPrefix(phone, "00")
+
+	digits := make([]byte, 0, len(phone))
+	for i := 0; i < len(phone); i++ {
+		switch ch := phone[i]; {
+		case ch >= '0' && ch <= '9':
+			digits = append(digits, ch)
+		case ch == '+' && i == 0, ch == ' ', ch == '-', ch == '(', ch == ')', ch == '.':
+		default:
+			return ""
+		}
+	}
+	number := string(digits)
+	if strings.HasPrefix(phone, "00") {
+		number = number[2:]
+	}
+
+	if !international {
+		switch {
+		case len(number) == 10 && number[0] == '0':
+			number = "254" + number[1:]
+		case len(number) == 9 && (number[0] == '7' || number[0] == '1'):
+			number = "254" + number
+		}
+	}
+
+	for code, rule := range eastAfricanNumbering {
+		if !strings.HasPrefix(number, code) {
+			continue
+		}
+		national := number[len(code):]
+		if len(national) != rule.length || !strings.ContainsRune(rule.prefixes, rune(national[0])) {
+			return ""
+		}
+		return "+" + number
+	}
+
+	if international && len(number) >= 8 && len(number) <= 15 && number[0] != '0' {
+		return "+" + number
+	}
+	return ""
+}
+
+// GuardianPhone - The number to text a guardian on, only if the school has verified it
+// A link-specific number wins over the parent's own account number
+func GuardianPhone(link models.ParentStudent) string {
+	if link.Phone != "" && link.PhoneVerified {
+		return link.Phone
+	}
+	if link.Parent.Phone != "" && link.Parent.PhoneVerified {
+		return link.Parent.Phone
+	}
+	return ""
+}
+
+// Guardian - Where and in which language to text a student's guardian
+type Guardian struct {
+	ParentID uint
+	Phone    string
+	Language string
+	Channel  string // SMS or WHATSAPP
+}
+
+// GuardiansForStudent - Guardians with a verified number, one entry per number
+func GuardiansForStudent(studentID uint) []Guardian {
+	var links []models.ParentStudent
+	models.DB.Where("student_id = ?", studentID).Preload("Parent").Order("id").Find(&links)
+
+	seen := make(map[string]bool)
+	var guardians []Guardian
+	for _, link := range links {
+		phone := GuardianPhone(link)
+		if phone == "" || seen[phone] {
+			continue
+		}
+		seen[phone] = true
+		language := link.Parent.Language
+		if language == "" {
+			language = models.LanguageEnglish
+		}
+		channel := link.Parent.MessageChannel
+		if channel == "" {
+			channel = models.ChannelSMS
+		}
+		guardians = append(guardians, Guardian{ParentID: link.ParentID, Phone: phone, Language: language, Channel: channel})
+	}
+	return guardians
+}
+
+// GuardianPhonesForStudent - Verified guardian numbers for one student, without duplicates
+func GuardianPhonesForStudent(studentID uint) []string {
+	var phones []string
+	for _, g := range GuardiansForStudent(studentID) {
+		phones = append(phones, g.Phone)
+	}
+	return phones
+}
@@ -0,0 +1,36 @@
+package services_test
+
+import (
+	"schoolms-go/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	cases := map[string]string{
+		"0712345678":         "+254712345678",
+		"0112 345 678":       "+254112345678",
+		"712345678":          "+254712345678",
+		"254712345678":       "+254712345678",
+		"+254 (712) 345-678": "+254712345678",
+		"+256772123456":      "+256772123456", // Uganda
+		"00255754123456":     "+255754123456", // Tanzania
+		"+250788123456":      "+250788123456", // Rwanda
+		"+25779123456":       "+25779123456",  // Burundi, 8 digits
+		"+447911123456":      "+447911123456", // Outside East Africa, E.164 only
+		"+2547123":           "",              // Too short for Kenya
+		"+256412123456":      "",              // Ugandan landline
+		"0812345678":         "",              // Not a Kenyan mobile prefix
+		"parent@school.com":  "",
+		"":                   "",
+	}
+	for input, want := range cases {
+		assert.Equal(t, want, services.NormalizePhone(input), input)
+	}
+}
+
+func TestNormalizeMSISDN(t *testing.T) {
+	assert.Equal(t, "254712345678", services.NormalizeMSISDN("0712 345 678"))
+	assert.Equal(t, "", services.NormalizeMSISDN("invalid"))
+}
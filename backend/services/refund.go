@@ -0,0 +1,255 @@
+package services
+
+import (
+	"errors"
+	"schoolms-go/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrRefundClaimed = errors.New("refund was already processed")
+	ErrRefundCredit  = errors.New("refund exceeds available credit")
+)
+
+// GetStudentCredit - Returns the student's refundable credit
+// Credit is the overpaid amount, i.e. a negative total vote head balance
+func GetStudentCredit(studentID, schoolID uint) (float64, error) {
+	return studentCredit(models.DB, studentID, schoolID)
+}
+
+// studentCredit - GetStudentCredit read inside a transaction
+func studentCredit(tx *gorm.DB, studentID, schoolID uint) (float64, error) {
+	var total float64
+	err := tx.Model(&models.VoteHeadBalance{}).
+		Joins("JOIN vote_heads ON vote_heads.id = vote_head_balances.vote_head_id").
+		Where("vote_head_balances.student_id = ? AND vote_head_balances.school_id = ?", studentID, schoolID).
+		Select("COALESCE(SUM(vote_head_balances.balance), 0)").
+		Scan(&total).Error
+	if err != nil {
+		return 0, err
+	}
+	if total >= 0 {
+		return 0, nil
+	}
+	return -total, nil
+}
+
+// ClaimRefund - Marks an approved refund PROCESSING before B2C is called, so it is only sent once
+// A CREDIT refund is checked again against the student's credit, less other CREDIT refunds already
+// sent but not yet applied; the student row is locked so two approvals can't spend the same credit
+func ClaimRefund(refund *models.Refund, approverID uint) error {
+	now := time.Now()
+	err := models.DB.Transaction(func(tx *gorm.DB) error {
+		if refund.Type == models.RefundTypeCredit {
+			var student models.Student
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&student, refund.StudentID).Error; err != nil {
+				return err
+			}
+			credit, err := studentCredit(tx, refund.StudentID, refund.SchoolID)
+			if err != nil {
+				return err
+			}
+			var inFlight float64
+			err = tx.Model(&models.Refund{}).
+				Where("student_id = ? AND school_id = ? AND type = ? AND status IN ? AND id <> ?",
+					refund.StudentID, refund.SchoolID, models.RefundTypeCredit,
+					[]string{models.RefundProcessing, models.RefundTimedOut}, refund.ID).
+				Select("COALESCE(SUM(amount), 0)").
+				Scan(&inFlight).Error
+			if err != nil {
+				return err
+			}
+			if refund.Amount > credit-inFlight+0.005 {
+				return ErrRefundCredit
+			}
+		}
+
+		result := tx.Model(&models.Refund{}).
+			Where("id = ? AND status = ?", refund.ID, models.RefundPendingApproval).
+			Updates(map[string]interface{}{
+				"status":      models.RefundProcessing,
+				"approved_by": approverID,
+				"approved_at": now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefundClaimed
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	refund.Status = models.RefundProcessing
+	refund.ApprovedBy = &approverID
+	refund.ApprovedAt = &now
+	return nil
+}
+
+// SettleRefund - Moves a sent refund (PROCESSING or TIMED_OUT) to its final status with the B2C result
+// Returns ErrRefundClaimed if another result callback settled it first
+func SettleRefund(refund *models.Refund, status string) error {
+	if err := settleRefund(models.DB, refund, status); err != nil {
+		return err
+	}
+	refund.Status = status
+	return nil
+}
+
+// settleRefund - The conditional update behind SettleRefund and ApplyRefund
+// Safaricom may send the same result twice, possibly at once; only one of them finds the refund still open
+func settleRefund(tx *gorm.DB, refund *models.Refund, status string) error {
+	result := tx.Model(&models.Refund{}).
+		Where("id = ? AND status IN ?", refund.ID, []string{models.RefundProcessing, models.RefundTimedOut}).
+		Updates(map[string]interface{}{
+			"status":         status,
+			"result_code":    refund.ResultCode,
+			"result_desc":    refund.ResultDesc,
+			"transaction_id": refund.TransactionID,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRefundClaimed
+	}
+	return nil
+}
+
+// ApplyRefund - Marks a paid B2C refund COMPLETED and records it against the student's ledger, in one transaction
+// REVERSAL: restores the vote head balances the original payment cleared
+// CREDIT: reduces the student's credit (negative vote head balances)
+// In both cases a negative payment is recorded so payment totals stay correct
+// Returns ErrRefundClaimed, writing nothing, if the refund was already settled
+func ApplyRefund(refund *models.Refund) (*models.Payment, error) {
+	var reversal models.Payment
+
+	err := models.DB.Transaction(func(tx *gorm.DB) error {
+		if err := settleRefund(tx, refund, models.RefundCompleted); err != nil {
+			return err
+		}
+
+		switch refund.Type {
+		case models.RefundTypeReversal:
+			if err := restorePaymentBalances(tx, refund); err != nil {
+				return err
+			}
+		case models.RefundTypeCredit:
+			if err := reduceStudentCredit(tx, refund.StudentID, refund.SchoolID, refund.Amount); err != nil {
+				return err
+			}
+		default:
+			return errors.New("unknown refund type")
+		}
+
+		reference := refund.TransactionID
+		if reference == "" {
+			reference = refund.ConversationID
+		}
+		reversal = models.Payment{
+			StudentID: refund.StudentID,
+			SchoolID:  refund.SchoolID,
+			Amount:    -refund.Amount,
+			Method:    "MPESA_REFUND",
+			Reference: reference,
+		}
+		if err := tx.Create(&reversal).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Refund{}).Where("id = ?", refund.ID).Update("reversal_payment_id", reversal.ID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refund.Status = models.RefundCompleted
+	refund.ReversalPaymentID = &reversal.ID
+	return &reversal, nil
+}
+
+// restorePaymentBalances - Undo the vote head allocation of a reversed payment
+func restorePaymentBalances(tx *gorm.DB, refund *models.Refund) error {
+	if refund.PaymentID == nil {
+		return errors.New("reversal refund has no payment")
+	}
+
+	var payment models.Payment
+	if err := tx.Where("id = ? AND school_id = ?", *refund.PaymentID, refund.SchoolID).First(&payment).Error; err != nil {
+		return err
+	}
+
+	var allocations []models.PaymentAllocation
+	tx.Where("payment_id = ?", payment.ID).Find(&allocations)
+
+	now := time.Now()
+	allocated := 0.0
+	for _, alloc := range allocations {
+		allocated += alloc.Amount
+		tx.Model(&models.VoteHeadBalance{}).
+			Where("student_id = ? AND vote_head_id = ? AND school_id = ?", payment.StudentID, alloc.VoteHeadID, refund.SchoolID).
+			Updates(map[string]interface{}{
+				"balance":      gorm.Expr("balance + ?", alloc.Amount),
+				"last_updated": now,
+			})
+	}
+
+	// Any overpayment was left as credit on the lowest priority vote head
+	if credit := payment.Amount - allocated; credit > 0 {
+		var last models.VoteHeadBalance
+		err := tx.
+			Joins("JOIN vote_heads ON vote_heads.id = vote_head_balances.vote_head_id").
+			Where("vote_head_balances.student_id = ? AND vote_head_balances.school_id = ?", payment.StudentID, refund.SchoolID).
+			Where("vote_heads.is_active = ?", true).
+			Order("vote_heads.priority DESC").
+			First(&last).Error
+		if err == nil {
+			last.Balance += credit
+			last.LastUpdated = now
+			tx.Save(&last)
+		}
+	}
+
+	return nil
+}
+
+// reduceStudentCredit - Moves negative vote head balances back towards zero
+// Lowest priority vote heads are drawn down first, mirroring where overpayments land
+func reduceStudentCredit(tx *gorm.DB, studentID, schoolID uint, amount float64) error {
+	var balances []models.VoteHeadBalance
+	err := tx.
+		Joins("JOIN vote_heads ON vote_heads.id = vote_head_balances.vote_head_id").
+		Where("vote_head_balances.student_id = ? AND vote_head_balances.school_id = ?", studentID, schoolID).
+		Where("vote_head_balances.balance < ?", 0).
+		Order("vote_heads.priority DESC").
+		Find(&balances).Error
+	if err != nil {
+		return err
+	}
+
+	remaining := amount
+	now := time.Now()
+	for i := range balances {
+		if remaining <= 0 {
+			break
+		}
+		balance := &balances[i]
+		take := -balance.Balance
+		if remaining < take {
+			take = remaining
+		}
+		balance.Balance += take
+		balance.LastUpdated = now
+		tx.Save(balance)
+		remaining -= take
+	}
+
+	if remaining > 0.005 {
+		return errors.New("refund exceeds available credit")
+	}
+	return nil
+}
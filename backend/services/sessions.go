@@ -0,0 +1,189 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"schoolms-go/models"
+	"schoolms-go/utils"
+	"time"
+)
+
+// RefreshTokenTTL - How long a session survives without being refreshed
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrAccountDeactivated  = errors.New("account deactivated")
+)
+
+// TokenPair - What a client holds for a session
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // Seconds until the access token expires
+}
+
+// StartSession - Sign the user in on a new device
+func StartSession(user models.User, ip, userAgent string) (TokenPair, models.UserSession, error) {
+	if user.DeactivatedAt != nil {
+		return TokenPair{}, models.UserSession{}, ErrAccountDeactivated
+	}
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return TokenPair{}, models.UserSession{}, err
+	}
+	now := time.Now()
+	session := models.UserSession{
+		UserID:           user.ID,
+		RefreshTokenHash: hashToken(refresh),
+		IPAddress:        ip,
+		UserAgent:        userAgent,
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(RefreshTokenTTL),
+	}
+	if err := models.DB.Create(&session).Error; err != nil {
+		return TokenPair{}, session, err
+	}
+	pair, err := tokenPair(user, session, refresh)
+	return pair, session, err
+}
+
+// RefreshSession - Swap a refresh token for a new pair; the old refresh token stops working
+// Presenting a refresh token that was already swapped means it was copied, so the whole session is revoked
+func RefreshSession(refreshToken, ip, userAgent string) (TokenPair, models.User, error) {
+	var user models.User
+	if refreshToken == "" {
+		return TokenPair{}, user, ErrInvalidRefreshToken
+	}
+	hash := hashToken(refreshToken)
+
+	var session models.UserSession
+	if err := models.DB.Where("refresh_token_hash = ?", hash).First(&session).Error; err != nil {
+		var reused models.UserSession
+		if models.DB.Where("previous_token_hash = ?", hash).First(&reused).Error == nil {
+			RevokeSession(reused.ID, models.SessionRevokedTokenReuse)
+		}
+		return TokenPair{}, user, ErrInvalidRefreshToken
+	}
+	if session.RevokedAt != nil || session.ExpiresAt.Before(time.Now()) {
+		return TokenPair{}, user, ErrInvalidRefreshToken
+	}
+	if err := models.DB.First(&user, session.UserID).Error; err != nil {
+		return TokenPair{}, user, ErrInvalidRefreshToken
+	}
+	if user.DeactivatedAt != nil {
+		RevokeSession(session.ID, models.SessionRevokedUserDeactivated)
+		return TokenPair{}, user, ErrAccountDeactivated
+	}
+
+	next, err := newRefreshToken()
+	if err != nil {
+		return TokenPair{}, user, err
+	}
+	now := time.Now()
+	// Conditional on the current hash so two concurrent refreshes can't both win
+	swap := models.DB.Model(&models.UserSession{}).
+		Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL", session.ID, hash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash":  hashToken(next),
+			"previous_token_hash": hash,
+			"ip_address":          ip,
+			"user_agent":          userAgent,
+			"last_used_at":        now,
+			"expires_at":          now.Add(RefreshTokenTTL),
+		})
+	if swap.Error != nil || swap.RowsAffected == 0 {
+		return TokenPair{}, user, ErrInvalidRefreshToken
+	}
+	pair, err := tokenPair(user, session, next)
+	return pair, user, err
+}
+
+// SessionUser - The user behind an active session; false once the session is revoked or expired or the user deactivated
+func SessionUser(sessionID, userID uint) (models.User, bool) {
+	var user models.User
+	err := models.DB.Joins("JOIN user_sessions ON user_sessions.user_id = users.id").
+		Where("user_sessions.id = ? AND users.id = ?", sessionID, userID).
+		Where("user_sessions.revoked_at IS NULL AND user_sessions.expires_at > ? AND users.deactivated_at IS NULL", time.Now()).
+		First(&user).Error
+	return user, err == nil
+}
+
+// SessionActive - Whether the session, and the membership it acts as (0 for none), would still let a request in
+// Long-lived connections such as the event stream check this again as they run
+func SessionActive(sessionID, userID, membershipID uint) bool {
+	if _, ok := SessionUser(sessionID, userID); !ok {
+		return false
+	}
+	return membershipID == 0 || MembershipActive(membershipID, userID)
+}
+
+// RevokeSession - Sign one device out; returns false if it was already revoked
+func RevokeSession(sessionID uint, reason string) bool {
+	result := models.DB.Model(&models.UserSession{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoked_reason": reason})
+	return result.RowsAffected > 0
+}
+
+// EndSession - Sign out the device holding the refresh token; false if it matches no active session
+func EndSession(refreshToken string) bool {
+	if refreshToken == "" {
+		return false
+	}
+	result := models.DB.Model(&models.UserSession{}).
+		Where("refresh_token_hash = ? AND revoked_at IS NULL", hashToken(refreshToken)).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoked_reason": models.SessionRevokedLogout})
+	return result.RowsAffected > 0
+}
+
+// RevokeUserSessions - Sign the user out everywhere except exceptSessionID (0 for none); returns how many
+func RevokeUserSessions(userID uint, reason string, exceptSessionID uint) int64 {
+	result := models.DB.Model(&models.UserSession{}).
+		Where("user_id = ? AND revoked_at IS NULL AND id <> ?", userID, exceptSessionID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoked_reason": reason})
+	return result.RowsAffected
+}
+
+// ActiveSessions - The user's signed-in devices, most recently used first
+func ActiveSessions(userID uint) []models.UserSession {
+	var sessions []models.UserSession
+	models.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").Find(&sessions)
+	return sessions
+}
+
+func tokenPair(user models.User, session models.UserSession, refresh string) (TokenPair, error) {
+	access, err := accessToken(user, session.ID, sessionMembership(user, session))
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(utils.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+func accessToken(user models.User, sessionID uint, active ActiveMembership) (string, error) {
+	return utils.GenerateAccessToken(user.ID, active.Role, active.SchoolID, sessionID, active.ID)
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken - Refresh tokens are stored hashed so a database leak doesn't hand out sessions
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,14 +1,12 @@
 package services
 
 import (
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"net/url"
 	"os"
 	"schoolms-go/models"
 	"strings"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 // SMSConfig - Africa's Talking configuration
@@ -28,199 +26,139 @@ func init() {
 		ShortCode: os.Getenv("AT_SHORTCODE"),
 		Env:       os.Getenv("AT_ENV"),
 	}
+	if smsConfig.ShortCode == "" {
+		smsConfig.ShortCode = os.Getenv("AT_SENDER_ID")
+	}
 	if smsConfig.Env == "" {
 		smsConfig.Env = "sandbox"
 	}
+	defaultSMSProvider = providerFromEnv()
 }
 
 // SMSMessage - Single SMS to send
 type SMSMessage struct {
-	To      string
-	Message string
+	To       string
+	Message  string
+	WhatsApp *WhatsAppTemplateMessage // Send as this WhatsApp template instead, with Message as the SMS fallback
 }
 
 // SMSResult - Result of sending SMS
 type SMSResult struct {
-	Success bool
-	Status  string
-	Cost    string
-	Error   string
+	Success   bool
+	Status    string
+	Cost      string
+	Error     string
+	Provider  string
+	MessageID string  // Provider's ID, used to match delivery reports
+	Segments  int     // SMS parts billed
+	Charged   float64 // Debited from the school's SMS wallet
 }
 
-// SendSMS - Send a single SMS via Africa's Talking
+// SendSMS - Send a single SMS through the server-wide provider
 func SendSMS(to, message string) SMSResult {
-	if smsConfig.APIKey == "" {
-		return SMSResult{Success: false, Error: "SMS not configured"}
-	}
-
-	// Format phone number (Kenya format)
-	to = formatKenyanPhone(to)
-	if to == "" {
-		return SMSResult{Success: false, Error: "Invalid phone number"}
-	}
+	return SendSMSWith(DefaultSMSProvider(), to, message)
+}
 
-	baseURL := "https://api.sandbox.africastalking.com"
-	if smsConfig.Env == "production" {
-		baseURL = "https://api.africastalking.com"
+// SendSchoolSMS - Send a single SMS through the school's configured provider
+// The message is charged to the school's SMS wallet and refunded if the provider rejects it
+func SendSchoolSMS(schoolID uint, to, message string) SMSResult {
+	if IsOptedOut(schoolID, to) {
+		return SMSResult{Success: false, Error: "Recipient opted out"}
 	}
-
-	data := url.Values{}
-	data.Set("username", smsConfig.Username)
-	data.Set("to", to)
-	data.Set("message", message)
-	if smsConfig.ShortCode != "" {
-		data.Set("from", smsConfig.ShortCode)
+	provider := SMSProviderForSchool(schoolID)
+	if provider == nil || NormalizePhone(to) == "" {
+		return SendSMSWith(provider, to, message)
 	}
 
-	req, _ := http.NewRequest("POST", baseURL+"/version1/messaging", strings.NewReader(data.Encode()))
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("apiKey", smsConfig.APIKey)
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	wallet, err := GetSMSWallet(schoolID)
 	if err != nil {
-		return SMSResult{Success: false, Error: err.Error()}
+		return SMSResult{Success: false, Error: "SMS wallet unavailable"}
 	}
-	defer resp.Body.Close()
-
-	var result struct {
-		SMSMessageData struct {
-			Message    string `json:"Message"`
-			Recipients []struct {
-				Cost       string `json:"cost"`
-				Status     string `json:"status"`
-				StatusCode int    `json:"statusCode"`
-			} `json:"Recipients"`
-		} `json:"SMSMessageData"`
+	segments, charge := SMSChargeFor(wallet, message)
+	err = models.DB.Transaction(func(tx *gorm.DB) error {
+		return ChargeSMSCredit(tx, schoolID, charge, segments, nil, "SMS to "+NormalizePhone(to))
+	})
+	if err != nil {
+		return SMSResult{Success: false, Error: "Insufficient SMS credit", Provider: provider.Name(), Segments: segments}
 	}
 
-	json.NewDecoder(resp.Body).Decode(&result)
-
-	if len(result.SMSMessageData.Recipients) > 0 {
-		r := result.SMSMessageData.Recipients[0]
-		success := r.StatusCode == 101 || r.Status == "Success"
-		return SMSResult{
-			Success: success,
-			Status:  r.Status,
-			Cost:    r.Cost,
-		}
+	result := SendSMSWith(provider, to, message)
+	result.Segments = segments
+	if result.Success {
+		result.Charged = charge
+	} else {
+		RefundSMSCredit(schoolID, charge, nil, "Failed SMS to "+NormalizePhone(to))
 	}
-
-	return SMSResult{Success: false, Error: "No recipient response"}
+	return result
 }
 
-// SendBulkSMS - Send SMS to multiple recipients with worker pool
-func SendBulkSMS(messages []SMSMessage) []SMSResult {
-	results := make([]SMSResult, len(messages))
-
-	// Use worker pool for bulk sending (max 5 concurrent)
-	workers := 5
-	jobs := make(chan int, len(messages))
-	done := make(chan bool)
-
-	for w := 0; w < workers; w++ {
-		go func() {
-			for i := range jobs {
-				results[i] = SendSMS(messages[i].To, messages[i].Message)
-				time.Sleep(100 * time.Millisecond) // Rate limit
-			}
-			done <- true
-		}()
+// SendSMSWith - Normalise the phone number and hand the message to a provider
+func SendSMSWith(provider SMSProvider, to, message string) SMSResult {
+	if provider == nil {
+		return SMSResult{Success: false, Error: "SMS not configured"}
 	}
 
-	for i := range messages {
-		jobs <- i
+	// Format phone number (E.164)
+	to = NormalizePhone(to)
+	if to == "" {
+		return SMSResult{Success: false, Error: "Invalid phone number", Provider: provider.Name()}
 	}
-	close(jobs)
 
-	for w := 0; w < workers; w++ {
-		<-done
-	}
+	result := provider.Send(to, message)
+	result.Provider = provider.Name()
+	return result
+}
 
-	return results
+// NormalizeMSISDN - Phone in 2547XXXXXXXX format as used by M-PESA
+func NormalizeMSISDN(phone string) string {
+	return strings.TrimPrefix(NormalizePhone(phone), "+")
 }
 
-// formatKenyanPhone - Ensure phone is in +254XXXXXXXXX format
-func formatKenyanPhone(phone string) string {
-	phone = strings.TrimSpace(phone)
-	phone = strings.ReplaceAll(phone, " ", "")
-	phone = strings.ReplaceAll(phone, "-", "")
+// --- SMS Templates ---
 
-	if strings.HasPrefix(phone, "+") {
-		return phone
-	}
-	if strings.HasPrefix(phone, "254") {
-		return "+" + phone
-	}
-	if strings.HasPrefix(phone, "0") {
-		return "+254" + phone[1:]
-	}
-	if strings.HasPrefix(phone, "7") || strings.HasPrefix(phone, "1") {
-		return "+254" + phone
+// SendTemplatedSMS - Render a school's template in the recipient's language and send it
+func SendTemplatedSMS(schoolID uint, phone, language, template string, fields MergeFields) SMSResult {
+	message, err := RenderMessage(schoolID, template, language, fields)
+	if err != nil {
+		return SMSResult{Success: false, Error: err.Error()}
 	}
-	return ""
+	return SendSchoolSMS(schoolID, phone, message)
 }
 
-// --- SMS Templates ---
-
 // SendPaymentConfirmation - Send payment receipt SMS
-func SendPaymentConfirmation(phone, studentName string, amount float64, balance float64) SMSResult {
-	message := fmt.Sprintf(
-		"Payment of KES %.2f received for %s. New balance: KES %.2f. Thank you! - SchoolMS",
-		amount, studentName, balance,
-	)
-	return SendSMS(phone, message)
+func SendPaymentConfirmation(schoolID uint, guardian Guardian, fields MergeFields) SMSResult {
+	return SendTemplatedSMS(schoolID, guardian.Phone, guardian.Language, models.TemplatePaymentConfirmation, fields)
 }
 
 // SendAttendanceAlert - Send absence notification to parent
-func SendAttendanceAlert(phone, studentName, date string) SMSResult {
-	message := fmt.Sprintf(
-		"Alert: %s was marked ABSENT on %s. Please contact the school. - SchoolMS",
-		studentName, date,
-	)
-	return SendSMS(phone, message)
+func SendAttendanceAlert(schoolID uint, guardian Guardian, fields MergeFields) SMSResult {
+	return SendTemplatedSMS(schoolID, guardian.Phone, guardian.Language, models.TemplateAttendanceAlert, fields)
 }
 
 // SendFeeReminder - Send fee balance reminder
-func SendFeeReminder(phone, studentName string, balance float64) SMSResult {
-	message := fmt.Sprintf(
-		"Reminder: %s has an outstanding fee balance of KES %.2f. Please pay via M-PESA PayBill. - SchoolMS",
-		studentName, balance,
-	)
-	return SendSMS(phone, message)
-}
-
-// SendBroadcast - Send school-wide announcement
-func SendBroadcast(phone, schoolName, announcement string) SMSResult {
-	message := fmt.Sprintf("%s: %s", schoolName, announcement)
-	if len(message) > 160 {
-		message = message[:157] + "..."
-	}
-	return SendSMS(phone, message)
-}
-
-// LogSMS - Log SMS to database
-type SMSLog struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	SchoolID  uint      `gorm:"index" json:"school_id"`
-	To        string    `json:"to"`
-	Message   string    `json:"message"`
-	Status    string    `json:"status"`
-	Cost      string    `json:"cost"`
-	Error     string    `json:"error"`
-	CreatedAt time.Time `json:"created_at"`
+func SendFeeReminder(schoolID uint, guardian Guardian, fields MergeFields) SMSResult {
+	return SendTemplatedSMS(schoolID, guardian.Phone, guardian.Language, models.TemplateFeeReminder, fields)
 }
 
+// LogSMSSent - Log SMS to database
 func LogSMSSent(schoolID uint, to, message string, result SMSResult) {
-	log := SMSLog{
-		SchoolID:  schoolID,
-		To:        to,
-		Message:   message,
-		Status:    result.Status,
-		Cost:      result.Cost,
-		Error:     result.Error,
-		CreatedAt: time.Now(),
+	segments := result.Segments
+	if segments == 0 && result.Provider != models.SMSProviderWhatsApp {
+		segments, _ = SMSSegments(message)
+	}
+	log := models.SMSLog{
+		SchoolID:          schoolID,
+		To:                to,
+		Message:           message,
+		Provider:          result.Provider,
+		ProviderMessageID: result.MessageID,
+		Status:            result.Status,
+		Cost:              result.Cost,
+		CostAmount:        ParseSMSCost(result.Cost),
+		Segments:          segments,
+		Charged:           result.Charged,
+		Error:             result.Error,
+		CreatedAt:         time.Now(),
 	}
 	models.DB.Create(&log)
 }
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"os"
+	"schoolms-go/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrInsufficientSMSCredit - A prepaid school's wallet can't cover the send
+var ErrInsufficientSMSCredit = errors.New("insufficient SMS credit")
+
+// defaultSMSBillingMode - Billing mode for new wallets (SMS_BILLING_MODE, default POSTPAID)
+func defaultSMSBillingMode() string {
+	if strings.EqualFold(os.Getenv("SMS_BILLING_MODE"), models.SMSBillingPrepaid) {
+		return models.SMSBillingPrepaid
+	}
+	return models.SMSBillingPostpaid
+}
+
+// GetSMSWallet - The school's wallet, created empty on first use
+func GetSMSWallet(schoolID uint) (models.SMSWallet, error) {
+	var wallet models.SMSWallet
+	err := models.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.SMSWallet{
+		SchoolID:    schoolID,
+		BillingMode: defaultSMSBillingMode(),
+	}).Error
+	if err != nil {
+		return wallet, err
+	}
+	err = models.DB.Where("school_id = ?", schoolID).First(&wallet).Error
+	return wallet, err
+}
+
+// SMSPrice - What the school pays per SMS part
+func SMSPrice(wallet models.SMSWallet) float64 {
+	if wallet.PricePerSegment > 0 {
+		return wallet.PricePerSegment
+	}
+	return SMSCostPerSegment()
+}
+
+// SMSChargeFor - Parts and price of one message at the wallet's rate
+func SMSChargeFor(wallet models.SMSWallet, message string) (int, float64) {
+	segments, _ := SMSSegments(message)
+	return segments, roundKES(float64(segments) * SMSPrice(wallet))
+}
+
+// SMSEstimate - What a batch would cost against the school's balance
+type SMSEstimate struct {
+	Messages    int     `json:"messages"`
+	Segments    int     `json:"segments"`
+	Cost        float64 `json:"cost"`
+	Balance     float64 `json:"balance"`
+	BillingMode string  `json:"billing_mode"`
+	Sufficient  bool    `json:"sufficient"`
+}
+
+// EstimateSMSCost - Price a batch before queueing it; unsendable numbers aren't counted
+func EstimateSMSCost(schoolID uint, messages []SMSMessage) (SMSEstimate, error) {
+	wallet, err := GetSMSWallet(schoolID)
+	if err != nil {
+		return SMSEstimate{}, err
+	}
+
+	estimate := SMSEstimate{Balance: wallet.Balance, BillingMode: wallet.BillingMode}
+	for _, m := range messages {
+		if NormalizePhone(m.To) == "" || IsOptedOut(schoolID, m.To) || m.WhatsApp != nil {
+			continue // WhatsApp is only charged if it falls back to SMS
+		}
+		segments, charge := SMSChargeFor(wallet, m.Message)
+		estimate.Messages++
+		estimate.Segments += segments
+		estimate.Cost += charge
+	}
+	estimate.Cost = roundKES(estimate.Cost)
+	estimate.Sufficient = wallet.BillingMode != models.SMSBillingPrepaid || estimate.Cost <= wallet.Balance
+	return estimate, nil
+}
+
+// ChargeSMSCredit - Debit a send from the wallet inside tx
+// Prepaid wallets refuse to go below zero
+func ChargeSMSCredit(tx *gorm.DB, schoolID uint, amount float64, segments int, jobID *uint, description string) error {
+	if amount <= 0 {
+		return nil
+	}
+	return applySMSCredit(tx, &models.SMSCreditTransaction{
+		SchoolID:    schoolID,
+		Type:        models.SMSCreditCharge,
+		Amount:      -amount,
+		Segments:    segments,
+		JobID:       jobID,
+		Description: description,
+	}, true)
+}
+
+// RefundSMSCredit - Give back the charge for a message that was never delivered
+func RefundSMSCredit(schoolID uint, amount float64, jobID *uint, description string) error {
+	if amount <= 0 {
+		return nil
+	}
+	return models.DB.Transaction(func(tx *gorm.DB) error {
+		return applySMSCredit(tx, &models.SMSCreditTransaction{
+			SchoolID:    schoolID,
+			Type:        models.SMSCreditRefund,
+			Amount:      amount,
+			JobID:       jobID,
+			Description: description,
+		}, false)
+	})
+}
+
+// TopUpSMSCredit - Add credit (or correct it with a negative adjustment) on a superadmin's say-so
+func TopUpSMSCredit(schoolID uint, amount float64, reference, description string, createdBy uint) (models.SMSCreditTransaction, error) {
+	txn := models.SMSCreditTransaction{
+		SchoolID:    schoolID,
+		Type:        models.SMSCreditTopUp,
+		Amount:      roundKES(amount),
+		Reference:   reference,
+		Description: description,
+		CreatedBy:   createdBy,
+	}
+	if amount < 0 {
+		txn.Type = models.SMSCreditAdjustment
+	}
+	err := models.DB.Transaction(func(tx *gorm.DB) error {
+		return applySMSCredit(tx, &txn, false)
+	})
+	return txn, err
+}
+
+// applySMSCredit - Move the balance and record the transaction
+// The balance check is part of the UPDATE so concurrent sends can't overspend
+func applySMSCredit(tx *gorm.DB, txn *models.SMSCreditTransaction, enforce bool) error {
+	wallet := models.SMSWallet{SchoolID: txn.SchoolID, BillingMode: defaultSMSBillingMode()}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&wallet).Error; err != nil {
+		return err
+	}
+
+	update := tx.Model(&models.SMSWallet{}).Where("school_id = ?", txn.SchoolID)
+	if enforce && txn.Amount < 0 {
+		update = update.Where("(billing_mode <> ? OR balance + ? >= 0)", models.SMSBillingPrepaid, txn.Amount)
+	}
+	result := update.Updates(map[string]interface{}{
+		"balance":    gorm.Expr("balance + ?", txn.Amount),
+		"updated_at": time.Now(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInsufficientSMSCredit
+	}
+
+	if err := tx.Where("school_id = ?", txn.SchoolID).First(&wallet).Error; err != nil {
+		return err
+	}
+	txn.BalanceAfter = wallet.Balance
+	return tx.Create(txn).Error
+}
+
+// ParseSMSCost - Provider cost text such as "KES 0.8000" as a number
+func ParseSMSCost(cost string) float64 {
+	fields := strings.Fields(cost)
+	for i := len(fields) - 1; i >= 0; i-- {
+		if v, err := strconv.ParseFloat(fields[i], 64); err == nil {
+			return v
+		}
+	}
+	return 0
+}
+
+// SMSStatement - A school's SMS usage and credit movements for one period
+type SMSStatement struct {
+	SchoolID       uint      `json:"school_id"`
+	SchoolName     string    `json:"school_name"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	BillingMode    string    `json:"billing_mode"`
+	OpeningBalance float64   `json:"opening_balance"`
+	TopUps         float64   `json:"top_ups"`
+	Charges        float64   `json:"charges"` // Net of refunds
+	Adjustments    float64   `json:"adjustments"`
+	ClosingBalance float64   `json:"closing_balance"`
+	MessagesSent   int64     `json:"messages_sent"`
+	Segments       int64     `json:"segments"`
+	ProviderCost   float64   `json:"provider_cost"` // What the providers billed the platform
+	AmountDue      float64   `json:"amount_due"`    // Charges to invoice for postpaid schools
+}
+
+// MonthlySMSStatement - Statement for the calendar month containing month
+func MonthlySMSStatement(schoolID uint, month time.Time) (SMSStatement, error) {
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, month.Location())
+	return BuildSMSStatement(schoolID, from, from.AddDate(0, 1, 0))
+}
+
+// BuildSMSStatement - Usage between from (inclusive) and to (exclusive)
+func BuildSMSStatement(schoolID uint, from, to time.Time) (SMSStatement, error) {
+	statement := SMSStatement{SchoolID: schoolID, From: from, To: to}
+
+	var school models.School
+	models.DB.Select("id", "name").First(&school, schoolID)
+	statement.SchoolName = school.Name
+
+	wallet, err := GetSMSWallet(schoolID)
+	if err != nil {
+		return statement, err
+	}
+	statement.BillingMode = wallet.BillingMode
+
+	var last models.SMSCreditTransaction
+	if models.DB.Where("school_id = ? AND created_at < ?", schoolID, from).Order("created_at DESC, id DESC").First(&last).Error == nil {
+		statement.OpeningBalance = last.BalanceAfter
+	}
+
+	var totals []struct {
+		Type  string
+		Total float64
+	}
+	models.DB.Model(&models.SMSCreditTransaction{}).
+		Select("type, SUM(amount) as total").
+		Where("school_id = ? AND created_at >= ? AND created_at < ?", schoolID, from, to).
+		Group("type").Scan(&totals)
+	for _, t := range totals {
+		switch t.Type {
+		case models.SMSCreditTopUp:
+			statement.TopUps += t.Total
+		case models.SMSCreditCharge, models.SMSCreditRefund:
+			statement.Charges -= t.Total
+		case models.SMSCreditAdjustment:
+			statement.Adjustments += t.Total
+		}
+	}
+	statement.TopUps = roundKES(statement.TopUps)
+	statement.Charges = roundKES(statement.Charges)
+	statement.Adjustments = roundKES(statement.Adjustments)
+	statement.ClosingBalance = roundKES(statement.OpeningBalance + statement.TopUps - statement.Charges + statement.Adjustments)
+
+	var usage struct {
+		Messages     int64
+		Segments     int64
+		ProviderCost float64
+	}
+	models.DB.Model(&models.SMSLog{}).
+		Select("COUNT(*) as messages, COALESCE(SUM(segments), 0) as segments, COALESCE(SUM(cost_amount), 0) as provider_cost").
+		Where("school_id = ? AND (error = '' OR error IS NULL) AND (provider IS NULL OR provider <> ?) AND created_at >= ? AND created_at < ?",
+			schoolID, models.SMSProviderWhatsApp, from, to).
+		Scan(&usage)
+	statement.MessagesSent = usage.Messages
+	statement.Segments = usage.Segments
+	statement.ProviderCost = math.Round(usage.ProviderCost*10000) / 10000
+
+	if wallet.BillingMode == models.SMSBillingPostpaid {
+		statement.AmountDue = statement.Charges
+	}
+	return statement, nil
+}
+
+func roundKES(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
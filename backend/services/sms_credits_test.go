@@ -0,0 +1,113 @@
+package services_test
+
+import (
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func setupSMSCreditTest(t *testing.T) *gorm.DB {
+	db := setupTestDB(t)
+	db.AutoMigrate(&models.SMSSettings{}, &models.SMSLog{}, &models.MessageJob{}, &models.OutboundMessage{},
+		&models.SMSWallet{}, &models.SMSCreditTransaction{})
+	t.Cleanup(func() { sqlDB, _ := db.DB(); sqlDB.Close() })
+	t.Setenv("SMS_COST_PER_SEGMENT", "1")
+	return db
+}
+
+func TestParseSMSCost(t *testing.T) {
+	assert.Equal(t, 0.8, services.ParseSMSCost("KES 0.8000"))
+	assert.Equal(t, 1.5, services.ParseSMSCost("1.5"))
+	assert.Equal(t, 0.0, services.ParseSMSCost(""))
+	assert.Equal(t, 0.0, services.ParseSMSCost("KES"))
+}
+
+func TestSMSCredits_PrepaidWalletBlocksOverspend(t *testing.T) {
+	db := setupSMSCreditTest(t)
+	t.Setenv("SMS_BILLING_MODE", "prepaid")
+
+	provider := &services.MemorySMSProvider{}
+	services.SetDefaultSMSProvider(provider)
+	defer services.SetDefaultSMSProvider(nil)
+
+	_, err := services.TopUpSMSCredit(1, 3, "INV-1", "", 99)
+	assert.NoError(t, err)
+
+	// Two single-part messages and one two-part message cost 4 against a balance of 3
+	long := strings.Repeat("a", 200)
+	msgs := []services.SMSMessage{{To: "0700000001", Message: "Hi"}, {To: "0700000002", Message: "Hi"}, {To: "0700000003", Message: long}}
+	estimate, _ := services.EstimateSMSCost(1, msgs)
+	assert.Equal(t, 4, estimate.Segments)
+	assert.Equal(t, 4.0, estimate.Cost)
+	assert.False(t, estimate.Sufficient)
+
+	_, err = services.EnqueueMessages(1, 1, models.MessageJobBroadcast, msgs)
+	assert.ErrorIs(t, err, services.ErrInsufficientSMSCredit)
+	var queued int64
+	db.Model(&models.OutboundMessage{}).Count(&queued)
+	assert.Zero(t, queued)
+
+	job, err := services.EnqueueMessages(1, 1, models.MessageJobBroadcast, msgs[:2])
+	assert.NoError(t, err)
+	wallet, _ := services.GetSMSWallet(1)
+	assert.Equal(t, 1.0, wallet.Balance) // Reserved at enqueue
+
+	services.ProcessOutbox(10)
+	var log models.SMSLog
+	db.First(&log)
+	assert.Equal(t, 1.0, log.Charged)
+	assert.Equal(t, 1, log.Segments)
+
+	var done models.MessageJob
+	db.First(&done, job.ID)
+	assert.Equal(t, 2, done.Sent)
+
+	// A single send is blocked once the balance runs out
+	result := services.SendSchoolSMS(1, "0700000001", long)
+	assert.False(t, result.Success)
+	assert.Equal(t, "Insufficient SMS credit", result.Error)
+	assert.Len(t, provider.Sent(), 2)
+}
+
+func TestSMSCredits_UndeliveredMessagesAreRefunded(t *testing.T) {
+	db := setupSMSCreditTest(t)
+
+	provider := &flakyProvider{failOnce: map[string]bool{"+254700000002": true}}
+	services.SetDefaultSMSProvider(provider)
+	defer services.SetDefaultSMSProvider(nil)
+
+	job, err := services.EnqueueMessages(1, 1, models.MessageJobBroadcast, []services.SMSMessage{
+		{To: "0700000001", Message: "Hello"},
+		{To: "0700000002", Message: "Hello"},
+	})
+	assert.NoError(t, err)
+
+	// Postpaid wallets run negative
+	wallet, _ := services.GetSMSWallet(1)
+	assert.Equal(t, models.SMSBillingPostpaid, wallet.BillingMode)
+	assert.Equal(t, -2.0, wallet.Balance)
+
+	// Give up on the second number after one attempt
+	db.Model(&models.OutboundMessage{}).Where("job_id = ?", job.ID).Update("max_attempts", 1)
+	services.ProcessOutbox(10)
+
+	wallet, _ = services.GetSMSWallet(1)
+	assert.Equal(t, -1.0, wallet.Balance)
+
+	statement, err := services.MonthlySMSStatement(1, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, statement.Charges)
+	assert.Equal(t, 1.0, statement.AmountDue)
+	assert.Equal(t, -1.0, statement.ClosingBalance)
+	assert.Equal(t, int64(1), statement.MessagesSent)
+
+	// Last month's statement is empty and opens where nothing had happened yet
+	statement, _ = services.MonthlySMSStatement(1, time.Now().AddDate(0, -1, 0))
+	assert.Zero(t, statement.Charges)
+	assert.Zero(t, statement.ClosingBalance)
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"errors"
+	"schoolms-go/models"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// Keywords that opt a number out of, or back into, school SMS
+var (
+	optOutKeywords = map[string]bool{"STOP": true, "STOPALL": true, "STOP ALL": true, "UNSUBSCRIBE": true, "ACHA": true}
+	optInKeywords  = map[string]bool{"START": true, "SUBSCRIBE": true}
+)
+
+// HandleDeliveryReport - Record the final delivery outcome of a sent SMS
+func HandleDeliveryReport(providerMessageID, status, failureReason string) (*models.SMSLog, error) {
+	if providerMessageID == "" {
+		return nil, errors.New("missing message id")
+	}
+
+	var log models.SMSLog
+	if err := models.DB.Where("provider_message_id = ?", providerMessageID).First(&log).Error; err != nil {
+		return nil, err
+	}
+
+	log.DeliveryStatus = deliveryState(status)
+	log.FailureReason = failureReason
+	if log.DeliveryStatus == models.DeliveryDelivered {
+		now := time.Now()
+		log.DeliveredAt = &now
+		log.FailureReason = ""
+	} else if log.DeliveryStatus == models.DeliveryFailed && log.FailureReason == "" {
+		log.FailureReason = status
+	}
+	models.DB.Model(&log).Select("delivery_status", "failure_reason", "delivered_at").Updates(&log)
+
+	return &log, nil
+}
+
+// deliveryState - Map provider delivery statuses onto ours
+func deliveryState(status string) string {
+	switch strings.ToLower(status) {
+	case "success", "delivered", "read":
+		return models.DeliveryDelivered
+	case "failed", "rejected", "expired", "absentsubscriber", "undelivered":
+		return models.DeliveryFailed
+	default: // Sent, Submitted, Buffered
+		return models.DeliveryPending
+	}
+}
+
+// HandleInboundSMS - Store a reply, or act on STOP/START
+func HandleInboundSMS(from, to, text, providerMessageID string) ([]models.InboundMessage, error) {
+	return HandleInboundMessage(models.ChannelSMS, from, to, text, providerMessageID)
+}
+
+// HandleInboundMessage - Store a reply from any channel, or act on STOP/START
+// The school is found from the shortcode or WhatsApp number it was sent to, falling
+// back to whichever schools know the sender's number
+func HandleInboundMessage(channel, from, to, text, providerMessageID string) ([]models.InboundMessage, error) {
+	phone := NormalizePhone(from)
+	if phone == "" {
+		return nil, errors.New("invalid sender number")
+	}
+
+	schools, userIDs := inboundSchools(phone, channel, to)
+	keyword := strings.ToUpper(strings.TrimSpace(text))
+
+	if optOutKeywords[keyword] {
+		for _, schoolID := range schools {
+			OptOutPhone(schoolID, phone, "SMS_REPLY")
+		}
+		return nil, nil
+	}
+	if optInKeywords[keyword] {
+		for _, schoolID := range schools {
+			models.DB.Where("school_id = ? AND phone = ?", schoolID, phone).Delete(&models.SMSOptOut{})
+		}
+		return nil, nil
+	}
+
+	if len(schools) == 0 {
+		schools = []uint{0} // Kept for the superadmin to route by hand
+	}
+
+	messages := make([]models.InboundMessage, 0, len(schools))
+	for _, schoolID := range schools {
+		msg := models.InboundMessage{
+			SchoolID:          schoolID,
+			From:              phone,
+			To:                to,
+			Text:              strings.TrimSpace(text),
+			ProviderMessageID: providerMessageID,
+			Channel:           channel,
+			ReceivedAt:        time.Now(),
+		}
+		if id, ok := userIDs[schoolID]; ok {
+			msg.UserID = &id
+		}
+		if err := models.DB.Create(&msg).Error; err != nil {
+			return messages, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// inboundSchools - Schools a reply belongs to, and the matching user in each
+func inboundSchools(phone, channel, shortcode string) ([]uint, map[uint]uint) {
+	userIDs := make(map[uint]uint)
+
+	// Users (parents, staff) with this number
+	var users []models.User
+	models.DB.Where("phone = ? AND school_id IS NOT NULL", phone).Find(&users)
+	for _, u := range users {
+		userIDs[*u.SchoolID] = u.ID
+	}
+
+	// Guardian numbers recorded on parent links
+	var links []models.ParentStudent
+	models.DB.Where("phone = ?", phone).Preload("Student").Find(&links)
+	for _, l := range links {
+		if _, ok := userIDs[l.Student.SchoolID]; !ok {
+			userIDs[l.Student.SchoolID] = l.ParentID
+		}
+	}
+
+	// A school's own shortcode, sender ID or WhatsApp number settles it
+	if shortcode != "" && channel == models.ChannelWhatsApp {
+		var settings models.WhatsAppSettings
+		if models.DB.Where("phone_number_id = ?", shortcode).First(&settings).Error == nil {
+			return []uint{settings.SchoolID}, userIDs
+		}
+	} else if shortcode != "" {
+		var settings models.SMSSettings
+		if models.DB.Where("sender_id = ?", shortcode).First(&settings).Error == nil {
+			return []uint{settings.SchoolID}, userIDs
+		}
+	}
+
+	schools := make([]uint, 0, len(userIDs))
+	for schoolID := range userIDs {
+		schools = append(schools, schoolID)
+	}
+	sort.Slice(schools, func(i, j int) bool { return schools[i] < schools[j] })
+	return schools, userIDs
+}
+
+// OptOutPhone - Stop sending to a number from this school
+func OptOutPhone(schoolID uint, phone, source string) error {
+	return models.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.SMSOptOut{
+		SchoolID: schoolID,
+		Phone:    phone,
+		Source:   source,
+	}).Error
+}
+
+// IsOptedOut - Whether the number has asked this school to stop texting
+func IsOptedOut(schoolID uint, phone string) bool {
+	var count int64
+	models.DB.Model(&models.SMSOptOut{}).
+		Where("school_id = ? AND phone = ?", schoolID, NormalizePhone(phone)).
+		Count(&count)
+	return count > 0
+}
@@ -0,0 +1,305 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"schoolms-go/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMSProvider - Anything that can deliver one SMS
+// Phone numbers are already in E.164 format when Send is called
+type SMSProvider interface {
+	Name() string
+	Send(to, message string) SMSResult
+}
+
+// AfricasTalkingProvider - Africa's Talking bulk SMS API
+type AfricasTalkingProvider struct {
+	Config  SMSConfig
+	BaseURL string // Optional override, defaults by Env
+	HTTP    *http.Client
+}
+
+func (p *AfricasTalkingProvider) Name() string { return models.SMSProviderAfricasTalking }
+
+func (p *AfricasTalkingProvider) Send(to, message string) SMSResult {
+	if p.Config.APIKey == "" {
+		return SMSResult{Success: false, Error: "SMS not configured"}
+	}
+
+	baseURL := p.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.sandbox.africastalking.com"
+		if p.Config.Env == "production" {
+			baseURL = "https://api.africastalking.com"
+		}
+	}
+
+	data := url.Values{}
+	data.Set("username", p.Config.Username)
+	data.Set("to", to)
+	data.Set("message", message)
+	if p.Config.ShortCode != "" {
+		data.Set("from", p.Config.ShortCode)
+	}
+
+	req, _ := http.NewRequest("POST", baseURL+"/version1/messaging", strings.NewReader(data.Encode()))
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("apiKey", p.Config.APIKey)
+
+	resp, err := httpClient(p.HTTP).Do(req)
+	if err != nil {
+		return SMSResult{Success: false, Error: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		SMSMessageData struct {
+			Message    string `json:"Message"`
+			Recipients []struct {
+				Cost       string `json:"cost"`
+				Status     string `json:"status"`
+				StatusCode int    `json:"statusCode"`
+				MessageID  string `json:"messageId"`
+			} `json:"Recipients"`
+		} `json:"SMSMessageData"`
+	}
+
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if len(result.SMSMessageData.Recipients) > 0 {
+		r := result.SMSMessageData.Recipients[0]
+		success := r.StatusCode == 101 || r.Status == "Success"
+		return SMSResult{
+			Success:   success,
+			Status:    r.Status,
+			Cost:      r.Cost,
+			MessageID: r.MessageID,
+		}
+	}
+
+	return SMSResult{Success: false, Error: "No recipient response"}
+}
+
+// HTTPGatewayProvider - Generic JSON gateway for other aggregators
+// POSTs {"to","message","from"} with a bearer token and expects {"id","status","cost"} back
+type HTTPGatewayProvider struct {
+	URL      string
+	Token    string
+	SenderID string
+	HTTP     *http.Client
+}
+
+func (p *HTTPGatewayProvider) Name() string { return models.SMSProviderHTTP }
+
+func (p *HTTPGatewayProvider) Send(to, message string) SMSResult {
+	if p.URL == "" {
+		return SMSResult{Success: false, Error: "SMS gateway URL not configured"}
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"to":      to,
+		"message": message,
+		"from":    p.SenderID,
+	})
+	req, _ := http.NewRequest("POST", p.URL, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	resp, err := httpClient(p.HTTP).Do(req)
+	if err != nil {
+		return SMSResult{Success: false, Error: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Cost   string `json:"cost"`
+		Error  string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if result.Error == "" {
+			result.Error = fmt.Sprintf("gateway returned HTTP %d", resp.StatusCode)
+		}
+		return SMSResult{Success: false, Status: result.Status, Error: result.Error}
+	}
+
+	if result.Status == "" {
+		result.Status = "Sent"
+	}
+	return SMSResult{Success: true, Status: result.Status, Cost: result.Cost, MessageID: result.ID}
+}
+
+// MemorySMSProvider - Keeps messages in memory for tests
+type MemorySMSProvider struct {
+	mu   sync.Mutex
+	sent []SMSMessage
+}
+
+func (p *MemorySMSProvider) Name() string { return models.SMSProviderMemory }
+
+func (p *MemorySMSProvider) Send(to, message string) SMSResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, SMSMessage{To: to, Message: message})
+	return SMSResult{Success: true, Status: "Success", Cost: "KES 0.0000", MessageID: fmt.Sprintf("mem-%d", len(p.sent))}
+}
+
+// Sent - Copy of every message delivered so far
+func (p *MemorySMSProvider) Sent() []SMSMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]SMSMessage(nil), p.sent...)
+}
+
+// FileSMSProvider - Appends messages as JSON lines to a file for local development
+type FileSMSProvider struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (p *FileSMSProvider) Name() string { return models.SMSProviderFile }
+
+func (p *FileSMSProvider) Send(to, message string) SMSResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return SMSResult{Success: false, Error: err.Error()}
+	}
+	defer f.Close()
+
+	id := fmt.Sprintf("file-%d", time.Now().UnixNano())
+	line, _ := json.Marshal(map[string]string{
+		"id":      id,
+		"to":      to,
+		"message": message,
+		"time":    time.Now().Format(time.RFC3339),
+	})
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return SMSResult{Success: false, Error: err.Error()}
+	}
+
+	return SMSResult{Success: true, Status: "Success", MessageID: id}
+}
+
+func httpClient(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+var (
+	providerMu          sync.RWMutex
+	defaultSMSProvider  SMSProvider
+	schoolProviderCache = map[uint]SMSProvider{}
+)
+
+// providerFromEnv - Server-wide default chosen by SMS_PROVIDER
+func providerFromEnv() SMSProvider {
+	switch strings.ToUpper(os.Getenv("SMS_PROVIDER")) {
+	case models.SMSProviderHTTP:
+		return &HTTPGatewayProvider{
+			URL:      os.Getenv("SMS_GATEWAY_URL"),
+			Token:    os.Getenv("SMS_GATEWAY_TOKEN"),
+			SenderID: smsConfig.ShortCode,
+		}
+	case models.SMSProviderFile:
+		path := os.Getenv("SMS_FILE_PATH")
+		if path == "" {
+			path = "sms_outbox.jsonl"
+		}
+		return &FileSMSProvider{Path: path}
+	case models.SMSProviderMemory:
+		return &MemorySMSProvider{}
+	default:
+		return &AfricasTalkingProvider{Config: smsConfig}
+	}
+}
+
+// SetDefaultSMSProvider - Replace the server-wide provider (tests, local development)
+func SetDefaultSMSProvider(p SMSProvider) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	defaultSMSProvider = p
+	schoolProviderCache = map[uint]SMSProvider{}
+}
+
+// DefaultSMSProvider - Provider used by schools without their own settings
+func DefaultSMSProvider() SMSProvider {
+	providerMu.RLock()
+	defer providerMu.RUnlock()
+	return defaultSMSProvider
+}
+
+// NewSMSProvider - Build a provider from a school's stored settings
+func NewSMSProvider(settings models.SMSSettings) (SMSProvider, error) {
+	switch settings.Provider {
+	case models.SMSProviderAfricasTalking:
+		env := settings.Environment
+		if env == "" {
+			env = "sandbox"
+		}
+		return &AfricasTalkingProvider{Config: SMSConfig{
+			APIKey:    settings.APIKey,
+			Username:  settings.Username,
+			ShortCode: settings.SenderID,
+			Env:       env,
+		}}, nil
+	case models.SMSProviderHTTP:
+		if settings.GatewayURL == "" {
+			return nil, errors.New("gateway_url is required for the HTTP provider")
+		}
+		return &HTTPGatewayProvider{URL: settings.GatewayURL, Token: settings.GatewayToken, SenderID: settings.SenderID}, nil
+	default:
+		return nil, fmt.Errorf("unsupported SMS provider %q", settings.Provider)
+	}
+}
+
+// SMSProviderForSchool - The school's own provider, or the server default
+func SMSProviderForSchool(schoolID uint) SMSProvider {
+	providerMu.RLock()
+	cached, ok := schoolProviderCache[schoolID]
+	fallback := defaultSMSProvider
+	providerMu.RUnlock()
+	if ok {
+		return cached
+	}
+
+	provider := fallback
+	var settings models.SMSSettings
+	if schoolID != 0 && models.DB != nil &&
+		models.DB.Where("school_id = ?", schoolID).First(&settings).Error == nil {
+		if p, err := NewSMSProvider(settings); err == nil {
+			provider = p
+		}
+	}
+
+	providerMu.Lock()
+	schoolProviderCache[schoolID] = provider
+	providerMu.Unlock()
+	return provider
+}
+
+// InvalidateSMSProvider - Forget a school's cached provider after its settings change
+func InvalidateSMSProvider(schoolID uint) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	delete(schoolProviderCache, schoolID)
+}
@@ -0,0 +1,60 @@
+package services_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendSMSWith_HTTPGateway(t *testing.T) {
+	var got map[string]string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(map[string]string{"id": "gw-1", "status": "Queued", "cost": "KES 0.80"})
+	}))
+	defer gateway.Close()
+
+	provider := &services.HTTPGatewayProvider{URL: gateway.URL, Token: "secret", SenderID: "SCHOOL"}
+	result := services.SendSMSWith(provider, "0712345678", "Hello")
+
+	assert.True(t, result.Success)
+	assert.Equal(t, "gw-1", result.MessageID)
+	assert.Equal(t, models.SMSProviderHTTP, result.Provider)
+	assert.Equal(t, "+254712345678", got["to"])
+	assert.Equal(t, "SCHOOL", got["from"])
+}
+
+func TestSMSProviderForSchool_UsesSchoolSettings(t *testing.T) {
+	db := setupTestDB(t)
+	db.AutoMigrate(&models.SMSSettings{}, &models.SMSLog{}, &models.SMSWallet{}, &models.SMSCreditTransaction{})
+	defer func() { sqlDB, _ := db.DB(); sqlDB.Close() }()
+
+	fallback := &services.MemorySMSProvider{}
+	services.SetDefaultSMSProvider(fallback)
+	defer services.SetDefaultSMSProvider(nil)
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"id": "gw-2"})
+	}))
+	defer gateway.Close()
+	db.Create(&models.SMSSettings{SchoolID: 1, Provider: models.SMSProviderHTTP, GatewayURL: gateway.URL})
+
+	// School 1 has its own gateway; school 2 falls back to the default
+	result := services.SendSchoolSMS(1, "0712345678", "Fee reminder")
+	assert.Equal(t, models.SMSProviderHTTP, result.Provider)
+	services.LogSMSSent(1, "0712345678", "Fee reminder", result)
+
+	result = services.SendSchoolSMS(2, "0712345678", "Fee reminder")
+	assert.Equal(t, models.SMSProviderMemory, result.Provider)
+	assert.Len(t, fallback.Sent(), 1)
+
+	var log models.SMSLog
+	db.Where("school_id = ?", 1).First(&log)
+	assert.Equal(t, "gw-2", log.ProviderMessageID)
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"schoolms-go/models"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CaughtEmail - A message received by SMTPCatcher
+type CaughtEmail struct {
+	From        string
+	To          []string
+	Raw         []byte
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []EmailAttachment
+}
+
+// SMTPCatcher - Minimal local SMTP server that keeps every message in memory
+// Used by tests and for trying email without a real server (no TLS or auth)
+type SMTPCatcher struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []CaughtEmail
+	wg       sync.WaitGroup
+}
+
+// StartSMTPCatcher - Listen on addr ("127.0.0.1:0" picks a free port)
+func StartSMTPCatcher(addr string) (*SMTPCatcher, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &SMTPCatcher{listener: l}
+	c.wg.Add(1)
+	go c.serve()
+	return c, nil
+}
+
+// Host - Address the catcher listens on
+func (c *SMTPCatcher) Host() string {
+	host, _, _ := net.SplitHostPort(c.listener.Addr().String())
+	return host
+}
+
+// Port - Port the catcher listens on
+func (c *SMTPCatcher) Port() int {
+	_, port, _ := net.SplitHostPort(c.listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// Mailer - An SMTPMailer pointed at the catcher
+func (c *SMTPCatcher) Mailer() *SMTPMailer {
+	return &SMTPMailer{Host: c.Host(), Port: c.Port(), Encryption: models.EmailEncryptionNone}
+}
+
+// Messages - Everything received so far
+func (c *SMTPCatcher) Messages() []CaughtEmail {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CaughtEmail(nil), c.messages...)
+}
+
+// Close - Stop listening
+func (c *SMTPCatcher) Close() error {
+	err := c.listener.Close()
+	c.wg.Wait()
+	return err
+}
+
+func (c *SMTPCatcher) serve() {
+	defer c.wg.Done()
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+// handle - One SMTP session: HELO/EHLO, MAIL, RCPT, DATA, RSET, NOOP, QUIT
+func (c *SMTPCatcher) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+
+	reply("220 localhost SMTP catcher")
+	var from string
+	var to []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(verb, "EHLO"):
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(verb, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(verb, "MAIL FROM:"):
+			from, to = smtpPath(line[len("MAIL FROM:"):]), nil
+			reply("250 OK")
+		case strings.HasPrefix(verb, "RCPT TO:"):
+			to = append(to, smtpPath(line[len("RCPT TO:"):]))
+			reply("250 OK")
+		case verb == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data bytes.Buffer
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" || l == ".\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			c.mu.Lock()
+			c.messages = append(c.messages, parseCaughtEmail(from, to, data.Bytes()))
+			c.mu.Unlock()
+			reply("250 OK: queued")
+		case verb == "RSET":
+			from, to = "", nil
+			reply("250 OK")
+		case verb == "NOOP":
+			reply("250 OK")
+		case verb == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// smtpPath - "<a@b.com> SIZE=10" -> "a@b.com"
+func smtpPath(arg string) string {
+	arg = strings.TrimSpace(arg)
+	if i := strings.Index(arg, ">"); i >= 0 {
+		arg = arg[:i]
+	}
+	return strings.TrimPrefix(arg, "<")
+}
+
+// parseCaughtEmail - Pull the subject, bodies and attachments out of a raw message
+func parseCaughtEmail(from string, to []string, raw []byte) CaughtEmail {
+	caught := CaughtEmail{From: from, To: to, Raw: raw}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return caught
+	}
+	caught.Subject, _ = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	collectParts(&caught, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body)
+	return caught
+}
+
+func collectParts(caught *CaughtEmail, contentType, encoding, disposition string, body io.Reader) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			collectParts(caught, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"), part)
+		}
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, _ := io.ReadAll(body)
+
+	if disp, dparams, err := mime.ParseMediaType(disposition); err == nil && disp == "attachment" {
+		caught.Attachments = append(caught.Attachments, EmailAttachment{Filename: dparams["filename"], ContentType: contentType, Data: data})
+		return
+	}
+	switch mediaType {
+	case "text/html":
+		caught.HTML = string(data)
+	default:
+		caught.Text = string(data)
+	}
+}
@@ -0,0 +1,322 @@
+package services
+
+import (
+	"fmt"
+	"schoolms-go/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Stream event types pushed to dashboards
+const (
+	StreamNotification = "notification"
+	StreamPayment      = "payment"
+	StreamAttendance   = "attendance"
+	StreamTicket       = "ticket"
+)
+
+// StreamMessage - One event for connected clients
+// It reaches clients of SchoolID that are listed in UserIDs or have one of Roles;
+// with neither set it reaches everyone in the school. SUPERADMIN clients only get
+// messages that name their role, from any school
+type StreamMessage struct {
+	ID       uint64      `json:"id"`
+	Type     string      `json:"type"`
+	SchoolID uint        `json:"school_id"`
+	UserIDs  []uint      `json:"-"`
+	Roles    []string    `json:"-"`
+	Data     interface{} `json:"data"`
+	SentAt   time.Time   `json:"sent_at"`
+}
+
+// StreamClient - Who is listening
+type StreamClient struct {
+	SchoolID uint
+	UserID   uint
+	Role     string
+}
+
+// Matches - Whether the message is for this client
+func (c StreamClient) Matches(msg StreamMessage) bool {
+	if c.Role == "SUPERADMIN" {
+		return containsString(msg.Roles, c.Role)
+	}
+	if msg.SchoolID != c.SchoolID {
+		return false
+	}
+	if len(msg.UserIDs) == 0 && len(msg.Roles) == 0 {
+		return true
+	}
+	for _, id := range msg.UserIDs {
+		if id == c.UserID {
+			return true
+		}
+	}
+	return containsString(msg.Roles, c.Role)
+}
+
+// StreamBroker - Fans stream messages out to subscribers
+// MemoryBroker serves a single instance; a shared backend (e.g. Redis pub/sub) can
+// implement the same interface and be installed with SetStreamBroker
+type StreamBroker interface {
+	// Publish - Assign the message an ID and deliver it to matching subscribers
+	Publish(msg StreamMessage) StreamMessage
+	// Subscribe - Messages for the client, starting with any after lastEventID still held for replay
+	// missed is true when lastEventID is older than the replay buffer, so the client should refetch.
+	// The channel is closed when cancel is called or the client falls too far behind
+	Subscribe(client StreamClient, lastEventID uint64) (messages <-chan StreamMessage, missed bool, cancel func())
+}
+
+const (
+	streamReplaySize  = 500 // Messages kept for clients reconnecting with Last-Event-ID
+	streamClientQueue = 64  // Messages buffered per client before it is dropped
+)
+
+// MemoryBroker - In-process StreamBroker
+type MemoryBroker struct {
+	mu     sync.Mutex
+	nextID uint64
+	replay []StreamMessage
+	subs   map[*memorySubscriber]struct{}
+}
+
+type memorySubscriber struct {
+	client StreamClient
+	ch     chan StreamMessage
+}
+
+// NewMemoryBroker - An empty in-process broker
+// IDs start from the clock so a client reconnecting after a restart is told it missed messages
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{nextID: uint64(time.Now().UnixMilli()), subs: map[*memorySubscriber]struct{}{}}
+}
+
+func (b *MemoryBroker) Publish(msg StreamMessage) StreamMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	msg.ID = b.nextID
+	if msg.SentAt.IsZero() {
+		msg.SentAt = time.Now()
+	}
+	b.replay = append(b.replay, msg)
+	if len(b.replay) > streamReplaySize {
+		b.replay = b.replay[len(b.replay)-streamReplaySize:]
+	}
+
+	for sub := range b.subs {
+		if !sub.client.Matches(msg) {
+			continue
+		}
+		select {
+		case sub.ch <- msg:
+		default:
+			// Too far behind; closing makes it reconnect and replay from its last ID
+			b.drop(sub)
+		}
+	}
+	return msg
+}
+
+func (b *MemoryBroker) Subscribe(client StreamClient, lastEventID uint64) (<-chan StreamMessage, bool, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	missed := false
+	var pending []StreamMessage
+	if lastEventID > 0 {
+		oldest := b.nextID + 1
+		if len(b.replay) > 0 {
+			oldest = b.replay[0].ID
+		}
+		missed = lastEventID > b.nextID || lastEventID+1 < oldest
+		for _, msg := range b.replay {
+			if msg.ID > lastEventID && client.Matches(msg) {
+				pending = append(pending, msg)
+			}
+		}
+	}
+
+	sub := &memorySubscriber{client: client, ch: make(chan StreamMessage, streamClientQueue+len(pending))}
+	for _, msg := range pending {
+		sub.ch <- msg
+	}
+	b.subs[sub] = struct{}{}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.drop(sub)
+	}
+	return sub.ch, missed, cancel
+}
+
+// Subscribers - How many clients are connected
+func (b *MemoryBroker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+func (b *MemoryBroker) drop(sub *memorySubscriber) {
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+var (
+	streamMu        sync.RWMutex
+	streamBroker    StreamBroker = NewMemoryBroker()
+	streamHeartbeat              = 25 * time.Second
+)
+
+// SetStreamBroker - Replace the broker, e.g. with one shared by several instances
+func SetStreamBroker(b StreamBroker) {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	streamBroker = b
+}
+
+// GetStreamBroker - The broker in use
+func GetStreamBroker() StreamBroker {
+	streamMu.RLock()
+	defer streamMu.RUnlock()
+	return streamBroker
+}
+
+// SetStreamHeartbeat - How often idle streams get a keep-alive comment (tests)
+func SetStreamHeartbeat(d time.Duration) {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	streamHeartbeat = d
+}
+
+// StreamHeartbeat - Keep-alive interval for idle streams
+func StreamHeartbeat() time.Duration {
+	streamMu.RLock()
+	defer streamMu.RUnlock()
+	return streamHeartbeat
+}
+
+// Stream - Push a message to connected clients
+func Stream(msg StreamMessage) StreamMessage {
+	return GetStreamBroker().Publish(msg)
+}
+
+// StreamNotificationPublished - Push a notification that just became visible to its recipients
+func StreamNotificationPublished(n models.Notification) {
+	recipients := NotificationRecipients(n)
+	if len(recipients) == 0 {
+		return
+	}
+	ids := make([]uint, len(recipients))
+	for i, u := range recipients {
+		ids[i] = u.ID
+	}
+	Stream(StreamMessage{Type: StreamNotification, SchoolID: n.SchoolID, UserIDs: ids, Data: n})
+}
+
+// StreamPaymentRecorded - Push a payment to the finance dashboards and the student's family
+func StreamPaymentRecorded(event models.Event, data map[string]string) error {
+	users := append(studentFamilyUserIDs(event.StudentID), event.ActorID)
+	Stream(StreamMessage{
+		Type:     StreamPayment,
+		SchoolID: event.SchoolID,
+		UserIDs:  users,
+		Roles:    []string{"SCHOOLADMIN", "FINANCE"},
+		Data: map[string]interface{}{
+			"payment_id": data["payment_id"],
+			"student_id": event.StudentID,
+			"amount":     data["amount"],
+			"reference":  data["reference"],
+			"method":     data["method"],
+		},
+	})
+	return nil
+}
+
+// StreamAttendanceSubmitted - Push a class register that was just marked to the admins and class teacher
+func StreamAttendanceSubmitted(schoolID, classID, markedBy uint, date time.Time, counts map[string]int) {
+	users := []uint{markedBy}
+	var class models.Class
+	if models.DB.First(&class, classID).Error == nil && class.TeacherID != nil {
+		users = append(users, *class.TeacherID)
+	}
+	Stream(StreamMessage{
+		Type:     StreamAttendance,
+		SchoolID: schoolID,
+		UserIDs:  users,
+		Roles:    []string{"SCHOOLADMIN"},
+		Data: map[string]interface{}{
+			"class_id":  classID,
+			"date":      date.Format("2006-01-02"),
+			"marked_by": markedBy,
+			"counts":    counts,
+		},
+	})
+}
+
+// StreamTicketChanged - Push a new or updated ticket to its author, the school's admins and the platform admins
+func StreamTicketChanged(ticket models.Ticket, action string) {
+	Stream(StreamMessage{
+		Type:     StreamTicket,
+		SchoolID: ticket.SchoolID,
+		UserIDs:  []uint{ticket.UserID},
+		Roles:    []string{"SCHOOLADMIN", "SUPERADMIN"},
+		Data:     map[string]interface{}{"action": action, "ticket": ticket},
+	})
+}
+
+var streamSubscribersOnce sync.Once
+
+// RegisterStreamSubscribers - Forward confirmed payments to connected dashboards; safe to call more than once
+func RegisterStreamSubscribers() {
+	streamSubscribersOnce.Do(func() {
+		Subscribe(models.EventPaymentRecorded, StreamPaymentRecorded)
+	})
+}
+
+// ParseLastEventID - The Last-Event-ID a reconnecting client sent; 0 when absent or invalid
+func ParseLastEventID(value string) uint64 {
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// studentFamilyUserIDs - The student's own account and their parents'
+func studentFamilyUserIDs(studentID uint) []uint {
+	var ids []uint
+	var student models.Student
+	if models.DB.First(&student, studentID).Error == nil {
+		ids = append(ids, student.UserID)
+	}
+	var parents []uint
+	models.DB.Model(&models.ParentStudent{}).Where("student_id = ?", studentID).Pluck("parent_id", &parents)
+	return append(ids, parents...)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatSSE - One message in text/event-stream format
+func FormatSSE(id uint64, event, data string) string {
+	out := ""
+	if id > 0 {
+		out += fmt.Sprintf("id: %d\n", id)
+	}
+	if event != "" {
+		out += "event: " + event + "\n"
+	}
+	return out + "data: " + data + "\n\n"
+}
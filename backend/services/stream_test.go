@@ -0,0 +1,98 @@
+package services_test
+
+import (
+	"schoolms-go/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func drain(ch <-chan services.StreamMessage) []services.StreamMessage {
+	var out []services.StreamMessage
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return out
+			}
+			out = append(out, msg)
+		default:
+			return out
+		}
+	}
+}
+
+func TestStream_MessagesReachOnlyTheirAudience(t *testing.T) {
+	b := services.NewMemoryBroker()
+	admin, _, cancelAdmin := b.Subscribe(services.StreamClient{SchoolID: 1, UserID: 1, Role: "SCHOOLADMIN"}, 0)
+	parent, _, cancelParent := b.Subscribe(services.StreamClient{SchoolID: 1, UserID: 2, Role: "PARENT"}, 0)
+	other, _, cancelOther := b.Subscribe(services.StreamClient{SchoolID: 2, UserID: 3, Role: "SCHOOLADMIN"}, 0)
+	platform, _, cancelPlatform := b.Subscribe(services.StreamClient{UserID: 4, Role: "SUPERADMIN"}, 0)
+	defer cancelAdmin()
+	defer cancelParent()
+	defer cancelOther()
+	defer cancelPlatform()
+
+	b.Publish(services.StreamMessage{Type: "everyone", SchoolID: 1})
+	b.Publish(services.StreamMessage{Type: "admins", SchoolID: 1, Roles: []string{"SCHOOLADMIN"}})
+	b.Publish(services.StreamMessage{Type: "parent", SchoolID: 1, UserIDs: []uint{2}})
+	b.Publish(services.StreamMessage{Type: "ticket", SchoolID: 2, Roles: []string{"SCHOOLADMIN", "SUPERADMIN"}})
+
+	types := func(msgs []services.StreamMessage) []string {
+		var out []string
+		for _, m := range msgs {
+			out = append(out, m.Type)
+		}
+		return out
+	}
+	assert.Equal(t, []string{"everyone", "admins"}, types(drain(admin)))
+	assert.Equal(t, []string{"everyone", "parent"}, types(drain(parent)))
+	assert.Equal(t, []string{"ticket"}, types(drain(other)))
+	assert.Equal(t, []string{"ticket"}, types(drain(platform)))
+}
+
+func TestStream_ReconnectReplaysFromLastEventID(t *testing.T) {
+	b := services.NewMemoryBroker()
+	client := services.StreamClient{SchoolID: 1, UserID: 1, Role: "SCHOOLADMIN"}
+
+	first := b.Publish(services.StreamMessage{Type: "a", SchoolID: 1})
+	b.Publish(services.StreamMessage{Type: "b", SchoolID: 1})
+	b.Publish(services.StreamMessage{Type: "c", SchoolID: 2})
+	b.Publish(services.StreamMessage{Type: "d", SchoolID: 1})
+
+	ch, missed, cancel := b.Subscribe(client, first.ID)
+	assert.False(t, missed)
+	replayed := drain(ch)
+	assert.Len(t, replayed, 2)
+	assert.Equal(t, "b", replayed[0].Type)
+	assert.Equal(t, "d", replayed[1].Type)
+	cancel()
+	_, open := <-ch
+	assert.False(t, open)
+
+	// An ID older than the buffer, or from before a restart, can't be replayed
+	for i := 0; i < 600; i++ {
+		b.Publish(services.StreamMessage{Type: "e", SchoolID: 1})
+	}
+	ch, missed, cancel = b.Subscribe(client, first.ID)
+	assert.True(t, missed)
+	assert.Len(t, drain(ch), 500)
+	cancel()
+	_, missed, cancel = services.NewMemoryBroker().Subscribe(client, first.ID+1000000)
+	assert.True(t, missed)
+	cancel()
+}
+
+func TestStream_SlowClientIsDropped(t *testing.T) {
+	b := services.NewMemoryBroker()
+	ch, _, cancel := b.Subscribe(services.StreamClient{SchoolID: 1, UserID: 1, Role: "TEACHER"}, 0)
+	defer cancel()
+
+	for i := 0; i < 100; i++ {
+		b.Publish(services.StreamMessage{Type: "x", SchoolID: 1})
+	}
+	assert.Equal(t, 0, b.Subscribers())
+	msgs := drain(ch)
+	assert.Len(t, msgs, 64)
+	assert.Equal(t, uint64(63), msgs[63].ID-msgs[0].ID)
+}
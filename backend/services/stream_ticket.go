@@ -0,0 +1,58 @@
+package services
+
+import (
+	"errors"
+	"schoolms-go/models"
+	"time"
+)
+
+// StreamTicketTTL - How long a stream ticket can wait before it is used
+const StreamTicketTTL = 30 * time.Second
+
+var ErrInvalidStreamTicket = errors.New("invalid or expired stream ticket")
+
+// IssueStreamTicket - A single-use ticket for opening the event stream as this session
+// Browsers fetch one right before each connect, so it is only ever valid for a few seconds
+func IssueStreamTicket(userID, sessionID, membershipID uint, role string, schoolID *uint) (string, error) {
+	ticket, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	// Used and expired tickets are worthless; clear them as new ones are issued
+	models.DB.Where("expires_at < ?", now.Add(-time.Hour)).Delete(&models.StreamTicket{})
+	err = models.DB.Create(&models.StreamTicket{
+		TicketHash:   hashToken(ticket),
+		UserID:       userID,
+		SessionID:    sessionID,
+		MembershipID: membershipID,
+		Role:         role,
+		SchoolID:     schoolID,
+		ExpiresAt:    now.Add(StreamTicketTTL),
+	}).Error
+	return ticket, err
+}
+
+// RedeemStreamTicket - Use up a ticket; it fails if already used, expired, or its session has since ended
+func RedeemStreamTicket(ticket string) (models.StreamTicket, error) {
+	var record models.StreamTicket
+	if ticket == "" {
+		return record, ErrInvalidStreamTicket
+	}
+	hash := hashToken(ticket)
+	now := time.Now()
+	// Conditional so two connections can't share a ticket
+	claim := models.DB.Model(&models.StreamTicket{}).
+		Where("ticket_hash = ? AND used_at IS NULL AND expires_at > ?", hash, now).
+		Update("used_at", now)
+	if claim.Error != nil || claim.RowsAffected == 0 {
+		return record, ErrInvalidStreamTicket
+	}
+	if err := models.DB.Where("ticket_hash = ?", hash).First(&record).Error; err != nil {
+		return record, ErrInvalidStreamTicket
+	}
+	if !SessionActive(record.SessionID, record.UserID, record.MembershipID) {
+		return record, ErrInvalidStreamTicket
+	}
+	return record, nil
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"schoolms-go/daraja"
+	"schoolms-go/models"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MergeFields - Values substituted into {{field}} placeholders
+type MergeFields map[string]string
+
+// TemplateFields - Merge fields a template may use, with a description for the editor
+var TemplateFields = map[string]string{
+	"student_name": "Student's full name",
+	"adm_no":       "Admission number (also the M-PESA account number)",
+	"class":        "Student's class",
+	"balance":      "Outstanding fee balance, e.g. 12,500.00",
+	"amount":       "Payment amount",
+	"paybill":      "School's M-PESA paybill",
+	"due_date":     "Fee due date",
+	"date":         "Date of the event (e.g. absence)",
+	"school_name":  "School name",
+	"message":      "Free text for broadcasts",
+	"absences":     "Consecutive days absent",
+	"subject":      "Subject of a published grade",
+	"score":        "Grade score, e.g. 45/50",
+	"term":         "Term of a published grade",
+	"reason":       "Reason a student was discharged",
+}
+
+// defaultTemplates - Wording used until a school saves its own
+var defaultTemplates = map[string][2]string{
+	models.TemplateFeeReminder: {
+		"Dear parent, {{student_name}} ({{adm_no}}) has a fee balance of KES {{balance}}. Please pay via M-PESA Paybill {{paybill}}, account {{adm_no}}. - {{school_name}}",
+		"Mzazi, {{student_name}} ({{adm_no}}) ana salio la karo la KES {{balance}}. Tafadhali lipa kupitia M-PESA Paybill {{paybill}}, akaunti {{adm_no}}. - {{school_name}}",
+	},
+	models.TemplatePaymentConfirmation: {
+		"Payment of KES {{amount}} received for {{student_name}} ({{adm_no}}). New balance: KES {{balance}}. Thank you! - {{school_name}}",
+		"Malipo ya KES {{amount}} yamepokelewa kwa {{student_name}} ({{adm_no}}). Salio jipya: KES {{balance}}. Asante! - {{school_name}}",
+	},
+	models.TemplateAttendanceAlert: {
+		"Alert: {{student_name}} was marked ABSENT on {{date}}. Please contact the school. - {{school_name}}",
+		"Taarifa: {{student_name}} hakuwepo shuleni tarehe {{date}}. Tafadhali wasiliana na shule. - {{school_name}}",
+	},
+	models.TemplateGradePublished: {
+		"{{student_name}} scored {{score}} in {{subject}} ({{term}}). - {{school_name}}",
+		"{{student_name}} amepata {{score}} katika {{subject}} ({{term}}). - {{school_name}}",
+	},
+	models.TemplateStudentDischarged: {
+		"{{student_name}} ({{adm_no}}) has been discharged from {{school_name}} on {{date}}. Reason: {{reason}}. Please contact the school for clearance.",
+		"{{student_name}} ({{adm_no}}) ameondolewa {{school_name}} tarehe {{date}}. Sababu: {{reason}}. Tafadhali wasiliana na shule.",
+	},
+	models.TemplateBroadcast: {
+		"{{school_name}}: {{message}}",
+		"{{school_name}}: {{message}}",
+	},
+}
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([a-z_]+)\s*\}\}`)
+
+// DefaultTemplateNames - Built-in templates, sorted
+func DefaultTemplateNames() []string {
+	names := make([]string, 0, len(defaultTemplates))
+	for name := range defaultTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetTemplate - The school's template, or the built-in default for that name
+func GetTemplate(schoolID uint, name string) (models.MessageTemplate, error) {
+	var tmpl models.MessageTemplate
+	if err := models.DB.Where("school_id = ? AND name = ?", schoolID, name).First(&tmpl).Error; err == nil {
+		return tmpl, nil
+	}
+
+	def, ok := defaultTemplates[name]
+	if !ok {
+		return tmpl, fmt.Errorf("template %s not found", name)
+	}
+	return models.MessageTemplate{SchoolID: schoolID, Name: name, BodyEN: def[0], BodySW: def[1]}, nil
+}
+
+// TemplateBody - The variant for a language, falling back to English
+func TemplateBody(tmpl models.MessageTemplate, language string) string {
+	if language == models.LanguageSwahili && strings.TrimSpace(tmpl.BodySW) != "" {
+		return tmpl.BodySW
+	}
+	return tmpl.BodyEN
+}
+
+// UnknownTemplateFields - Placeholders in a body that aren't merge fields
+func UnknownTemplateFields(body string) []string {
+	var unknown []string
+	for _, m := range placeholderPattern.FindAllStringSubmatch(body, -1) {
+		if _, ok := TemplateFields[m[1]]; !ok {
+			unknown = append(unknown, m[1])
+		}
+	}
+	return unknown
+}
+
+// RenderBody - Substitute merge fields; missing values render as empty
+func RenderBody(body string, fields MergeFields) string {
+	return placeholderPattern.ReplaceAllStringFunc(body, func(p string) string {
+		key := placeholderPattern.FindStringSubmatch(p)[1]
+		return fields[key]
+	})
+}
+
+// RenderMessage - Text of a named template for one recipient
+func RenderMessage(schoolID uint, name, language string, fields MergeFields) (string, error) {
+	tmpl, err := GetTemplate(schoolID, name)
+	if err != nil {
+		return "", err
+	}
+	return RenderBody(TemplateBody(tmpl, language), WithSchoolFields(schoolID, fields)), nil
+}
+
+// WithSchoolFields - Fill school_name and paybill unless the caller set them
+func WithSchoolFields(schoolID uint, fields MergeFields) MergeFields {
+	var school models.School
+	models.DB.Select("id", "name", "paybill").First(&school, schoolID)
+
+	merged := MergeFields{"school_name": school.Name, "paybill": school.Paybill}
+	if merged["paybill"] == "" {
+		merged["paybill"] = daraja.ConfigFromEnv().Shortcode
+	}
+	for k, v := range fields {
+		if v != "" || merged[k] == "" {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// StudentMergeFields - Fields describing a student, with their balance
+func StudentMergeFields(student models.Student, balance float64) MergeFields {
+	name := student.User.FullName
+	if name == "" {
+		name = student.User.Email
+	}
+	fields := MergeFields{
+		"student_name": name,
+		"adm_no":       student.EnrollmentNumber,
+		"balance":      FormatKES(balance),
+	}
+	if student.Class != nil {
+		fields["class"] = student.Class.Name
+	}
+	return fields
+}
+
+// FormatKES - 12500 -> "12,500.00"
+func FormatKES(amount float64) string {
+	s := strconv.FormatFloat(amount, 'f', 2, 64)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	whole, frac := s[:len(s)-3], s[len(s)-3:]
+	var b strings.Builder
+	for i, ch := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(ch)
+	}
+	return sign + b.String() + frac
+}
+
+// gsm7Basic / gsm7Extended - GSM 03.38 characters; extended ones take two septets
+const (
+	gsm7Basic    = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extended = "^{}\\[~]|€\f"
+)
+
+// SMSSegments - How many SMS parts a text is billed as, and its encoding
+// GSM-7 fits 160 characters (153 per part when split); anything else is UCS-2 at 70 (67)
+func SMSSegments(text string) (int, string) {
+	septets := 0
+	for _, ch := range text {
+		switch {
+		case strings.ContainsRune(gsm7Basic, ch):
+			septets++
+		case strings.ContainsRune(gsm7Extended, ch):
+			septets += 2
+		default:
+			units := len([]rune(text))
+			for _, r := range text {
+				if r > 0xFFFF {
+					units++ // Surrogate pair
+				}
+			}
+			return segmentCount(units, 70, 67), "UCS-2"
+		}
+	}
+	return segmentCount(septets, 160, 153), "GSM-7"
+}
+
+func segmentCount(length, single, multi int) int {
+	if length == 0 {
+		return 0
+	}
+	if length <= single {
+		return 1
+	}
+	return (length + multi - 1) / multi
+}
+
+// SMSCostPerSegment - Price of one SMS part in KES (SMS_COST_PER_SEGMENT, default 0.80)
+func SMSCostPerSegment() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv("SMS_COST_PER_SEGMENT"), 64); err == nil && v >= 0 {
+		return v
+	}
+	return 0.80
+}
@@ -0,0 +1,65 @@
+package services_test
+
+import (
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMessage_SchoolTemplateAndLanguageFallback(t *testing.T) {
+	db := setupTestDB(t)
+	db.AutoMigrate(&models.MessageTemplate{})
+	defer func() { sqlDB, _ := db.DB(); sqlDB.Close() }()
+
+	school := models.School{Name: "Moi Girls", Paybill: "522522"}
+	db.Create(&school)
+	fields := services.MergeFields{"student_name": "Amani", "adm_no": "ADM001", "balance": services.FormatKES(12500)}
+
+	// Built-in Swahili text until the school customises it
+	msg, err := services.RenderMessage(school.ID, models.TemplateFeeReminder, models.LanguageSwahili, fields)
+	assert.NoError(t, err)
+	assert.Contains(t, msg, "ana salio la karo la KES 12,500.00")
+	assert.Contains(t, msg, "Paybill 522522")
+	assert.True(t, strings.HasSuffix(msg, "- Moi Girls"))
+
+	// A school template with no Swahili variant falls back to English
+	db.Create(&models.MessageTemplate{SchoolID: school.ID, Name: models.TemplateFeeReminder, BodyEN: "{{student_name}} owes {{balance}} by {{due_date}}"})
+	fields["due_date"] = "5 Jan"
+	msg, _ = services.RenderMessage(school.ID, models.TemplateFeeReminder, models.LanguageSwahili, fields)
+	assert.Equal(t, "Amani owes 12,500.00 by 5 Jan", msg)
+}
+
+func TestUnknownTemplateFields(t *testing.T) {
+	assert.Empty(t, services.UnknownTemplateFields("{{student_name}} {{ balance }}"))
+	assert.Equal(t, []string{"parent_name"}, services.UnknownTemplateFields("Dear {{parent_name}}"))
+}
+
+func TestSMSSegments(t *testing.T) {
+	segments, encoding := services.SMSSegments(strings.Repeat("a", 160))
+	assert.Equal(t, 1, segments)
+	assert.Equal(t, "GSM-7", encoding)
+
+	segments, _ = services.SMSSegments(strings.Repeat("a", 161))
+	assert.Equal(t, 2, segments)
+
+	// Extended characters take two septets
+	segments, _ = services.SMSSegments(strings.Repeat("€", 81))
+	assert.Equal(t, 2, segments)
+
+	segments, encoding = services.SMSSegments("Habari 👋")
+	assert.Equal(t, 1, segments)
+	assert.Equal(t, "UCS-2", encoding)
+
+	segments, _ = services.SMSSegments(strings.Repeat("ŵ", 71))
+	assert.Equal(t, 2, segments)
+}
+
+func TestFormatKES(t *testing.T) {
+	assert.Equal(t, "0.00", services.FormatKES(0))
+	assert.Equal(t, "999.50", services.FormatKES(999.5))
+	assert.Equal(t, "1,234,567.00", services.FormatKES(1234567))
+	assert.Equal(t, "-12,500.00", services.FormatKES(-12500))
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"math/big"
+	"os"
+	"schoolms-go/models"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpIssuer        = "SchoolMS"
+	totpPeriod        = 30 // Seconds per code
+	recoveryCodeCount = 10
+	recoveryAlphabet  = "abcdefghjkmnpqrstuvwxyz23456789" // No 0/o or 1/l/i to misread
+)
+
+var (
+	ErrTwoFactorCodeInvalid  = errors.New("invalid two-factor code")
+	ErrTwoFactorNotSetUp     = errors.New("two-factor setup not started")
+	ErrTwoFactorAlreadyOn    = errors.New("two-factor already enabled")
+	ErrTwoFactorRequiredRole = errors.New("two-factor is required for this role")
+)
+
+// TwoFactorRoles - The roles that may be required to use two-factor sign-in
+var TwoFactorRoles = []string{"SCHOOLADMIN", "FINANCE", "TEACHER"}
+
+// TOTPSetup - What the user needs to add the account to an authenticator app
+type TOTPSetup struct {
+	Secret     string `json:"secret"`      // For typing in by hand
+	OTPAuthURL string `json:"otpauth_url"` // otpauth://totp/... as encoded in the QR code
+	QRCode     string `json:"qr_code"`     // data:image/png;base64,...
+}
+
+// TwoFactorRequired - Whether the user's role must sign in with two-factor
+// Schools pick roles in their policy; SUPERADMIN_2FA_REQUIRED=true covers platform admins
+func TwoFactorRequired(user models.User) bool {
+	return TwoFactorRequiredFor(HomeMembership(user))
+}
+
+// TwoFactorRequiredByAnyMembership - Whether the home role or any other membership needs two-factor,
+// so it can't be turned off while the user could still switch into such a role
+func TwoFactorRequiredByAnyMembership(user models.User) bool {
+	if TwoFactorRequired(user) {
+		return true
+	}
+	var memberships []models.Membership
+	models.DB.Where("user_id = ?", user.ID).Find(&memberships)
+	for _, m := range memberships {
+		if TwoFactorRequiredFor(ActiveMembership{ID: m.ID, SchoolID: &m.SchoolID, Role: m.Role}) {
+			return true
+		}
+	}
+	return false
+}
+
+// TwoFactorRequiredFor - Whether acting as this school and role needs two-factor, e.g. a membership being switched to
+func TwoFactorRequiredFor(active ActiveMembership) bool {
+	if active.Role == "SUPERADMIN" {
+		return os.Getenv("SUPERADMIN_2FA_REQUIRED") == "true"
+	}
+	if active.SchoolID == nil {
+		return false
+	}
+	var school models.School
+	if models.DB.Select("id", "two_factor_roles").First(&school, *active.SchoolID).Error != nil {
+		return false
+	}
+	return containsString(ParseRoleList(school.TwoFactorRoles), active.Role)
+}
+
+// ParseRoleList - Roles from a comma-separated list, upper-cased and without blanks
+func ParseRoleList(list string) []string {
+	var roles []string
+	for _, r := range strings.Split(list, ",") {
+		if r = strings.ToUpper(strings.TrimSpace(r)); r != "" {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+// BeginTOTPSetup - Give the user a new secret to scan; it only takes effect once EnableTOTP confirms a code
+func BeginTOTPSetup(user *models.User) (TOTPSetup, error) {
+	if user.TOTPEnabledAt != nil {
+		return TOTPSetup{}, ErrTwoFactorAlreadyOn
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: user.Email, Period: totpPeriod})
+	if err != nil {
+		return TOTPSetup{}, err
+	}
+	img, err := key.Image(240, 240)
+	if err != nil {
+		return TOTPSetup{}, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return TOTPSetup{}, err
+	}
+
+	if err := models.DB.Model(user).Updates(map[string]interface{}{"totp_secret": key.Secret(), "totp_last_step": 0}).Error; err != nil {
+		return TOTPSetup{}, err
+	}
+	return TOTPSetup{
+		Secret:     key.Secret(),
+		OTPAuthURL: key.URL(),
+		QRCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+// EnableTOTP - Turn two-factor on once the user proves their app works; returns fresh recovery codes
+func EnableTOTP(user *models.User, code string) ([]string, error) {
+	if user.TOTPEnabledAt != nil {
+		return nil, ErrTwoFactorAlreadyOn
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotSetUp
+	}
+	if !VerifyTOTP(user, code) {
+		return nil, ErrTwoFactorCodeInvalid
+	}
+	now := time.Now()
+	if err := models.DB.Model(user).Update("totp_enabled_at", now).Error; err != nil {
+		return nil, err
+	}
+	return GenerateRecoveryCodes(user.ID)
+}
+
+// DisableTOTP - Turn two-factor off and discard the secret and recovery codes
+func DisableTOTP(userID uint) error {
+	err := models.DB.Model(&models.User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"totp_secret": "", "totp_enabled_at": nil, "totp_last_step": 0}).Error
+	if err != nil {
+		return err
+	}
+	return models.DB.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+}
+
+// VerifyTOTP - Check a code from the authenticator app, allowing one step of clock drift
+// A code is accepted once; replaying it (or an older one) fails
+func VerifyTOTP(user *models.User, code string) bool {
+	code = strings.TrimSpace(code)
+	if user.TOTPSecret == "" || len(code) != 6 {
+		return false
+	}
+	now := time.Now()
+	for _, drift := range []int64{0, -1, 1} {
+		at := now.Add(time.Duration(drift*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(user.TOTPSecret, at, totp.ValidateOpts{
+			Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil || expected != code {
+			continue
+		}
+		step := at.Unix() / totpPeriod
+		claim := models.DB.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if claim.RowsAffected == 0 {
+			return false
+		}
+		user.TOTPLastStep = step
+		return true
+	}
+	return false
+}
+
+// VerifySecondFactor - Accept an authenticator code or an unused recovery code
+func VerifySecondFactor(user *models.User, code string) (usedRecoveryCode bool, ok bool) {
+	if VerifyTOTP(user, code) {
+		return false, true
+	}
+	if UseRecoveryCode(user.ID, code) {
+		return true, true
+	}
+	return false, false
+}
+
+// GenerateRecoveryCodes - Replace the user's recovery codes; the plain codes are only ever returned here
+func GenerateRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]models.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		rows[i] = models.RecoveryCode{UserID: userID, CodeHash: hashToken(normalizeRecoveryCode(code))}
+	}
+	models.DB.Where("user_id = ?", userID).Delete(&models.RecoveryCode{})
+	if err := models.DB.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode - Spend one of the user's recovery codes
+func UseRecoveryCode(userID uint, code string) bool {
+	code = normalizeRecoveryCode(code)
+	if len(code) != 10 {
+		return false
+	}
+	result := models.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(code)).
+		Update("used_at", time.Now())
+	return result.RowsAffected > 0
+}
+
+// RecoveryCodesLeft - How many unused recovery codes the user has
+func RecoveryCodesLeft(userID uint) int64 {
+	var count int64
+	models.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return count
+}
+
+// newRecoveryCode - e.g. k7m2p-x9qrt
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = recoveryAlphabet[n.Int64()]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
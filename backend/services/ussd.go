@@ -0,0 +1,283 @@
+package services
+
+import (
+	"fmt"
+	"schoolms-go/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ussdMaxLength - Longest screen most handsets display without cutting it off
+const ussdMaxLength = 182
+
+// USSD child menu options
+const (
+	ussdOptionBalance    = "1"
+	ussdOptionPayment    = "2"
+	ussdOptionAttendance = "3"
+	ussdOptionResults    = "4"
+	ussdOptionBack       = "0"
+)
+
+// ussdState - Where a session is in the menu
+type ussdState int
+
+const (
+	ussdChooseChild ussdState = iota
+	ussdChildMenu
+)
+
+// USSDResponse - Screen text and whether the session stays open
+type USSDResponse struct {
+	Text     string
+	Continue bool
+}
+
+// String - Africa's Talking format: "CON ..." keeps the session open, "END ..." closes it
+func (r USSDResponse) String() string {
+	if r.Continue {
+		return "CON " + r.Text
+	}
+	return "END " + r.Text
+}
+
+func ussdCon(text string) USSDResponse { return USSDResponse{Text: truncateUSSD(text), Continue: true} }
+func ussdEnd(text string) USSDResponse { return USSDResponse{Text: truncateUSSD(text)} }
+
+// HandleUSSD - Next screen for a parent, given everything typed so far
+// The gateway sends the whole session's input joined with "*", so the menu is
+// rebuilt by replaying each step; no session state is kept on the server
+func HandleUSSD(phone, text string) USSDResponse {
+	children := ussdChildren(NormalizePhone(phone))
+	if len(children) == 0 {
+		return ussdEnd("This number is not registered with any school. Please contact the school office.")
+	}
+
+	var inputs []string
+	if text != "" {
+		inputs = strings.Split(text, "*")
+	}
+
+	// With one child there is nothing to choose
+	state, child := ussdChooseChild, -1
+	if len(children) == 1 {
+		state, child = ussdChildMenu, 0
+	}
+	invalid := false
+
+	for _, input := range inputs {
+		input = strings.TrimSpace(input)
+		invalid = false
+
+		switch state {
+		case ussdChooseChild:
+			n, err := strconv.Atoi(input)
+			if err != nil || n < 1 || n > len(children) {
+				invalid = true
+				continue
+			}
+			state, child = ussdChildMenu, n-1
+
+		case ussdChildMenu:
+			switch input {
+			case ussdOptionBack:
+				if len(children) > 1 {
+					state, child = ussdChooseChild, -1
+				}
+			case ussdOptionBalance:
+				return ussdEnd(ussdBalance(children[child]))
+			case ussdOptionPayment:
+				return ussdEnd(ussdLastPayment(children[child]))
+			case ussdOptionAttendance:
+				return ussdEnd(ussdAttendance(children[child], time.Now()))
+			case ussdOptionResults:
+				return ussdEnd(ussdResults(children[child]))
+			default:
+				invalid = true
+			}
+		}
+	}
+
+	prefix := ""
+	if invalid {
+		prefix = "Invalid choice.\n"
+	}
+	if state == ussdChooseChild {
+		return ussdCon(prefix + ussdChildList(children))
+	}
+	return ussdCon(prefix + ussdChildMenuText(children[child], len(children) > 1))
+}
+
+// ussdChildren - Students whose guardian has verified this number, in a stable order
+func ussdChildren(phone string) []models.Student {
+	if phone == "" {
+		return nil
+	}
+
+	var links []models.ParentStudent
+	models.DB.Where("(phone = ? AND phone_verified = ?) OR parent_id IN (?)",
+		phone, true,
+		models.DB.Model(&models.User{}).Select("id").Where("phone = ? AND phone_verified = ?", phone, true),
+	).Preload("Parent").Preload("Student.User").Order("student_id").Find(&links)
+
+	seen := make(map[uint]bool)
+	var children []models.Student
+	for _, link := range links {
+		// A link with its own number only answers to that number
+		if GuardianPhone(link) != phone || seen[link.StudentID] || link.Student.Status == "DISCHARGED" {
+			continue
+		}
+		seen[link.StudentID] = true
+		children = append(children, link.Student)
+	}
+	return children
+}
+
+func ussdChildList(children []models.Student) string {
+	var b strings.Builder
+	b.WriteString("Choose a child:")
+	for i, s := range children {
+		fmt.Fprintf(&b, "\n%d. %s", i+1, ussdStudentName(s))
+	}
+	return b.String()
+}
+
+func ussdChildMenuText(student models.Student, canGoBack bool) string {
+	text := ussdStudentName(student) + "\n1. Fee balance\n2. Last payment\n3. Attendance this week\n4. Latest results"
+	if canGoBack {
+		text += "\n0. Back"
+	}
+	return text
+}
+
+func ussdStudentName(student models.Student) string {
+	if student.User.FullName != "" {
+		return student.User.FullName
+	}
+	return student.EnrollmentNumber
+}
+
+// ussdBalance - Total owed, then each vote head with a balance
+func ussdBalance(student models.Student) string {
+	breakdown, total, err := GetStudentVoteHeadBreakdown(student.ID, student.SchoolID)
+	if err != nil {
+		return "Balance is unavailable right now. Please try again later."
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s fee balance: KES %s", ussdStudentName(student), FormatKES(total))
+	for _, line := range breakdown {
+		if balance, _ := line["balance"].(float64); balance > 0 {
+			fmt.Fprintf(&b, "\n%s: %s", line["vote_head_name"], FormatKES(balance))
+		}
+	}
+	if total > 0 {
+		paybill := WithSchoolFields(student.SchoolID, nil)["paybill"]
+		if paybill != "" {
+			fmt.Fprintf(&b, "\nPay via Paybill %s, A/C %s", paybill, student.EnrollmentNumber)
+		}
+	}
+	return b.String()
+}
+
+func ussdLastPayment(student models.Student) string {
+	var payment models.Payment
+	if err := models.DB.Where("student_id = ?", student.ID).Order("created_at DESC, id DESC").First(&payment).Error; err != nil {
+		return "No payments recorded for " + ussdStudentName(student) + "."
+	}
+
+	text := fmt.Sprintf("Last payment for %s: KES %s on %s via %s",
+		ussdStudentName(student), FormatKES(payment.Amount), payment.CreatedAt.Format("02 Jan 2006"), payment.Method)
+	if payment.Reference != "" {
+		text += " (" + payment.Reference + ")"
+	}
+	return text + "."
+}
+
+// ussdAttendance - Counts since Monday of the current week
+func ussdAttendance(student models.Student, now time.Time) string {
+	weekday := int(now.Weekday()+6) % 7 // Monday = 0
+	monday := time.Date(now.Year(), now.Month(), now.Day()-weekday, 0, 0, 0, 0, now.Location())
+
+	var records []models.Attendance
+	models.DB.Where("student_id = ? AND date >= ?", student.ID, monday).Find(&records)
+	if len(records) == 0 {
+		return "No attendance marked for " + ussdStudentName(student) + " this week."
+	}
+
+	counts := map[string]int{}
+	for _, r := range records {
+		counts[r.Status]++
+	}
+	return fmt.Sprintf("%s this week: Present %d, Absent %d, Late %d, Excused %d",
+		ussdStudentName(student), counts["PRESENT"], counts["ABSENT"], counts["LATE"], counts["EXCUSED"])
+}
+
+// ussdResults - Every subject from the most recent term with grades
+func ussdResults(student models.Student) string {
+	var latest models.Grade
+	if err := models.DB.Where("student_id = ?", student.ID).Order("year DESC, term DESC").First(&latest).Error; err != nil {
+		return "No results recorded for " + ussdStudentName(student) + " yet."
+	}
+
+	var grades []models.Grade
+	models.DB.Where("student_id = ? AND year = ? AND term = ?", student.ID, latest.Year, latest.Term).
+		Order("subject").Find(&grades)
+
+	var b strings.Builder
+	var score, maxScore float64
+	fmt.Fprintf(&b, "%s %d:", latest.Term, latest.Year)
+	for _, g := range grades {
+		fmt.Fprintf(&b, "\n%s %g/%g", g.Subject, g.Score, g.MaxScore)
+		score += g.Score
+		maxScore += g.MaxScore
+	}
+	if maxScore > 0 {
+		fmt.Fprintf(&b, "\nAverage %.0f%%", score/maxScore*100)
+	}
+	return b.String()
+}
+
+// truncateUSSD - Keep screens within what a handset shows
+func truncateUSSD(text string) string {
+	runes := []rune(text)
+	if len(runes) <= ussdMaxLength {
+		return text
+	}
+	return string(runes[:ussdMaxLength-3]) + "..."
+}
+
+// USSDSimulator - Plays a USSD session locally the way the gateway would
+type USSDSimulator struct {
+	Phone  string
+	inputs []string
+	ended  bool
+}
+
+// Dial - Start a session and return the first screen
+func (s *USSDSimulator) Dial() USSDResponse {
+	s.inputs = nil
+	s.ended = false
+	return s.respond()
+}
+
+// Send - Type a reply; replies after the session has ended are ignored
+func (s *USSDSimulator) Send(input string) USSDResponse {
+	if s.ended {
+		return USSDResponse{Text: "Session ended"}
+	}
+	s.inputs = append(s.inputs, input)
+	return s.respond()
+}
+
+// Text - The accumulated input, as the gateway would post it
+func (s *USSDSimulator) Text() string {
+	return strings.Join(s.inputs, "*")
+}
+
+func (s *USSDSimulator) respond() USSDResponse {
+	resp := HandleUSSD(s.Phone, s.Text())
+	s.ended = !resp.Continue
+	return resp
+}
@@ -0,0 +1,118 @@
+package services_test
+
+import (
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func setupUSSDTest(t *testing.T) (*gorm.DB, models.School, []models.Student) {
+	db := setupTestDB(t)
+	db.AutoMigrate(&models.ParentStudent{}, &models.Attendance{}, &models.Grade{})
+	t.Cleanup(func() { sqlDB, _ := db.DB(); sqlDB.Close() })
+
+	school := models.School{Name: "Moi Girls", Paybill: "522522"}
+	db.Create(&school)
+	parent := models.User{Email: "parent@test.com", Role: "PARENT", SchoolID: &school.ID, Phone: "+254712345678", PhoneVerified: true}
+	db.Create(&parent)
+
+	var students []models.Student
+	for i, name := range []string{"Amani Otieno", "Baraka Otieno"} {
+		u := models.User{Email: strings.ToLower(strings.Fields(name)[0]) + "@test.com", FullName: name, Role: "STUDENT", SchoolID: &school.ID}
+		db.Create(&u)
+		s := models.Student{UserID: u.ID, SchoolID: school.ID, EnrollmentNumber: []string{"ADM001", "ADM002"}[i], Status: "ENROLLED"}
+		db.Create(&s)
+		db.Create(&models.ParentStudent{ParentID: parent.ID, StudentID: s.ID})
+		students = append(students, s)
+	}
+	return db, school, students
+}
+
+func TestUSSD_UnknownNumberEndsSession(t *testing.T) {
+	setupUSSDTest(t)
+
+	sim := &services.USSDSimulator{Phone: "+254799000000"}
+	resp := sim.Dial()
+	assert.False(t, resp.Continue)
+	assert.True(t, strings.HasPrefix(resp.String(), "END "))
+	assert.Contains(t, resp.Text, "not registered")
+}
+
+func TestUSSD_BalanceForChosenChild(t *testing.T) {
+	db, school, students := setupUSSDTest(t)
+	tuition := models.VoteHead{SchoolID: school.ID, Name: "Tuition", Priority: 1, IsActive: true}
+	db.Create(&tuition)
+	db.Create(&models.VoteHeadBalance{StudentID: students[1].ID, VoteHeadID: tuition.ID, SchoolID: school.ID, Balance: 12500})
+
+	sim := &services.USSDSimulator{Phone: "0712345678"}
+	resp := sim.Dial()
+	assert.True(t, resp.Continue)
+	assert.Equal(t, "Choose a child:\n1. Amani Otieno\n2. Baraka Otieno", resp.Text)
+
+	resp = sim.Send("7")
+	assert.True(t, resp.Continue)
+	assert.True(t, strings.HasPrefix(resp.Text, "Invalid choice.\nChoose a child:"))
+
+	resp = sim.Send("2")
+	assert.Contains(t, resp.Text, "Baraka Otieno\n1. Fee balance")
+	assert.Contains(t, resp.Text, "0. Back")
+
+	resp = sim.Send("1")
+	assert.False(t, resp.Continue)
+	assert.Equal(t, "Baraka Otieno fee balance: KES 12,500.00\nTuition: 12,500.00\nPay via Paybill 522522, A/C ADM002", resp.Text)
+	assert.Equal(t, "7*2*1", sim.Text())
+}
+
+func TestUSSD_BackPaymentsAttendanceAndResults(t *testing.T) {
+	db, school, students := setupUSSDTest(t)
+	amani := students[0]
+
+	db.Create(&models.Payment{StudentID: amani.ID, SchoolID: school.ID, Amount: 5000, Method: "MPESA", Reference: "QK12345"})
+	db.Create(&models.Attendance{StudentID: amani.ID, SchoolID: school.ID, ClassID: 1, Date: time.Now(), Status: "ABSENT"})
+	db.Create(&models.Attendance{StudentID: amani.ID, SchoolID: school.ID, ClassID: 1, Date: time.Now().AddDate(0, 0, -14), Status: "PRESENT"})
+	db.Create(&models.Grade{StudentID: amani.ID, SchoolID: school.ID, ClassID: 1, Subject: "Maths", Score: 40, MaxScore: 50, Term: "Term 1", Year: 2026})
+	db.Create(&models.Grade{StudentID: amani.ID, SchoolID: school.ID, ClassID: 1, Subject: "English", Score: 30, MaxScore: 50, Term: "Term 2", Year: 2026})
+	db.Create(&models.Grade{StudentID: amani.ID, SchoolID: school.ID, ClassID: 1, Subject: "Maths", Score: 45, MaxScore: 50, Term: "Term 2", Year: 2026})
+
+	sim := &services.USSDSimulator{Phone: "+254712345678"}
+	sim.Dial()
+	sim.Send("2")
+	resp := sim.Send("0") // Back to the child list
+	assert.Contains(t, resp.Text, "Choose a child:")
+
+	sim.Send("1")
+	resp = sim.Send("2")
+	assert.Contains(t, resp.Text, "Last payment for Amani Otieno: KES 5,000.00")
+	assert.Contains(t, resp.Text, "via MPESA (QK12345)")
+
+	sim.Dial()
+	sim.Send("1")
+	resp = sim.Send("3")
+	assert.Equal(t, "Amani Otieno this week: Present 0, Absent 1, Late 0, Excused 0", resp.Text)
+
+	sim.Dial()
+	sim.Send("1")
+	resp = sim.Send("4")
+	assert.Equal(t, "Term 2 2026:\nEnglish 30/50\nMaths 45/50\nAverage 75%", resp.Text)
+
+	// Replies after END are ignored
+	assert.False(t, sim.Send("1").Continue)
+}
+
+func TestUSSD_SingleChildSkipsChoice(t *testing.T) {
+	db, _, students := setupUSSDTest(t)
+	db.Where("student_id = ?", students[1].ID).Delete(&models.ParentStudent{})
+
+	sim := &services.USSDSimulator{Phone: "+254712345678"}
+	resp := sim.Dial()
+	assert.True(t, strings.HasPrefix(resp.Text, "Amani Otieno\n1. Fee balance"))
+	assert.NotContains(t, resp.Text, "0. Back")
+
+	resp = sim.Send("2")
+	assert.Equal(t, "No payments recorded for Amani Otieno.", resp.Text)
+}
@@ -2,21 +2,34 @@ package services
 
 import (
 	"errors"
+	"fmt"
 	"schoolms-go/models"
 	"time"
+
+	"gorm.io/gorm"
 )
 
+// ErrNoFeeStructure - The student has no vote head balances and none can be set up (no class or fee structure)
+// The payment stands; it just can't be broken down by vote head
+var ErrNoFeeStructure = errors.New("no fee structure to allocate against")
+
 // AllocatePaymentToVoteHeads - Allocates a payment across vote heads by priority
 // Kenya school accounting: Fees are cleared in order of priority
 // Priority 1 (e.g., Tuition) gets paid first, then Priority 2, etc.
 func AllocatePaymentToVoteHeads(payment *models.Payment, studentID, schoolID uint) ([]models.PaymentAllocation, error) {
+	return allocatePaymentToVoteHeads(models.DB, payment, studentID, schoolID)
+}
+
+// allocatePaymentToVoteHeads - AllocatePaymentToVoteHeads inside the caller's transaction
+// Write errors are returned so the caller can roll back
+func allocatePaymentToVoteHeads(tx *gorm.DB, payment *models.Payment, studentID, schoolID uint) ([]models.PaymentAllocation, error) {
 	if payment.Amount <= 0 {
 		return nil, errors.New("payment amount must be positive")
 	}
 
 	// Get student's vote head balances ordered by vote head priority (only active vote heads)
 	var balances []models.VoteHeadBalance
-	err := models.DB.
+	err := tx.
 		Joins("JOIN vote_heads ON vote_heads.id = vote_head_balances.vote_head_id").
 		Where("vote_head_balances.student_id = ? AND vote_head_balances.school_id = ?", studentID, schoolID).
 		Where("vote_heads.is_active = ?", true).
@@ -30,11 +43,11 @@ func AllocatePaymentToVoteHeads(payment *models.Payment, studentID, schoolID uin
 
 	// If no balances exist, initialize them from fee structure
 	if len(balances) == 0 {
-		if err := initializeStudentVoteHeadBalances(studentID, schoolID); err != nil {
+		if err := initializeStudentVoteHeadBalances(tx, studentID, schoolID); err != nil {
 			return nil, err
 		}
 		// Re-fetch (also filter by active vote heads)
-		models.DB.
+		tx.
 			Joins("JOIN vote_heads ON vote_heads.id = vote_head_balances.vote_head_id").
 			Where("vote_head_balances.student_id = ? AND vote_head_balances.school_id = ?", studentID, schoolID).
 			Where("vote_heads.is_active = ?", true).
@@ -76,14 +89,18 @@ func AllocatePaymentToVoteHeads(payment *models.Payment, studentID, schoolID uin
 		// Update balance
 		balance.Balance -= allocationAmount
 		balance.LastUpdated = time.Now()
-		models.DB.Save(balance)
+		if err := tx.Save(balance).Error; err != nil {
+			return nil, err
+		}
 
 		remainingAmount -= allocationAmount
 	}
 
 	// Save allocations
 	for i := range allocations {
-		models.DB.Create(&allocations[i])
+		if err := tx.Create(&allocations[i]).Error; err != nil {
+			return nil, err
+		}
 	}
 
 	// If there's overpayment, it stays as credit (negative balance on last vote head)
@@ -91,34 +108,39 @@ func AllocatePaymentToVoteHeads(payment *models.Payment, studentID, schoolID uin
 		lastBalance := &balances[len(balances)-1]
 		lastBalance.Balance -= remainingAmount
 		lastBalance.LastUpdated = time.Now()
-		models.DB.Save(lastBalance)
+		if err := tx.Save(lastBalance).Error; err != nil {
+			return nil, err
+		}
 	}
 
 	return allocations, nil
 }
 
 // initializeStudentVoteHeadBalances - Sets up vote head balances from fee structure
-func initializeStudentVoteHeadBalances(studentID, schoolID uint) error {
+func initializeStudentVoteHeadBalances(tx *gorm.DB, studentID, schoolID uint) error {
 	// Get student's class
 	var student models.Student
-	if err := models.DB.Where("id = ? AND school_id = ?", studentID, schoolID).First(&student).Error; err != nil {
+	if err := tx.Where("id = ? AND school_id = ?", studentID, schoolID).First(&student).Error; err != nil {
 		return err
 	}
 
 	if student.ClassID == nil {
-		return errors.New("student not assigned to a class")
+		return fmt.Errorf("%w: student not assigned to a class", ErrNoFeeStructure)
 	}
 
 	// Get fee structure for the class
 	var feeStructure models.FeeStructure
-	if err := models.DB.Where("class_id = ? AND school_id = ?", *student.ClassID, schoolID).
+	if err := tx.Where("class_id = ? AND school_id = ?", *student.ClassID, schoolID).
 		Order("created_at DESC").First(&feeStructure).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: no fee structure for the student's class", ErrNoFeeStructure)
+		}
 		return err
 	}
 
 	// Get fee items (vote head allocations)
 	var feeItems []models.FeeItem
-	models.DB.Where("fee_structure_id = ?", feeStructure.ID).Preload("VoteHead").Find(&feeItems)
+	tx.Where("fee_structure_id = ?", feeStructure.ID).Preload("VoteHead").Find(&feeItems)
 
 	// Create vote head balances
 	now := time.Now()
@@ -128,9 +150,12 @@ func initializeStudentVoteHeadBalances(studentID, schoolID uint) error {
 			VoteHeadID:  item.VoteHeadID,
 			SchoolID:    schoolID,
 			Balance:     item.Amount,
+			ChargedAt:   feeStructure.CreatedAt,
 			LastUpdated: now,
 		}
-		models.DB.Create(&balance)
+		if err := tx.Create(&balance).Error; err != nil {
+			return err
+		}
 	}
 
 	return nil
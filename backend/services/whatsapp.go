@@ -0,0 +1,313 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"schoolms-go/models"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// WhatsAppTemplateMessage - A pre-approved template and the values for its placeholders
+type WhatsAppTemplateMessage struct {
+	Name     string
+	Language string // WhatsApp language code, e.g. "en", "sw"
+	Params   []string
+}
+
+// WhatsAppProvider - WhatsApp Business Cloud API
+// It satisfies SMSProvider for free-form text, which WhatsApp only delivers within 24 hours
+// of the parent's last message; anything else must go through SendTemplate
+type WhatsAppProvider struct {
+	PhoneNumberID string
+	AccessToken   string
+	BaseURL       string // Defaults to WHATSAPP_API_URL or the Graph API
+	HTTP          *http.Client
+}
+
+func (p *WhatsAppProvider) Name() string { return models.SMSProviderWhatsApp }
+
+// Send - Free-form text message
+func (p *WhatsAppProvider) Send(to, message string) SMSResult {
+	return p.post(map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                strings.TrimPrefix(to, "+"),
+		"type":              "text",
+		"text":              map[string]string{"body": message},
+	})
+}
+
+// SendTemplate - Pre-approved template message, allowed at any time
+func (p *WhatsAppProvider) SendTemplate(to string, tmpl WhatsAppTemplateMessage) SMSResult {
+	params := make([]map[string]string, len(tmpl.Params))
+	for i, v := range tmpl.Params {
+		params[i] = map[string]string{"type": "text", "text": v}
+	}
+	template := map[string]interface{}{
+		"name":     tmpl.Name,
+		"language": map[string]string{"code": tmpl.Language},
+	}
+	if len(params) > 0 {
+		template["components"] = []map[string]interface{}{{"type": "body", "parameters": params}}
+	}
+	return p.post(map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                strings.TrimPrefix(NormalizePhone(to), "+"),
+		"type":              "template",
+		"template":          template,
+	})
+}
+
+func (p *WhatsAppProvider) post(payload map[string]interface{}) SMSResult {
+	if p.PhoneNumberID == "" || p.AccessToken == "" {
+		return SMSResult{Success: false, Error: "WhatsApp not configured"}
+	}
+
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", whatsAppBaseURL(p.BaseURL)+"/"+p.PhoneNumberID+"/messages", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.AccessToken)
+
+	resp, err := httpClient(p.HTTP).Do(req)
+	if err != nil {
+		return SMSResult{Success: false, Error: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Messages []struct {
+			ID string `json:"id"`
+		} `json:"messages"`
+		Error struct {
+			Message string `json:"message"`
+			Code    int    `json:"code"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if resp.StatusCode >= 300 || len(result.Messages) == 0 {
+		reason := result.Error.Message
+		if reason == "" {
+			reason = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		}
+		return SMSResult{Success: false, Status: fmt.Sprint(result.Error.Code), Error: reason}
+	}
+	return SMSResult{Success: true, Status: "accepted", MessageID: result.Messages[0].ID}
+}
+
+func whatsAppBaseURL(override string) string {
+	if override != "" {
+		return strings.TrimRight(override, "/")
+	}
+	if env := os.Getenv("WHATSAPP_API_URL"); env != "" {
+		return strings.TrimRight(env, "/")
+	}
+	return "https://graph.facebook.com/v20.0"
+}
+
+var (
+	whatsAppMu      sync.RWMutex
+	defaultWhatsApp *WhatsAppProvider
+)
+
+func init() {
+	if id := os.Getenv("WHATSAPP_PHONE_NUMBER_ID"); id != "" {
+		defaultWhatsApp = &WhatsAppProvider{PhoneNumberID: id, AccessToken: os.Getenv("WHATSAPP_ACCESS_TOKEN")}
+	}
+}
+
+// SetDefaultWhatsAppProvider - Replace the server-wide WhatsApp number (tests, local development)
+func SetDefaultWhatsAppProvider(p *WhatsAppProvider) {
+	whatsAppMu.Lock()
+	defer whatsAppMu.Unlock()
+	defaultWhatsApp = p
+}
+
+// WhatsAppProviderForSchool - The school's own WhatsApp number, or the server default; nil when neither is set
+func WhatsAppProviderForSchool(schoolID uint) *WhatsAppProvider {
+	var settings models.WhatsAppSettings
+	if schoolID != 0 && models.DB.Where("school_id = ?", schoolID).First(&settings).Error == nil {
+		return &WhatsAppProvider{PhoneNumberID: settings.PhoneNumberID, AccessToken: settings.AccessToken}
+	}
+
+	whatsAppMu.RLock()
+	defer whatsAppMu.RUnlock()
+	return defaultWhatsApp
+}
+
+// defaultWhatsAppTemplates - Template names and parameter order we ask schools to get approved
+var defaultWhatsAppTemplates = map[string]models.WhatsAppTemplate{
+	models.TemplateFeeReminder: {
+		TemplateName: "fee_reminder",
+		Params:       "student_name,adm_no,balance,paybill,school_name",
+	},
+	models.TemplatePaymentConfirmation: {
+		TemplateName: "payment_receipt",
+		Params:       "amount,student_name,adm_no,balance,school_name",
+	},
+}
+
+// WhatsAppTemplateNames - Message templates that can go out on WhatsApp, sorted
+func WhatsAppTemplateNames() []string {
+	names := make([]string, 0, len(defaultWhatsAppTemplates))
+	for name := range defaultWhatsAppTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetWhatsAppTemplate - The school's mapping for a message template, or the default
+func GetWhatsAppTemplate(schoolID uint, name string) (models.WhatsAppTemplate, bool) {
+	var tmpl models.WhatsAppTemplate
+	if models.DB.Where("school_id = ? AND name = ?", schoolID, name).First(&tmpl).Error == nil {
+		return tmpl, true
+	}
+	tmpl, ok := defaultWhatsAppTemplates[name]
+	tmpl.SchoolID = schoolID
+	tmpl.Name = name
+	return tmpl, ok
+}
+
+// WhatsAppParams - Merge field values in the order the template expects
+func WhatsAppParams(tmpl models.WhatsAppTemplate, fields MergeFields) []string {
+	var params []string
+	for _, field := range strings.Split(tmpl.Params, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			value := fields[field]
+			if value == "" {
+				value = "-" // WhatsApp rejects empty parameters
+			}
+			params = append(params, value)
+		}
+	}
+	return params
+}
+
+// GuardianMessage - A templated message for one guardian, on the channel they prefer
+// WhatsApp is used only when the guardian asked for it, the school has a number and the
+// template is mapped; the SMS text is always filled in for the fallback
+func GuardianMessage(schoolID uint, guardian Guardian, template string, fields MergeFields) (SMSMessage, error) {
+	text, err := RenderMessage(schoolID, template, guardian.Language, fields)
+	if err != nil {
+		return SMSMessage{}, err
+	}
+	msg := SMSMessage{To: guardian.Phone, Message: text}
+
+	if guardian.Channel != models.ChannelWhatsApp || WhatsAppProviderForSchool(schoolID) == nil {
+		return msg, nil
+	}
+	tmpl, ok := GetWhatsAppTemplate(schoolID, template)
+	if !ok {
+		return msg, nil
+	}
+	language := guardian.Language
+	if language == "" {
+		language = models.LanguageEnglish
+	}
+	msg.WhatsApp = &WhatsAppTemplateMessage{
+		Name:     tmpl.TemplateName,
+		Language: language,
+		Params:   WhatsAppParams(tmpl, WithSchoolFields(schoolID, fields)),
+	}
+	return msg, nil
+}
+
+// VerifyWhatsAppSignature - Check X-Hub-Signature-256 against WHATSAPP_APP_SECRET (skipped when unset)
+func VerifyWhatsAppSignature(body []byte, signature string) bool {
+	secret := os.Getenv("WHATSAPP_APP_SECRET")
+	if secret == "" {
+		return true
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// WhatsAppWebhook - The parts of a Cloud API webhook we act on
+type WhatsAppWebhook struct {
+	Entry []struct {
+		Changes []struct {
+			Value struct {
+				Metadata struct {
+					PhoneNumberID string `json:"phone_number_id"`
+				} `json:"metadata"`
+				Messages []struct {
+					From string `json:"from"`
+					ID   string `json:"id"`
+					Type string `json:"type"`
+					Text struct {
+						Body string `json:"body"`
+					} `json:"text"`
+					Button struct {
+						Text string `json:"text"`
+					} `json:"button"`
+					Interactive struct {
+						ButtonReply struct {
+							Title string `json:"title"`
+						} `json:"button_reply"`
+						ListReply struct {
+							Title string `json:"title"`
+						} `json:"list_reply"`
+					} `json:"interactive"`
+				} `json:"messages"`
+				Statuses []struct {
+					ID     string `json:"id"`
+					Status string `json:"status"`
+					Errors []struct {
+						Title string `json:"title"`
+					} `json:"errors"`
+				} `json:"statuses"`
+			} `json:"value"`
+		} `json:"changes"`
+	} `json:"entry"`
+}
+
+// HandleWhatsAppWebhook - Store replies and record delivery statuses; returns how many of each
+func HandleWhatsAppWebhook(body []byte) (int, int, error) {
+	var hook WhatsAppWebhook
+	if err := json.Unmarshal(body, &hook); err != nil {
+		return 0, 0, err
+	}
+
+	replies, statuses := 0, 0
+	for _, entry := range hook.Entry {
+		for _, change := range entry.Changes {
+			value := change.Value
+			for _, m := range value.Messages {
+				text := m.Text.Body
+				switch {
+				case m.Button.Text != "":
+					text = m.Button.Text
+				case m.Interactive.ButtonReply.Title != "":
+					text = m.Interactive.ButtonReply.Title
+				case m.Interactive.ListReply.Title != "":
+					text = m.Interactive.ListReply.Title
+				case text == "":
+					text = "[" + m.Type + "]"
+				}
+				if _, err := HandleInboundMessage(models.ChannelWhatsApp, "+"+m.From, value.Metadata.PhoneNumberID, text, m.ID); err == nil {
+					replies++
+				}
+			}
+			for _, s := range value.Statuses {
+				reason := ""
+				if len(s.Errors) > 0 {
+					reason = s.Errors[0].Title
+				}
+				if _, err := HandleDeliveryReport(s.ID, s.Status, reason); err == nil {
+					statuses++
+				}
+			}
+		}
+	}
+	return replies, statuses, nil
+}
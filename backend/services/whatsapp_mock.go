@@ -0,0 +1,129 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// WhatsAppMockMessage - A send received by WhatsAppCloudMock
+type WhatsAppMockMessage struct {
+	PhoneNumberID string
+	To            string
+	Type          string // template or text
+	Template      string
+	Language      string
+	Params        []string
+	Text          string
+}
+
+// WhatsAppCloudMock - Local stand-in for the Cloud API messages endpoint, for tests and development
+type WhatsAppCloudMock struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	sent     []WhatsAppMockMessage
+	failWith string
+}
+
+// StartWhatsAppCloudMock - Serve POST /{phone-number-id}/messages on a local port
+func StartWhatsAppCloudMock() *WhatsAppCloudMock {
+	m := &WhatsAppCloudMock{}
+	m.server = httptest.NewServer(http.HandlerFunc(m.handle))
+	return m
+}
+
+// URL - Base URL to use as WHATSAPP_API_URL or WhatsAppProvider.BaseURL
+func (m *WhatsAppCloudMock) URL() string { return m.server.URL }
+
+// Provider - A provider pointed at the mock
+func (m *WhatsAppCloudMock) Provider(phoneNumberID string) *WhatsAppProvider {
+	return &WhatsAppProvider{PhoneNumberID: phoneNumberID, AccessToken: "test-token", BaseURL: m.URL()}
+}
+
+// FailWith - Reject every following send with this error; "" accepts them again
+func (m *WhatsAppCloudMock) FailWith(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failWith = reason
+}
+
+// Sent - Messages accepted so far
+func (m *WhatsAppCloudMock) Sent() []WhatsAppMockMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]WhatsAppMockMessage(nil), m.sent...)
+}
+
+// Close - Stop the server
+func (m *WhatsAppCloudMock) Close() { m.server.Close() }
+
+func (m *WhatsAppCloudMock) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reject := func(status, code int, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"message": message, "code": code}})
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 2 || parts[1] != "messages" {
+		reject(http.StatusNotFound, 100, "Unknown path")
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		reject(http.StatusUnauthorized, 190, "Invalid OAuth access token")
+		return
+	}
+
+	var body struct {
+		To       string                `json:"to"`
+		Type     string                `json:"type"`
+		Text     struct{ Body string } `json:"text"`
+		Template struct {
+			Name     string `json:"name"`
+			Language struct {
+				Code string `json:"code"`
+			} `json:"language"`
+			Components []struct {
+				Parameters []struct {
+					Text string `json:"text"`
+				} `json:"parameters"`
+			} `json:"components"`
+		} `json:"template"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.To == "" {
+		reject(http.StatusBadRequest, 100, "Invalid parameter")
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failWith != "" {
+		reject(http.StatusBadRequest, 131026, m.failWith)
+		return
+	}
+
+	msg := WhatsAppMockMessage{
+		PhoneNumberID: parts[0],
+		To:            body.To,
+		Type:          body.Type,
+		Template:      body.Template.Name,
+		Language:      body.Template.Language.Code,
+		Text:          body.Text.Body,
+	}
+	for _, c := range body.Template.Components {
+		for _, p := range c.Parameters {
+			msg.Params = append(msg.Params, p.Text)
+		}
+	}
+	m.sent = append(m.sent, msg)
+
+	id := fmt.Sprintf("wamid.mock%d", len(m.sent))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"contacts":          []map[string]string{{"input": body.To, "wa_id": body.To}},
+		"messages":          []map[string]string{{"id": id}},
+	})
+}
@@ -0,0 +1,146 @@
+package services_test
+
+import (
+	"schoolms-go/models"
+	"schoolms-go/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func setupWhatsAppTest(t *testing.T) (*gorm.DB, *services.WhatsAppCloudMock, *services.MemorySMSProvider) {
+	db := setupTestDB(t)
+	db.AutoMigrate(&models.SMSSettings{}, &models.SMSLog{}, &models.MessageJob{}, &models.OutboundMessage{},
+		&models.SMSWallet{}, &models.SMSCreditTransaction{}, &models.SMSOptOut{}, &models.InboundMessage{},
+		&models.ParentStudent{}, &models.WhatsAppSettings{}, &models.WhatsAppTemplate{}, &models.MessageTemplate{})
+	t.Cleanup(func() { sqlDB, _ := db.DB(); sqlDB.Close() })
+
+	mock := services.StartWhatsAppCloudMock()
+	t.Cleanup(mock.Close)
+	services.SetDefaultWhatsAppProvider(mock.Provider("100200300"))
+	t.Cleanup(func() { services.SetDefaultWhatsAppProvider(nil) })
+
+	sms := &services.MemorySMSProvider{}
+	services.SetDefaultSMSProvider(sms)
+	t.Cleanup(func() { services.SetDefaultSMSProvider(nil) })
+	return db, mock, sms
+}
+
+func TestGuardianMessage_FollowsChannelPreference(t *testing.T) {
+	db, _, _ := setupWhatsAppTest(t)
+	school := models.School{Name: "Shule Bora", Paybill: "247247"}
+	db.Create(&school)
+
+	fields := services.MergeFields{"student_name": "Amani", "adm_no": "ADM001", "balance": "1,500.00"}
+
+	msg, err := services.GuardianMessage(school.ID, services.Guardian{Phone: "+254712345678", Channel: models.ChannelSMS}, models.TemplateFeeReminder, fields)
+	assert.NoError(t, err)
+	assert.Nil(t, msg.WhatsApp)
+
+	msg, err = services.GuardianMessage(school.ID, services.Guardian{Phone: "+254712345678", Language: "sw", Channel: models.ChannelWhatsApp}, models.TemplateFeeReminder, fields)
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Message, "salio la karo") // SMS fallback text is still rendered
+	assert.Equal(t, "fee_reminder", msg.WhatsApp.Name)
+	assert.Equal(t, "sw", msg.WhatsApp.Language)
+	assert.Equal(t, []string{"Amani", "ADM001", "1,500.00", "247247", "Shule Bora"}, msg.WhatsApp.Params)
+
+	// Attendance alerts have no approved template, so they stay on SMS
+	msg, _ = services.GuardianMessage(school.ID, services.Guardian{Phone: "+254712345678", Channel: models.ChannelWhatsApp}, models.TemplateAttendanceAlert, fields)
+	assert.Nil(t, msg.WhatsApp)
+}
+
+func TestOutbox_WhatsAppDeliveredWithoutSMSCharge(t *testing.T) {
+	db, mock, sms := setupWhatsAppTest(t)
+
+	job, err := services.EnqueueMessages(1, 1, models.MessageJobFeeReminder, []services.SMSMessage{{
+		To: "0712345678", Message: "Fee reminder",
+		WhatsApp: &services.WhatsAppTemplateMessage{Name: "fee_reminder", Language: "en", Params: []string{"Amani", "ADM001"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, services.ProcessOutbox(10))
+
+	sent := mock.Sent()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, "254712345678", sent[0].To)
+	assert.Equal(t, "100200300", sent[0].PhoneNumberID)
+	assert.Equal(t, []string{"Amani", "ADM001"}, sent[0].Params)
+	assert.Empty(t, sms.Sent())
+
+	var row models.OutboundMessage
+	db.First(&row)
+	assert.Equal(t, models.OutboxSent, row.Status)
+	assert.Equal(t, models.ChannelWhatsApp, row.Channel)
+	assert.Equal(t, "wamid.mock1", row.ProviderMessageID)
+
+	var charges int64
+	db.Model(&models.SMSCreditTransaction{}).Where("amount <> 0").Count(&charges)
+	assert.Zero(t, charges)
+
+	db.First(job, job.ID)
+	assert.Equal(t, models.JobCompleted, job.Status)
+	assert.Equal(t, 1, job.Sent)
+}
+
+func TestOutbox_WhatsAppFailureFallsBackToSMS(t *testing.T) {
+	db, mock, sms := setupWhatsAppTest(t)
+	mock.FailWith("Message undeliverable")
+
+	_, err := services.EnqueueMessages(1, 1, models.MessageJobAlert, []services.SMSMessage{{
+		To: "0712345678", Message: "Payment received",
+		WhatsApp: &services.WhatsAppTemplateMessage{Name: "payment_receipt", Language: "en"},
+	}})
+	assert.NoError(t, err)
+	services.ProcessOutbox(10)
+
+	assert.Empty(t, mock.Sent())
+	assert.Len(t, sms.Sent(), 1)
+	assert.Equal(t, "Payment received", sms.Sent()[0].Message)
+
+	var row models.OutboundMessage
+	db.First(&row)
+	assert.Equal(t, models.OutboxSent, row.Status)
+	assert.Equal(t, models.ChannelSMS, row.Channel)
+	assert.Greater(t, row.Charge, 0.0)
+
+	var logs []models.SMSLog
+	db.Order("id").Find(&logs)
+	assert.Len(t, logs, 2)
+	assert.Equal(t, models.SMSProviderWhatsApp, logs[0].Provider)
+	assert.Equal(t, "Message undeliverable", logs[0].Error)
+
+	wallet, _ := services.GetSMSWallet(1)
+	assert.Equal(t, -row.Charge, wallet.Balance) // Postpaid: charged only for the SMS fallback
+}
+
+func TestHandleWhatsAppWebhook_StoresRepliesAndStatuses(t *testing.T) {
+	db, _, _ := setupWhatsAppTest(t)
+
+	school := models.School{Name: "Shule Bora"}
+	db.Create(&school)
+	db.Create(&models.WhatsAppSettings{SchoolID: school.ID, PhoneNumberID: "555", AccessToken: "t"})
+	parent := models.User{Email: "p@test.com", Role: "PARENT", SchoolID: &school.ID, Phone: "+254712345678", PhoneVerified: true}
+	db.Create(&parent)
+	db.Create(&models.SMSLog{SchoolID: school.ID, Provider: models.SMSProviderWhatsApp, ProviderMessageID: "wamid.out1"})
+
+	body := `{"object":"whatsapp_business_account","entry":[{"id":"1","changes":[{"field":"messages","value":{
+		"messaging_product":"whatsapp","metadata":{"display_phone_number":"254700000000","phone_number_id":"555"},
+		"messages":[{"from":"254712345678","id":"wamid.in1","type":"text","text":{"body":"Asante, nitalipa kesho"}}],
+		"statuses":[{"id":"wamid.out1","status":"read","recipient_id":"254712345678"}]}}]}]}`
+
+	replies, statuses, err := services.HandleWhatsAppWebhook([]byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replies)
+	assert.Equal(t, 1, statuses)
+
+	var inbound models.InboundMessage
+	db.First(&inbound)
+	assert.Equal(t, school.ID, inbound.SchoolID)
+	assert.Equal(t, models.ChannelWhatsApp, inbound.Channel)
+	assert.Equal(t, parent.ID, *inbound.UserID)
+	assert.Equal(t, "Asante, nitalipa kesho", inbound.Text)
+
+	var log models.SMSLog
+	db.First(&log)
+	assert.Equal(t, models.DeliveryDelivered, log.DeliveryStatus)
+}
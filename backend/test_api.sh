@@ -87,7 +87,7 @@ echo "\n--- 7. Verify Data Isolation (Student listing classes) ---"
 # First we need student ID.
 # For MVP we don't have a "me" endpoint, so we decode token or guess ID?
 # The login response didn't return ID.
-# Let's fallback to checking if Student can List Students (RoleGuard should block it: SchoolAdmin/Teacher only)
+# Let's fallback to checking if Student can List Students (students.view should block it: SchoolAdmin/Teacher/Finance only)
 
 echo "Attempting to list students as Student (Should Fail/403):"
 curl -s -o /dev/null -w "%{http_code}" -X GET $BASE_URL/students \
@@ -8,10 +8,25 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// AccessTokenTTL - How long an access token is valid; clients renew it with their refresh token
+const AccessTokenTTL = 15 * time.Minute
+
+// PreAuthTokenTTL - How long a user has to enter their two-factor code after their password
+const PreAuthTokenTTL = 5 * time.Minute
+
+// Pre-auth token purposes; such tokens are only accepted by the two-factor endpoints
+const (
+	PurposeTwoFactor      = "2fa"       // Password checked, code still to be verified
+	PurposeTwoFactorSetup = "2fa_setup" // Password checked, two-factor must be set up first
+)
+
 type Claims struct {
-	UserID   uint   `json:"sub"`
-	Role     string `json:"role"`
-	SchoolID *uint  `json:"school_id,omitempty"`
+	UserID       uint   `json:"sub"`
+	Role         string `json:"role"`
+	SchoolID     *uint  `json:"school_id,omitempty"`
+	SessionID    uint   `json:"sid,omitempty"`     // The UserSession it was issued for; checked for revocation
+	MembershipID uint   `json:"mid,omitempty"`     // The active Membership; 0 when acting in the user's home school and role
+	Purpose      string `json:"purpose,omitempty"` // Set on pre-auth tokens only
 	jwt.RegisteredClaims
 }
 
@@ -24,15 +39,18 @@ func getJWTSecret() []byte {
 	return []byte(secret)
 }
 
-func GenerateToken(userID uint, role string, schoolID *uint) (string, error) {
+// GenerateAccessToken - A short-lived access token for a session, acting as a membership (0 for the home one)
+func GenerateAccessToken(userID uint, role string, schoolID *uint, sessionID, membershipID uint) (string, error) {
 	jwtSecret := getJWTSecret()
 
 	claims := Claims{
-		UserID:   userID,
-		Role:     role,
-		SchoolID: schoolID,
+		UserID:       userID,
+		Role:         role,
+		SchoolID:     schoolID,
+		SessionID:    sessionID,
+		MembershipID: membershipID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "schoolms-api",
 		},
@@ -42,6 +60,22 @@ func GenerateToken(userID uint, role string, schoolID *uint) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
+// GeneratePreAuthToken - A short-lived token proving the password was right, for finishing a two-factor sign-in
+func GeneratePreAuthToken(userID uint, role string, schoolID *uint, purpose string) (string, error) {
+	claims := Claims{
+		UserID:   userID,
+		Role:     role,
+		SchoolID: schoolID,
+		Purpose:  purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(PreAuthTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "schoolms-api",
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(getJWTSecret())
+}
+
 func ValidateToken(tokenString string) (*Claims, error) {
 	jwtSecret := getJWTSecret()
 
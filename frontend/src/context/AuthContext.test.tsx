@@ -2,6 +2,15 @@ import { describe, it, expect, beforeEach, afterEach, vi } from 'vitest'
 import { render, screen, act } from '@testing-library/react'
 import { AuthProvider, useAuth } from '../context/AuthContext'
 import { BrowserRouter } from 'react-router-dom'
+import { SESSION_EXPIRED_EVENT } from '../services/tokens'
+
+vi.mock('../services/api', () => ({
+    default: {
+        post: vi.fn(() => Promise.resolve({ data: {} })),
+    },
+}))
+
+import api from '../services/api'
 
 // Test component that exposes auth context
 function TestAuthConsumer() {
@@ -12,7 +21,7 @@ function TestAuthConsumer() {
             <span data-testid="role">{auth.role || 'none'}</span>
             <span data-testid="token">{auth.token || 'none'}</span>
             <span data-testid="user">{auth.user ? JSON.stringify(auth.user) : 'null'}</span>
-            <button onClick={() => auth.login('test-token', 'STUDENT', { id: 1, email: 'test@test.com' })}>
+            <button onClick={() => auth.login('test-token', 'STUDENT', { id: 1, email: 'test@test.com' }, 'test-refresh')}>
                 Login
             </button>
             <button onClick={auth.logout}>Logout</button>
@@ -182,6 +191,46 @@ describe('AuthContext', () => {
             })
             expect(localStorage.getItem('role')).toBeNull()
         })
+
+        it('keeps and clears the refresh token with the access token', async () => {
+            renderWithProvider()
+
+            await act(async () => {
+                screen.getByText('Login').click()
+            })
+            expect(localStorage.getItem('refresh_token')).toBe('test-refresh')
+
+            await act(async () => {
+                screen.getByText('Logout').click()
+            })
+            expect(localStorage.getItem('refresh_token')).toBeNull()
+        })
+
+        it('revokes the session on the server with the refresh token', async () => {
+            renderWithProvider()
+
+            await act(async () => {
+                screen.getByText('Login').click()
+            })
+            await act(async () => {
+                screen.getByText('Logout').click()
+            })
+            expect(api.post).toHaveBeenCalledWith('/auth/logout', { refresh_token: 'test-refresh' })
+        })
+
+        it('logs out when the API client reports the session has ended', async () => {
+            renderWithProvider()
+
+            await act(async () => {
+                screen.getByText('Login').click()
+            })
+            await act(async () => {
+                window.dispatchEvent(new Event(SESSION_EXPIRED_EVENT))
+            })
+            expect(screen.getByTestId('isAuthenticated').textContent).toBe('false')
+            expect(localStorage.getItem('token')).toBeNull()
+            expect(api.post).not.toHaveBeenCalled() // The server already refused the session
+        })
     })
 
     describe('Persistence (pre-existing localStorage)', () => {
@@ -1,10 +1,12 @@
 import { createContext, useContext, useState, useEffect, type ReactNode } from 'react';
+import api from '../services/api';
+import { SESSION_EXPIRED_EVENT, clearTokens, storeTokens } from '../services/tokens';
 
 interface AuthContextType {
     user: any | null; // Replace any with proper User type
     token: string | null;
     role: string | null;
-    login: (token: string, role: string, user: any) => void;
+    login: (token: string, role: string, user: any, refreshToken?: string) => void;
     logout: () => void;
     isAuthenticated: boolean;
 }
@@ -20,22 +22,38 @@ export const AuthProvider = ({ children }: { children: ReactNode }) => {
         // Ideally verify token validity here or fetch user profile
     }, [token]);
 
-    const login = (newToken: string, newRole: string, newUser: any) => {
-        localStorage.setItem('token', newToken);
+    const login = (newToken: string, newRole: string, newUser: any, refreshToken?: string) => {
+        storeTokens(newToken, refreshToken);
         localStorage.setItem('role', newRole);
         setToken(newToken);
         setRole(newRole);
         setUser(newUser);
     };
 
-    const logout = () => {
-        localStorage.removeItem('token');
+    const clearSession = () => {
+        clearTokens();
         localStorage.removeItem('role');
         setToken(null);
         setRole(null);
         setUser(null);
     };
 
+    // Revoke the session on the server too, so the refresh token stops working; signing out locally
+    // doesn't wait for it or depend on it succeeding
+    const logout = () => {
+        const refreshToken = localStorage.getItem('refresh_token');
+        if (refreshToken) {
+            api.post('/auth/logout', { refresh_token: refreshToken }).catch(() => {});
+        }
+        clearSession();
+    };
+
+    // The API client couldn't refresh the access token, so the session has already ended on the server
+    useEffect(() => {
+        window.addEventListener(SESSION_EXPIRED_EVENT, clearSession);
+        return () => window.removeEventListener(SESSION_EXPIRED_EVENT, clearSession);
+    }, []);
+
     return (
         <AuthContext.Provider value={{ user, token, role, login, logout, isAuthenticated: !!token }}>
             {children}
@@ -18,6 +18,16 @@ interface ImportResult {
     imported: number;
     skipped: number;
     errors: ImportRow[];
+    guardian_matches: GuardianMatch[] | null;
+}
+
+// A parent_phone that belongs to an existing guardian; staff link them from the student's page
+interface GuardianMatch {
+    row_num: number;
+    adm_no: string;
+    student_id: number;
+    parent_id: number;
+    phone: string;
 }
 
 export default function ImportPage() {
@@ -244,6 +254,20 @@ export default function ImportPage() {
                             <p className="text-sm text-amber-600">Skipped</p>
                         </div>
                     </div>
+                    {result.guardian_matches && result.guardian_matches.length > 0 && (
+                        <div className="bg-amber-50 rounded-xl p-4 mb-4">
+                            <p className="font-medium text-amber-800 mb-2">
+                                {result.guardian_matches.length} phone number(s) belong to existing guardians and were not linked
+                            </p>
+                            <ul className="text-sm text-amber-700 space-y-1">
+                                {result.guardian_matches.map((m) => (
+                                    <li key={m.row_num}>
+                                        Row {m.row_num}: {m.adm_no} - {m.phone}
+                                    </li>
+                                ))}
+                            </ul>
+                        </div>
+                    )}
                     <button
                         onClick={resetForm}
                         className="px-6 py-3 bg-primary-600 text-white rounded-xl font-medium hover:bg-primary-700"
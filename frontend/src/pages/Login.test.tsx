@@ -20,6 +20,7 @@ import api from '../services/api'
 
 describe('Login Page', () => {
     beforeEach(() => {
+        localStorage.clear()
         vi.clearAllMocks()
     })
 
@@ -192,6 +193,95 @@ describe('Login Page', () => {
         })
     })
 
+    // ============ Two-Step Sign-In Tests ============
+    describe('Two-Step Sign-In', () => {
+        const signIn = () => {
+            fireEvent.change(screen.getByPlaceholderText('admin@school.com'), {
+                target: { value: 'admin@example.com' }
+            })
+            fireEvent.change(screen.getByPlaceholderText('••••••••'), {
+                target: { value: 'password123' }
+            })
+            fireEvent.click(screen.getByRole('button', { name: /sign in/i }))
+        }
+
+        const session = {
+            access_token: 'access', refresh_token: 'refresh',
+            user: { id: 1, email: 'admin@example.com', role: 'SCHOOLADMIN' },
+        }
+
+        it('asks for the two-factor code and verifies it with the pre-auth token', async () => {
+            vi.mocked(api.post)
+                .mockResolvedValueOnce({ data: { two_factor_required: true, two_factor_setup_required: false, pre_auth_token: 'pre' } })
+                .mockResolvedValueOnce({ data: session })
+
+            render(<Login />)
+            signIn()
+
+            await waitFor(() => {
+                expect(screen.getByText('Two-factor sign-in')).toBeInTheDocument()
+            })
+            fireEvent.change(screen.getByPlaceholderText('123456'), { target: { value: '654321' } })
+            fireEvent.click(screen.getByRole('button', { name: /verify/i }))
+
+            await waitFor(() => {
+                expect(api.post).toHaveBeenLastCalledWith('/auth/2fa/verify', { code: '654321' }, {
+                    headers: { Authorization: 'Bearer pre' }
+                })
+                expect(localStorage.getItem('token')).toBe('access')
+            })
+        })
+
+        it('sets two-factor up when the school requires it and shows the recovery codes', async () => {
+            vi.mocked(api.post)
+                .mockResolvedValueOnce({ data: { two_factor_required: true, two_factor_setup_required: true, pre_auth_token: 'pre' } })
+                .mockResolvedValueOnce({ data: { secret: 'JBSWY3DP', qr_code: 'data:image/png;base64,AAAA' } })
+                .mockResolvedValueOnce({ data: { ...session, recovery_codes: ['aaaa-bbbb', 'cccc-dddd'] } })
+
+            render(<Login />)
+            signIn()
+
+            await waitFor(() => {
+                expect(screen.getByText('JBSWY3DP')).toBeInTheDocument()
+            })
+            expect(api.post).toHaveBeenCalledWith('/auth/2fa/setup', {}, { headers: { Authorization: 'Bearer pre' } })
+            fireEvent.change(screen.getByPlaceholderText('123456'), { target: { value: '654321' } })
+            fireEvent.click(screen.getByRole('button', { name: /verify/i }))
+
+            await waitFor(() => {
+                expect(screen.getByText('aaaa-bbbb')).toBeInTheDocument()
+            })
+            expect(api.post).toHaveBeenLastCalledWith('/auth/2fa/enable', { code: '654321' }, {
+                headers: { Authorization: 'Bearer pre' }
+            })
+            fireEvent.click(screen.getByRole('button', { name: /saved them/i }))
+            expect(localStorage.getItem('token')).toBe('access')
+        })
+
+        it('makes the user change their password before entering', async () => {
+            vi.mocked(api.post)
+                .mockResolvedValueOnce({ data: { ...session, must_change_password: true } })
+                .mockResolvedValueOnce({ data: { message: 'Password changed' } })
+
+            render(<Login />)
+            signIn()
+
+            await waitFor(() => {
+                expect(screen.getByText('Choose a new password')).toBeInTheDocument()
+            })
+            expect(localStorage.getItem('token')).toBeNull()
+            fireEvent.change(screen.getByPlaceholderText('At least 6 characters'), { target: { value: 'new-secret' } })
+            fireEvent.click(screen.getByRole('button', { name: /change password/i }))
+
+            await waitFor(() => {
+                expect(api.post).toHaveBeenLastCalledWith('/auth/change-password', {
+                    current_password: 'password123', new_password: 'new-secret'
+                }, { headers: { Authorization: 'Bearer access' } })
+                expect(localStorage.getItem('token')).toBe('access')
+            })
+        })
+    })
+
     // ============ Error Handling Tests ============
     describe('Error Handling', () => {
         it('shows error message on failed login', async () => {
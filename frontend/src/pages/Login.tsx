@@ -4,37 +4,128 @@ import { useNavigate } from 'react-router-dom';
 import api from '../services/api';
 import { School, Loader2 } from 'lucide-react';
 
+// Sign-in steps after the password: a two-factor code, setting two-factor up, showing the new
+// recovery codes once, and a forced password change (e.g. an account created by an admin)
+type Step = 'credentials' | 'code' | 'setup' | 'recovery' | 'password';
+
+interface TwoFactorSetup {
+    secret: string;
+    qr_code: string;
+}
+
+const STEP_TITLES: Record<Step, { title: string; hint: string }> = {
+    credentials: { title: 'Welcome back', hint: 'Please enter your details to sign in.' },
+    code: { title: 'Two-factor sign-in', hint: 'Enter the 6-digit code from your authenticator app, or a recovery code.' },
+    setup: { title: 'Set up two-factor', hint: 'Your school requires two-factor sign-in. Scan the code with your authenticator app, then enter the code it shows.' },
+    recovery: { title: 'Save your recovery codes', hint: 'Each code signs you in once if you lose your phone. They will not be shown again.' },
+    password: { title: 'Choose a new password', hint: 'You must change your password before continuing.' },
+};
+
+const SUBMIT_CLASS = 'w-full bg-gradient-to-r from-primary-600 to-primary-700 hover:from-primary-700 hover:to-primary-800 text-white font-bold py-3.5 rounded-xl shadow-lg shadow-primary-500/20 transition-all transform active:scale-[0.98] flex items-center justify-center';
+
+const INPUT_CLASS = 'w-full px-4 py-3 rounded-xl border border-slate-200 focus:border-primary-500 focus:ring-4 focus:ring-primary-500/10 outline-none transition-all placeholder:text-slate-400 bg-slate-50 hover:bg-white';
+
+// The pre-auth token from a two-step login stands in for the session until the code is accepted
+const withToken = (token: string) => ({ headers: { Authorization: `Bearer ${token}` } });
+
 export default function Login() {
     const [email, setEmail] = useState('');
     const [password, setPassword] = useState('');
     const [loading, setLoading] = useState(false);
     const [error, setError] = useState('');
+    const [step, setStep] = useState<Step>('credentials');
+    const [preAuthToken, setPreAuthToken] = useState('');
+    const [code, setCode] = useState('');
+    const [setup, setSetup] = useState<TwoFactorSetup | null>(null);
+    const [recoveryCodes, setRecoveryCodes] = useState<string[]>([]);
+    const [newPassword, setNewPassword] = useState('');
+    const [session, setSession] = useState<any>(null);
     const { login } = useAuth();
     const navigate = useNavigate();
 
-    const handleSubmit = async (e: React.FormEvent) => {
-        e.preventDefault();
-        setLoading(true);
-        setError('');
+    // enter - Store the session and go to the user's home page
+    const enter = (data: any) => {
+        login(data.access_token, data.user.role, data.user, data.refresh_token);
 
-        try {
-            const response = await api.post('/auth/login', { email, password });
-            const { access_token, user } = response.data;
+        if (data.user.role === 'SUPERADMIN') {
+            navigate('/superadmin');
+        } else {
+            navigate('/dashboard');
+        }
+    };
 
-            login(access_token, user.role, user);
+    // signedIn - A session was opened; it may still need the recovery codes shown or a new password
+    const signedIn = (data: any) => {
+        setSession(data);
+        if (data.recovery_codes?.length) {
+            setRecoveryCodes(data.recovery_codes);
+            setStep('recovery');
+        } else if (data.must_change_password) {
+            setStep('password');
+        } else {
+            enter(data);
+        }
+    };
 
-            if (user.role === 'SUPERADMIN') {
-                navigate('/superadmin');
-            } else {
-                navigate('/dashboard');
-            }
+    const run = async (action: () => Promise<void>, fallback: string) => {
+        setLoading(true);
+        setError('');
+        try {
+            await action();
         } catch (err: any) {
-            setError(err.response?.data?.error || 'Login failed. Please try again.');
+            setError(err.response?.data?.error || fallback);
         } finally {
             setLoading(false);
         }
     };
 
+    const handleSubmit = (e: React.FormEvent) => {
+        e.preventDefault();
+        run(async () => {
+            const response = await api.post('/auth/login', { email, password });
+            const data = response.data;
+
+            if (data.two_factor_required) {
+                setPreAuthToken(data.pre_auth_token);
+                setCode('');
+                if (data.two_factor_setup_required) {
+                    const started = await api.post('/auth/2fa/setup', {}, withToken(data.pre_auth_token));
+                    setSetup(started.data);
+                    setStep('setup');
+                } else {
+                    setStep('code');
+                }
+                return;
+            }
+            signedIn(data);
+        }, 'Login failed. Please try again.');
+    };
+
+    const handleCode = (e: React.FormEvent) => {
+        e.preventDefault();
+        const path = step === 'setup' ? '/auth/2fa/enable' : '/auth/2fa/verify';
+        run(async () => {
+            const response = await api.post(path, { code }, withToken(preAuthToken));
+            signedIn(response.data);
+        }, 'Verification failed. Please try again.');
+    };
+
+    const handlePasswordChange = (e: React.FormEvent) => {
+        e.preventDefault();
+        run(async () => {
+            await api.post('/auth/change-password', { current_password: password, new_password: newPassword }, withToken(session.access_token));
+            enter(session);
+        }, 'Could not change password. Please try again.');
+    };
+
+    const restart = () => {
+        setStep('credentials');
+        setPreAuthToken('');
+        setSetup(null);
+        setCode('');
+        setError('');
+    };
+
     return (
         <div className="min-h-screen flex font-sans">
             {/* Left Side - Hero / Branding */}
@@ -75,8 +166,8 @@ export default function Login() {
                                 <School className="h-10 w-10 text-primary-600" />
                             </div>
                         </div>
-                        <h2 className="text-3xl font-bold text-slate-900 tracking-tight">Welcome back</h2>
-                        <p className="mt-2 text-slate-500">Please enter your details to sign in.</p>
+                        <h2 className="text-3xl font-bold text-slate-900 tracking-tight">{STEP_TITLES[step].title}</h2>
+                        <p className="mt-2 text-slate-500">{STEP_TITLES[step].hint}</p>
                     </div>
 
                     {error && (
@@ -88,53 +179,121 @@ export default function Login() {
                         </div>
                     )}
 
-                    <form onSubmit={handleSubmit} className="space-y-6">
-                        <div className="space-y-5">
+                    {step === 'credentials' && (
+                        <form onSubmit={handleSubmit} className="space-y-6">
+                            <div className="space-y-5">
+                                <div>
+                                    <label className="text-sm font-semibold text-slate-700 mb-1.5 block">Email</label>
+                                    <input
+                                        type="email"
+                                        required
+                                        value={email}
+                                        onChange={(e) => setEmail(e.target.value)}
+                                        className={INPUT_CLASS}
+                                        placeholder="admin@school.com"
+                                    />
+                                </div>
+
+                                <div>
+                                    <label className="flex justify-between text-sm font-semibold text-slate-700 mb-1.5">
+                                        Password
+                                        <a href="#" className="text-primary-600 hover:text-primary-700 text-sm font-medium">Forgot password?</a>
+                                    </label>
+                                    <input
+                                        type="password"
+                                        required
+                                        value={password}
+                                        onChange={(e) => setPassword(e.target.value)}
+                                        className={INPUT_CLASS}
+                                        placeholder="••••••••"
+                                    />
+                                </div>
+                            </div>
+
+                            <button type="submit" disabled={loading} className={SUBMIT_CLASS}>
+                                {loading ? <Loader2 className="animate-spin h-5 w-5" /> : 'Sign In'}
+                            </button>
+
+                            <div className="text-center mt-6">
+                                <p className="text-slate-600">
+                                    Don't have an account?{' '}
+                                    <a href="/signup" className="font-semibold text-primary-600 hover:text-primary-700 transition-colors">
+                                        Sign up
+                                    </a>
+                                </p>
+                            </div>
+                        </form>
+                    )}
+
+                    {(step === 'code' || step === 'setup') && (
+                        <form onSubmit={handleCode} className="space-y-6">
+                            {step === 'setup' && setup && (
+                                <div className="flex flex-col items-center space-y-3">
+                                    <img src={setup.qr_code} alt="Two-factor QR code" className="h-48 w-48" />
+                                    <p className="text-xs text-slate-500 break-all">
+                                        Or enter this key by hand: <span className="font-mono">{setup.secret}</span>
+                                    </p>
+                                </div>
+                            )}
                             <div>
-                                <label className="text-sm font-semibold text-slate-700 mb-1.5 block">Email</label>
+                                <label className="text-sm font-semibold text-slate-700 mb-1.5 block">Code</label>
                                 <input
-                                    type="email"
+                                    type="text"
                                     required
-                                    value={email}
-                                    onChange={(e) => setEmail(e.target.value)}
-                                    className="w-full px-4 py-3 rounded-xl border border-slate-200 focus:border-primary-500 focus:ring-4 focus:ring-primary-500/10 outline-none transition-all placeholder:text-slate-400 bg-slate-50 hover:bg-white"
-                                    placeholder="admin@school.com"
+                                    autoFocus
+                                    autoComplete="one-time-code"
+                                    value={code}
+                                    onChange={(e) => setCode(e.target.value)}
+                                    className={INPUT_CLASS}
+                                    placeholder="123456"
                                 />
                             </div>
+                            <button type="submit" disabled={loading} className={SUBMIT_CLASS}>
+                                {loading ? <Loader2 className="animate-spin h-5 w-5" /> : 'Verify'}
+                            </button>
+                            <button type="button" onClick={restart} className="w-full text-sm font-medium text-slate-500 hover:text-slate-700">
+                                Back to sign in
+                            </button>
+                        </form>
+                    )}
+
+                    {step === 'recovery' && (
+                        <div className="space-y-6">
+                            <ul className="grid grid-cols-2 gap-2 p-4 rounded-xl bg-slate-50 border border-slate-200 font-mono text-sm text-slate-700">
+                                {recoveryCodes.map((c) => (
+                                    <li key={c}>{c}</li>
+                                ))}
+                            </ul>
+                            <button
+                                type="button"
+                                onClick={() => (session.must_change_password ? setStep('password') : enter(session))}
+                                className={SUBMIT_CLASS}
+                            >
+                                I have saved them
+                            </button>
+                        </div>
+                    )}
 
+                    {step === 'password' && (
+                        <form onSubmit={handlePasswordChange} className="space-y-6">
                             <div>
-                                <label className="flex justify-between text-sm font-semibold text-slate-700 mb-1.5">
-                                    Password
-                                    <a href="#" className="text-primary-600 hover:text-primary-700 text-sm font-medium">Forgot password?</a>
-                                </label>
+                                <label className="text-sm font-semibold text-slate-700 mb-1.5 block">New password</label>
                                 <input
                                     type="password"
                                     required
-                                    value={password}
-                                    onChange={(e) => setPassword(e.target.value)}
-                                    className="w-full px-4 py-3 rounded-xl border border-slate-200 focus:border-primary-500 focus:ring-4 focus:ring-primary-500/10 outline-none transition-all placeholder:text-slate-400 bg-slate-50 hover:bg-white"
-                                    placeholder="••••••••"
+                                    minLength={6}
+                                    autoFocus
+                                    value={newPassword}
+                                    onChange={(e) => setNewPassword(e.target.value)}
+                                    className={INPUT_CLASS}
+                                    placeholder="At least 6 characters"
                                 />
                             </div>
-                        </div>
-
-                        <button
-                            type="submit"
-                            disabled={loading}
-                            className="w-full bg-gradient-to-r from-primary-600 to-primary-700 hover:from-primary-700 hover:to-primary-800 text-white font-bold py-3.5 rounded-xl shadow-lg shadow-primary-500/20 transition-all transform active:scale-[0.98] flex items-center justify-center"
-                        >
-                            {loading ? <Loader2 className="animate-spin h-5 w-5" /> : 'Sign In'}
-                        </button>
-
-                        <div className="text-center mt-6">
-                            <p className="text-slate-600">
-                                Don't have an account?{' '}
-                                <a href="/signup" className="font-semibold text-primary-600 hover:text-primary-700 transition-colors">
-                                    Sign up
-                                </a>
-                            </p>
-                        </div>
-                    </form>
+                            <button type="submit" disabled={loading} className={SUBMIT_CLASS}>
+                                {loading ? <Loader2 className="animate-spin h-5 w-5" /> : 'Change password'}
+                            </button>
+                        </form>
+                    )}
 
                     <div className="relative">
                         <div className="absolute inset-0 flex items-center">
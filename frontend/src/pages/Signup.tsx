@@ -28,9 +28,9 @@ export default function Signup() {
 
             // 2. Auto Login after signup
             const response = await api.post('/auth/login', { email, password });
-            const { access_token, user } = response.data;
+            const { access_token, refresh_token, user } = response.data;
 
-            login(access_token, user.role, user);
+            login(access_token, user.role, user, refresh_token);
             navigate('/dashboard');
 
         } catch (err: any) {
@@ -1,4 +1,18 @@
 import { describe, it, expect, beforeEach, afterEach, vi } from 'vitest'
+import axios, { AxiosError, type InternalAxiosRequestConfig } from 'axios'
+import { SESSION_EXPIRED_EVENT } from './tokens'
+
+// An adapter that refuses the expired access token with a 401 and answers anything else
+const expiringAdapter = (seen: string[]) => async (config: InternalAxiosRequestConfig) => {
+    const auth = String(config.headers.Authorization)
+    seen.push(auth)
+    if (auth === 'Bearer expired') {
+        throw new AxiosError('Unauthorized', 'ERR_BAD_REQUEST', config, null, {
+            status: 401, statusText: 'Unauthorized', data: { error: 'Invalid or expired token' }, headers: {}, config,
+        })
+    }
+    return { status: 200, statusText: 'OK', data: { ok: true }, headers: {}, config }
+}
 
 // We need to test the actual api.ts behavior
 // Since axios.create returns a new instance, we test the configuration
@@ -11,6 +25,7 @@ describe('API Service', () => {
 
     afterEach(() => {
         localStorage.clear()
+        vi.restoreAllMocks()
     })
 
     describe('Module Configuration', () => {
@@ -72,6 +87,55 @@ describe('API Service', () => {
         })
     })
 
+    describe('Token Refresh', () => {
+        it('swaps the refresh token for a new pair and retries once', async () => {
+            const api = (await import('../services/api')).default
+            localStorage.setItem('token', 'expired')
+            localStorage.setItem('refresh_token', 'refresh-1')
+            const refresh = vi.spyOn(axios, 'post').mockResolvedValueOnce({
+                data: { access_token: 'fresh', refresh_token: 'refresh-2' },
+            })
+
+            const seen: string[] = []
+            const response = await api.get('/students', { adapter: expiringAdapter(seen) })
+
+            expect(response.data).toEqual({ ok: true })
+            expect(seen).toEqual(['Bearer expired', 'Bearer fresh'])
+            expect(refresh).toHaveBeenCalledTimes(1)
+            expect(refresh.mock.calls[0][0]).toContain('/auth/refresh')
+            expect(refresh.mock.calls[0][1]).toEqual({ refresh_token: 'refresh-1' })
+            expect(localStorage.getItem('token')).toBe('fresh')
+            expect(localStorage.getItem('refresh_token')).toBe('refresh-2')
+        })
+
+        it('signals the session has ended when the refresh is refused', async () => {
+            const api = (await import('../services/api')).default
+            localStorage.setItem('token', 'expired')
+            localStorage.setItem('refresh_token', 'revoked')
+            vi.spyOn(axios, 'post').mockRejectedValueOnce(new Error('401'))
+            const expired = vi.fn()
+            window.addEventListener(SESSION_EXPIRED_EVENT, expired)
+
+            await expect(api.get('/students', { adapter: expiringAdapter([]) })).rejects.toThrow('Unauthorized')
+            expect(expired).toHaveBeenCalledTimes(1)
+            window.removeEventListener(SESSION_EXPIRED_EVENT, expired)
+        })
+
+        it('keeps a pre-auth token and does not refresh on a wrong two-factor code', async () => {
+            const api = (await import('../services/api')).default
+            localStorage.setItem('token', 'stale')
+            const refresh = vi.spyOn(axios, 'post')
+
+            const seen: string[] = []
+            await expect(api.post('/auth/2fa/verify', { code: '000000' }, {
+                headers: { Authorization: 'Bearer expired' },
+                adapter: expiringAdapter(seen),
+            })).rejects.toThrow('Unauthorized')
+            expect(seen).toEqual(['Bearer expired'])
+            expect(refresh).not.toHaveBeenCalled()
+        })
+    })
+
     describe('Base URL Configuration', () => {
         it('defaults to localhost:8080 in test environment', async () => {
             const api = await import('../services/api')
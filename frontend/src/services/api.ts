@@ -1,4 +1,5 @@
-import axios from 'axios';
+import axios, { type AxiosError, type InternalAxiosRequestConfig } from 'axios';
+import { SESSION_EXPIRED_EVENT, storeTokens } from './tokens';
 
 // Use environment variable for production, fallback to localhost for dev
 const API_BASE_URL = import.meta.env.VITE_API_URL || 'http://localhost:8080/api/v1';
@@ -10,11 +11,11 @@ const api = axios.create({
     },
 });
 
-// Request interceptor to add token
+// Request interceptor to add token, unless the caller passed one (a pre-auth token during sign-in)
 api.interceptors.request.use(
     (config) => {
         const token = localStorage.getItem('token');
-        if (token) {
+        if (token && !config.headers.Authorization) {
             config.headers.Authorization = `Bearer ${token}`;
         }
         return config;
@@ -22,4 +23,53 @@ api.interceptors.request.use(
     (error) => Promise.reject(error)
 );
 
+// Requests that must not trigger a refresh: they don't use the access token (sign-in steps use the
+// pre-auth token, and a 401 there means a wrong code; logout sends the refresh token), or are the refresh itself
+const NO_REFRESH = ['/auth/login', '/auth/signup', '/auth/refresh', '/auth/logout', '/auth/2fa/setup', '/auth/2fa/enable', '/auth/2fa/verify'];
+
+type RetriableConfig = InternalAxiosRequestConfig & { _retried?: boolean };
+
+// One refresh at a time; requests that fail together all wait for it
+let refreshing: Promise<string> | null = null;
+
+const refreshAccessToken = (): Promise<string> => {
+    if (!refreshing) {
+        const refreshToken = localStorage.getItem('refresh_token');
+        const request = refreshToken
+            ? axios.post(`${API_BASE_URL}/auth/refresh`, { refresh_token: refreshToken })
+            : Promise.reject(new Error('No refresh token'));
+        refreshing = request
+            .then((response) => {
+                storeTokens(response.data.access_token, response.data.refresh_token);
+                return response.data.access_token as string;
+            })
+            .finally(() => {
+                refreshing = null;
+            });
+    }
+    return refreshing;
+};
+
+// Response interceptor: access tokens last 15 minutes, so on a 401 swap the refresh token for a new pair and retry once
+api.interceptors.response.use(
+    (response) => response,
+    async (error: AxiosError) => {
+        const original = error.config as RetriableConfig | undefined;
+        if (error.response?.status !== 401 || !original || original._retried || NO_REFRESH.includes(original.url ?? '')) {
+            return Promise.reject(error);
+        }
+        original._retried = true;
+        let accessToken: string;
+        try {
+            accessToken = await refreshAccessToken();
+        } catch {
+            // The session is over (signed out elsewhere, expired or revoked)
+            window.dispatchEvent(new Event(SESSION_EXPIRED_EVENT));
+            return Promise.reject(error);
+        }
+        original.headers.Authorization = `Bearer ${accessToken}`;
+        return api(original);
+    }
+);
+
 export default api;
@@ -0,0 +1,16 @@
+// Where the session's tokens are kept between page loads
+
+// Fired when the refresh token is refused, so the app signs out
+export const SESSION_EXPIRED_EVENT = 'auth:session-expired';
+
+export const storeTokens = (accessToken: string, refreshToken?: string) => {
+    localStorage.setItem('token', accessToken);
+    if (refreshToken) {
+        localStorage.setItem('refresh_token', refreshToken);
+    }
+};
+
+export const clearTokens = () => {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
+};